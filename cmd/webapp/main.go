@@ -1,13 +1,22 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/routes"
 	"github.com/dvo-dev/go-get-started/server"
+	"github.com/dvo-dev/go-get-started/services/cluster"
 	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/services/replication"
+	_ "github.com/lib/pq"
 )
 
 func main() {
@@ -37,24 +46,627 @@ func run() error {
 		webappPort = "8080"
 	}
 
+	// TODO: decide if we want to attach handlers to the server
+	storage, err := initStorage()
+	if err != nil {
+		return err
+	}
+	decorated, err := decorateStorage(storage)
+	if err != nil {
+		if closer, ok := storage.(io.Closer); ok {
+			closer.Close()
+		}
+		return err
+	}
+	defer decorated.storage.Close()
+	reaper := datastorage.Reaper{}.Initialize(decorated.storage, time.Minute)
+	defer reaper.Stop()
+
+	// Every instance streams its changes, so followers may chain
+	primary := replication.Primary{}.Initialize(decorated.feed, replication.PrimaryConfig{})
+	s.AssignHandler(
+		replication.StreamRoute,
+		routes.RecoveryWrapper(routes.HandleReplicationStream(primary)),
+	)
+	follower, writes, err := initFollower(decorated)
+	if err != nil {
+		return err
+	}
+	// wrap applies to the data storage routes, bounding how long each request
+	// may take, refusing or forwarding the writes of a follower, and proxying
+	// requests to the node owning their names in a cluster
+	wrap := func(h http.HandlerFunc) http.HandlerFunc {
+		return h
+	}
+	timeout, err := requestTimeout()
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		wrap = func(h http.HandlerFunc) http.HandlerFunc {
+			return routes.TimeoutWrapper(h, timeout)
+		}
+	}
+	replicationStatus := func() any { return primary.Status() }
+	if follower != nil {
+		defer follower.Stop()
+		local := wrap
+		wrap = func(h http.HandlerFunc) http.HandlerFunc {
+			return routes.FollowerWrapper(local(h), writes.primary, writes.forward)
+		}
+		replicationStatus = func() any { return follower.Status() }
+	}
+	clustered, err := initCluster(decorated)
+	if err != nil {
+		return err
+	}
+	if clustered != nil {
+		defer clustered.Stop()
+		s.AssignHandler(
+			cluster.EntriesRoute,
+			routes.RecoveryWrapper(routes.HandleClusterEntries(decorated.feed, decorated.storage.Refresh)),
+		)
+		s.AssignHandler(
+			cluster.StatusRoute,
+			routes.RecoveryWrapper(routes.HandleClusterStatus(clustered)),
+		)
+		local := wrap
+		wrap = func(h http.HandlerFunc) http.HandlerFunc {
+			return routes.ClusterWrapper(local(h), clustered)
+		}
+	}
+
 	// TODO: add route handlers
 	s.AssignHandler(
 		"/health",
-		routes.RecoveryWrapper(routes.HandleHealth()),
+		routes.RecoveryWrapper(routes.HandleHealthWithReplication(replicationStatus)),
 	)
 
-	// TODO: decide if we want to attach handlers to the server
-	mem := datastorage.MemStorage{}.Initialize()
 	dsHandler := routes.DataStorageHandler{}.Initialize(
-		mem,
+		decorated.storage,
 	)
 	s.AssignHandler(
 		"/datastorage",
-		routes.RecoveryWrapper(dsHandler.HandleClientRequest()),
+		routes.RecoveryWrapper(wrap(dsHandler.HandleClientRequest())),
+	)
+	s.AssignHandler(
+		"/datastorage/versions",
+		routes.RecoveryWrapper(wrap(dsHandler.HandleVersionRequest())),
+	)
+	s.AssignHandler(
+		"/datastorage/metadata",
+		routes.RecoveryWrapper(wrap(dsHandler.HandleMetadataRequest())),
 	)
+	s.AssignHandler(
+		"/datastorage/batch",
+		routes.RecoveryWrapper(wrap(dsHandler.HandleBatchRequest())),
+	)
+	s.AssignHandler(
+		"/datastorage/buckets",
+		routes.RecoveryWrapper(wrap(dsHandler.HandleBucketRequest())),
+	)
+	s.AssignHandler(
+		"/datastorage/",
+		routes.RecoveryWrapper(wrap(dsHandler.HandleBucketDataRequest())),
+	)
+	if decorated.quotas != nil {
+		s.AssignHandler(
+			"/datastorage/admin/quotas",
+			routes.RecoveryWrapper(routes.HandleQuotaRequest(decorated.quotas)),
+		)
+	}
+	// Backups are of the storage beneath the buckets, so include every bucket,
+	// and are of the names held by this node alone in a cluster
+	s.AssignHandler(
+		"/datastorage/admin/backup",
+		routes.RecoveryWrapper(routes.HandleBackupRequest(decorated.feed)),
+	)
+	if follower == nil {
+		// A follower is restored by replicating its primary
+		s.AssignHandler(
+			"/datastorage/admin/restore",
+			routes.RecoveryWrapper(routes.HandleRestoreRequest(decorated.feed, decorated.storage.Refresh)),
+		)
+	}
+	// Each node of a cluster streams the changes to the names it holds
+	s.AssignHandler(
+		"/datastorage/watch",
+		routes.RecoveryWrapper(routes.HandleWatchRequest(decorated.feed)),
+	)
+	if decorated.encrypted != nil {
+		s.AssignHandler(
+			"/datastorage/admin/reencrypt",
+			routes.RecoveryWrapper(routes.HandleReencryptRequest(decorated.encrypted)),
+		)
+	}
 
 	log.Println("Webapp server has been initialized, now serving...")
 	err = s.ServeAndListen(fmt.Sprintf(":%s", webappPort))
 
 	return err
 }
+
+// initStorage creates the `DataStorage` backing the webapp, selected by the
+// `WEBAPP_STORAGE` env var:
+//
+// - memory (default): data is lost whenever `run()` restarts, see
+// `memStorageConfig` for optional durability and capacity
+//
+// - sharded: in-memory, spread across independently locked shards to reduce
+// writer contention
+//
+// - file: data is persisted beneath `WEBAPP_STORAGE_DIR` (default "./data")
+//
+// - log: data is appended to a compacted log beneath `WEBAPP_STORAGE_DIR`
+//
+// - postgres: data is persisted to the database at `WEBAPP_POSTGRES_DSN`
+func initStorage() (datastorage.DataStorage, error) {
+	switch kind := os.Getenv("WEBAPP_STORAGE"); kind {
+	case "", "memory":
+		cfg, err := memStorageConfig()
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Using in-memory data storage...")
+		return datastorage.MemStorage{}.InitializeWithConfig(cfg)
+
+	case "sharded":
+		log.Println("Using sharded in-memory data storage...")
+		return datastorage.ShardedMemStorage{}.Initialize(0), nil
+
+	case "file":
+		dir := storageDir()
+		log.Printf("Using file data storage at: '%s'...\n", dir)
+		return datastorage.FileStorage{}.Initialize(dir)
+
+	case "log":
+		dir := storageDir()
+		log.Printf("Using log data storage at: '%s'...\n", dir)
+		return datastorage.LogStorage{}.Initialize(
+			dir,
+			datastorage.LogStorageOptions{
+				SyncWrites:          true,
+				CompactInterval:     5 * time.Minute,
+				CompactGarbageRatio: 0.5,
+			},
+		)
+
+	case "postgres":
+		dsn := os.Getenv("WEBAPP_POSTGRES_DSN")
+		if len(dsn) == 0 {
+			return nil, fmt.Errorf("WEBAPP_POSTGRES_DSN must be set for postgres storage")
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		if err = db.Ping(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		log.Println("Using postgres data storage...")
+		return datastorage.PostgresStorage{}.Initialize(db)
+
+	default:
+		return nil, fmt.Errorf("unsupported WEBAPP_STORAGE: '%s'", kind)
+	}
+}
+
+// decoratedStorage is the `DataStorage` of the webapp, along with the
+// decorators within it which other parts of the webapp use.
+type decoratedStorage struct {
+	storage *datastorage.BucketStorage
+
+	// feed records the changes beneath the buckets, so they replicate too
+	feed *datastorage.ChangeFeed
+
+	// encrypted is nil unless encryption is enabled
+	encrypted *datastorage.EncryptedStorage
+
+	// quotas is nil unless quotas are configured
+	quotas *datastorage.QuotaStorage
+}
+
+// decorateStorage wraps `storage` in the optional decorators enabled by env
+// vars, see `initEncryption`, `initCompression`, `initChunks`, `initCache`,
+// `initVersions` and `initQuotas`, then a `ChangeFeed` (see `initChangeFeed`)
+// and finally a `BucketStorage`.
+func decorateStorage(storage datastorage.DataStorage) (decoratedStorage, error) {
+	var decorated decoratedStorage
+
+	encrypted, err := initEncryption(storage)
+	if err != nil {
+		return decorated, err
+	}
+	if encrypted != nil {
+		decorated.encrypted = encrypted
+		storage = encrypted
+	}
+	storage, err = initCompression(storage)
+	if err != nil {
+		return decorated, err
+	}
+	storage, err = initChunks(storage)
+	if err != nil {
+		return decorated, err
+	}
+	storage, err = initCache(storage)
+	if err != nil {
+		return decorated, err
+	}
+	storage, err = initVersions(storage)
+	if err != nil {
+		return decorated, err
+	}
+	quotas, err := initQuotas(storage)
+	if err != nil {
+		return decorated, err
+	}
+	if quotas != nil {
+		decorated.quotas = quotas
+		storage = quotas
+	}
+
+	decorated.feed, err = initChangeFeed(storage)
+	if err != nil {
+		return decorated, err
+	}
+	decorated.storage, err = datastorage.BucketStorage{}.Initialize(decorated.feed)
+	return decorated, err
+}
+
+// initChangeFeed wraps `storage` in a `ChangeFeed`, keeping the last
+// `WEBAPP_CHANGEFEED_CAPACITY` changes (default 65536) - journaled to
+// `WEBAPP_CHANGEFEED_DIR` if set, so watchers and followers resume across
+// restarts. Only journal the changes of a durable storage.
+func initChangeFeed(storage datastorage.DataStorage) (*datastorage.ChangeFeed, error) {
+	var (
+		cfg datastorage.ChangeFeedConfig
+		err error
+	)
+	if capacity := os.Getenv("WEBAPP_CHANGEFEED_CAPACITY"); len(capacity) > 0 {
+		if cfg.Capacity, err = strconv.Atoi(capacity); err != nil || cfg.Capacity <= 0 {
+			return nil, fmt.Errorf("invalid WEBAPP_CHANGEFEED_CAPACITY: '%s'", capacity)
+		}
+	}
+	if dir := os.Getenv("WEBAPP_CHANGEFEED_DIR"); len(dir) > 0 {
+		log.Printf("Journaling data storage changes at: '%s'...\n", dir)
+		cfg.JournalDir = dir
+		cfg.SyncJournal = true
+	}
+	return datastorage.ChangeFeed{}.InitializeWithConfig(storage, cfg)
+}
+
+// followerWrites is how a follower handles writes, see `initFollower`.
+type followerWrites struct {
+	primary *url.URL
+	forward bool
+}
+
+// initFollower optionally starts a `replication.Follower` replicating the
+// primary at the `WEBAPP_REPLICATE_FROM` base URL (e.g.
+// "http://localhost:8080") to `decorated`, returning nil otherwise.
+//
+// A follower serves reads from its own storage, while writes are refused -
+// or, if `WEBAPP_FOLLOWER_WRITES` is "forward" rather than "reject" (the
+// default), forwarded to the primary. Replication restarts from a snapshot
+// whenever the follower restarts.
+func initFollower(decorated decoratedStorage) (*replication.Follower, followerWrites, error) {
+	primaryEnv := os.Getenv("WEBAPP_REPLICATE_FROM")
+	if len(primaryEnv) == 0 {
+		return nil, followerWrites{}, nil
+	}
+	primary, err := url.Parse(primaryEnv)
+	if err != nil || len(primary.Host) == 0 {
+		return nil, followerWrites{}, fmt.Errorf("invalid WEBAPP_REPLICATE_FROM: '%s'", primaryEnv)
+	}
+
+	writes := followerWrites{primary: primary}
+	switch writesEnv := os.Getenv("WEBAPP_FOLLOWER_WRITES"); writesEnv {
+	case "", "reject":
+	case "forward":
+		writes.forward = true
+	default:
+		return nil, followerWrites{}, fmt.Errorf("unsupported WEBAPP_FOLLOWER_WRITES: '%s'", writesEnv)
+	}
+
+	log.Printf("Following primary at: '%s'...\n", primaryEnv)
+	follower := replication.Follower{}.Initialize(decorated.feed, replication.FollowerConfig{
+		Primary: primaryEnv,
+		OnApply: decorated.storage.Refresh,
+	})
+	return follower, writes, nil
+}
+
+// initCluster optionally starts a `cluster.Cluster` of the nodes configured
+// by the membership file at `WEBAPP_CLUSTER_CONFIG`, see `cluster.Membership`,
+// returning nil otherwise. The other nodes reach this one at
+// `WEBAPP_CLUSTER_SELF` (e.g. "http://localhost:8080").
+//
+// The membership file is reloaded every few seconds, entries moving to the
+// nodes owning them whenever it changes.
+func initCluster(decorated decoratedStorage) (*cluster.Cluster, error) {
+	configFile := os.Getenv("WEBAPP_CLUSTER_CONFIG")
+	if len(configFile) == 0 {
+		return nil, nil
+	}
+	self := os.Getenv("WEBAPP_CLUSTER_SELF")
+	if len(self) == 0 {
+		return nil, fmt.Errorf("WEBAPP_CLUSTER_SELF must be set with WEBAPP_CLUSTER_CONFIG")
+	}
+
+	log.Printf("Joining cluster as: '%s'...\n", self)
+	return cluster.Cluster{}.Initialize(decorated.feed, cluster.Config{
+		Self:           self,
+		MembershipFile: configFile,
+	})
+}
+
+// initEncryption optionally wraps `storage` in an `EncryptedStorage`, enabled
+// by the `WEBAPP_ENCRYPTION_KEYRING` env var naming its key file - returning
+// nil otherwise. Encryption is innermost, so only ever sees data already
+// compressed.
+//
+// To rotate keys, add a key to the key file (`webapptool keys add`) then POST
+// "/datastorage/admin/reencrypt". Names are not encrypted - with
+// deduplication, these include the SHA-256 hashes of chunks.
+func initEncryption(storage datastorage.DataStorage) (*datastorage.EncryptedStorage, error) {
+	keyFile := os.Getenv("WEBAPP_ENCRYPTION_KEYRING")
+	if len(keyFile) == 0 {
+		return nil, nil
+	}
+	keyring, err := datastorage.Keyring{}.Initialize(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Encrypting data storage with keys from: '%s'...\n", keyFile)
+	return datastorage.EncryptedStorage{}.Initialize(
+		storage, keyring, datastorage.EncryptedStorageConfig{},
+	), nil
+}
+
+// initCompression optionally wraps `storage` in a `CompressedStorage`,
+// enabled by the `WEBAPP_COMPRESSION` env var of "gzip" or "flate".
+//
+// `WEBAPP_COMPRESSION_LEVEL` sets the level from 1 (fastest) to 9 (smallest),
+// and data smaller than `WEBAPP_COMPRESSION_MIN_SIZE` (default 512) is stored
+// as is. Chunks are compressed individually, so deduplication is unaffected.
+func initCompression(storage datastorage.DataStorage) (datastorage.DataStorage, error) {
+	algorithmEnv := os.Getenv("WEBAPP_COMPRESSION")
+	if len(algorithmEnv) == 0 {
+		return storage, nil
+	}
+	algorithm, err := datastorage.ParseCompressionAlgorithm(algorithmEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := datastorage.CompressedStorageConfig{
+		Algorithm: algorithm,
+	}
+	if level := os.Getenv("WEBAPP_COMPRESSION_LEVEL"); len(level) > 0 {
+		if cfg.Level, err = strconv.Atoi(level); err != nil {
+			return nil, fmt.Errorf("invalid WEBAPP_COMPRESSION_LEVEL: %w", err)
+		}
+	}
+	if minSize := os.Getenv("WEBAPP_COMPRESSION_MIN_SIZE"); len(minSize) > 0 {
+		if cfg.MinSize, err = strconv.Atoi(minSize); err != nil {
+			return nil, fmt.Errorf("invalid WEBAPP_COMPRESSION_MIN_SIZE: %w", err)
+		}
+	}
+
+	log.Printf("Compressing data storage with %s...\n", algorithmEnv)
+	return datastorage.CompressedStorage{}.Initialize(storage, cfg)
+}
+
+// initChunks optionally wraps `storage` in a `ChunkStorage`, deduplicating
+// data in content defined chunks when `WEBAPP_DEDUP` is "true".
+//
+// Once enabled the storage holds only chunks and manifests, so must not be
+// used without deduplication again.
+//
+// Deduplication is refused over in-memory storage bounded by
+// `WEBAPP_MEMORY_MAX_BYTES` or `WEBAPP_MEMORY_MAX_ENTRIES`, whose eviction
+// knows nothing of chunks - evicting one shared by many names would corrupt
+// all of them, rather than drop the least wanted.
+func initChunks(storage datastorage.DataStorage) (datastorage.DataStorage, error) {
+	dedupEnv := os.Getenv("WEBAPP_DEDUP")
+	if len(dedupEnv) == 0 {
+		return storage, nil
+	}
+	dedup, err := strconv.ParseBool(dedupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WEBAPP_DEDUP: '%s'", dedupEnv)
+	}
+	if !dedup {
+		return storage, nil
+	}
+	if kind := os.Getenv("WEBAPP_STORAGE"); kind == "" || kind == "memory" {
+		for _, env := range []string{"WEBAPP_MEMORY_MAX_BYTES", "WEBAPP_MEMORY_MAX_ENTRIES"} {
+			if len(os.Getenv(env)) > 0 {
+				return nil, fmt.Errorf("WEBAPP_DEDUP cannot be combined with %s, as eviction would drop shared chunks", env)
+			}
+		}
+	}
+
+	log.Println("Deduplicating data storage in content defined chunks...")
+	return datastorage.ChunkStorage{}.Initialize(storage, datastorage.ChunkStorageConfig{})
+}
+
+// initVersions optionally wraps `storage` in a `VersionedStorage`, keeping
+// `WEBAPP_MAX_VERSIONS` previous versions of each name when set.
+func initVersions(storage datastorage.DataStorage) (datastorage.DataStorage, error) {
+	maxVersionsEnv := os.Getenv("WEBAPP_MAX_VERSIONS")
+	if len(maxVersionsEnv) == 0 {
+		return storage, nil
+	}
+	maxVersions, err := strconv.Atoi(maxVersionsEnv)
+	if err != nil || maxVersions <= 0 {
+		return nil, fmt.Errorf("invalid WEBAPP_MAX_VERSIONS: '%s'", maxVersionsEnv)
+	}
+
+	log.Printf("Keeping up to %d previous versions of data...\n", maxVersions)
+	return datastorage.VersionedStorage{}.Initialize(storage, maxVersions), nil
+}
+
+// initQuotas optionally wraps `storage` in a `QuotaStorage`, enforcing the
+// quotas listed in the JSON file at `WEBAPP_QUOTAS_FILE` (see
+// `datastorage.ReadQuotas`) along with a quota of every name limited by
+// `WEBAPP_QUOTA_MAX_BYTES`, `WEBAPP_QUOTA_MAX_ENTRY_SIZE` and
+// `WEBAPP_QUOTA_MAX_ENTRIES` - returning nil if none are set.
+//
+// Quotas are not enforced by a follower (see `initFollower`): it must hold
+// every entry of its primary, which enforces its own quotas, as replication
+// refused by a quota would only restart from a snapshot, and be refused again.
+func initQuotas(storage datastorage.DataStorage) (*datastorage.QuotaStorage, error) {
+	var (
+		quotas []datastorage.Quota
+		err    error
+	)
+	if quotasFile := os.Getenv("WEBAPP_QUOTAS_FILE"); len(quotasFile) > 0 {
+		if quotas, err = datastorage.ReadQuotas(quotasFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var global datastorage.Quota
+	for env, limit := range map[string]*int64{
+		"WEBAPP_QUOTA_MAX_BYTES":      &global.MaxBytes,
+		"WEBAPP_QUOTA_MAX_ENTRY_SIZE": &global.MaxEntrySize,
+		"WEBAPP_QUOTA_MAX_ENTRIES":    &global.MaxEntries,
+	} {
+		if value := os.Getenv(env); len(value) > 0 {
+			if *limit, err = strconv.ParseInt(value, 10, 64); err != nil || *limit <= 0 {
+				return nil, fmt.Errorf("invalid %s: '%s'", env, value)
+			}
+		}
+	}
+	if global != (datastorage.Quota{}) {
+		quotas = append(quotas, global)
+	}
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+	if len(os.Getenv("WEBAPP_REPLICATE_FROM")) > 0 {
+		log.Printf("Ignoring %d data storage quotas of a follower...\n", len(quotas))
+		return nil, nil
+	}
+
+	log.Printf("Enforcing %d data storage quotas...\n", len(quotas))
+	return datastorage.QuotaStorage{}.Initialize(storage, datastorage.QuotaStorageConfig{
+		Quotas: quotas,
+	})
+}
+
+// initCache optionally wraps `storage` in a `CachedStorage`, enabled by the
+// `WEBAPP_CACHE` env var of "writethrough" or "writeback".
+//
+// The cache holds up to `WEBAPP_CACHE_MAX_BYTES` (default 64MiB), and
+// remembers names not found for `WEBAPP_CACHE_NEGATIVE_TTL` (default 5s).
+func initCache(storage datastorage.DataStorage) (datastorage.DataStorage, error) {
+	modeEnv := os.Getenv("WEBAPP_CACHE")
+	if len(modeEnv) == 0 {
+		return storage, nil
+	}
+	mode, err := datastorage.ParseCacheMode(modeEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := datastorage.CachedStorageConfig{
+		Mode:        mode,
+		MaxBytes:    64 << 20,
+		NegativeTTL: 5 * time.Second,
+	}
+	if maxBytes := os.Getenv("WEBAPP_CACHE_MAX_BYTES"); len(maxBytes) > 0 {
+		if cfg.MaxBytes, err = strconv.ParseInt(maxBytes, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid WEBAPP_CACHE_MAX_BYTES: %w", err)
+		}
+	}
+	if negativeTTL := os.Getenv("WEBAPP_CACHE_NEGATIVE_TTL"); len(negativeTTL) > 0 {
+		if cfg.NegativeTTL, err = time.ParseDuration(negativeTTL); err != nil {
+			return nil, fmt.Errorf("invalid WEBAPP_CACHE_NEGATIVE_TTL: %w", err)
+		}
+	}
+
+	log.Printf("Using %s cache in front of data storage...\n", modeEnv)
+	return datastorage.CachedStorage{}.Initialize(storage, cfg)
+}
+
+// requestTimeout returns how long each request to the data storage routes may
+// take, configured by the `WEBAPP_REQUEST_TIMEOUT` env var - unbounded if
+// unset.
+//
+// Requests still running at their deadline are abandoned, responding 504.
+func requestTimeout() (time.Duration, error) {
+	timeoutEnv := os.Getenv("WEBAPP_REQUEST_TIMEOUT")
+	if len(timeoutEnv) == 0 {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(timeoutEnv)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid WEBAPP_REQUEST_TIMEOUT: %s", timeoutEnv)
+	}
+	log.Printf("Abandoning data storage requests after %s...\n", timeout)
+	return timeout, nil
+}
+
+// storageDir returns the directory for disk backed storage, configured by the
+// `WEBAPP_STORAGE_DIR` env var.
+func storageDir() string {
+	dir := os.Getenv("WEBAPP_STORAGE_DIR")
+	if len(dir) == 0 {
+		dir = "./data"
+	}
+	return dir
+}
+
+// memStorageConfig builds the in-memory storage configuration from env vars:
+//
+// - `WEBAPP_WAL_DIR` enables a write-ahead log, with `WEBAPP_WAL_SYNC` policy
+// of "always" (default), "interval" or "never"
+//
+// - `WEBAPP_MEMORY_MAX_BYTES` and `WEBAPP_MEMORY_MAX_ENTRIES` bound the
+// capacity, evicting by `WEBAPP_MEMORY_EVICTION` of "lru" (default), "lfu",
+// "fifo" or "random" - neither may be set with `WEBAPP_DEDUP`, see `initChunks`
+func memStorageConfig() (datastorage.MemStorageConfig, error) {
+	var (
+		cfg datastorage.MemStorageConfig
+		err error
+	)
+
+	if walDir := os.Getenv("WEBAPP_WAL_DIR"); len(walDir) > 0 {
+		policy := datastorage.WALSyncAlways
+		if syncEnv := os.Getenv("WEBAPP_WAL_SYNC"); len(syncEnv) > 0 {
+			if policy, err = datastorage.ParseWALSyncPolicy(syncEnv); err != nil {
+				return cfg, err
+			}
+		}
+		cfg.WAL = &datastorage.WALConfig{
+			Dir:              walDir,
+			SyncPolicy:       policy,
+			SyncInterval:     time.Second,
+			SnapshotInterval: 5 * time.Minute,
+		}
+	}
+
+	if maxBytes := os.Getenv("WEBAPP_MEMORY_MAX_BYTES"); len(maxBytes) > 0 {
+		if cfg.MaxBytes, err = strconv.ParseInt(maxBytes, 10, 64); err != nil {
+			return cfg, fmt.Errorf("invalid WEBAPP_MEMORY_MAX_BYTES: %w", err)
+		}
+	}
+	if maxEntries := os.Getenv("WEBAPP_MEMORY_MAX_ENTRIES"); len(maxEntries) > 0 {
+		if cfg.MaxEntries, err = strconv.Atoi(maxEntries); err != nil {
+			return cfg, fmt.Errorf("invalid WEBAPP_MEMORY_MAX_ENTRIES: %w", err)
+		}
+	}
+	if eviction := os.Getenv("WEBAPP_MEMORY_EVICTION"); len(eviction) > 0 {
+		if cfg.Eviction, err = datastorage.ParseEvictionPolicy(eviction); err != nil {
+			return cfg, err
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,88 @@
+package subcommands
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Command to back up the datastorage into a file",
+	Long:  "This command streams every entry of webapp's datastorage, in every bucket, into a tar archive file which may be restored into any datastorage",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("this command requires the path of the file to write")
+			return
+		}
+
+		// Backups take however long they need
+		resp, err := http.Get(nodeURL("/datastorage/admin/backup"))
+		if err != nil {
+			fmt.Printf("failed to GET /datastorage/admin/backup: %v\n", err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			printResponse(resp)
+			return
+		}
+		defer resp.Body.Close()
+
+		file, err := os.Create(args[0])
+		if err != nil {
+			fmt.Printf("failed to create file: %v\n", err)
+			return
+		}
+		defer file.Close()
+		written, err := io.Copy(file, resp.Body)
+		if err != nil {
+			fmt.Printf("failed to back up data: %v\n", err)
+			return
+		}
+
+		fmt.Printf("backed up %d bytes to %s\n", written, args[0])
+	},
+}
+
+var restoreBackupCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Command to restore the datastorage from a backup file",
+	Long:  "This command streams a tar archive file written by the backup command into webapp's datastorage, restoring its entries",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("this command requires the path of the backup file")
+			return
+		}
+
+		file, err := os.Open(args[0])
+		if err != nil {
+			fmt.Printf("failed to open file: %v\n", err)
+			return
+		}
+		defer file.Close()
+
+		mode, _ := cmd.Flags().GetString("mode")
+		query := url.Values{"mode": {mode}}
+		resp, err := http.Post(
+			nodeURL("/datastorage/admin/restore")+"?"+query.Encode(),
+			"application/x-tar",
+			file,
+		)
+		if err != nil {
+			fmt.Printf("failed to POST /datastorage/admin/restore: %v\n", err)
+			return
+		}
+
+		printResponse(resp)
+	},
+}
+
+func init() {
+	restoreBackupCmd.Flags().String("mode", "merge", "where names are already held, keep whichever was written last (merge), the backup (overwrite) or the datastorage (skip)")
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(restoreBackupCmd)
+}
@@ -0,0 +1,112 @@
+package subcommands
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/spf13/cobra"
+)
+
+// bucketRoute is the path of the datastorage bucket management route
+const bucketRoute = "/datastorage/buckets"
+
+var bucketCmd = &cobra.Command{
+	Use:   "bucket",
+	Short: "Root cmd for datastorage bucket operations",
+	Long:  "This is the root cmd for datastorage bucket operations:\n\tlist\n\tcreate\n\tconfigure\n\tdelete",
+}
+
+var bucketListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Command to list datastorage buckets",
+	Long:  "This is a bucket subcommand to list the buckets of webapp's datastorage and their configs",
+	Run: func(cmd *cobra.Command, args []string) {
+		resp, err := requests.GetRequest(nodeURL(bucketRoute), nil, nil)
+		if err != nil {
+			fmt.Printf("failed to GET /datastorage/buckets: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+var bucketCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Command to create a datastorage bucket with a given name",
+	Long:  "This is a bucket subcommand to create an empty bucket in webapp's datastorage with a given name, configured by the optional flags",
+	Run: func(cmd *cobra.Command, args []string) {
+		sendBucketConfig(cmd, args, http.MethodPost)
+	},
+}
+
+var bucketConfigureCmd = &cobra.Command{
+	Use:   "configure",
+	Short: "Command to replace the config of a datastorage bucket with a given name",
+	Long:  "This is a bucket subcommand to replace the config of a bucket in webapp's datastorage with a given name by the optional flags, unset flags are reset",
+	Run: func(cmd *cobra.Command, args []string) {
+		sendBucketConfig(cmd, args, http.MethodPut)
+	},
+}
+
+var bucketDeleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Command to delete an empty datastorage bucket with a given name",
+	Long:  "This is a bucket subcommand to delete a bucket in webapp's datastorage with a given name, which must hold no data",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("this command requires the name of the bucket to delete")
+			return
+		}
+
+		params := map[string]string{"name": string(args[0])}
+		resp, err := requests.CustomRequest(nodeURL(bucketRoute), http.MethodDelete, &params, nil)
+		if err != nil {
+			fmt.Printf("failed to DELETE from /datastorage/buckets: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+// sendBucketConfig sends the bucket config given by the flags of `cmd` for
+// the bucket named by `args`, with request `method`.
+func sendBucketConfig(cmd *cobra.Command, args []string, method string) {
+	if len(args) < 1 {
+		fmt.Println("this command requires the name of the bucket")
+		return
+	}
+
+	params := map[string]string{"name": string(args[0])}
+	if maxSize, _ := cmd.Flags().GetInt64("max-size"); maxSize > 0 {
+		params["max_size"] = strconv.FormatInt(maxSize, 10)
+	}
+	if ttl, _ := cmd.Flags().GetString("ttl"); len(ttl) > 0 {
+		params["ttl"] = ttl
+	}
+	if readOnly, _ := cmd.Flags().GetBool("read-only"); readOnly {
+		params["read_only"] = "true"
+	}
+
+	resp, err := requests.CustomRequest(nodeURL(bucketRoute), method, &params, nil)
+	if err != nil {
+		fmt.Printf("failed to %s to /datastorage/buckets: %v\n", method, err)
+		return
+	}
+	printResponse(resp)
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{bucketCreateCmd, bucketConfigureCmd} {
+		cmd.Flags().Int64("max-size", 0, "refuse data larger than this many bytes")
+		cmd.Flags().String("ttl", "", "expire data written without a ttl after this long, in seconds or as a duration (e.g. 1h)")
+		cmd.Flags().Bool("read-only", false, "refuse all writes and deletions")
+	}
+
+	bucketCmd.AddCommand(bucketListCmd)
+	bucketCmd.AddCommand(bucketCreateCmd)
+	bucketCmd.AddCommand(bucketConfigureCmd)
+	bucketCmd.AddCommand(bucketDeleteCmd)
+	RootCmd.AddCommand(bucketCmd)
+}
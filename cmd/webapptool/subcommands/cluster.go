@@ -0,0 +1,71 @@
+package subcommands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dvo-dev/go-get-started/services/cluster"
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/spf13/cobra"
+)
+
+var clusterCmd = &cobra.Command{
+	Use:   "cluster",
+	Short: "Root cmd for cluster operations",
+	Long:  "This is the root cmd for operations on a cluster of webapps, sent to the `--node` targeted:\n\tstatus\n\towner",
+}
+
+var clusterStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Command to show the cluster membership and rebalancing progress of a node",
+	Long:  "This is a cluster subcommand to show the members of the cluster as the targeted node knows them, and how far it is through moving entries to the nodes owning them",
+	Run: func(cmd *cobra.Command, args []string) {
+		resp, err := requests.GetRequest(nodeURL(cluster.StatusRoute), nil, nil)
+		if err != nil {
+			fmt.Printf("failed to GET %s: %v\n", cluster.StatusRoute, err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+var clusterOwnerCmd = &cobra.Command{
+	Use:   "owner",
+	Short: "Command to show the node owning a given name",
+	Long:  "This is a cluster subcommand to show the node of the cluster owning a given name, optionally within `--bucket`, by the membership of the targeted node",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("this command requires a name")
+			return
+		}
+
+		resp, err := requests.GetRequest(nodeURL(cluster.StatusRoute), nil, nil)
+		if err != nil {
+			fmt.Printf("failed to GET %s: %v\n", cluster.StatusRoute, err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			fmt.Printf("node is not part of a cluster: %v\n", resp.StatusCode)
+			return
+		}
+		var status cluster.Status
+		if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			fmt.Printf("failed to read response: %v\n", err)
+			return
+		}
+
+		bucket, _ := cmd.Flags().GetString("bucket")
+		ring := cluster.Ring{}.Initialize(status.Nodes, status.VNodes)
+		fmt.Println(ring.Owner(cluster.Key(bucket, args[0])))
+	},
+}
+
+func init() {
+	clusterOwnerCmd.Flags().String("bucket", "", "the bucket of the name")
+
+	clusterCmd.AddCommand(clusterStatusCmd)
+	clusterCmd.AddCommand(clusterOwnerCmd)
+	RootCmd.AddCommand(clusterCmd)
+}
@@ -1,10 +1,19 @@
 package subcommands
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/utils/requests"
 	"github.com/spf13/cobra"
@@ -13,7 +22,32 @@ import (
 var dataCmd = &cobra.Command{
 	Use:   "data",
 	Short: "Root cmd for datastorage operations",
-	Long:  "This is the root cmd for datastorage operations:\n\tretrieve\n\tupload\n\tdelete",
+	Long:  "This is the root cmd for datastorage operations, on the data of --bucket if given:\n\tlist\n\tretrieve\n\tmetadata\n\tupload\n\tdownload\n\tdelete\n\tversions\n\trestore\n\tbatch\n\twatch",
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Command to list the names of datastorage data, optionally with a given prefix",
+	Long:  "This is a data subcommand to list the names of data in webapp's datastorage a page at a time, optionally only those beginning with a given prefix - pass the returned cursor with --cursor for the next page",
+	Run: func(cmd *cobra.Command, args []string) {
+		params := map[string]string{"list": "true"}
+		if len(args) > 0 {
+			params["prefix"] = args[0]
+		}
+		if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 {
+			params["limit"] = strconv.Itoa(limit)
+		}
+		if cursor, _ := cmd.Flags().GetString("cursor"); len(cursor) > 0 {
+			params["cursor"] = cursor
+		}
+
+		resp, err := requests.GetRequest(dataURL(cmd, ""), &params, nil)
+		if err != nil {
+			fmt.Printf("failed to GET /datastorage: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
 }
 
 var retrieveCmd = &cobra.Command{
@@ -27,68 +61,126 @@ var retrieveCmd = &cobra.Command{
 		}
 
 		params := map[string]string{"name": string(args[0])}
-		resp, err := requests.GetRequest("http://0.0.0.0:8080/datastorage", &params, nil)
+		if version, _ := cmd.Flags().GetInt("version"); version > 0 {
+			params["version"] = strconv.Itoa(version)
+		}
+		resp, err := requests.GetRequest(dataURL(cmd, ""), &params, nil)
 		if err != nil {
 			fmt.Printf("failed to GET /datastorage: %v\n", err)
 			return
 		}
 
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+		printResponse(resp)
+	},
+}
+
+var metadataCmd = &cobra.Command{
+	Use:   "metadata",
+	Short: "Command to retrieve the metadata of datastorage data with a given name",
+	Long:  "This is a data subcommand to access the content type, size, checksum and timestamps of data in webapp's datastorage with a given name, without its content",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("this command requires the name of the data to describe")
 			return
 		}
 
-		var JSON map[string]any
-		err = json.Unmarshal([]byte(body), &JSON)
+		params := map[string]string{"name": string(args[0])}
+		resp, err := requests.GetRequest(dataURL(cmd, "/metadata"), &params, nil)
 		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+			fmt.Printf("failed to GET /datastorage/metadata: %v\n", err)
 			return
 		}
-		fmt.Printf("server response:\n\t%+v\n", JSON)
+		printResponse(resp)
 	},
 }
 
 var uploadCmd = &cobra.Command{
 	Use:   "upload",
-	Short: "Command to upload data (string only at this time)",
-	Long:  "This is a data subcommand to upload data (string only at this time) to the webapp's datastorage with a given name",
+	Short: "Command to upload data, a string or the content of a file",
+	Long:  "This is a data subcommand to upload data to the webapp's datastorage with a given name - either a string, or with --file the content of a file, which is streamed however large",
 	Run: func(cmd *cobra.Command, args []string) {
-		if len(args) != 2 {
+		path, _ := cmd.Flags().GetString("file")
+		if len(path) > 0 && len(args) != 1 {
+			fmt.Println("this command requires 1 argument with --file:\n\t1. Name of data")
+			return
+		}
+		if len(path) == 0 && len(args) != 2 {
 			fmt.Println("this command requires 2 arguments:\n\t1. Name of data\n\t2. Data value (string)")
 			return
 		}
 
 		params := map[string]string{"name": string(args[0])}
-		data := map[string][]byte{"data": []byte(args[1])}
-		resp, err := requests.PostRequest(
-			"http://0.0.0.0:8080/datastorage",
-			"multipart/form-data",
-			&params,
-			&data,
-			nil,
+		if ttl, _ := cmd.Flags().GetString("ttl"); len(ttl) > 0 {
+			params["ttl"] = ttl
+		}
+
+		var (
+			resp *http.Response
+			err  error
 		)
+		if len(path) > 0 {
+			resp, err = uploadFile(cmd, params, path)
+		} else {
+			data := map[string][]byte{"data": []byte(args[1])}
+			resp, err = requests.PostRequest(
+				dataURL(cmd, ""),
+				"multipart/form-data",
+				&params,
+				&data,
+				conditionalClient(cmd),
+			)
+		}
 
 		if err != nil {
 			fmt.Printf("failed to POST to /datastorage: %v\n", err)
 			return
 		}
 
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		printResponse(resp)
+	},
+}
+
+var downloadCmd = &cobra.Command{
+	Use:   "download",
+	Short: "Command to download datastorage data with a given name into a file",
+	Long:  "This is a data subcommand to stream data in webapp's datastorage with a given name into a file as is, however large",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("this command requires 2 arguments:\n\t1. Name of data\n\t2. Path of the file to write")
+			return
+		}
+
+		query := url.Values{"raw": {"true"}, "name": {args[0]}}
+		if version, _ := cmd.Flags().GetInt("version"); version > 0 {
+			query.Set("version", strconv.Itoa(version))
+		}
+		resp, err := http.Get(dataURL(cmd, "") + "?" + query.Encode())
 		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+			fmt.Printf("failed to GET /datastorage: %v\n", err)
 			return
 		}
+		if resp.StatusCode != http.StatusOK {
+			printResponse(resp)
+			return
+		}
+		defer resp.Body.Close()
 
-		var JSON map[string]any
-		err = json.Unmarshal([]byte(body), &JSON)
+		file, err := os.Create(args[1])
+		if err != nil {
+			fmt.Printf("failed to create file: %v\n", err)
+			return
+		}
+		defer file.Close()
+		written, err := io.Copy(file, resp.Body)
 		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+			fmt.Printf("failed to download data: %v\n", err)
 			return
 		}
-		fmt.Printf("server response:\n\t%+v\n", JSON)
+
+		if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+			fmt.Printf("etag: %s\n", etag)
+		}
+		fmt.Printf("downloaded %d bytes of %s to %s\n", written, resp.Header.Get("Content-Type"), args[1])
 	},
 }
 
@@ -104,36 +196,271 @@ var deleteCmd = &cobra.Command{
 
 		params := map[string]string{"name": string(args[0])}
 		resp, err := requests.CustomRequest(
-			"http://0.0.0.0:8080/datastorage",
+			dataURL(cmd, ""),
 			http.MethodDelete,
 			&params,
-			nil,
+			conditionalClient(cmd),
 		)
 		if err != nil {
 			fmt.Printf("failed to DELETE from /datastorage: %v\n", err)
 			return
 		}
 
-		defer resp.Body.Close()
-		body, err := io.ReadAll(resp.Body)
+		printResponse(resp)
+	},
+}
+
+var versionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "Command to list the versions of datastorage data with a given name",
+	Long:  "This is a data subcommand to list the kept versions of data in webapp's datastorage with a given name",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("this command requires the name of the data to list versions of")
+			return
+		}
+
+		params := map[string]string{"name": string(args[0])}
+		resp, err := requests.GetRequest(dataURL(cmd, "/versions"), &params, nil)
 		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+			fmt.Printf("failed to GET /datastorage/versions: %v\n", err)
 			return
 		}
+		printResponse(resp)
+	},
+}
 
-		var JSON map[string]any
-		err = json.Unmarshal([]byte(body), &JSON)
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Command to restore datastorage data with a given name to a previous version",
+	Long:  "This is a data subcommand to restore data in webapp's datastorage with a given name to a previous version, which is written as a new version",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("this command requires 2 arguments:\n\t1. Name of data\n\t2. Version to restore")
+			return
+		}
+
+		params := map[string]string{"name": string(args[0]), "version": string(args[1])}
+		resp, err := requests.CustomRequest(
+			dataURL(cmd, "/versions"),
+			http.MethodPost,
+			&params,
+			nil,
+		)
+		if err != nil {
+			fmt.Printf("failed to POST to /datastorage/versions: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+var batchCmd = &cobra.Command{
+	Use:   "batch",
+	Short: "Command to atomically apply a batch of datastorage operations from a JSON file",
+	Long:  "This is a data subcommand to apply a batch of stores and deletes in webapp's datastorage all at once or not at all, read from a JSON file of the form:\n\t{\"operations\": [{\"op\": \"store\", \"name\": \"a\", \"data\": \"value\", \"if_none_match\": \"*\"}, {\"op\": \"delete\", \"name\": \"b\"}]}",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			fmt.Println("this command requires the path of the JSON batch file")
+			return
+		}
+
+		body, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Printf("failed to read batch file: %v\n", err)
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(dataURL(cmd, "/batch"), "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Printf("failed to POST to /datastorage/batch: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Command to watch the changes to datastorage data, optionally with a given prefix",
+	Long:  "This is a data subcommand to stream every store and delete of data in webapp's datastorage as it happens, optionally only of names beginning with a given prefix, printing each as its event type, ID and JSON - pass the ID of the last change seen with --since to resume from it",
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		if len(args) > 0 {
+			query.Set("prefix", args[0])
+		}
+		if bucket, _ := cmd.Flags().GetString("bucket"); len(bucket) > 0 {
+			query.Set("bucket", bucket)
+		}
+		if since, _ := cmd.Flags().GetString("since"); len(since) > 0 {
+			query.Set("since", since)
+		}
+		resp, err := http.Get(nodeURL("/datastorage/watch") + "?" + query.Encode())
 		if err != nil {
-			fmt.Printf("failed to read response: %v\n", err)
+			fmt.Printf("failed to GET /datastorage/watch: %v\n", err)
 			return
 		}
-		fmt.Printf("server response:\n\t%+v\n", JSON)
+		if resp.StatusCode != http.StatusOK {
+			printResponse(resp)
+			return
+		}
+		defer resp.Body.Close()
+
+		event, id := "", ""
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				fmt.Printf("%s %s %s\n", event, id, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			fmt.Printf("stopped watching: %v\n", err)
+		}
 	},
 }
 
+// uploadFile streams the content of the file at `path` to the datastorage as
+// a multipart form with `params`, without reading it all into memory.
+func uploadFile(cmd *cobra.Command, params map[string]string, path string) (*http.Response, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	body, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		// The form fields must precede the data
+		for key, value := range params {
+			if err := writer.WriteField(key, value); err != nil {
+				pipe.CloseWithError(err)
+				return
+			}
+		}
+		fw, err := writer.CreateFormFile("data", filepath.Base(path))
+		if err != nil {
+			pipe.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(fw, file); err != nil {
+			pipe.CloseWithError(err)
+			return
+		}
+		pipe.CloseWithError(writer.Close())
+	}()
+
+	// Large uploads may take however long they need
+	client := conditionalClient(cmd)
+	if client == nil {
+		client = &http.Client{}
+	}
+	client.Timeout = 0
+
+	resp, err := client.Post(dataURL(cmd, ""), writer.FormDataContentType(), body)
+	body.Close()
+	return resp, err
+}
+
+// dataURL returns the URL of the datastorage `route` ("", "/metadata",
+// "/versions" or "/batch"), within the `--bucket` given to the data command if
+// any.
+func dataURL(cmd *cobra.Command, route string) string {
+	base := nodeURL("/datastorage")
+	if bucket, _ := cmd.Flags().GetString("bucket"); len(bucket) > 0 {
+		base += "/" + url.PathEscape(bucket)
+	}
+	return base + route
+}
+
+// conditionalHeaders is an `http.RoundTripper` adding conditional request
+// headers to every request.
+type conditionalHeaders struct {
+	header http.Header
+}
+
+func (c conditionalHeaders) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// conditionalClient returns a client sending the `--if-match` and
+// `--if-none-match` flags of `cmd` as request headers, or nil for the default
+// client if neither is set.
+func conditionalClient(cmd *cobra.Command) *http.Client {
+	header := http.Header{}
+	for flag, key := range map[string]string{
+		"if-match":      "If-Match",
+		"if-none-match": "If-None-Match",
+	} {
+		if value, _ := cmd.Flags().GetString(flag); len(value) > 0 {
+			header.Set(key, value)
+		}
+	}
+	if len(header) == 0 {
+		return nil
+	}
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: conditionalHeaders{header: header},
+	}
+}
+
+// printResponse prints the JSON body of a server response, and the ETag of the
+// data if given.
+func printResponse(resp *http.Response) {
+	defer resp.Body.Close()
+	if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+		fmt.Printf("etag: %s\n", etag)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("failed to read response: %v\n", err)
+		return
+	}
+
+	var JSON map[string]any
+	err = json.Unmarshal([]byte(body), &JSON)
+	if err != nil {
+		fmt.Printf("failed to read response: %v\n", err)
+		return
+	}
+	fmt.Printf("server response:\n\t%+v\n", JSON)
+}
+
 func init() {
+	dataCmd.PersistentFlags().String("bucket", "", "operate on the data of this bucket")
+	listCmd.Flags().Int("limit", 0, "list at most this many names (default 100)")
+	listCmd.Flags().String("cursor", "", "continue a previous listing from its cursor")
+	retrieveCmd.Flags().Int("version", 0, "retrieve a previous version of the data")
+	downloadCmd.Flags().Int("version", 0, "download a previous version of the data")
+	watchCmd.Flags().String("since", "", "resume from the ID of the last change seen")
+	uploadCmd.Flags().String("file", "", "upload the content of this file, streamed, instead of a string")
+	uploadCmd.Flags().String("ttl", "", "expire the data after this long, in seconds or as a duration (e.g. 1h)")
+	for _, cmd := range []*cobra.Command{uploadCmd, deleteCmd} {
+		cmd.Flags().String("if-match", "", "only if the data is at this etag (\"*\" for any)")
+		cmd.Flags().String("if-none-match", "", "only if the data is not at this etag (\"*\" for not at all)")
+	}
+
+	dataCmd.AddCommand(listCmd)
 	dataCmd.AddCommand(retrieveCmd)
+	dataCmd.AddCommand(metadataCmd)
 	dataCmd.AddCommand(uploadCmd)
+	dataCmd.AddCommand(downloadCmd)
 	dataCmd.AddCommand(deleteCmd)
+	dataCmd.AddCommand(versionsCmd)
+	dataCmd.AddCommand(restoreCmd)
+	dataCmd.AddCommand(batchCmd)
+	dataCmd.AddCommand(watchCmd)
 	RootCmd.AddCommand(dataCmd)
 }
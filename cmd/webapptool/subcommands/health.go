@@ -13,8 +13,7 @@ var healthCmd = &cobra.Command{
 	Short: "Checks the health status of the webapp",
 	Long:  "This command makes a GET request to the webapp's `/health` endpoint",
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: parse URL from args or config
-		resp, err := requests.GetRequest("http://0.0.0.0:8080/health", nil, nil)
+		resp, err := requests.GetRequest(nodeURL("/health"), nil, nil)
 		if err != nil {
 			fmt.Printf("failed to GET /health: %v\n", err)
 			return
@@ -0,0 +1,60 @@
+package subcommands
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/spf13/cobra"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Root cmd for datastorage encryption key operations",
+	Long:  "This is the root cmd for the encryption keys of webapp's datastorage, when started with WEBAPP_ENCRYPTION_KEYRING:\n\tadd\n\treencrypt",
+}
+
+var keysAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Command to add a new key to an encryption key file",
+	Long:  "This is a keys subcommand to add a new random key with a given ID to a local key file, created if it does not exist - data is encrypted with the newest key once the webapp re-encrypts, or restarts",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("this command requires 2 arguments:\n\t1. Path of key file\n\t2. ID of the new key")
+			return
+		}
+
+		if err := datastorage.AddKeyringKey(args[0], args[1]); err != nil {
+			fmt.Printf("failed to add key: %v\n", err)
+			return
+		}
+		fmt.Printf("added key: '%s' to '%s'\n", args[1], args[0])
+	},
+}
+
+var keysReencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Command to re-encrypt all datastorage data with the newest key",
+	Long:  "This is a keys subcommand to have the webapp reload its key file, then re-encrypt all data not encrypted with the newest key - once done, older keys may be removed from the key file",
+	Run: func(cmd *cobra.Command, args []string) {
+		// Re-encrypting everything takes as long as it takes
+		resp, err := requests.CustomRequest(
+			nodeURL("/datastorage/admin/reencrypt"),
+			http.MethodPost,
+			nil,
+			&http.Client{},
+		)
+		if err != nil {
+			fmt.Printf("failed to POST to /datastorage/admin/reencrypt: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+func init() {
+	keysCmd.AddCommand(keysAddCmd)
+	keysCmd.AddCommand(keysReencryptCmd)
+	RootCmd.AddCommand(keysCmd)
+}
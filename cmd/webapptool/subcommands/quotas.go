@@ -0,0 +1,26 @@
+package subcommands
+
+import (
+	"fmt"
+
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/spf13/cobra"
+)
+
+var quotasCmd = &cobra.Command{
+	Use:   "quotas",
+	Short: "Command to show the usage of the datastorage quotas",
+	Long:  "This command shows the limits and current usage of each quota of webapp's datastorage, when started with quotas configured",
+	Run: func(cmd *cobra.Command, args []string) {
+		resp, err := requests.GetRequest(nodeURL("/datastorage/admin/quotas"), nil, nil)
+		if err != nil {
+			fmt.Printf("failed to GET /datastorage/admin/quotas: %v\n", err)
+			return
+		}
+		printResponse(resp)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(quotasCmd)
+}
@@ -1,12 +1,38 @@
 package subcommands
 
 import (
+	"os"
+	"strings"
+
 	"github.com/spf13/cobra"
 )
 
+// defaultNode is the webapp targeted when neither `--node` nor the
+// `WEBAPPTOOL_NODE` env var is set.
+const defaultNode = "http://0.0.0.0:8080"
+
 // This is the base command, i.e. called without subcommands
 var RootCmd = &cobra.Command{
 	Use:   "webapp-tool",
 	Short: "webapp CLI tool",
 	Long:  "webapp CLI tool called with no args...", // TODO: add list of args
 }
+
+// node is the base URL of the webapp targeted, any node of a cluster
+var node string
+
+// nodeURL returns the URL of `path` on the targeted webapp.
+func nodeURL(path string) string {
+	return strings.TrimSuffix(node, "/") + path
+}
+
+func init() {
+	target := os.Getenv("WEBAPPTOOL_NODE")
+	if len(target) == 0 {
+		target = defaultNode
+	}
+	RootCmd.PersistentFlags().StringVar(
+		&node, "node", target,
+		"base URL of the webapp to target, any node of a cluster (or set WEBAPPTOOL_NODE)",
+	)
+}
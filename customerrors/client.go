@@ -40,3 +40,70 @@ func (e ClientErrorBadMethod) ClientErrorMsg() ClientErrorMessage {
 		Error: e.Error(),
 	}
 }
+
+type ClientErrorBadParam struct {
+	Param  string
+	Value  string
+	Reason string
+}
+
+func (e ClientErrorBadParam) Error() string {
+	return fmt.Sprintf(
+		`request param: '%s' has invalid value: '%s' - %s`,
+		e.Param, e.Value, e.Reason,
+	)
+}
+
+func (e ClientErrorBadParam) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e ClientErrorBadParam) ClientErrorMsg() ClientErrorMessage {
+	return ClientErrorMessage{
+		Error: e.Error(),
+	}
+}
+
+type ClientErrorFollower struct {
+	RequestMethod string
+	Primary       string
+}
+
+func (e ClientErrorFollower) Error() string {
+	return fmt.Sprintf(
+		`request method: '%s' not supported by a read only follower - write to the primary: '%s'`,
+		e.RequestMethod, e.Primary,
+	)
+}
+
+func (e ClientErrorFollower) StatusCode() int {
+	return http.StatusForbidden
+}
+
+func (e ClientErrorFollower) ClientErrorMsg() ClientErrorMessage {
+	return ClientErrorMessage{
+		Error: e.Error(),
+	}
+}
+
+type ClientErrorClusterNode struct {
+	Node   string
+	Reason string
+}
+
+func (e ClientErrorClusterNode) Error() string {
+	return fmt.Sprintf(
+		`cluster node: '%s' failed to serve the request - %s`,
+		e.Node, e.Reason,
+	)
+}
+
+func (e ClientErrorClusterNode) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+func (e ClientErrorClusterNode) ClientErrorMsg() ClientErrorMessage {
+	return ClientErrorMessage{
+		Error: e.Error(),
+	}
+}
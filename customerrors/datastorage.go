@@ -15,3 +15,218 @@ func (e DataStorageNameNotFound) Error() string {
 		e.Name,
 	)
 }
+
+// DataStorageEntryTooLarge is an `error` returned when data associated with
+// `Name` is larger than the `DataStorage` can ever hold.
+type DataStorageEntryTooLarge struct {
+	Name  string
+	Size  int64
+	Limit int64
+}
+
+func (e DataStorageEntryTooLarge) Error() string {
+	return fmt.Sprintf(
+		"data associated with name: %s is %d bytes - exceeds limit of %d bytes",
+		e.Name, e.Size, e.Limit,
+	)
+}
+
+// DataStorageVersionNotFound is an `error` returned when a version of the data
+// associated with `Name` was never written, or is no longer kept.
+type DataStorageVersionNotFound struct {
+	Name    string
+	Version int
+}
+
+func (e DataStorageVersionNotFound) Error() string {
+	return fmt.Sprintf(
+		"attempted to access version %d of data associated with name: %s - not found",
+		e.Version, e.Name,
+	)
+}
+
+// DataStorageUnsupported is an `error` returned when the `DataStorage` in use
+// does not support the requested `Operation`.
+type DataStorageUnsupported struct {
+	Operation string
+}
+
+func (e DataStorageUnsupported) Error() string {
+	return fmt.Sprintf(
+		"data storage does not support: %s",
+		e.Operation,
+	)
+}
+
+// DataStoragePreconditionFailed is an `error` returned when a conditional
+// write to the data associated with `Name` is refused, as its current state
+// does not satisfy the condition.
+type DataStoragePreconditionFailed struct {
+	Name   string
+	Reason string
+}
+
+func (e DataStoragePreconditionFailed) Error() string {
+	return fmt.Sprintf(
+		"precondition failed for data associated with name: %s - %s",
+		e.Name, e.Reason,
+	)
+}
+
+// DataStorageBucketNotFound is an `error` returned when the `Bucket` accessed
+// does not exist.
+type DataStorageBucketNotFound struct {
+	Bucket string
+}
+
+func (e DataStorageBucketNotFound) Error() string {
+	return fmt.Sprintf(
+		"attempted to access bucket: %s - not found",
+		e.Bucket,
+	)
+}
+
+// DataStorageBucketExists is an `error` returned when creating a `Bucket`
+// which already exists.
+type DataStorageBucketExists struct {
+	Bucket string
+}
+
+func (e DataStorageBucketExists) Error() string {
+	return fmt.Sprintf(
+		"attempted to create bucket: %s - already exists",
+		e.Bucket,
+	)
+}
+
+// DataStorageBucketNotEmpty is an `error` returned when deleting a `Bucket`
+// which still holds data.
+type DataStorageBucketNotEmpty struct {
+	Bucket string
+}
+
+func (e DataStorageBucketNotEmpty) Error() string {
+	return fmt.Sprintf(
+		"attempted to delete bucket: %s - still holds data",
+		e.Bucket,
+	)
+}
+
+// DataStorageBucketInvalid is an `error` returned when `Bucket` is not a
+// valid bucket name.
+type DataStorageBucketInvalid struct {
+	Bucket string
+	Reason string
+}
+
+func (e DataStorageBucketInvalid) Error() string {
+	return fmt.Sprintf(
+		"invalid bucket name: '%s' - %s",
+		e.Bucket, e.Reason,
+	)
+}
+
+// DataStorageReadOnly is an `error` returned when writing to data associated
+// with `Name` in a read only `Bucket`.
+type DataStorageReadOnly struct {
+	Bucket string
+	Name   string
+}
+
+func (e DataStorageReadOnly) Error() string {
+	return fmt.Sprintf(
+		"attempted to write data associated with name: %s - bucket: %s is read only",
+		e.Name, e.Bucket,
+	)
+}
+
+// DataStorageBatchInvalid is an `error` returned when a batch of operations
+// could never be applied.
+type DataStorageBatchInvalid struct {
+	Reason string
+}
+
+func (e DataStorageBatchInvalid) Error() string {
+	return fmt.Sprintf(
+		"invalid batch - %s",
+		e.Reason,
+	)
+}
+
+// DataStorageChangesTruncated is an `error` returned when reading the changes
+// made to a `DataStorage` after `Since`, where those up to `Oldest` are no
+// longer kept.
+type DataStorageChangesTruncated struct {
+	Since  uint64
+	Oldest uint64
+}
+
+func (e DataStorageChangesTruncated) Error() string {
+	return fmt.Sprintf(
+		"attempted to read changes after: %d - only changes from %d are kept",
+		e.Since, e.Oldest,
+	)
+}
+
+// The quotas a `DataStorageQuotaExceeded` may be of.
+const (
+	// QuotaEntrySize limits the size of each entry, in bytes.
+	QuotaEntrySize = "entry size"
+
+	// QuotaBytes limits the total size of every entry, in bytes.
+	QuotaBytes = "bytes"
+
+	// QuotaEntries limits the number of entries.
+	QuotaEntries = "entries"
+)
+
+// DataStorageQuotaExceeded is an `error` returned when writing data associated
+// with `Name` would take the `Quota` of the names beginning with `Prefix` to
+// `Usage`, beyond its `Limit`.
+type DataStorageQuotaExceeded struct {
+	Name   string
+	Prefix string
+	Quota  string
+	Usage  int64
+	Limit  int64
+}
+
+func (e DataStorageQuotaExceeded) Error() string {
+	return fmt.Sprintf(
+		"data associated with name: %s would take the %s quota of names beginning with '%s' to %d - exceeds limit of %d",
+		e.Name, e.Quota, e.Prefix, e.Usage, e.Limit,
+	)
+}
+
+// EntryTooLarge reports whether the data alone exceeds the quota, so could
+// never be written - rather than the storage being full.
+func (e DataStorageQuotaExceeded) EntryTooLarge() bool {
+	return e.Quota == QuotaEntrySize
+}
+
+// DataStorageBackupInvalid is an `error` returned when restoring from an
+// archive which is not a backup of a `DataStorage`, or is corrupt.
+type DataStorageBackupInvalid struct {
+	Reason string
+}
+
+func (e DataStorageBackupInvalid) Error() string {
+	return fmt.Sprintf(
+		"invalid backup - %s",
+		e.Reason,
+	)
+}
+
+// DataStorageNameReserved is an `error` returned when accessing a `Name`
+// reserved for the internal keys of a `DataStorage`, which callers may not
+// read or write directly.
+type DataStorageNameReserved struct {
+	Name string
+}
+
+func (e DataStorageNameReserved) Error() string {
+	return fmt.Sprintf(
+		"name: %q is reserved for internal use",
+		e.Name,
+	)
+}
@@ -3,6 +3,7 @@ module github.com/dvo-dev/go-get-started
 go 1.18
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/spf13/cobra v1.7.0
 	github.com/stretchr/testify v1.8.2
 )
@@ -1,15 +1,59 @@
 package responses
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// entryMetadata is the client view of `datastorage.Metadata`, shared by
+// responses describing stored data.
+type entryMetadata struct {
+	Size        int        `json:"size"`
+	TTL         int64      `json:"ttl,omitempty"` // seconds
+	ContentType string     `json:"content_type,omitempty"`
+	Checksum    string     `json:"checksum,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// newEntryMetadata returns the client view of `meta`, omitting timestamps the
+// storage did not record.
+func newEntryMetadata(meta datastorage.Metadata, ttl time.Duration) entryMetadata {
+	view := entryMetadata{
+		Size:        meta.Size,
+		TTL:         int64(ttl.Round(time.Second) / time.Second),
+		ContentType: meta.ContentType,
+		Checksum:    meta.Checksum,
+	}
+	if !meta.CreatedAt.IsZero() {
+		view.CreatedAt = &meta.CreatedAt
+	}
+	if !meta.UpdatedAt.IsZero() {
+		view.UpdatedAt = &meta.UpdatedAt
+	}
+	return view
+}
 
 // DataFound is the client response generator when data is successfully
 // retrieved from `DataStorage`.
+//
+// A non-zero `TTL` is the time remaining before the data expires, and a
+// non-zero `Version` is the previous version retrieved.
 type DataFound struct {
 	DataName string
-	Data     []byte // TODO: add metadata?
+	Data     []byte
+	Metadata datastorage.Metadata
+	TTL      time.Duration
+	Version  int
 }
 
 func (d DataFound) GetResponse() ResponsePayload {
+	meta := newEntryMetadata(d.Metadata, d.TTL)
+	meta.Size = len(d.Data)
+
 	return ResponsePayload{
 		Status: "success",
 		Message: fmt.Sprintf(
@@ -18,10 +62,60 @@ func (d DataFound) GetResponse() ResponsePayload {
 		),
 		Data: struct {
 			Content string `json:"content"`
-			Size    int    `json:"size"`
+			entryMetadata
+			Version int `json:"version,omitempty"`
+		}{
+			Content:       string(d.Data),
+			entryMetadata: meta,
+			Version:       d.Version,
+		},
+	}
+}
+
+// DataMetadataFound is the client response generator when the metadata of data
+// is successfully retrieved from `DataStorage`.
+//
+// A non-zero `TTL` is the time remaining before the data expires.
+type DataMetadataFound struct {
+	DataName string
+	Metadata datastorage.Metadata
+	TTL      time.Duration
+}
+
+func (d DataMetadataFound) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"metadata of data with name: '%s' found",
+			d.DataName,
+		),
+		Data: newEntryMetadata(d.Metadata, d.TTL),
+	}
+}
+
+// DataListed is the client response generator when names are successfully
+// listed from `DataStorage`.
+//
+// An empty `Cursor` means there are no more names to list.
+type DataListed struct {
+	Prefix string
+	Names  []string
+	Cursor string
+}
+
+func (d DataListed) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"%d names with prefix: '%s' found",
+			len(d.Names), d.Prefix,
+		),
+		Data: struct {
+			Names  []string `json:"names"`
+			Cursor string   `json:"cursor,omitempty"`
 		}{
-			Content: string(d.Data),
-			Size:    len(d.Data),
+			Names:  d.Names,
+			Cursor: d.Cursor,
 		},
 	}
 }
@@ -30,7 +124,7 @@ func (d DataFound) GetResponse() ResponsePayload {
 // written to `DataStorage`.
 type DataStored struct {
 	DataName string
-	Data     []byte
+	Size     int
 }
 
 func (d DataStored) GetResponse() ResponsePayload {
@@ -43,7 +137,7 @@ func (d DataStored) GetResponse() ResponsePayload {
 		Data: struct {
 			Size int `json:"size"`
 		}{
-			Size: len(d.Data),
+			Size: d.Size,
 		},
 	}
 }
@@ -63,3 +157,222 @@ func (d DataDeleted) GetResponse() ResponsePayload {
 		),
 	}
 }
+
+// DataVersions is the client response generator when the versions of data are
+// listed from `DataStorage`.
+type DataVersions struct {
+	DataName string
+	Versions []datastorage.VersionInfo
+}
+
+func (d DataVersions) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"%d versions of data with name: '%s' found",
+			len(d.Versions), d.DataName,
+		),
+		Data: struct {
+			Versions []datastorage.VersionInfo `json:"versions"`
+		}{
+			Versions: d.Versions,
+		},
+	}
+}
+
+// DataRestored is the client response generator when data is successfully
+// restored to a previous version in `DataStorage`.
+type DataRestored struct {
+	DataName        string
+	RestoredVersion int
+	Version         int
+}
+
+func (d DataRestored) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"data with name: '%s' restored to version %d",
+			d.DataName, d.RestoredVersion,
+		),
+		Data: struct {
+			RestoredVersion int `json:"restored_version"`
+			Version         int `json:"version"`
+		}{
+			RestoredVersion: d.RestoredVersion,
+			Version:         d.Version,
+		},
+	}
+}
+
+// BatchApplied is the client response generator when a batch of operations
+// is successfully applied to `DataStorage`, `Metadata` being that of each
+// stored entry.
+type BatchApplied struct {
+	Operations []datastorage.BatchOp
+	Metadata   []datastorage.Metadata
+}
+
+func (b BatchApplied) GetResponse() ResponsePayload {
+	type result struct {
+		Op   string `json:"op"`
+		Name string `json:"name"`
+		ETag string `json:"etag,omitempty"`
+		Size int    `json:"size,omitempty"`
+	}
+
+	results := make([]result, len(b.Operations))
+	for i, op := range b.Operations {
+		results[i] = result{Op: "delete", Name: op.Name}
+		if op.Delete {
+			continue
+		}
+		results[i].Op = "store"
+		results[i].Size = len(op.Data)
+		if revision := b.Metadata[i].Revision; revision != 0 {
+			results[i].ETag = `"` + strconv.FormatUint(revision, 10) + `"`
+		}
+	}
+
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"batch of %d operations applied",
+			len(b.Operations),
+		),
+		Data: struct {
+			Operations []result `json:"operations"`
+		}{
+			Operations: results,
+		},
+	}
+}
+
+// bucketView is the client view of a bucket and its
+// `datastorage.BucketConfig`.
+type bucketView struct {
+	Name          string `json:"name"`
+	MaxObjectSize int64  `json:"max_object_size,omitempty"`
+	DefaultTTL    int64  `json:"default_ttl,omitempty"` // seconds
+	ReadOnly      bool   `json:"read_only"`
+}
+
+// newBucketView returns the client view of `bucket` configured by `cfg`.
+func newBucketView(bucket string, cfg datastorage.BucketConfig) bucketView {
+	return bucketView{
+		Name:          bucket,
+		MaxObjectSize: cfg.MaxObjectSize,
+		DefaultTTL:    int64(cfg.DefaultTTL.Round(time.Second) / time.Second),
+		ReadOnly:      cfg.ReadOnly,
+	}
+}
+
+// BucketsListed is the client response generator when the buckets of
+// `DataStorage` are listed.
+type BucketsListed struct {
+	Buckets []datastorage.BucketInfo
+}
+
+func (b BucketsListed) GetResponse() ResponsePayload {
+	views := make([]bucketView, 0, len(b.Buckets))
+	for _, bucket := range b.Buckets {
+		views = append(views, newBucketView(bucket.Name, bucket.Config))
+	}
+
+	return ResponsePayload{
+		Status:  "success",
+		Message: fmt.Sprintf("%d buckets found", len(b.Buckets)),
+		Data: struct {
+			Buckets []bucketView `json:"buckets"`
+		}{
+			Buckets: views,
+		},
+	}
+}
+
+// BucketConfigured is the client response generator when a bucket of
+// `DataStorage` is successfully created, or reconfigured if not `Created`.
+type BucketConfigured struct {
+	Bucket  string
+	Config  datastorage.BucketConfig
+	Created bool
+}
+
+func (b BucketConfigured) GetResponse() ResponsePayload {
+	action := "configured"
+	if b.Created {
+		action = "created"
+	}
+
+	return ResponsePayload{
+		Status:  "success",
+		Message: fmt.Sprintf("bucket: '%s' %s", b.Bucket, action),
+		Data:    newBucketView(b.Bucket, b.Config),
+	}
+}
+
+// BucketDeleted is the client response generator when a bucket is
+// successfully deleted from `DataStorage`.
+type BucketDeleted struct {
+	Bucket string
+}
+
+func (b BucketDeleted) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status:  "success",
+		Message: fmt.Sprintf("bucket: '%s' deleted", b.Bucket),
+	}
+}
+
+// DataReencrypted is the client response generator when the data of
+// `DataStorage` is re-encrypted with its newest key.
+type DataReencrypted struct {
+	Reencrypted int
+}
+
+func (d DataReencrypted) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status:  "success",
+		Message: fmt.Sprintf("%d entries re-encrypted", d.Reencrypted),
+		Data: struct {
+			Reencrypted int `json:"reencrypted"`
+		}{
+			Reencrypted: d.Reencrypted,
+		},
+	}
+}
+
+// QuotaUsage is the client response generator when the usage of the quotas of
+// `DataStorage` is retrieved.
+type QuotaUsage struct {
+	Quotas []datastorage.QuotaUsage
+}
+
+func (q QuotaUsage) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status:  "success",
+		Message: fmt.Sprintf("usage of %d quotas found", len(q.Quotas)),
+		Data: struct {
+			Quotas []datastorage.QuotaUsage `json:"quotas"`
+		}{
+			Quotas: q.Quotas,
+		},
+	}
+}
+
+// DataRestoredFromBackup is the client response generator when a backup is
+// restored into `DataStorage`.
+type DataRestoredFromBackup struct {
+	Result datastorage.RestoreResult
+}
+
+func (d DataRestoredFromBackup) GetResponse() ResponsePayload {
+	return ResponsePayload{
+		Status: "success",
+		Message: fmt.Sprintf(
+			"%d entries restored, %d skipped and %d expired",
+			d.Result.Restored, d.Result.Skipped, d.Result.Expired,
+		),
+		Data: d.Result,
+	}
+}
@@ -0,0 +1,202 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/responses"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// HandleReencryptRequest will execute on any admin requests to re-encrypt
+// `storage` with the newest key of its keyring, once a key was added to the
+// key file - see `datastorage.EncryptedStorage.Reencrypt`.
+//
+// The supported request method is POST, responding with how many entries were
+// re-encrypted.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func HandleReencryptRequest(storage *datastorage.EncryptedStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		log.Println("DataStorageHandler - re-encrypting data storage...")
+		reencrypted, err := storage.Reencrypt()
+		if err != nil {
+			log.Printf(
+				"DataStorageHandler - re-encrypted %d entries before failing: %v",
+				reencrypted, err,
+			)
+			writeErrorResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Printf("DataStorageHandler - re-encrypted %d entries", reencrypted)
+
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.DataReencrypted{
+			Reencrypted: reencrypted,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHandler - data re-encrypted but writing response failed: %v",
+				rErr,
+			)
+		}
+	}
+}
+
+// HandleQuotaRequest will execute on any admin requests for the usage of the
+// quotas of `storage`, see `datastorage.QuotaStorage`.
+//
+// The supported request method is GET.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func HandleQuotaRequest(storage *datastorage.QuotaStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.QuotaUsage{
+			Quotas: storage.Usage(),
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHandler - writing quota usage response failed: %v",
+				rErr,
+			)
+		}
+	}
+}
+
+// HandleBackupRequest will execute on any admin requests to back up every
+// entry of `storage`, see `datastorage.Backup`.
+//
+// The supported request method is GET, responding with the backup as a tar
+// archive streamed as it is written. Should backing up fail once streaming,
+// the archive ends without its manifest, so it is never restored as if whole.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func HandleBackupRequest(storage datastorage.DataStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		log.Println("DataStorageHandler - backing up data storage...")
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(
+			"attachment; filename=\"datastorage-%s.tar\"",
+			time.Now().UTC().Format("20060102T150405Z"),
+		))
+		w.WriteHeader(http.StatusOK)
+
+		manifest, err := datastorage.Backup(r.Context(), storage, w)
+		if err != nil {
+			log.Printf("DataStorageHandler - backing up data storage failed: %v", err)
+			return
+		}
+		log.Printf(
+			"DataStorageHandler - backed up %d entries of %d bytes",
+			len(manifest.Entries), manifest.Bytes,
+		)
+	}
+}
+
+// HandleRestoreRequest will execute on any admin requests to restore a backup
+// into `storage`, see `datastorage.Restore`, calling `onRestore` (if not nil)
+// with the name of each entry restored.
+//
+// The supported request method is POST, with the tar archive written by
+// `HandleBackupRequest` as the body and the optional param `mode`: "merge"
+// (default), "overwrite" or "skip" - see `datastorage.RestoreMode`. Responds
+// with how many entries were restored, or 400 if the archive is invalid - in
+// which case the entries before the fault are already restored.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func HandleRestoreRequest(storage datastorage.DataStorage, onRestore func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		opts := datastorage.RestoreOptions{OnRestore: onRestore}
+		if mode := r.URL.Query().Get("mode"); len(mode) > 0 {
+			var err error
+			if opts.Mode, err = datastorage.ParseRestoreMode(mode); err != nil {
+				cErr := customerrors.ClientErrorBadParam{
+					Param:  "mode",
+					Value:  mode,
+					Reason: "must be one of: merge, overwrite, skip",
+				}
+				writeErrorResponse(w, cErr.StatusCode(), cErr)
+				return
+			}
+		}
+
+		log.Println("DataStorageHandler - restoring data storage from backup...")
+		result, err := datastorage.Restore(r.Context(), storage, r.Body, opts)
+		if err != nil {
+			log.Printf(
+				"DataStorageHandler - restored %d entries before failing: %v",
+				result.Restored, err,
+			)
+		}
+		switch err.(type) {
+		case nil:
+		case customerrors.DataStorageBackupInvalid:
+			writeErrorResponse(w, http.StatusBadRequest, err)
+			return
+		case customerrors.DataStorageQuotaExceeded:
+			writeErrorResponse(w, quotaExceededStatus(err), err)
+			return
+		case customerrors.DataStorageReadOnly:
+			writeErrorResponse(w, http.StatusForbidden, err)
+			return
+		default:
+			writeFailure(w, r, err)
+			return
+		}
+		log.Printf(
+			"DataStorageHandler - restored %d entries, skipped %d and %d expired",
+			result.Restored, result.Skipped, result.Expired,
+		)
+
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.DataRestoredFromBackup{
+			Result: result,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHandler - data restored but writing response failed: %v",
+				rErr,
+			)
+		}
+	}
+}
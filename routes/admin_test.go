@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReencryptRequest(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, datastorage.AddKeyringKey(keyFile, "first"))
+	keyring, err := datastorage.Keyring{}.Initialize(keyFile)
+	require.NoError(t, err)
+	storage := datastorage.EncryptedStorage{}.Initialize(
+		datastorage.MemStorage{}.Initialize(), keyring, datastorage.EncryptedStorageConfig{},
+	)
+	require.NoError(t, storage.StoreData("a", []byte("test data a")))
+	require.NoError(t, storage.StoreData("b", []byte("test data b")))
+
+	testServer := httptest.NewServer(HandleReencryptRequest(storage))
+	t.Cleanup(testServer.Close)
+
+	reencrypt := func(t *testing.T) int {
+		resp, err := http.Post(testServer.URL, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rcvMsg struct {
+			Data struct {
+				Reencrypted int `json:"reencrypted"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		return rcvMsg.Data.Reencrypted
+	}
+
+	assert.Zero(t, reencrypt(t))
+	require.NoError(t, datastorage.AddKeyringKey(keyFile, "second"))
+	assert.Equal(t, 2, reencrypt(t))
+
+	data, err := storage.RetrieveData("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test data a"), data)
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestHandleQuotaRequest(t *testing.T) {
+	storage, err := datastorage.QuotaStorage{}.Initialize(
+		datastorage.MemStorage{}.Initialize(),
+		datastorage.QuotaStorageConfig{Quotas: []datastorage.Quota{{MaxBytes: 100}}},
+	)
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreData("a", []byte("test data")))
+
+	testServer := httptest.NewServer(HandleQuotaRequest(storage))
+	t.Cleanup(testServer.Close)
+
+	resp, err := http.Get(testServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rcvMsg struct {
+		Data struct {
+			Quotas []datastorage.QuotaUsage `json:"quotas"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+	require.Len(t, rcvMsg.Data.Quotas, 1)
+	assert.Equal(t, int64(100), rcvMsg.Data.Quotas[0].MaxBytes)
+	assert.Equal(t, int64(9), rcvMsg.Data.Quotas[0].Bytes)
+	assert.Equal(t, int64(1), rcvMsg.Data.Quotas[0].Entries)
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := http.Post(testServer.URL, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestHandleBackupAndRestoreRequest(t *testing.T) {
+	source := datastorage.MemStorage{}.Initialize()
+	require.NoError(t, source.StoreData("a", []byte("test data a")))
+	require.NoError(t, source.StoreData("b", []byte("test data b")))
+	backupServer := httptest.NewServer(HandleBackupRequest(source))
+	t.Cleanup(backupServer.Close)
+
+	target := datastorage.MemStorage{}.Initialize()
+	require.NoError(t, target.StoreData("b", []byte("newer b")))
+	var restored []string
+	restoreServer := httptest.NewServer(HandleRestoreRequest(target, func(name string) error {
+		restored = append(restored, name)
+		return nil
+	}))
+	t.Cleanup(restoreServer.Close)
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := http.Post(backupServer.URL, "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+		resp, err = http.Get(restoreServer.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	resp, err := http.Get(backupServer.URL)
+	require.NoError(t, err)
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-tar", resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), ".tar")
+
+	restore := func(t *testing.T, query string, body []byte) (*http.Response, datastorage.RestoreResult) {
+		resp, err := http.Post(restoreServer.URL+query, "application/x-tar", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var rcvMsg struct {
+			Data datastorage.RestoreResult `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		return resp, rcvMsg.Data
+	}
+
+	t.Run("bad mode", func(t *testing.T) {
+		resp, _ := restore(t, "?mode=replace", archive)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("invalid archive", func(t *testing.T) {
+		resp, _ := restore(t, "", []byte("test data"))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		restored = nil
+		resp, result := restore(t, "?mode=skip", archive)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, datastorage.RestoreResult{Restored: 1, Skipped: 1}, result)
+		assert.Equal(t, []string{"a"}, restored)
+
+		data, err := target.RetrieveData("b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("newer b"), data)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		resp, result := restore(t, "?mode=overwrite", archive)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, datastorage.RestoreResult{Restored: 2}, result)
+
+		data, err := target.RetrieveData("b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data b"), data)
+	})
+}
@@ -0,0 +1,250 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/responses"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// maxBatchBodySize bounds the JSON body of a batch request.
+const maxBatchBodySize = 32 << 20
+
+// batchRequest is the JSON body of a batch request.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is a single operation of a `batchRequest`.
+type batchOperation struct {
+	// Op is either "store" or "delete"
+	Op   string `json:"op"`
+	Name string `json:"name"`
+
+	// Data is stored as given, or decoded first if Encoding is "base64"
+	Data        string `json:"data"`
+	Encoding    string `json:"encoding"`
+	ContentType string `json:"content_type"`
+	TTL         string `json:"ttl"`
+
+	// IfMatch and IfNoneMatch hold as the conditional request headers do
+	IfMatch     string `json:"if_match"`
+	IfNoneMatch string `json:"if_none_match"`
+}
+
+// HandleBatchRequest will parse and execute on any client requests applying a
+// batch of stores and deletes to a `DataStorage` atomically - either every
+// operation is applied, or none are.
+//
+// The supported request method is POST, with a JSON body listing the
+// `operations` in order. Each has an `op` ("store" or "delete") and a `name`,
+// stores have `data` (a string, or base64 if `encoding` is "base64") and
+// optionally a `content_type` and `ttl`, and any operation may have the
+// preconditions `if_match` and `if_none_match` as for `HandleClientRequest`.
+//
+// Responds 412 if any precondition does not hold, 404 if any name to delete
+// does not exist, and 413 or 507 if the batch exceeds a quota.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func (h *DataStorageHandler) HandleBatchRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		if err := h.applyBatch(w, r); err != nil {
+			writeFailure(w, r, err)
+		}
+	}
+}
+
+func (h *DataStorageHandler) applyBatch(w http.ResponseWriter, r *http.Request) error {
+	// Parse request body
+	var body batchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		log.Printf(
+			"DataStorageHandler - failed to parse batch request: %v",
+			err,
+		)
+		writeErrorResponse(w, http.StatusBadRequest, customerrors.ClientErrorBadParam{
+			Param:  "body",
+			Value:  "",
+			Reason: fmt.Sprintf("expected a JSON batch of operations: %v", err),
+		})
+		return nil
+	}
+
+	ops, err := parseBatchOperations(body.Operations)
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	log.Printf(
+		"DataStorageHandler - attempting to apply batch of %d operations",
+		len(ops),
+	)
+
+	// Attempt to apply the batch to our storage
+	metas, err := datastorage.WithContext(h.storage).ApplyBatchContext(r.Context(), ops)
+	switch err.(type) {
+	case nil:
+		log.Printf(
+			"successfully applied to storage batch of %d operations",
+			len(ops),
+		)
+		w.WriteHeader(http.StatusOK)
+
+		// Attempt to write response message
+		if rErr := responses.WriteJSON(w, responses.BatchApplied{
+			Operations: ops,
+			Metadata:   metas,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - batch applied but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	case customerrors.DataStorageBatchInvalid:
+		writeBatchError(w, http.StatusBadRequest, err)
+		return nil
+	case customerrors.DataStorageNameNotFound, customerrors.DataStorageBucketNotFound:
+		writeBatchError(w, http.StatusNotFound, err)
+		return nil
+	case customerrors.DataStoragePreconditionFailed:
+		writeBatchError(w, http.StatusPreconditionFailed, err)
+		return nil
+	case customerrors.DataStorageEntryTooLarge:
+		writeBatchError(w, http.StatusRequestEntityTooLarge, err)
+		return nil
+	case customerrors.DataStorageQuotaExceeded:
+		writeBatchError(w, quotaExceededStatus(err), err)
+		return nil
+	case customerrors.DataStorageReadOnly:
+		writeBatchError(w, http.StatusForbidden, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// writeBatchError logs and writes the client error response of a batch
+// refused by the storage.
+func writeBatchError(w http.ResponseWriter, status int, err error) {
+	log.Printf(
+		"DataStorageHandler - refused to apply batch\n\t%v",
+		err,
+	)
+	writeErrorResponse(w, status, err)
+}
+
+// parseBatchOperations parses the operations of a batch request into
+// `datastorage.BatchOp`s, in order.
+//
+// Returns a `customerrors.ClientErrorBadParam` naming the first invalid field.
+func parseBatchOperations(operations []batchOperation) ([]datastorage.BatchOp, error) {
+	if len(operations) == 0 {
+		return nil, customerrors.ClientErrorBadParam{
+			Param:  "operations",
+			Value:  "",
+			Reason: "expected at least one operation",
+		}
+	}
+
+	ops := make([]datastorage.BatchOp, len(operations))
+	for i, operation := range operations {
+		param := func(field string) string {
+			return fmt.Sprintf("operations[%d].%s", i, field)
+		}
+
+		op := datastorage.BatchOp{
+			Name: strings.TrimSpace(operation.Name),
+		}
+		if len(op.Name) == 0 {
+			return nil, customerrors.ClientErrorBadParam{
+				Param:  param("name"),
+				Value:  operation.Name,
+				Reason: "must not be empty",
+			}
+		}
+		if err := validateName(param("name"), op.Name); err != nil {
+			return nil, err
+		}
+
+		switch operation.Op {
+		case "store":
+			data := []byte(operation.Data)
+			switch operation.Encoding {
+			case "":
+			case "base64":
+				var err error
+				if data, err = base64.StdEncoding.DecodeString(operation.Data); err != nil {
+					return nil, customerrors.ClientErrorBadParam{
+						Param:  param("data"),
+						Value:  "",
+						Reason: "not valid base64",
+					}
+				}
+			default:
+				return nil, customerrors.ClientErrorBadParam{
+					Param:  param("encoding"),
+					Value:  operation.Encoding,
+					Reason: "expected base64 or none",
+				}
+			}
+
+			ttl, err := parseTTL(operation.TTL)
+			if err != nil {
+				cErr := err.(customerrors.ClientErrorBadParam)
+				cErr.Param = param(cErr.Param)
+				return nil, cErr
+			}
+			op.Data = data
+			op.Options = datastorage.StoreOptions{
+				TTL:         ttl,
+				ContentType: contentType(operation.ContentType, data),
+			}
+		case "delete":
+			op.Delete = true
+		default:
+			return nil, customerrors.ClientErrorBadParam{
+				Param:  param("op"),
+				Value:  operation.Op,
+				Reason: "expected store or delete",
+			}
+		}
+
+		var err error
+		op.Precondition.MustExist, op.Precondition.IfMatch, err = parseETags(
+			param("if_match"), []string{operation.IfMatch}, false,
+		)
+		if err != nil {
+			return nil, err
+		}
+		op.Precondition.MustNotExist, op.Precondition.IfNoneMatch, err = parseETags(
+			param("if_none_match"), []string{operation.IfNoneMatch}, true,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		ops[i] = op
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataStorage_Batch(t *testing.T) {
+	testServer := initTestBucketServer(t)
+	rootURL := testServer.URL + "/datastorage"
+
+	batchRequest := func(t *testing.T, targetURL, body string) *http.Response {
+		resp, err := http.Post(targetURL+"/batch", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	var etag string
+	t.Run("apply", func(t *testing.T) {
+		resp := batchRequest(t, rootURL, `{"operations": [
+			{"op": "store", "name": "config/a", "data": "a1", "if_none_match": "*"},
+			{"op": "store", "name": "config/b", "data": "YjE=", "encoding": "base64", "ttl": "1h"}
+		]}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rcvMsg struct {
+			Data struct {
+				Operations []struct {
+					Op   string `json:"op"`
+					Name string `json:"name"`
+					ETag string `json:"etag"`
+					Size int    `json:"size"`
+				} `json:"operations"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		require.Len(t, rcvMsg.Data.Operations, 2)
+		assert.Equal(t, "config/b", rcvMsg.Data.Operations[1].Name)
+		assert.Equal(t, 2, rcvMsg.Data.Operations[1].Size)
+		etag = rcvMsg.Data.Operations[0].ETag
+		assert.NotEmpty(t, etag)
+
+		resp = conditionalRequest(t, http.MethodGet, rootURL, "config/b", nil, http.Header{})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var found struct {
+			Data struct {
+				Content string `json:"content"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+		assert.Equal(t, "b1", found.Data.Content)
+	})
+
+	t.Run("all or nothing", func(t *testing.T) {
+		etagJSON, err := json.Marshal(etag)
+		require.NoError(t, err)
+
+		for status, body := range map[int]string{
+			http.StatusPreconditionFailed: `{"operations": [
+				{"op": "store", "name": "config/c", "data": "c1"},
+				{"op": "store", "name": "config/a", "data": "a2", "if_none_match": "*"}
+			]}`,
+			http.StatusNotFound: `{"operations": [
+				{"op": "store", "name": "config/c", "data": "c1"},
+				{"op": "delete", "name": "config/missing"}
+			]}`,
+			http.StatusBadRequest: `{"operations": [
+				{"op": "store", "name": "config/c", "data": "c1"},
+				{"op": "delete", "name": "config/c"}
+			]}`,
+		} {
+			resp := batchRequest(t, rootURL, body)
+			assert.Equal(t, status, resp.StatusCode, body)
+		}
+		resp := conditionalRequest(t, http.MethodGet, rootURL, "config/c", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = batchRequest(t, rootURL, `{"operations": [
+			{"op": "store", "name": "config/c", "data": "c1"},
+			{"op": "delete", "name": "config/a", "if_match": `+string(etagJSON)+`}
+		]}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, rootURL, "config/a", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		for _, body := range []string{
+			`not json`,
+			`{"operations": []}`,
+			`{"operations": [{"op": "rename", "name": "a"}]}`,
+			`{"operations": [{"op": "store", "name": ""}]}`,
+			`{"operations": [{"op": "store", "name": "a", "data": "!", "encoding": "base64"}]}`,
+			`{"operations": [{"op": "store", "name": "a", "ttl": "soon"}]}`,
+			`{"operations": [{"op": "delete", "name": "a", "if_match": "3"}]}`,
+		} {
+			resp := batchRequest(t, rootURL, body)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		}
+
+		resp, err := requests.CustomRequest(rootURL+"/batch", http.MethodGet, nil, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		resp, err := requests.CustomRequest(
+			rootURL+"/buckets", http.MethodPost, &map[string]string{"name": "team-a", "max_size": "2"}, nil,
+		)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		teamA := rootURL + "/team-a"
+		resp = batchRequest(t, teamA, `{"operations": [{"op": "store", "name": "config/a", "data": "a1"}]}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = batchRequest(t, teamA, `{"operations": [{"op": "store", "name": "config/b", "data": "large"}]}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		resp = batchRequest(t, rootURL+"/missing", `{"operations": [{"op": "delete", "name": "config/a"}]}`)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Bucket data is not the unbucketed data
+		resp = conditionalRequest(t, http.MethodGet, teamA, "config/a", nil, http.Header{})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, rootURL, "config/a", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
@@ -0,0 +1,307 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/responses"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// bucketRoutePrefix is the URL path beneath which `HandleBucketDataRequest`
+// expects to be assigned, followed by the bucket name.
+const bucketRoutePrefix = "/datastorage/"
+
+// reservedBucketNames are the bucket names clashing with other routes beneath
+// `bucketRoutePrefix`, which cannot be created over HTTP.
+var reservedBucketNames = map[string]bool{
+	"admin":    true,
+	"batch":    true,
+	"buckets":  true,
+	"metadata": true,
+	"versions": true,
+	"watch":    true,
+}
+
+// HandleBucketRequest will parse and execute on any client requests managing
+// the buckets of a `DataStorage`, which must implement
+// `datastorage.BucketManager`.
+//
+// Supported request methods are GET (list buckets), POST (create bucket
+// `name`), PUT (replace the config of bucket `name`) and DELETE (delete the
+// empty bucket `name`). POST and PUT configure the bucket by the optional
+// params `max_size` (bytes), `ttl` (default TTL) and `read_only`.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func (h *DataStorageHandler) HandleBucketRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Catch any anomaly errors - will write status code 500
+		var err error
+		w.Header().Set("Content-Type", "application/json")
+
+		manager, ok := h.storage.(datastorage.BucketManager)
+		if !ok {
+			writeErrorResponse(w, http.StatusNotImplemented, customerrors.DataStorageUnsupported{
+				Operation: "buckets",
+			})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			err = listBuckets(w, manager)
+
+		case http.MethodPost:
+			err = createBucket(w, r, manager)
+
+		case http.MethodPut:
+			err = configureBucket(w, r, manager)
+
+		case http.MethodDelete:
+			err = deleteBucket(w, r, manager)
+
+		default:
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		if err != nil {
+			writeFailure(w, r, err)
+		}
+	}
+}
+
+func listBuckets(w http.ResponseWriter, manager datastorage.BucketManager) error {
+	buckets, err := manager.ListBuckets()
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if rErr := responses.WriteJSON(w, responses.BucketsListed{
+		Buckets: buckets,
+	}); rErr != nil {
+		log.Printf(
+			"DataStorageHander - buckets listed but writing response failed: %v",
+			rErr,
+		)
+	}
+	return nil
+}
+
+func createBucket(w http.ResponseWriter, r *http.Request, manager datastorage.BucketManager) error {
+	// Parse request params
+	bucket := strings.TrimSpace(r.FormValue("name"))
+	cfg, err := parseBucketConfig(r)
+	if err == nil && reservedBucketNames[bucket] {
+		err = customerrors.ClientErrorBadParam{
+			Param:  "name",
+			Value:  bucket,
+			Reason: "reserved",
+		}
+	}
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	log.Printf(
+		"DataStorageHandler - attempting to create bucket: '%s'",
+		bucket,
+	)
+
+	err = manager.CreateBucket(bucket, cfg)
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+		if rErr := responses.WriteJSON(w, responses.BucketConfigured{
+			Bucket:  bucket,
+			Config:  cfg,
+			Created: true,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - bucket created but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	default:
+		return writeBucketError(w, bucket, err)
+	}
+}
+
+func configureBucket(w http.ResponseWriter, r *http.Request, manager datastorage.BucketManager) error {
+	// Parse request params
+	bucket := strings.TrimSpace(r.FormValue("name"))
+	cfg, err := parseBucketConfig(r)
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	log.Printf(
+		"DataStorageHandler - attempting to configure bucket: '%s'",
+		bucket,
+	)
+
+	err = manager.ConfigureBucket(bucket, cfg)
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.BucketConfigured{
+			Bucket: bucket,
+			Config: cfg,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - bucket configured but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	default:
+		return writeBucketError(w, bucket, err)
+	}
+}
+
+func deleteBucket(w http.ResponseWriter, r *http.Request, manager datastorage.BucketManager) error {
+	// Parse request param
+	bucket := r.URL.Query().Get("name")
+	log.Printf(
+		"DataStorageHandler - attempting to delete bucket: '%s'",
+		bucket,
+	)
+
+	err := manager.DeleteBucket(bucket)
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.BucketDeleted{
+			Bucket: bucket,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - bucket deleted but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	default:
+		return writeBucketError(w, bucket, err)
+	}
+}
+
+// HandleBucketDataRequest will parse and execute on any client requests
+// intended for the data in a single bucket of a `DataStorage`, which must
+// implement `datastorage.BucketManager`.
+//
+// It expects to be assigned to `bucketRoutePrefix`, serving the URL paths
+// "{bucket}", "{bucket}/metadata", "{bucket}/versions" and "{bucket}/batch"
+// beneath it exactly as `HandleClientRequest`, `HandleMetadataRequest`,
+// `HandleVersionRequest` and `HandleBatchRequest` serve the unbucketed data.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func (h *DataStorageHandler) HandleBucketDataRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		manager, ok := h.storage.(datastorage.BucketManager)
+		if !ok {
+			writeErrorResponse(w, http.StatusNotImplemented, customerrors.DataStorageUnsupported{
+				Operation: "buckets",
+			})
+			return
+		}
+
+		// Parse the bucket, and the route within it, from the path
+		path := strings.TrimPrefix(r.URL.Path, bucketRoutePrefix)
+		bucket, route, _ := strings.Cut(path, "/")
+		storage, err := manager.Bucket(bucket)
+		if err != nil {
+			if wErr := writeBucketError(w, bucket, err); wErr != nil {
+				writeFailure(w, r, wErr)
+			}
+			return
+		}
+
+		scoped := DataStorageHandler{}.Initialize(storage)
+		switch route {
+		case "":
+			scoped.HandleClientRequest()(w, r)
+		case "metadata":
+			scoped.HandleMetadataRequest()(w, r)
+		case "versions":
+			scoped.HandleVersionRequest()(w, r)
+		case "batch":
+			scoped.HandleBatchRequest()(w, r)
+		default:
+			writeErrorResponse(w, http.StatusNotFound, customerrors.ClientErrorBadParam{
+				Param:  "path",
+				Value:  r.URL.Path,
+				Reason: "expected a bucket, optionally followed by /metadata, /versions or /batch",
+			})
+		}
+	}
+}
+
+// parseBucketConfig parses the `datastorage.BucketConfig` given by the
+// optional `max_size`, `ttl` and `read_only` request params.
+//
+// Returns a `customerrors.ClientErrorBadParam` if any is invalid.
+func parseBucketConfig(r *http.Request) (datastorage.BucketConfig, error) {
+	var (
+		cfg datastorage.BucketConfig
+		err error
+	)
+
+	if value := strings.TrimSpace(r.FormValue("max_size")); len(value) > 0 {
+		cfg.MaxObjectSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || cfg.MaxObjectSize < 0 {
+			return datastorage.BucketConfig{}, customerrors.ClientErrorBadParam{
+				Param:  "max_size",
+				Value:  value,
+				Reason: "must be a non-negative integer of bytes",
+			}
+		}
+	}
+	if cfg.DefaultTTL, err = parseTTL(r.FormValue("ttl")); err != nil {
+		return datastorage.BucketConfig{}, err
+	}
+	if value := strings.TrimSpace(r.FormValue("read_only")); len(value) > 0 {
+		cfg.ReadOnly, err = strconv.ParseBool(value)
+		if err != nil {
+			return datastorage.BucketConfig{}, customerrors.ClientErrorBadParam{
+				Param:  "read_only",
+				Value:  value,
+				Reason: "must be true or false",
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// writeBucketError writes the client error response of a failed operation on
+// `bucket`, or returns `err` if it is not a client error.
+func writeBucketError(w http.ResponseWriter, bucket string, err error) error {
+	log.Printf(
+		"DataStorageHandler - failed operation on bucket: '%s'\n\t%v",
+		bucket, err,
+	)
+
+	switch err.(type) {
+	case customerrors.DataStorageBucketNotFound:
+		writeErrorResponse(w, http.StatusNotFound, err)
+	case customerrors.DataStorageBucketExists, customerrors.DataStorageBucketNotEmpty:
+		writeErrorResponse(w, http.StatusConflict, err)
+	case customerrors.DataStorageBucketInvalid:
+		writeErrorResponse(w, http.StatusBadRequest, err)
+	default:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initTestBucketServer returns a test server serving the bucket routes of a
+// `datastorage.BucketStorage` as the webapp does.
+func initTestBucketServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	storage, err := datastorage.BucketStorage{}.Initialize(datastorage.MemStorage{}.Initialize())
+	require.NoError(t, err)
+	dsh := DataStorageHandler{}.Initialize(storage)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/datastorage", dsh.HandleClientRequest())
+	mux.HandleFunc("/datastorage/batch", dsh.HandleBatchRequest())
+	mux.HandleFunc("/datastorage/buckets", dsh.HandleBucketRequest())
+	mux.HandleFunc("/datastorage/", dsh.HandleBucketDataRequest())
+	testServer := httptest.NewServer(mux)
+	t.Cleanup(testServer.Close)
+
+	return testServer
+}
+
+func TestDataStorage_Buckets(t *testing.T) {
+	testServer := initTestBucketServer(t)
+	bucketsURL := testServer.URL + "/datastorage/buckets"
+
+	bucketRequest := func(t *testing.T, method string, params map[string]string) *http.Response {
+		resp, err := requests.CustomRequest(bucketsURL, method, &params, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("create", func(t *testing.T) {
+		resp := bucketRequest(t, http.MethodPost, map[string]string{
+			"name": "team-a", "max_size": "4", "ttl": "1h",
+		})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		resp = bucketRequest(t, http.MethodPost, map[string]string{"name": "team-b"})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		for status, params := range map[int]map[string]string{
+			http.StatusConflict:   {"name": "team-a"},
+			http.StatusBadRequest: {"name": "Team-A"},
+		} {
+			resp = bucketRequest(t, http.MethodPost, params)
+			assert.Equal(t, status, resp.StatusCode, params)
+		}
+		for _, params := range []map[string]string{
+			{"name": "versions"},
+			{"name": "team-c", "max_size": "-1"},
+			{"name": "team-c", "read_only": "maybe"},
+		} {
+			resp = bucketRequest(t, http.MethodPost, params)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode, params)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp := bucketRequest(t, http.MethodGet, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rcvMsg struct {
+			Data struct {
+				Buckets []map[string]any `json:"buckets"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		assert.Equal(t, []map[string]any{
+			{"name": "team-a", "max_object_size": float64(4), "default_ttl": float64(3600), "read_only": false},
+			{"name": "team-b", "read_only": false},
+		}, rcvMsg.Data.Buckets)
+	})
+
+	t.Run("bucket data", func(t *testing.T) {
+		rootURL := testServer.URL + "/datastorage"
+		teamA := rootURL + "/team-a"
+		teamB := rootURL + "/team-b"
+
+		resp := conditionalRequest(t, http.MethodPost, teamA, "shared", []byte("a"), http.Header{})
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodPost, teamB, "shared", []byte("b"), http.Header{})
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		for targetURL, expected := range map[string]string{teamA: "a", teamB: "b"} {
+			resp = conditionalRequest(t, http.MethodGet, targetURL, "shared", nil, http.Header{})
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var rcvMsg struct {
+				Data struct {
+					Content string `json:"content"`
+					TTL     int64  `json:"ttl"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+			assert.Equal(t, expected, rcvMsg.Data.Content)
+			// Only team-a has a default TTL
+			assert.Equal(t, targetURL == teamA, rcvMsg.Data.TTL > 0)
+		}
+
+		// Unbucketed, over the max size, and in no bucket
+		resp = conditionalRequest(t, http.MethodGet, rootURL, "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodPost, teamA, "large", []byte("12345"), http.Header{})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, rootURL+"/missing", "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, teamA+"/unknown", "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Scoped metadata and versions routes
+		resp = conditionalRequest(t, http.MethodGet, teamA+"/metadata", "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, teamA+"/versions", "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		resp := bucketRequest(t, http.MethodPut, map[string]string{"name": "team-b", "read_only": "true"})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		teamB := testServer.URL + "/datastorage/team-b"
+		resp = conditionalRequest(t, http.MethodPost, teamB, "shared", []byte("b2"), http.Header{})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodDelete, teamB, "shared", nil, http.Header{})
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = bucketRequest(t, http.MethodPut, map[string]string{"name": "missing"})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// Nor through the unbucketed names its data is stored under
+		rootURL := testServer.URL + "/datastorage"
+		key := "\x00bucket\x00data\x00team-b\x00shared"
+		resp = conditionalRequest(t, http.MethodPost, rootURL, key, []byte("b2"), http.Header{})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodDelete, rootURL, key, nil, http.Header{})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp = conditionalRequest(t, http.MethodGet, rootURL, "\x00bucket\x00config\x00team-b", nil, http.Header{})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp, err := http.Post(rootURL+"/batch", "application/json", strings.NewReader(
+			`{"operations": [{"op": "store", "name": "\u0000bucket\u0000data\u0000team-b\u0000shared", "data": "b2"}]}`,
+		))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = conditionalRequest(t, http.MethodGet, teamB, "shared", nil, http.Header{})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var rcvMsg struct {
+			Data struct {
+				Content string `json:"content"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		assert.Equal(t, "b", rcvMsg.Data.Content)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp := bucketRequest(t, http.MethodDelete, map[string]string{"name": "team-a"})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		resp = conditionalRequest(t, http.MethodDelete, testServer.URL+"/datastorage/team-a", "shared", nil, http.Header{})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = bucketRequest(t, http.MethodDelete, map[string]string{"name": "team-a"})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp = bucketRequest(t, http.MethodDelete, map[string]string{"name": "team-a"})
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestDataStorage_BucketsUnsupported(t *testing.T) {
+	dsh := DataStorageHandler{}.Initialize(datastorage.MemStorage{}.Initialize())
+
+	for _, handler := range []http.HandlerFunc{dsh.HandleBucketRequest(), dsh.HandleBucketDataRequest()} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/datastorage/team-a", nil))
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	}
+}
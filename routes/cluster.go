@@ -0,0 +1,758 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/responses"
+	"github.com/dvo-dev/go-get-started/services/cluster"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+const (
+	// clusterRoutePrefix is the URL path every route `ClusterWrapper` wraps
+	// begins with.
+	clusterRoutePrefix = "/datastorage"
+
+	// maxPeekSize bounds the request body read by `ClusterWrapper` to find
+	// the names a request is for, beyond which it is served locally.
+	maxPeekSize = 1 << 20
+)
+
+// HandleClusterEntries will parse and execute on any requests from the other
+// nodes of a `cluster.Cluster` moving entries to this node as they rebalance.
+//
+// The supported request methods are POST and DELETE, with the param `name`
+// (the name within `storage`):
+//   - POST writes the data of the body. The entry keeps the request
+//     `Content-Type`, the expiry given by `cluster.ExpiresHeader`, and the
+//     revision and times given by `cluster.RevisionHeader`,
+//     `cluster.CreatedHeader` and `cluster.UpdatedHeader`. `onStore`, if set,
+//     is called with `name` once written.
+//   - DELETE deletes the entry, undoing a move.
+//
+// Either is only applied if the `If-Match` and `If-None-Match` headers, and
+// `cluster.IfOlderHeader`, hold.
+//
+// To use, assign to your `http.Handler` at `cluster.EntriesRoute`.
+func HandleClusterEntries(storage datastorage.DataStorage, onStore func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if len(name) == 0 {
+			cErr := customerrors.ClientErrorBadParam{
+				Param:  "name",
+				Value:  "",
+				Reason: "expected the name of the entry",
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+		cond, err := parsePrecondition(r)
+		if err != nil {
+			cErr := err.(customerrors.ClientErrorBadParam)
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			deleteClusterEntry(w, r, storage, name, cond)
+			return
+		}
+		storeClusterEntry(w, r, storage, name, cond, onStore)
+	}
+}
+
+// storeClusterEntry writes the entry of `name` moved to this node by `r`, as
+// `HandleClusterEntries` does.
+func storeClusterEntry(
+	w http.ResponseWriter, r *http.Request, storage datastorage.DataStorage,
+	name string, cond datastorage.Precondition, onStore func(name string) error,
+) {
+	opts := datastorage.StoreOptions{
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	var err error
+	for header, at := range map[string]*time.Time{
+		cluster.CreatedHeader: &opts.CreatedAt,
+		cluster.UpdatedHeader: &opts.UpdatedAt,
+	} {
+		if value := r.Header.Get(header); len(value) > 0 {
+			if *at, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				cErr := customerrors.ClientErrorBadParam{
+					Param:  header,
+					Value:  value,
+					Reason: "expected an RFC 3339 time",
+				}
+				writeErrorResponse(w, cErr.StatusCode(), cErr)
+				return
+			}
+		}
+	}
+	if revision := r.Header.Get(cluster.RevisionHeader); len(revision) > 0 {
+		if opts.Revision, err = strconv.ParseUint(revision, 10, 64); err != nil {
+			cErr := customerrors.ClientErrorBadParam{
+				Param:  cluster.RevisionHeader,
+				Value:  revision,
+				Reason: "expected a revision",
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+	}
+	if expires := r.Header.Get(cluster.ExpiresHeader); len(expires) > 0 {
+		expiresAt, err := time.Parse(time.RFC3339Nano, expires)
+		if err != nil {
+			cErr := customerrors.ClientErrorBadParam{
+				Param:  cluster.ExpiresHeader,
+				Value:  expires,
+				Reason: "expected an RFC 3339 time",
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+		if opts.TTL = time.Until(expiresAt); opts.TTL <= 0 {
+			// Expired in transit, so nothing to write
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if len(r.Header.Get(cluster.IfOlderHeader)) > 0 {
+		// Written only over an entry updated before the one moved
+		meta, err := datastorage.WithContext(storage).RetrieveMetadataContext(r.Context(), name)
+		switch err.(type) {
+		case nil:
+			if !meta.UpdatedAt.Before(opts.UpdatedAt) {
+				writeErrorResponse(w, http.StatusPreconditionFailed, customerrors.DataStoragePreconditionFailed{
+					Name:   name,
+					Reason: "an entry updated as recently is held",
+				})
+				return
+			}
+			cond.IfMatch = append(cond.IfMatch, meta.Revision)
+		case customerrors.DataStorageNameNotFound:
+			cond.MustNotExist = true
+		default:
+			writeFailure(w, r, err)
+			return
+		}
+	}
+
+	meta, err := datastorage.StoreStreamContext(r.Context(), storage, name, r.Body, opts, cond)
+	switch err.(type) {
+	case nil:
+	case customerrors.DataStoragePreconditionFailed:
+		writeErrorResponse(w, http.StatusPreconditionFailed, err)
+		return
+	case customerrors.DataStorageQuotaExceeded:
+		writeErrorResponse(w, quotaExceededStatus(err), err)
+		return
+	default:
+		log.Printf(
+			"ClusterHandler - failed to write entry moved from: '%s'\n\t%v",
+			r.Header.Get(cluster.ForwardedHeader), err,
+		)
+		writeFailure(w, r, err)
+		return
+	}
+	if onStore != nil {
+		if err = onStore(name); err != nil {
+			log.Printf("ClusterHandler - failed to apply moved entry: %v", err)
+		}
+	}
+
+	setETag(w, meta.Revision)
+	w.WriteHeader(http.StatusCreated)
+	if rErr := responses.WriteJSON(w, responses.DataStored{
+		DataName: name,
+		Size:     meta.Size,
+	}); rErr != nil {
+		log.Printf(
+			"ClusterHandler - entry written but writing response failed: %v",
+			rErr,
+		)
+	}
+}
+
+// deleteClusterEntry deletes the entry of `name` moved to this node, as
+// `HandleClusterEntries` does.
+func deleteClusterEntry(
+	w http.ResponseWriter, r *http.Request, storage datastorage.DataStorage,
+	name string, cond datastorage.Precondition,
+) {
+	err := datastorage.WithContext(storage).CompareAndDeleteContext(r.Context(), name, cond)
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.DataDeleted{DataName: name}); rErr != nil {
+			log.Printf(
+				"ClusterHandler - entry deleted but writing response failed: %v",
+				rErr,
+			)
+		}
+	case customerrors.DataStorageNameNotFound:
+		writeErrorResponse(w, http.StatusNotFound, err)
+	case customerrors.DataStoragePreconditionFailed:
+		writeErrorResponse(w, http.StatusPreconditionFailed, err)
+	default:
+		log.Printf(
+			"ClusterHandler - failed to delete entry moved from: '%s'\n\t%v",
+			r.Header.Get(cluster.ForwardedHeader), err,
+		)
+		writeFailure(w, r, err)
+	}
+}
+
+// HandleClusterStatus will parse and execute on any client requests for the
+// `cluster.Status` of this node of `c`.
+//
+// The supported request method is GET.
+//
+// To use, assign to your `http.Handler` at `cluster.StatusRoute`.
+func HandleClusterStatus(c *cluster.Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			err = json.NewEncoder(w).Encode(c.Status())
+
+		default:
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			w.WriteHeader(cErr.StatusCode())
+			err = json.NewEncoder(w).Encode(cErr.ClientErrorMsg())
+		}
+
+		if err != nil {
+			log.Printf("ClusterHandler - error writing response: %v", err)
+		}
+	}
+}
+
+// ClusterWrapper is a function wrapper for the `DataStorageHandler` routes of
+// a node of the cluster `c`, serving requests for names this node owns with
+// `h` and proxying all others to their owner. Requests forwarded by another
+// node are always served with `h`.
+//
+// Until the entries of a name are moved to its owner after the membership
+// changes, they may still be held by its previous owner: reads missing at the
+// owner are retried there, and deletes are applied there too - lest the entry
+// is moved back afterwards.
+//
+// Requests spanning names are served by every node as needed: listings merge
+// the names of every node, bucket changes are applied to every node (should
+// some fail, responding 502 to be retried), and batches are proxied to the
+// owner of their names - which must all belong to the same node.
+func ClusterWrapper(h http.HandlerFunc, c *cluster.Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get(cluster.ForwardedHeader)) > 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		bucket, route := clusterRoute(r.URL.Path)
+		var name string
+		switch {
+		case route == "buckets":
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				h.ServeHTTP(w, r)
+			} else {
+				broadcastClusterRequest(w, r, h, c)
+			}
+			return
+
+		case route == "admin":
+			// Administers this node alone
+			h.ServeHTTP(w, r)
+			return
+
+		case route == "batch" && r.Method == http.MethodPost:
+			owner, err := batchOwner(r, c, bucket)
+			if err != nil {
+				cErr := err.(customerrors.ClientErrorBadParam)
+				writeErrorResponse(w, cErr.StatusCode(), cErr)
+				return
+			}
+			serveClusterRequest(w, r, h, c, owner)
+			return
+
+		case route == "" && r.Method == http.MethodGet && r.URL.Query().Has("list"):
+			listClusterNames(w, r, c)
+			return
+
+		case route == "" && r.Method == http.MethodPost:
+			name = peekUploadName(r)
+
+		case r.Method == http.MethodPost:
+			name = peekFormValue(r, "name")
+
+		case route == "" || route == "metadata":
+			name = r.URL.Query().Get("name")
+			key := cluster.Key(bucket, name)
+			if previous := c.PreviousOwner(key); len(name) > 0 && len(previous) > 0 {
+				serveMovingRequest(w, r, h, c, c.Ring().Owner(key), previous)
+				return
+			}
+
+		default:
+			name = r.URL.Query().Get("name")
+		}
+
+		if len(name) == 0 {
+			// Refused by `h`
+			h.ServeHTTP(w, r)
+			return
+		}
+		serveClusterRequest(w, r, h, c, c.Ring().Owner(cluster.Key(bucket, name)))
+	}
+}
+
+// clusterRoute parses the bucket, if any, and the route beneath
+// `clusterRoutePrefix` (or beneath the bucket) of the URL `path`, as
+// `HandleBucketDataRequest` does.
+func clusterRoute(path string) (bucket, route string) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, clusterRoutePrefix), "/")
+	first, rest, _ := strings.Cut(path, "/")
+	if len(first) == 0 || reservedBucketNames[first] {
+		return "", first
+	}
+	return first, rest
+}
+
+// serveClusterRequest serves `r` with `h` if `owner` is this node of `c`, or
+// proxies it to `owner` otherwise.
+func serveClusterRequest(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, c *cluster.Cluster, owner string) {
+	if len(owner) == 0 || owner == c.Self() {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	target, err := url.Parse(owner)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("ClusterHandler - failed to proxy request to: '%s'\n\t%v", owner, err)
+		w.Header().Set("Content-Type", "application/json")
+		cErr := customerrors.ClientErrorClusterNode{
+			Node:   owner,
+			Reason: err.Error(),
+		}
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+	}
+
+	r.Header.Set(cluster.ForwardedHeader, c.Self())
+	proxy.ServeHTTP(w, r)
+}
+
+// serveMovingRequest serves `r`, for a name which `previous` owned before
+// `owner`, at `owner` - retrying reads missing there at `previous`, and
+// applying deletes at `previous` too, as `ClusterWrapper` does.
+func serveMovingRequest(
+	w http.ResponseWriter, r *http.Request, h http.HandlerFunc, c *cluster.Cluster, owner, previous string,
+) {
+	isDelete := r.Method == http.MethodDelete
+	if !isDelete && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		serveClusterRequest(w, r, h, c, owner)
+		return
+	}
+	body, ok := peekBody(r)
+	if !ok {
+		// Refused by `h`
+		serveClusterRequest(w, r, h, c, owner)
+		return
+	}
+	replay := func() *http.Request {
+		retry := r.Clone(r.Context())
+		retry.Body = io.NopCloser(bytes.NewReader(body))
+		return retry
+	}
+
+	served := &missedResponse{ResponseWriter: w}
+	serveClusterRequest(served, replay(), h, c, owner)
+	if served.missed == nil {
+		if isDelete && served.status < http.StatusMultipleChoices {
+			// Deleted at the owner, so must not be moved to it afterwards
+			deleted := replay()
+			deleted.Header.Del("If-Match")
+			deleted.Header.Del("If-None-Match")
+			if err := forwardClusterRequest(deleted, c, previous, body); err != nil {
+				log.Printf("ClusterHandler - failed to delete entry held by: '%s'\n\t%v", previous, err)
+			}
+		}
+		return
+	}
+
+	// Missing at the owner, so may not be moved to it yet
+	retried := &missedResponse{ResponseWriter: w, unavailable: true}
+	serveClusterRequest(retried, replay(), h, c, previous)
+	if retried.missed != nil {
+		served.missed.writeTo(w)
+	}
+}
+
+// missedResponse is an `http.ResponseWriter` writing to `ResponseWriter`
+// unless the response is 404 - or, if `unavailable`, any server error - which
+// it holds in `missed` instead.
+type missedResponse struct {
+	http.ResponseWriter
+	unavailable bool
+
+	status int
+	missed *bufferedResponse
+}
+
+func (mr *missedResponse) Header() http.Header {
+	if mr.missed != nil {
+		return mr.missed.Header()
+	}
+	return mr.ResponseWriter.Header()
+}
+
+func (mr *missedResponse) Write(p []byte) (int, error) {
+	if mr.status == 0 {
+		mr.WriteHeader(http.StatusOK)
+	}
+	if mr.missed != nil {
+		return mr.missed.Write(p)
+	}
+	return mr.ResponseWriter.Write(p)
+}
+
+func (mr *missedResponse) WriteHeader(status int) {
+	if mr.status != 0 {
+		return
+	}
+	mr.status = status
+	if status == http.StatusNotFound || (mr.unavailable && status >= http.StatusInternalServerError) {
+		header := mr.ResponseWriter.Header()
+		mr.missed = &bufferedResponse{header: header.Clone()}
+		mr.missed.WriteHeader(status)
+		for key := range header {
+			delete(header, key)
+		}
+		return
+	}
+	mr.ResponseWriter.WriteHeader(status)
+}
+
+// broadcastClusterRequest serves `r` with `h`, then sends it to every other
+// node of `c` if it succeeded - responding 502 if any of them fail.
+func broadcastClusterRequest(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, c *cluster.Cluster) {
+	body, ok := peekBody(r)
+	if !ok {
+		// Refused by `h`
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	local := &bufferedResponse{header: http.Header{}}
+	h.ServeHTTP(local, r)
+	if local.status >= http.StatusMultipleChoices {
+		local.writeTo(w)
+		return
+	}
+
+	var failed []string
+	for _, node := range c.Nodes() {
+		if node == c.Self() {
+			continue
+		}
+		if err := forwardClusterRequest(r, c, node, body); err != nil {
+			log.Printf("ClusterHandler - failed to apply request to: '%s'\n\t%v", node, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", node, err))
+		}
+	}
+	if len(failed) > 0 {
+		// Bucket configs are copied to the nodes missing them once rebalanced
+		c.Rebalance()
+		w.Header().Set("Content-Type", "application/json")
+		cErr := customerrors.ClientErrorClusterNode{
+			Node:   c.Self(),
+			Reason: "applied here, but not by: " + strings.Join(failed, ", "),
+		}
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return
+	}
+	local.writeTo(w)
+}
+
+// forwardClusterRequest sends a copy of `r`, with `body`, to `node` of `c`,
+// returning an error unless it succeeds.
+func forwardClusterRequest(r *http.Request, c *cluster.Cluster, node string, body []byte) error {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, node+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(cluster.ForwardedHeader, c.Self())
+
+	resp, err := c.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		var msg customerrors.ClientErrorMessage
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		return fmt.Errorf("responded %d: %s", resp.StatusCode, msg.Error)
+	}
+	return nil
+}
+
+// listClusterNames lists the names of every node of `c` as `listNames` does,
+// merging the page of names after the cursor from each node.
+func listClusterNames(w http.ResponseWriter, r *http.Request, c *cluster.Cluster) {
+	query := r.URL.Query()
+	limit, err := parseListLimit(query.Get("limit"))
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var (
+		names []string
+		seen  = map[string]bool{}
+		more  bool
+	)
+	for _, node := range c.Nodes() {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, node+r.URL.RequestURI(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req.Header.Set(cluster.ForwardedHeader, c.Self())
+
+		resp, err := c.Client().Do(req)
+		if err != nil {
+			cErr := customerrors.ClientErrorClusterNode{
+				Node:   node,
+				Reason: err.Error(),
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			// Relay the refusal of the node, such as a missing bucket
+			w.WriteHeader(resp.StatusCode)
+			_, _ = io.Copy(w, resp.Body)
+			resp.Body.Close()
+			return
+		}
+
+		var listed struct {
+			Data struct {
+				Names  []string `json:"names"`
+				Cursor string   `json:"cursor"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&listed)
+		resp.Body.Close()
+		if err != nil {
+			cErr := customerrors.ClientErrorClusterNode{
+				Node:   node,
+				Reason: err.Error(),
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		// An entry is on two nodes while being moved
+		for _, name := range listed.Data.Names {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		more = more || len(listed.Data.Cursor) > 0
+	}
+
+	// The first `limit` names of every node include the first `limit` names
+	// of the cluster
+	sort.Strings(names)
+	if len(names) > limit {
+		names = names[:limit]
+		more = true
+	}
+	var next string
+	if more && len(names) > 0 {
+		next = encodeListCursor(names[len(names)-1])
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if rErr := responses.WriteJSON(w, responses.DataListed{
+		Prefix: query.Get("prefix"),
+		Names:  names,
+		Cursor: next,
+	}); rErr != nil {
+		log.Printf(
+			"ClusterHandler - names listed but writing response failed: %v",
+			rErr,
+		)
+	}
+}
+
+// batchOwner returns the node of `c` owning every name of the batch request
+// `r` in `bucket`, or "" if the batch is invalid - for `h` to refuse.
+//
+// Returns a `customerrors.ClientErrorBadParam` if the names belong to several
+// nodes, as the batch could not be applied atomically.
+func batchOwner(r *http.Request, c *cluster.Cluster, bucket string) (string, error) {
+	body, ok := peekBody(r)
+	if !ok {
+		return "", nil
+	}
+	var batch batchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return "", nil
+	}
+
+	ring := c.Ring()
+	var owner string
+	for _, op := range batch.Operations {
+		opOwner := ring.Owner(cluster.Key(bucket, op.Name))
+		if len(owner) > 0 && opOwner != owner {
+			return "", customerrors.ClientErrorBadParam{
+				Param:  "operations",
+				Value:  op.Name,
+				Reason: "every name of a batch must belong to the same node of the cluster",
+			}
+		}
+		owner = opOwner
+	}
+	return owner, nil
+}
+
+// peekUploadName returns the name a data upload request `r` stores to, as
+// `storeData` parses it, or "" if it does not name one. Its body is left
+// unread.
+func peekUploadName(r *http.Request) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || len(params["boundary"]) == 0 {
+		return ""
+	}
+
+	// Read no further than the uploaded file, then replay what was read
+	peeked := &bytes.Buffer{}
+	body := r.Body
+	defer func() {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(peeked.Bytes()), body), body}
+	}()
+	form := multipart.NewReader(io.TeeReader(io.LimitReader(body, maxPeekSize), peeked), params["boundary"])
+
+	var name string
+	for {
+		part, err := form.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == "data" && len(part.FileName()) > 0 {
+			if len(name) == 0 {
+				name = part.FileName()
+			}
+			return name
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == "name" {
+			name = strings.TrimSpace(string(value))
+		}
+	}
+}
+
+// peekFormValue returns the form value `key` of `r`, leaving its body unread.
+func peekFormValue(r *http.Request, key string) string {
+	body, ok := peekBody(r)
+	if !ok {
+		return ""
+	}
+
+	peek := r.Clone(r.Context())
+	peek.Body = io.NopCloser(bytes.NewReader(body))
+	return peek.FormValue(key)
+}
+
+// peekBody reads the body of `r`, leaving it unread, unless it is larger than
+// `maxPeekSize`.
+func peekBody(r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPeekSize+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, err == nil && len(body) <= maxPeekSize
+}
+
+// readCloser reads from `Reader`, closing `Closer`.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferedResponse is an `http.ResponseWriter` holding the response written,
+// to write it later.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) Write(p []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(p)
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+// writeTo writes the response held to `w`.
+func (br *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range br.header {
+		w.Header()[key] = values
+	}
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	w.WriteHeader(br.status)
+	_, _ = w.Write(br.body.Bytes())
+}
@@ -0,0 +1,332 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/cluster"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClusterNode is a node of a test cluster, serving the data storage
+// routes as the webapp does.
+type testClusterNode struct {
+	url            string
+	storage        *datastorage.BucketStorage
+	cluster        *cluster.Cluster
+	mux            *http.ServeMux
+	membershipFile string
+}
+
+// initTestCluster returns a cluster of `n` nodes.
+func initTestCluster(t *testing.T, n int) []*testClusterNode {
+	t.Helper()
+
+	nodes := make([]*testClusterNode, n)
+	var membership cluster.Membership
+	for i := range nodes {
+		node := &testClusterNode{mux: http.NewServeMux()}
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			node.mux.ServeHTTP(w, r)
+		}))
+		t.Cleanup(testServer.Close)
+		node.url = testServer.URL
+		nodes[i] = node
+		membership.Nodes = append(membership.Nodes, node.url)
+	}
+	membershipFile := filepath.Join(t.TempDir(), "membership.json")
+	contents, err := json.Marshal(membership)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(membershipFile, contents, 0o600))
+
+	for _, node := range nodes {
+		node.membershipFile = membershipFile
+		backing := datastorage.MemStorage{}.Initialize()
+		node.storage, err = datastorage.BucketStorage{}.Initialize(backing)
+		require.NoError(t, err)
+		node.cluster, err = cluster.Cluster{}.Initialize(backing, cluster.Config{
+			Self:           node.url,
+			MembershipFile: membershipFile,
+		})
+		require.NoError(t, err)
+		t.Cleanup(node.cluster.Stop)
+
+		dsh := DataStorageHandler{}.Initialize(node.storage)
+		for route, h := range map[string]http.HandlerFunc{
+			"/datastorage":          dsh.HandleClientRequest(),
+			"/datastorage/metadata": dsh.HandleMetadataRequest(),
+			"/datastorage/batch":    dsh.HandleBatchRequest(),
+			"/datastorage/buckets":  dsh.HandleBucketRequest(),
+			"/datastorage/":         dsh.HandleBucketDataRequest(),
+		} {
+			node.mux.HandleFunc(route, ClusterWrapper(h, node.cluster))
+		}
+		node.mux.HandleFunc(cluster.EntriesRoute, HandleClusterEntries(backing, node.storage.Refresh))
+		node.mux.HandleFunc(cluster.StatusRoute, HandleClusterStatus(node.cluster))
+	}
+
+	return nodes
+}
+
+// owner returns the node of `nodes` owning `name` in `bucket`, and another.
+func owner(nodes []*testClusterNode, bucket, name string) (*testClusterNode, *testClusterNode) {
+	ownerURL := nodes[0].cluster.Ring().Owner(cluster.Key(bucket, name))
+	if ownerURL == nodes[0].url {
+		return nodes[0], nodes[1]
+	}
+	return nodes[1], nodes[0]
+}
+
+func TestClusterWrapper(t *testing.T) {
+	nodes := initTestCluster(t, 2)
+	names := make([]string, 30)
+	for i := range names {
+		names[i] = fmt.Sprintf("name-%02d", i)
+	}
+
+	store := func(t *testing.T, targetURL, name string) {
+		params := map[string]string{"name": name}
+		uploadData := map[string][]byte{"data": []byte("test data " + name)}
+		resp, err := requests.PostRequest(targetURL, "multipart/form-data", &params, &uploadData, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode, name)
+	}
+
+	t.Run("store", func(t *testing.T) {
+		for _, name := range names {
+			store(t, nodes[0].url+"/datastorage", name)
+
+			// Held by the owner alone
+			owner, other := owner(nodes, "", name)
+			data, err := owner.storage.RetrieveData(name)
+			require.NoError(t, err, name)
+			assert.Equal(t, []byte("test data "+name), data)
+			_, err = other.storage.RetrieveData(name)
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{}, name)
+		}
+	})
+
+	t.Run("retrieve", func(t *testing.T) {
+		for _, name := range names {
+			for _, route := range []string{"/datastorage", "/datastorage/metadata"} {
+				resp, err := http.Get(nodes[1].url + route + "?name=" + name)
+				require.NoError(t, err)
+				resp.Body.Close()
+				assert.Equal(t, http.StatusOK, resp.StatusCode, name)
+			}
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		var listed []string
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			resp, err := http.Get(nodes[1].url + "/datastorage?list&limit=7&cursor=" + cursor)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var rcvMsg struct {
+				Data struct {
+					Names  []string `json:"names"`
+					Cursor string   `json:"cursor"`
+				} `json:"data"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+			resp.Body.Close()
+
+			assert.LessOrEqual(t, len(rcvMsg.Data.Names), 7)
+			listed = append(listed, rcvMsg.Data.Names...)
+			if cursor = rcvMsg.Data.Cursor; len(cursor) == 0 {
+				break
+			}
+		}
+		assert.Equal(t, names, listed)
+	})
+
+	t.Run("buckets", func(t *testing.T) {
+		params := map[string]string{"name": "pics"}
+		resp, err := requests.CustomRequest(nodes[1].url+"/datastorage/buckets", http.MethodPost, &params, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// Created on every node
+		for _, node := range nodes {
+			_, err = node.storage.Bucket("pics")
+			require.NoError(t, err)
+		}
+
+		for _, name := range names[:10] {
+			store(t, nodes[0].url+"/datastorage/pics", name)
+			owner, other := owner(nodes, "pics", name)
+			bucket, err := owner.storage.Bucket("pics")
+			require.NoError(t, err)
+			_, err = bucket.RetrieveData(name)
+			require.NoError(t, err, name)
+			bucket, err = other.storage.Bucket("pics")
+			require.NoError(t, err)
+			_, err = bucket.RetrieveData(name)
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{}, name)
+		}
+
+		// Conflicts on the first node are not applied to the others
+		resp, err = requests.CustomRequest(nodes[0].url+"/datastorage/buckets", http.MethodPost, &params, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		batch := func(names ...string) *http.Response {
+			var ops []string
+			for _, name := range names {
+				ops = append(ops, fmt.Sprintf(`{"op": "store", "name": %q, "data": "batched"}`, name))
+			}
+			resp, err := http.Post(
+				nodes[0].url+"/datastorage/batch", "application/json",
+				strings.NewReader(`{"operations": [`+strings.Join(ops, ",")+`]}`),
+			)
+			require.NoError(t, err)
+			t.Cleanup(func() { resp.Body.Close() })
+			return resp
+		}
+
+		// Find names owned by each node
+		var firstOwned, secondOwned []string
+		for i := 0; len(firstOwned) < 2 || len(secondOwned) < 1; i++ {
+			name := "batch-" + strconv.Itoa(i)
+			if owner, _ := owner(nodes, "", name); owner == nodes[0] {
+				firstOwned = append(firstOwned, name)
+			} else {
+				secondOwned = append(secondOwned, name)
+			}
+		}
+
+		resp := batch(firstOwned[0], secondOwned[0])
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp = batch(secondOwned[0])
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		data, err := nodes[1].storage.RetrieveData(secondOwned[0])
+		require.NoError(t, err)
+		assert.Equal(t, []byte("batched"), data)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		owner, other := owner(nodes, "", names[0])
+		params := map[string]string{"name": names[0]}
+		resp, err := requests.CustomRequest(other.url+"/datastorage", http.MethodDelete, &params, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = owner.storage.RetrieveData(names[0])
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		// Served by the node it is sent to, regardless of the owner
+		_, other := owner(nodes, "", names[1])
+		req, err := http.NewRequest(http.MethodGet, other.url+"/datastorage?name="+url.QueryEscape(names[1]), nil)
+		require.NoError(t, err)
+		req.Header.Set(cluster.ForwardedHeader, "test")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		resp, err := http.Get(nodes[0].url + cluster.StatusRoute)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var status cluster.Status
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		assert.Equal(t, nodes[0].url, status.Self)
+		assert.Len(t, status.Nodes, 2)
+	})
+}
+
+func TestClusterWrapper_Moving(t *testing.T) {
+	nodes := initTestCluster(t, 2)
+
+	// The first node leaves, before the entries it held are moved
+	contents, err := json.Marshal(cluster.Membership{Nodes: []string{nodes[1].url}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(nodes[0].membershipFile, contents, 0o600))
+	for _, node := range nodes {
+		require.NoError(t, node.cluster.Reload())
+		require.Eventually(t, func() bool {
+			status := node.cluster.Status()
+			return len(status.Nodes) == 1 && status.LastRebalance != nil && !status.Rebalancing
+		}, 5*time.Second, 5*time.Millisecond)
+	}
+	var names []string
+	for i := 0; len(names) < 2; i++ {
+		name := "moving-" + strconv.Itoa(i)
+		if nodes[0].cluster.PreviousOwner(name) == nodes[0].url {
+			names = append(names, name)
+			require.NoError(t, nodes[0].storage.StoreData(name, []byte("test data")))
+		}
+	}
+
+	request := func(t *testing.T, method, route, name string) int {
+		req, err := http.NewRequest(method, nodes[1].url+route+"?name="+url.QueryEscape(name), nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("retrieve", func(t *testing.T) {
+		for _, route := range []string{"/datastorage", "/datastorage/metadata"} {
+			assert.Equal(t, http.StatusOK, request(t, http.MethodGet, route, names[0]), route)
+			assert.Equal(t, http.StatusNotFound, request(t, http.MethodGet, route, "moving-missing"), route)
+		}
+	})
+
+	t.Run("delete held by the previous owner", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, request(t, http.MethodDelete, "/datastorage", names[0]))
+		_, err := nodes[0].storage.RetrieveData(names[0])
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Equal(t, http.StatusNotFound, request(t, http.MethodGet, "/datastorage", names[0]))
+	})
+
+	t.Run("delete held by both", func(t *testing.T) {
+		require.NoError(t, nodes[1].storage.StoreData(names[1], []byte("newer data")))
+		assert.Equal(t, http.StatusOK, request(t, http.MethodDelete, "/datastorage", names[1]))
+		for _, node := range nodes {
+			_, err := node.storage.RetrieveData(names[1])
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{}, node.url)
+		}
+	})
+}
+
+func TestClusterRoute(t *testing.T) {
+	for path, expected := range map[string][2]string{
+		"/datastorage":                 {"", ""},
+		"/datastorage/metadata":        {"", "metadata"},
+		"/datastorage/buckets":         {"", "buckets"},
+		"/datastorage/pics":            {"pics", ""},
+		"/datastorage/pics/versions":   {"pics", "versions"},
+		"/datastorage/admin/reencrypt": {"", "admin"},
+	} {
+		bucket, route := clusterRoute(path)
+		assert.Equal(t, expected, [2]string{bucket, route}, path)
+	}
+}
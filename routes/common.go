@@ -1,9 +1,11 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/customerrors"
 )
@@ -31,10 +33,27 @@ func RecoveryWrapper(h http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
+// TimeoutWrapper is a function wrapper for route handlers, giving each request
+// handled by `h` a deadline `timeout` after it is received.
+//
+// The `DataStorageHandler` routes abandon their storage operations once the
+// deadline passes, responding 504.
+func TimeoutWrapper(h http.HandlerFunc, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
 // HealthStatus is a simple struct to construct the response payload of
 // `HandleHealth`.
 type HealthStatus struct {
 	Status string `json:"status"`
+
+	// Replication is the replication status, if reported.
+	Replication any `json:"replication,omitempty"`
 }
 
 // HandleHealth is to essentially act as a "heartbeat" for its server.
@@ -43,6 +62,13 @@ type HealthStatus struct {
 // simple http.StatusOK (`200`) with a status field of "healthy" from this
 // function.
 func HandleHealth() http.HandlerFunc {
+	return HandleHealthWithReplication(nil)
+}
+
+// HandleHealthWithReplication behaves as `HandleHealth`, also reporting the
+// replication status returned by `replicationStatus` - such as how far a
+// follower lags behind its primary.
+func HandleHealthWithReplication(replicationStatus func() any) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		w.Header().Set("Content-Type", "application/json")
@@ -51,9 +77,13 @@ func HandleHealth() http.HandlerFunc {
 
 		case http.MethodGet:
 			w.WriteHeader(http.StatusOK)
-			err = json.NewEncoder(w).Encode(HealthStatus{
+			status := HealthStatus{
 				Status: "healthy",
-			})
+			}
+			if replicationStatus != nil {
+				status.Replication = replicationStatus()
+			}
+			err = json.NewEncoder(w).Encode(status)
 
 		default:
 			cErr := customerrors.ClientErrorBadMethod{
@@ -1,12 +1,21 @@
 package routes
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/customerrors"
 	"github.com/dvo-dev/go-get-started/responses"
@@ -30,7 +39,21 @@ func (h DataStorageHandler) Initialize(storage datastorage.DataStorage) *DataSto
 // HandleClientRequest will parse and execute on any client requests intended
 // for access to a `DataStorage`.
 //
-// Supported request methods are GET, POST, DELETE.
+// Supported request methods are GET, POST, DELETE. A GET with the `list`
+// param lists stored names instead, see `listNames`, and with the `raw` param
+// responds with the data itself rather than JSON.
+//
+// Data is streamed to and from the storage where it supports streaming, so
+// POST form fields must precede the uploaded `data` file.
+//
+// Responses carry the revision of the data as an `ETag`, and POST and DELETE
+// honour `If-Match` and `If-None-Match`, responding 412 if they do not hold.
+// A POST exceeding a quota of the storage responds 413 if the data alone
+// exceeds it, or 507 if the storage is full, see `datastorage.QuotaStorage`.
+//
+// The storage operations of a request are abandoned once its context is done,
+// responding 504 if its deadline passed - see `datastorage.WithContext` and
+// `TimeoutWrapper`.
 //
 // To use, assign to your `http.Handler` with the desired URL pattern.
 func (h *DataStorageHandler) HandleClientRequest() http.HandlerFunc {
@@ -41,7 +64,11 @@ func (h *DataStorageHandler) HandleClientRequest() http.HandlerFunc {
 
 		switch r.Method {
 		case http.MethodGet:
-			err = h.retrieveData(w, r)
+			if r.URL.Query().Has("list") {
+				err = h.listNames(w, r)
+			} else {
+				err = h.retrieveData(w, r)
+			}
 
 		case http.MethodPost:
 			err = h.storeData(w, r)
@@ -64,7 +91,7 @@ func (h *DataStorageHandler) HandleClientRequest() http.HandlerFunc {
 		}
 
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeFailure(w, r, err)
 		}
 	}
 }
@@ -76,9 +103,35 @@ func (h *DataStorageHandler) retrieveData(w http.ResponseWriter, r *http.Request
 		"DataStorageHandler - attempting retrieval of data associated with the key: '%s'",
 		dataKey,
 	)
+	if err := validateName("name", dataKey); err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
 
-	// Attempt to retrieve the data from our storage
-	data, err := h.storage.RetrieveData(dataKey)
+	// Attempt to retrieve the data from our storage, at a previous version if
+	// requested
+	version, err := parseVersion(r.URL.Query().Get("version"))
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	var (
+		raw    = r.URL.Query().Has("raw")
+		data   []byte
+		stream io.ReadCloser
+		meta   datastorage.Metadata
+	)
+	switch {
+	case version > 0:
+		data, meta, err = h.retrieveVersion(r.Context(), dataKey, version)
+		stream = io.NopCloser(bytes.NewReader(data))
+	case raw:
+		stream, meta, err = datastorage.RetrieveStreamContext(r.Context(), h.storage, dataKey)
+	default:
+		data, meta, err = datastorage.WithContext(h.storage).RetrieveEntryContext(r.Context(), dataKey)
+	}
 	switch err.(type) {
 	case nil:
 		// Successfully retrieved associated data
@@ -86,6 +139,11 @@ func (h *DataStorageHandler) retrieveData(w http.ResponseWriter, r *http.Request
 			"DataStorageHandler - successfully retrieved data with key: '%s'",
 			dataKey,
 		)
+		setETag(w, meta.Revision)
+		if raw {
+			writeRawData(w, stream, meta)
+			return nil
+		}
 		w.WriteHeader(http.StatusOK)
 
 		// Attempt to write response message
@@ -93,6 +151,9 @@ func (h *DataStorageHandler) retrieveData(w http.ResponseWriter, r *http.Request
 			responses.DataFound{
 				DataName: dataKey,
 				Data:     data,
+				Metadata: meta,
+				TTL:      meta.TTL(time.Now()),
+				Version:  version,
 			},
 		); rErr != nil {
 			log.Printf(
@@ -119,24 +180,63 @@ func (h *DataStorageHandler) retrieveData(w http.ResponseWriter, r *http.Request
 			)
 		}
 		return nil
+	case customerrors.DataStorageVersionNotFound:
+		log.Printf(
+			"DataStorageHandler - failed to retrieve data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusNotFound, err)
+		return nil
+	case customerrors.DataStorageUnsupported:
+		writeErrorResponse(w, http.StatusNotImplemented, err)
+		return nil
 	default:
 		return err
 	}
 }
 
 func (h *DataStorageHandler) storeData(w http.ResponseWriter, r *http.Request) error {
-	// Parse request params
-	err := r.ParseMultipartForm(2 << 20) // TODO: set constant somewhere
+	// Parse request params, streaming the form - its fields must precede the
+	// uploaded data, which is never held in memory
+	form, err := r.MultipartReader()
+	if err != nil {
+		log.Printf(
+			"DataStorageHandler - failed to parse storage request: %v",
+			err,
+		)
+		cErr := customerrors.ClientErrorBadParam{
+			Param:  "Content-Type",
+			Value:  r.Header.Get("Content-Type"),
+			Reason: "must be multipart/form-data with a boundary",
+		}
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	fields, file, err := readFormFields(form, "data")
 	if err != nil {
 		log.Printf(
 			"DataStorageHandler - failed to parse storage request: %v",
 			err,
 		)
+		if cErr, ok := err.(customerrors.ClientErrorBadParam); ok {
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return nil
+		}
 		return err
 	}
+	if file == nil {
+		cErr := customerrors.ClientErrorBadParam{
+			Param:  "data",
+			Value:  "",
+			Reason: "expected a file after all other fields",
+		}
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	defer file.Close()
 
 	// Get user defined name to associate with data
-	name := strings.TrimSpace(r.PostFormValue("name"))
+	name := strings.TrimSpace(fields.Get("name"))
 	if len(name) > 0 {
 		log.Printf(
 			"DataStorageHandler - attempting to write data to key: '%s'",
@@ -146,47 +246,74 @@ func (h *DataStorageHandler) storeData(w http.ResponseWriter, r *http.Request) e
 		log.Println(
 			"DataStorageHandler - no name given by client, will use file name...",
 		)
+		name = file.FileName()
 	}
-
-	// Read user uploaded data
-	var dataBuffer bytes.Buffer
-	file, header, err := r.FormFile("data")
-	if len(name) == 0 {
-		name = header.Filename
+	if err := validateName("name", name); err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
 	}
+
+	// Optional expiry of the data
+	ttl, err := parseTTL(fields.Get("ttl"))
 	if err != nil {
 		log.Printf(
-			"DataStorageHandler - failed to read request file with key: '%s'\n\t%v",
+			"DataStorageHandler - invalid ttl for key: '%s'\n\t%v",
 			name, err,
 		)
-		return err
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
 	}
-	defer file.Close()
-	_, err = io.Copy(&dataBuffer, file)
+
+	// Optional conditions on the existing data
+	cond, err := parsePrecondition(r)
 	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+
+	// Peek at the start of the user uploaded data to detect its content type -
+	// fields following it fail the upload rather than being ignored
+	upload := &formFileReader{form: form, part: file}
+	data := bufio.NewReaderSize(upload, sniffLen)
+	head, err := data.Peek(sniffLen)
+	if cErr, misplaced := upload.misplacedField(); misplaced {
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	if err != nil && err != io.EOF {
 		log.Printf(
 			"DataStorageHandler - failed to read request file with key: '%s'\n\t%v",
 			name, err,
 		)
 		return err
 	}
-	data := dataBuffer.Bytes()
 
 	// Attempt to write the data to our storage
-	err = h.storage.StoreData(name, data)
+	meta, err := datastorage.StoreStreamContext(r.Context(), h.storage, name, data, datastorage.StoreOptions{
+		TTL:         ttl,
+		ContentType: contentType(file.Header.Get("Content-Type"), head),
+	}, cond)
+	if cErr, misplaced := upload.misplacedField(); misplaced {
+		// Failed before the data was committed, see `formFileReader`
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
 	switch err.(type) {
-	// Other errors in the future
 	case nil:
 		log.Printf(
 			"successfully wrote to storage data with key: '%s'",
 			name,
 		)
+		setETag(w, meta.Revision)
 		w.WriteHeader(http.StatusCreated)
 
 		// Attempt to write response message
 		if rErr := responses.WriteJSON(w, responses.DataStored{
 			DataName: name,
-			Data:     data,
+			Size:     meta.Size,
 		}); rErr != nil {
 			log.Printf(
 				"DataStorageHander - data written but writing response failed: %v",
@@ -194,6 +321,34 @@ func (h *DataStorageHandler) storeData(w http.ResponseWriter, r *http.Request) e
 			)
 		}
 		return nil
+	case customerrors.DataStorageEntryTooLarge:
+		log.Printf(
+			"DataStorageHandler - refused to write data with key: '%s'\n\t%v",
+			name, err,
+		)
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, err)
+		return nil
+	case customerrors.DataStorageQuotaExceeded:
+		log.Printf(
+			"DataStorageHandler - refused to write data with key: '%s'\n\t%v",
+			name, err,
+		)
+		writeErrorResponse(w, quotaExceededStatus(err), err)
+		return nil
+	case customerrors.DataStoragePreconditionFailed:
+		log.Printf(
+			"DataStorageHandler - refused to write data with key: '%s'\n\t%v",
+			name, err,
+		)
+		writeErrorResponse(w, http.StatusPreconditionFailed, err)
+		return nil
+	case customerrors.DataStorageReadOnly:
+		log.Printf(
+			"DataStorageHandler - refused to write data with key: '%s'\n\t%v",
+			name, err,
+		)
+		writeErrorResponse(w, http.StatusForbidden, err)
+		return nil
 	default:
 		return err
 	}
@@ -206,9 +361,22 @@ func (h *DataStorageHandler) deleteData(w http.ResponseWriter, r *http.Request)
 		"DataStorageHandler - attempting deletion of data associated with the key: '%s'",
 		dataKey,
 	)
+	if err := validateName("name", dataKey); err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+
+	// Optional conditions on the existing data
+	cond, err := parsePrecondition(r)
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
 
 	// Attempt to delete the data fro our storage
-	err := h.storage.DeleteData(dataKey)
+	err = datastorage.WithContext(h.storage).CompareAndDeleteContext(r.Context(), dataKey, cond)
 	switch err.(type) {
 	case nil:
 		// Successfully deleted data associated with key
@@ -246,7 +414,673 @@ func (h *DataStorageHandler) deleteData(w http.ResponseWriter, r *http.Request)
 			)
 		}
 		return nil
+	case customerrors.DataStoragePreconditionFailed:
+		log.Printf(
+			"DataStorageHandler - refused to delete data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusPreconditionFailed, err)
+		return nil
+	case customerrors.DataStorageReadOnly:
+		log.Printf(
+			"DataStorageHandler - refused to delete data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusForbidden, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// listNames lists stored names beginning with the `prefix` param, a page of
+// at most `limit` (default 100) at a time - the `cursor` of the next page is
+// given in the response, until there are no more.
+func (h *DataStorageHandler) listNames(w http.ResponseWriter, r *http.Request) error {
+	// Parse request params
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit, err := parseListLimit(query.Get("limit"))
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	cursor, err := decodeListCursor(query.Get("cursor"))
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	log.Printf(
+		"DataStorageHandler - attempting to list names with the prefix: '%s'",
+		prefix,
+	)
+
+	names, next, err := datastorage.WithContext(h.storage).ListNamesContext(r.Context(), prefix, cursor, limit)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if rErr := responses.WriteJSON(w, responses.DataListed{
+		Prefix: prefix,
+		Names:  names,
+		Cursor: encodeListCursor(next),
+	}); rErr != nil {
+		log.Printf(
+			"DataStorageHander - names listed but writing response failed: %v",
+			rErr,
+		)
+	}
+	return nil
+}
+
+// HandleMetadataRequest will parse and execute on any client requests for the
+// metadata of data in a `DataStorage`, without its content.
+//
+// The supported request method is GET.
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func (h *DataStorageHandler) HandleMetadataRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		// Catch any anomaly errors - will write status code 500
+		if err := h.retrieveMetadata(w, r); err != nil {
+			writeFailure(w, r, err)
+		}
+	}
+}
+
+func (h *DataStorageHandler) retrieveMetadata(w http.ResponseWriter, r *http.Request) error {
+	// Parse request param
+	dataKey := r.URL.Query().Get("name")
+	log.Printf(
+		"DataStorageHandler - attempting retrieval of metadata of data with the key: '%s'",
+		dataKey,
+	)
+	if err := validateName("name", dataKey); err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+
+	meta, err := datastorage.WithContext(h.storage).RetrieveMetadataContext(r.Context(), dataKey)
+	switch err.(type) {
+	case nil:
+		setETag(w, meta.Revision)
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.DataMetadataFound{
+			DataName: dataKey,
+			Metadata: meta,
+			TTL:      meta.TTL(time.Now()),
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - metadata retrieved but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	case customerrors.DataStorageNameNotFound:
+		log.Printf(
+			"DataStorageHandler - failed to retrieve metadata of data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusNotFound, err)
+		return nil
 	default:
 		return err
 	}
 }
+
+// HandleVersionRequest will parse and execute on any client requests intended
+// for the version history of data in a `DataStorage`, which must implement
+// `datastorage.VersionHistory`.
+//
+// Supported request methods are GET (list versions of `name`) and POST
+// (restore `name` to `version`).
+//
+// To use, assign to your `http.Handler` with the desired URL pattern.
+func (h *DataStorageHandler) HandleVersionRequest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Catch any anomaly errors - will write status code 500
+		var err error
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			err = h.listVersions(w, r)
+
+		case http.MethodPost:
+			err = h.restoreVersion(w, r)
+
+		default:
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		if err != nil {
+			writeFailure(w, r, err)
+		}
+	}
+}
+
+func (h *DataStorageHandler) listVersions(w http.ResponseWriter, r *http.Request) error {
+	// Parse request param
+	dataKey := r.URL.Query().Get("name")
+	log.Printf(
+		"DataStorageHandler - attempting to list versions of data with the key: '%s'",
+		dataKey,
+	)
+	if err := validateName("name", dataKey); err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+
+	history, ok := h.storage.(datastorage.VersionHistory)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotImplemented, customerrors.DataStorageUnsupported{
+			Operation: "version history",
+		})
+		return nil
+	}
+
+	versions, err := history.ListVersions(dataKey)
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+		if rErr := responses.WriteJSON(w, responses.DataVersions{
+			DataName: dataKey,
+			Versions: versions,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - versions listed but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	case customerrors.DataStorageNameNotFound:
+		log.Printf(
+			"DataStorageHandler - failed to list versions of data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusNotFound, err)
+		return nil
+	case customerrors.DataStorageUnsupported:
+		writeErrorResponse(w, http.StatusNotImplemented, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+func (h *DataStorageHandler) restoreVersion(w http.ResponseWriter, r *http.Request) error {
+	// Parse request params, from either the query or a form
+	dataKey := r.FormValue("name")
+	version, err := parseVersion(r.FormValue("version"))
+	if err == nil && version == 0 {
+		err = customerrors.ClientErrorBadParam{
+			Param:  "version",
+			Reason: "required",
+		}
+	}
+	if err == nil {
+		err = validateName("name", dataKey)
+	}
+	if err != nil {
+		cErr := err.(customerrors.ClientErrorBadParam)
+		writeErrorResponse(w, cErr.StatusCode(), cErr)
+		return nil
+	}
+	log.Printf(
+		"DataStorageHandler - attempting to restore data with the key: '%s' to version %d",
+		dataKey, version,
+	)
+
+	history, ok := h.storage.(datastorage.VersionHistory)
+	if !ok {
+		writeErrorResponse(w, http.StatusNotImplemented, customerrors.DataStorageUnsupported{
+			Operation: "version history",
+		})
+		return nil
+	}
+
+	newVersion, err := history.RestoreVersion(dataKey, version)
+	switch err.(type) {
+	case nil:
+		log.Printf(
+			"DataStorageHandler - restored data with the key: '%s' to version %d as version %d",
+			dataKey, version, newVersion,
+		)
+		w.WriteHeader(http.StatusCreated)
+		if rErr := responses.WriteJSON(w, responses.DataRestored{
+			DataName:        dataKey,
+			RestoredVersion: version,
+			Version:         newVersion,
+		}); rErr != nil {
+			log.Printf(
+				"DataStorageHander - data restored but writing response failed: %v",
+				rErr,
+			)
+		}
+		return nil
+	case customerrors.DataStorageNameNotFound, customerrors.DataStorageVersionNotFound:
+		log.Printf(
+			"DataStorageHandler - failed to restore data with the key: '%s'\n\t%v",
+			dataKey, err,
+		)
+		writeErrorResponse(w, http.StatusNotFound, err)
+		return nil
+	case customerrors.DataStorageReadOnly:
+		writeErrorResponse(w, http.StatusForbidden, err)
+		return nil
+	case customerrors.DataStorageQuotaExceeded:
+		writeErrorResponse(w, quotaExceededStatus(err), err)
+		return nil
+	case customerrors.DataStorageUnsupported:
+		writeErrorResponse(w, http.StatusNotImplemented, err)
+		return nil
+	default:
+		return err
+	}
+}
+
+// retrieveVersion retrieves a previous `version` of `name` within `ctx`, if
+// the storage keeps version history.
+func (h *DataStorageHandler) retrieveVersion(ctx context.Context, name string, version int) ([]byte, datastorage.Metadata, error) {
+	return datastorage.RetrieveVersionContext(ctx, h.storage, name, version)
+}
+
+// validateName returns a `customerrors.ClientErrorBadParam` if `value`, the
+// data name of request param `param`, is reserved for the internal keys of
+// the storage - see `datastorage.IsReservedName`.
+func validateName(param, value string) error {
+	if datastorage.IsReservedName(value) {
+		return customerrors.ClientErrorBadParam{
+			Param:  param,
+			Value:  value,
+			Reason: "names beginning with a NUL byte are reserved",
+		}
+	}
+	return nil
+}
+
+// parseVersion parses the optional `version` request param, a positive
+// integer - zero if absent.
+//
+// Returns a `customerrors.ClientErrorBadParam` if `value` is invalid.
+func parseVersion(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version <= 0 {
+		return 0, customerrors.ClientErrorBadParam{
+			Param:  "version",
+			Value:  value,
+			Reason: "must be a positive integer",
+		}
+	}
+
+	return version, nil
+}
+
+const (
+	// defaultListLimit is the page size of name listings if not given.
+	defaultListLimit = 100
+
+	// maxListLimit is the largest page size of name listings.
+	maxListLimit = 1000
+)
+
+// parseListLimit parses the optional `limit` request param, an integer from 1
+// to `maxListLimit` - `defaultListLimit` if absent.
+//
+// Returns a `customerrors.ClientErrorBadParam` if `value` is invalid.
+func parseListLimit(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return defaultListLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		return 0, customerrors.ClientErrorBadParam{
+			Param:  "limit",
+			Value:  value,
+			Reason: fmt.Sprintf("must be an integer from 1 to %d", maxListLimit),
+		}
+	}
+
+	return limit, nil
+}
+
+// encodeListCursor encodes the `cursor` of a name listing for clients, names
+// may hold any bytes.
+func encodeListCursor(cursor string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor))
+}
+
+// decodeListCursor decodes a `cursor` request param given by
+// `encodeListCursor`, empty for the first page.
+//
+// Returns a `customerrors.ClientErrorBadParam` if `value` is invalid.
+func decodeListCursor(value string) (string, error) {
+	cursor, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return "", customerrors.ClientErrorBadParam{
+			Param:  "cursor",
+			Value:  value,
+			Reason: "not a cursor given by a previous listing",
+		}
+	}
+
+	return string(cursor), nil
+}
+
+// writeErrorResponse writes `err` to the client as a JSON
+// `customerrors.ClientErrorMessage` with the given `status` code.
+func writeErrorResponse(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	cErr := customerrors.ClientErrorMessage{
+		Error: err.Error(),
+	}
+	if rErr := json.NewEncoder(w).Encode(cErr); rErr != nil {
+		log.Printf(
+			"DataStorageHandler - writing error response failed: %v",
+			rErr,
+		)
+	}
+}
+
+// writeFailure responds to a request `r` which failed with an unexpected
+// `err`: 504 if the deadline of the request passed first, nothing if the
+// client went away, and 500 otherwise.
+//
+// A write which timed out may still be applied after the 504 is sent, should
+// the deadline pass as it is committed - or at any point for a storage not
+// honouring contexts natively, see `datastorage.WithContext`.
+func writeFailure(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Printf(
+			"DataStorageHandler - request deadline exceeded: %s %s",
+			r.Method, r.URL.Path,
+		)
+		writeErrorResponse(w, http.StatusGatewayTimeout, err)
+	case errors.Is(err, context.Canceled):
+		log.Printf(
+			"DataStorageHandler - client went away: %s %s from %s",
+			r.Method, r.URL.Path, r.RemoteAddr,
+		)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// parseTTL parses the optional `ttl` request param, given as either integer
+// seconds or a `time.Duration` string (e.g. "90s", "1h").
+//
+// An empty `value` is no expiry. Returns a `customerrors.ClientErrorBadParam`
+// if `value` is invalid or not positive.
+func parseTTL(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if seconds, aErr := strconv.ParseInt(value, 10, 64); aErr == nil {
+		ttl, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil {
+		return 0, customerrors.ClientErrorBadParam{
+			Param:  "ttl",
+			Value:  value,
+			Reason: "expected seconds or a duration such as 1h30m",
+		}
+	}
+	if ttl <= 0 {
+		return 0, customerrors.ClientErrorBadParam{
+			Param:  "ttl",
+			Value:  value,
+			Reason: "must be positive",
+		}
+	}
+
+	return ttl, nil
+}
+
+// contentType returns the MIME type to store `data` uploaded with the given
+// `declared` type, sniffing it if the client sent none or only the generic
+// "application/octet-stream".
+func contentType(declared string, data []byte) string {
+	declared = strings.TrimSpace(declared)
+	if len(declared) == 0 || declared == "application/octet-stream" {
+		return http.DetectContentType(data)
+	}
+	return declared
+}
+
+// sniffLen is the length of data considered to detect its content type, as
+// `http.DetectContentType`.
+const sniffLen = 512
+
+// maxFormFieldSize bounds each field of a streamed form.
+const maxFormFieldSize = 64 << 10
+
+// readFormFields reads the fields of a multipart `form` up to its file part
+// named `fileName`, which is returned unread for streaming.
+//
+// Returns a nil part if the form has no such file. Any fields following it
+// are left unread, see `formFileReader`.
+//
+// Returns a `customerrors.ClientErrorBadParam` if a field exceeds
+// `maxFormFieldSize`.
+func readFormFields(form *multipart.Reader, fileName string) (url.Values, *multipart.Part, error) {
+	fields := url.Values{}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return fields, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FormName() == fileName {
+			return fields, part, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(value) > maxFormFieldSize {
+			return nil, nil, customerrors.ClientErrorBadParam{
+				Param:  part.FormName(),
+				Value:  "",
+				Reason: fmt.Sprintf("exceeds %d bytes", maxFormFieldSize),
+			}
+		}
+		fields.Add(part.FormName(), string(value))
+	}
+}
+
+// formFileReader reads the file `part` of a multipart `form`, checking that
+// no fields follow it - else failing in place of the end of the file, so that
+// it is never stored without the fields, such as its name, sent after it.
+type formFileReader struct {
+	form *multipart.Reader
+	part *multipart.Part
+
+	// The error in place of the end of the file, once reached
+	err error
+}
+
+func (r *formFileReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.part.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+
+	next, err := r.form.NextPart()
+	switch err {
+	case io.EOF:
+		r.err = io.EOF
+	case nil:
+		next.Close()
+		r.err = customerrors.ClientErrorBadParam{
+			Param:  next.FormName(),
+			Value:  "",
+			Reason: fmt.Sprintf("must precede the file '%s'", r.part.FormName()),
+		}
+	default:
+		r.err = err
+	}
+	return n, r.err
+}
+
+// misplacedField returns the `customerrors.ClientErrorBadParam` of a field
+// found following the file, if any.
+func (r *formFileReader) misplacedField() (customerrors.ClientErrorBadParam, bool) {
+	cErr, ok := r.err.(customerrors.ClientErrorBadParam)
+	return cErr, ok
+}
+
+// writeRawData writes the `stream` of data with `meta` to the client as is,
+// closing it after.
+func writeRawData(w http.ResponseWriter, stream io.ReadCloser, meta datastorage.Metadata) {
+	defer stream.Close()
+
+	contentType := meta.ContentType
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if meta.Size > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(meta.Size))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if _, rErr := io.Copy(w, stream); rErr != nil {
+		log.Printf(
+			"DataStorageHander - data retrieved but writing response failed: %v",
+			rErr,
+		)
+	}
+}
+
+// setETag sets the `ETag` response header to the ETag of `revision`,
+// unless the storage did not give one.
+func setETag(w http.ResponseWriter, revision uint64) {
+	if revision == 0 {
+		return
+	}
+	w.Header().Set("ETag", formatETag(revision))
+}
+
+// formatETag returns the ETag of a data `revision`, a quoted decimal.
+func formatETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// quotaExceededStatus returns the status code of a
+// `customerrors.DataStorageQuotaExceeded`: 413 if the data alone exceeds the
+// quota, or 507 if the storage is full.
+func quotaExceededStatus(err error) int {
+	if exceeded, ok := err.(customerrors.DataStorageQuotaExceeded); ok && exceeded.EntryTooLarge() {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInsufficientStorage
+}
+
+// parsePrecondition parses the optional `If-Match` and `If-None-Match` request
+// headers into a `datastorage.Precondition`. Each holds either "*" or a comma
+// separated list of ETags. As `If-Match` uses the strong comparison, weak
+// ETags never match it, while `If-None-Match` compares them as strong.
+//
+// Returns a `customerrors.ClientErrorBadParam` if either header is invalid.
+func parsePrecondition(r *http.Request) (datastorage.Precondition, error) {
+	var (
+		cond datastorage.Precondition
+		err  error
+	)
+
+	cond.MustExist, cond.IfMatch, err = parseETags("If-Match", r.Header.Values("If-Match"), false)
+	if err != nil {
+		return datastorage.Precondition{}, err
+	}
+	cond.MustNotExist, cond.IfNoneMatch, err = parseETags("If-None-Match", r.Header.Values("If-None-Match"), true)
+	if err != nil {
+		return datastorage.Precondition{}, err
+	}
+
+	return cond, nil
+}
+
+// parseETags parses the `values` of the conditional request header `param`,
+// returning whether any was "*", and the revisions of all others.
+//
+// Unless `weak`, weak ETags are returned as revision 0, which no entry has,
+// so they never match.
+func parseETags(param string, values []string, weak bool) (bool, []uint64, error) {
+	var (
+		wildcard  bool
+		revisions []uint64
+	)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			switch {
+			case len(tag) == 0:
+				continue
+			case tag == "*":
+				wildcard = true
+				continue
+			}
+
+			unquoted := strings.TrimPrefix(tag, "W/")
+			isWeak := len(unquoted) < len(tag)
+			var (
+				revision uint64
+				err      = strconv.ErrSyntax
+			)
+			if len(unquoted) >= 2 && unquoted[0] == '"' && unquoted[len(unquoted)-1] == '"' {
+				revision, err = strconv.ParseUint(unquoted[1:len(unquoted)-1], 10, 64)
+			}
+			if err != nil {
+				return false, nil, customerrors.ClientErrorBadParam{
+					Param:  param,
+					Value:  tag,
+					Reason: "expected * or an ETag given by this server",
+				}
+			}
+			if isWeak && !weak {
+				revision = 0
+			}
+			revisions = append(revisions, revision)
+		}
+	}
+
+	return wildcard, revisions, nil
+}
@@ -1,12 +1,16 @@
 package routes
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/customerrors"
 	"github.com/dvo-dev/go-get-started/responses"
@@ -85,13 +89,64 @@ func TestDataStorage_StoreData(t *testing.T) {
 	require.NoError(t, err)
 	expMsg := responses.DataStored{
 		DataName: testName,
-		Data:     []byte("test data"),
+		Size:     len(testData),
 	}.GetResponse()
 
 	// Have to do this back and forth because Data is undefined type
 	JSON, _ := json.Marshal(expMsg)
 	_ = json.Unmarshal(JSON, &expMsg)
 	assert.Equal(t, expMsg, rcvMsg)
+
+	t.Run("too large", func(t *testing.T) {
+		mem, err := datastorage.MemStorage{}.InitializeWithConfig(
+			datastorage.MemStorageConfig{MaxBytes: 8},
+		)
+		require.NoError(t, err)
+		dsh := DataStorageHandler{}.Initialize(mem)
+		testServer := httptest.NewServer(dsh.HandleClientRequest())
+
+		resp, err := requests.PostRequest(
+			testServer.URL+"/datastorage",
+			"multipart/form-data",
+			&params,
+			&uploadData,
+			nil,
+		)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		rcvMsg := customerrors.ClientErrorMessage{}
+		err = json.Unmarshal(data, &rcvMsg)
+		require.NoError(t, err)
+		assert.NotEmpty(t, rcvMsg.Error)
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		quotas, err := datastorage.QuotaStorage{}.Initialize(
+			datastorage.MemStorage{}.Initialize(),
+			datastorage.QuotaStorageConfig{Quotas: []datastorage.Quota{
+				{Prefix: "small/", MaxEntrySize: 4},
+				{MaxBytes: 12},
+			}},
+		)
+		require.NoError(t, err)
+		testServer := httptest.NewServer(DataStorageHandler{}.Initialize(quotas).HandleClientRequest())
+		t.Cleanup(testServer.Close)
+
+		store := func(name string) int {
+			params := map[string]string{"name": name}
+			resp, err := requests.PostRequest(testServer.URL, "multipart/form-data", &params, &uploadData, nil)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+		assert.Equal(t, http.StatusRequestEntityTooLarge, store("small/a"))
+		assert.Equal(t, http.StatusCreated, store("a"))
+		assert.Equal(t, http.StatusInsufficientStorage, store("b"))
+	})
 }
 
 func TestDataStorage_RetrieveData(t *testing.T) {
@@ -123,9 +178,12 @@ func TestDataStorage_RetrieveData(t *testing.T) {
 	rcvMsg := responses.DataFound{}.GetResponse()
 	err = json.Unmarshal(data, &rcvMsg)
 	require.NoError(t, err)
+	_, testMeta, err := dsh.storage.RetrieveEntry(testName)
+	require.NoError(t, err)
 	expMsg := responses.DataFound{
 		DataName: testName,
 		Data:     []byte("test data"),
+		Metadata: testMeta,
 	}.GetResponse()
 
 	// Have to do this back and forth because Data is undefined type
@@ -224,3 +282,676 @@ func TestDataStorage_DeleteData(t *testing.T) {
 		assert.Equal(t, expMsg, rcvMsg)
 	})
 }
+
+func TestDataStorage_TTL(t *testing.T) {
+	// Init test server + client
+	dsh := DataStorageHandler{}.Initialize(
+		datastorage.MemStorage{}.Initialize(),
+	)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+
+	testName := "testname"
+	uploadData := map[string][]byte{"data": []byte("test data")}
+
+	t.Run("store with ttl", func(t *testing.T) {
+		params := map[string]string{"name": testName, "ttl": "1h"}
+		resp, err := requests.PostRequest(
+			testURL,
+			"multipart/form-data",
+			&params,
+			&uploadData,
+			nil,
+		)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		_, meta, err := dsh.storage.RetrieveEntry(testName)
+		require.NoError(t, err)
+		assert.False(t, meta.ExpiresAt.IsZero())
+	})
+
+	t.Run("retrieve reports ttl", func(t *testing.T) {
+		params := map[string]string{"name": testName}
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		defer resp.Body.Close()
+		var rcvMsg struct {
+			Data struct {
+				TTL int64 `json:"ttl"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		assert.InDelta(t, 3600, rcvMsg.Data.TTL, 1)
+	})
+
+	t.Run("invalid ttl", func(t *testing.T) {
+		for _, ttl := range []string{"soon", "-5", "0"} {
+			params := map[string]string{"name": testName, "ttl": ttl}
+			resp, err := requests.PostRequest(
+				testURL,
+				"multipart/form-data",
+				&params,
+				&uploadData,
+				nil,
+			)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			rcvMsg := customerrors.ClientErrorMessage{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+			resp.Body.Close()
+			assert.Contains(t, rcvMsg.Error, "ttl")
+		}
+	})
+}
+
+func TestParseTTL(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":      0,
+		"30":    30 * time.Second,
+		"1h30m": 90 * time.Minute,
+	} {
+		ttl, err := parseTTL(value)
+		require.NoError(t, err)
+		assert.Equal(t, expected, ttl)
+	}
+
+	_, err := parseTTL("soon")
+	assert.ErrorAs(t, err, &customerrors.ClientErrorBadParam{})
+}
+
+func TestDataStorage_Versions(t *testing.T) {
+	// Init test server + client
+	dsh := DataStorageHandler{}.Initialize(
+		datastorage.VersionedStorage{}.Initialize(
+			datastorage.MemStorage{}.Initialize(), 10,
+		),
+	)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+	versionServer := httptest.NewServer(dsh.HandleVersionRequest())
+	versionURL := versionServer.URL + "/datastorage/versions"
+
+	testName := "testname"
+	require.NoError(t, dsh.storage.StoreData(testName, []byte("v1")))
+	require.NoError(t, dsh.storage.StoreData(testName, []byte("v2")))
+
+	t.Run("retrieve version", func(t *testing.T) {
+		params := map[string]string{"name": testName, "version": "1"}
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		rcvMsg := responses.DataFound{}.GetResponse()
+		require.NoError(t, json.Unmarshal(data, &rcvMsg))
+		_, versionMeta, err := dsh.storage.(datastorage.VersionHistory).RetrieveVersion(testName, 1)
+		require.NoError(t, err)
+		expMsg := responses.DataFound{
+			DataName: testName,
+			Data:     []byte("v1"),
+			Metadata: versionMeta,
+			Version:  1,
+		}.GetResponse()
+
+		// Have to do this back and forth because Data is undefined type
+		JSON, _ := json.Marshal(expMsg)
+		_ = json.Unmarshal(JSON, &expMsg)
+		assert.Equal(t, expMsg, rcvMsg)
+	})
+
+	t.Run("nonexistent version", func(t *testing.T) {
+		params := map[string]string{"name": testName, "version": "3"}
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		params := map[string]string{"name": testName, "version": "latest"}
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("list versions", func(t *testing.T) {
+		params := map[string]string{"name": testName}
+		resp, err := requests.GetRequest(versionURL, &params, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		defer resp.Body.Close()
+		var rcvMsg struct {
+			Data struct {
+				Versions []datastorage.VersionInfo `json:"versions"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		require.Len(t, rcvMsg.Data.Versions, 2)
+		assert.Equal(t, 1, rcvMsg.Data.Versions[0].Version)
+		assert.True(t, rcvMsg.Data.Versions[1].Current)
+	})
+
+	t.Run("restore version", func(t *testing.T) {
+		params := map[string]string{"name": testName, "version": "1"}
+		resp, err := requests.CustomRequest(versionURL, http.MethodPost, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		data, err := dsh.storage.RetrieveData(testName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v1"), data)
+
+		params["version"] = "9"
+		resp, err = requests.CustomRequest(versionURL, http.MethodPost, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		dsh := DataStorageHandler{}.Initialize(
+			datastorage.MemStorage{}.Initialize(),
+		)
+		versionServer := httptest.NewServer(dsh.HandleVersionRequest())
+
+		params := map[string]string{"name": testName}
+		resp, err := requests.GetRequest(versionServer.URL, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	})
+}
+
+// conditionalRequest executes a `method` request to `targetURL` for `name`
+// with the given conditional request `header`, uploading `data` if a POST.
+func conditionalRequest(t *testing.T, method, targetURL, name string, data []byte, header http.Header) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	if method == http.MethodPost {
+		writer := multipart.NewWriter(&body)
+		require.NoError(t, writer.WriteField("name", name))
+		fw, err := writer.CreateFormFile("data", "data")
+		require.NoError(t, err)
+		_, err = fw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		header = header.Clone()
+		header.Set("Content-Type", writer.FormDataContentType())
+	} else {
+		targetURL += "?" + url.Values{"name": {name}}.Encode()
+	}
+
+	req, err := http.NewRequest(method, targetURL, &body)
+	require.NoError(t, err)
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func TestDataStorage_ConditionalRequests(t *testing.T) {
+	// Init test server + client
+	dsh := DataStorageHandler{}.Initialize(
+		datastorage.MemStorage{}.Initialize(),
+	)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+
+	testName := "testname"
+	var etag string
+
+	t.Run("create only", func(t *testing.T) {
+		header := http.Header{"If-None-Match": {"*"}}
+		resp := conditionalRequest(t, http.MethodPost, testURL, testName, []byte("v1"), header)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		etag = resp.Header.Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		resp = conditionalRequest(t, http.MethodPost, testURL, testName, []byte("v2"), header)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		rcvMsg := customerrors.ClientErrorMessage{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		assert.NotEmpty(t, rcvMsg.Error)
+	})
+
+	t.Run("retrieve reports etag", func(t *testing.T) {
+		resp := conditionalRequest(t, http.MethodGet, testURL, testName, nil, http.Header{})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+	})
+
+	t.Run("update if match", func(t *testing.T) {
+		header := http.Header{"If-Match": {etag}}
+		resp := conditionalRequest(t, http.MethodPost, testURL, testName, []byte("v2"), header)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+		// The lost update is refused
+		resp = conditionalRequest(t, http.MethodPost, testURL, testName, []byte("v3"), header)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+		data, err := dsh.storage.RetrieveData(testName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+	})
+
+	t.Run("delete if match", func(t *testing.T) {
+		resp := conditionalRequest(t, http.MethodDelete, testURL, testName, nil, http.Header{"If-Match": {etag}})
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+		_, meta, err := dsh.storage.RetrieveEntry(testName)
+		require.NoError(t, err)
+		// Weak ETags never match
+		header := http.Header{"If-Match": {`W/` + formatETag(meta.Revision)}}
+		resp = conditionalRequest(t, http.MethodDelete, testURL, testName, nil, header)
+		assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+		header = http.Header{"If-Match": {etag + `, ` + formatETag(meta.Revision)}}
+		resp = conditionalRequest(t, http.MethodDelete, testURL, testName, nil, header)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("invalid etag", func(t *testing.T) {
+		resp := conditionalRequest(t, http.MethodDelete, testURL, testName, nil, http.Header{"If-Match": {"v1"}})
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestParsePrecondition(t *testing.T) {
+	for name, tc := range map[string]struct {
+		header   http.Header
+		expected datastorage.Precondition
+	}{
+		"none": {http.Header{}, datastorage.Precondition{}},
+		"any": {
+			http.Header{"If-Match": {"*"}, "If-None-Match": {"*"}},
+			datastorage.Precondition{MustExist: true, MustNotExist: true},
+		},
+		"lists": {
+			http.Header{"If-Match": {`"1", W/"2"`, `"3"`}, "If-None-Match": {`"4", W/"5"`}},
+			datastorage.Precondition{IfMatch: []uint64{1, 0, 3}, IfNoneMatch: []uint64{4, 5}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cond, err := parsePrecondition(&http.Request{Header: tc.header})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cond)
+		})
+	}
+
+	for _, value := range []string{"1", `"one"`, `"`, `W/`} {
+		_, err := parsePrecondition(&http.Request{Header: http.Header{"If-Match": {value}}})
+		assert.ErrorAs(t, err, &customerrors.ClientErrorBadParam{})
+	}
+}
+
+func TestDataStorage_Metadata(t *testing.T) {
+	// Init test server + client
+	dsh := DataStorageHandler{}.Initialize(
+		datastorage.MemStorage{}.Initialize(),
+	)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+	metadataServer := httptest.NewServer(dsh.HandleMetadataRequest())
+	metadataURL := metadataServer.URL + "/datastorage/metadata"
+
+	testName := "testname"
+	params := map[string]string{"name": testName}
+
+	// The form file is sent as application/octet-stream, so is sniffed
+	uploadData := map[string][]byte{"data": []byte("test data")}
+	resp, err := requests.PostRequest(testURL, "multipart/form-data", &params, &uploadData, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var rcvMsg struct {
+		Data struct {
+			Size        int        `json:"size"`
+			ContentType string     `json:"content_type"`
+			Checksum    string     `json:"checksum"`
+			CreatedAt   *time.Time `json:"created_at"`
+			UpdatedAt   *time.Time `json:"updated_at"`
+		} `json:"data"`
+	}
+	checkMetadata := func(t *testing.T, resp *http.Response) {
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("ETag"))
+
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		assert.Equal(t, 9, rcvMsg.Data.Size)
+		assert.Equal(t, "text/plain; charset=utf-8", rcvMsg.Data.ContentType)
+		assert.Len(t, rcvMsg.Data.Checksum, 64)
+		assert.NotNil(t, rcvMsg.Data.CreatedAt)
+		assert.NotNil(t, rcvMsg.Data.UpdatedAt)
+	}
+
+	t.Run("retrieve includes metadata", func(t *testing.T) {
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		checkMetadata(t, resp)
+	})
+
+	t.Run("metadata only", func(t *testing.T) {
+		resp, err := requests.GetRequest(metadataURL, &params, nil)
+		require.NoError(t, err)
+		checkMetadata(t, resp)
+	})
+
+	t.Run("nonexistent name", func(t *testing.T) {
+		params := map[string]string{"name": testName + "foo"}
+		resp, err := requests.GetRequest(metadataURL, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := requests.CustomRequest(metadataURL, http.MethodDelete, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestContentType(t *testing.T) {
+	assert.Equal(t, "image/png", contentType("image/png", []byte("test data")))
+	assert.Equal(t, "text/plain; charset=utf-8", contentType("", []byte("test data")))
+	assert.Equal(t, "text/plain; charset=utf-8", contentType("application/octet-stream", []byte("test data")))
+}
+
+func TestDataStorage_ListNames(t *testing.T) {
+	// Init test server + client
+	dsh := DataStorageHandler{}.Initialize(
+		datastorage.MemStorage{}.Initialize(),
+	)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+
+	for _, name := range []string{"a/1", "a/2", "a/\x00binary", "b/1"} {
+		require.NoError(t, dsh.storage.StoreData(name, []byte("test data")))
+	}
+
+	type listed struct {
+		Data struct {
+			Names  []string `json:"names"`
+			Cursor string   `json:"cursor"`
+		} `json:"data"`
+	}
+	list := func(t *testing.T, params map[string]string) listed {
+		params["list"] = ""
+		resp, err := requests.GetRequest(testURL, &params, nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rcvMsg listed
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+		return rcvMsg
+	}
+
+	t.Run("all", func(t *testing.T) {
+		rcvMsg := list(t, map[string]string{})
+		assert.Equal(t, []string{"a/\x00binary", "a/1", "a/2", "b/1"}, rcvMsg.Data.Names)
+		assert.Empty(t, rcvMsg.Data.Cursor)
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		var (
+			names  []string
+			cursor string
+		)
+		for pages := 1; ; pages++ {
+			require.LessOrEqual(t, pages, 2)
+			rcvMsg := list(t, map[string]string{"prefix": "a/", "limit": "2", "cursor": cursor})
+			names = append(names, rcvMsg.Data.Names...)
+			if cursor = rcvMsg.Data.Cursor; len(cursor) == 0 {
+				break
+			}
+		}
+		assert.Equal(t, []string{"a/\x00binary", "a/1", "a/2"}, names)
+	})
+
+	t.Run("invalid params", func(t *testing.T) {
+		for _, params := range []map[string]string{
+			{"list": "", "limit": "0"},
+			{"list": "", "limit": "1001"},
+			{"list": "", "cursor": "not base64!"},
+		} {
+			resp, err := requests.GetRequest(testURL, &params, nil)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+func TestDataStorage_Streaming(t *testing.T) {
+	// Init test server + client
+	storage, err := datastorage.FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	dsh := DataStorageHandler{}.Initialize(storage)
+	testServer := httptest.NewServer(dsh.HandleClientRequest())
+	testURL := testServer.URL + "/datastorage"
+
+	testName := "testname"
+	testData := bytes.Repeat([]byte("streamed data "), 1<<20)
+
+	// Stream the upload, never holding the whole body
+	body, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		writer.WriteField("name", testName)
+		writer.WriteField("ttl", "1h")
+		fw, _ := writer.CreateFormFile("data", "data")
+		fw.Write(testData)
+		pipe.CloseWithError(writer.Close())
+	}()
+	resp, err := http.Post(testURL, writer.FormDataContentType(), body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	var rcvMsg struct {
+		Data struct {
+			Size int `json:"size"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+	assert.Equal(t, len(testData), rcvMsg.Data.Size)
+
+	t.Run("raw download", func(t *testing.T) {
+		resp, err := http.Get(testURL + "?raw&name=" + testName)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, int64(len(testData)), resp.ContentLength)
+		assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+
+	t.Run("raw download of nonexistent name", func(t *testing.T) {
+		resp, err := http.Get(testURL + "?raw&name=" + testName + "foo")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("file name as name", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		fw, err := writer.CreateFormFile("data", "file.txt")
+		require.NoError(t, err)
+		_, err = fw.Write([]byte("test data"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		resp, err := http.Post(testURL, writer.FormDataContentType(), &body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		data, err := storage.RetrieveData("file.txt")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+	})
+
+	t.Run("fields after data", func(t *testing.T) {
+		// Both within the sniffed head of the data and past it
+		for _, fileData := range [][]byte{[]byte("test data"), testData} {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			fw, err := writer.CreateFormFile("data", "late.txt")
+			require.NoError(t, err)
+			_, err = fw.Write(fileData)
+			require.NoError(t, err)
+			require.NoError(t, writer.WriteField("name", "late"))
+			require.NoError(t, writer.Close())
+
+			resp, err := http.Post(testURL, writer.FormDataContentType(), &body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			// Stored under neither name
+			_, err = storage.RetrieveData("late.txt")
+			assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+			_, err = storage.RetrieveData("late")
+			assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+		}
+	})
+
+	t.Run("no data", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		require.NoError(t, writer.WriteField("name", testName))
+		require.NoError(t, writer.Close())
+
+		resp, err := http.Post(testURL, writer.FormDataContentType(), &body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("oversized field", func(t *testing.T) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		require.NoError(t, writer.WriteField("name", strings.Repeat("a", maxFormFieldSize+1)))
+		fw, err := writer.CreateFormFile("data", "data")
+		require.NoError(t, err)
+		_, err = fw.Write([]byte("test data"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		resp, err := http.Post(testURL, writer.FormDataContentType(), &body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("not multipart", func(t *testing.T) {
+		resp, err := http.Post(testURL, "text/plain", strings.NewReader("test data"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	})
+}
+
+// slowStorage is a `datastorage.DataStorage` whose reads, deletes and batches
+// block until `release` is closed.
+type slowStorage struct {
+	datastorage.DataStorage
+	release chan struct{}
+}
+
+func (s slowStorage) RetrieveEntry(name string) ([]byte, datastorage.Metadata, error) {
+	<-s.release
+	return s.DataStorage.RetrieveEntry(name)
+}
+
+func (s slowStorage) RetrieveMetadata(name string) (datastorage.Metadata, error) {
+	<-s.release
+	return s.DataStorage.RetrieveMetadata(name)
+}
+
+func (s slowStorage) CompareAndDelete(name string, cond datastorage.Precondition) error {
+	<-s.release
+	return s.DataStorage.CompareAndDelete(name, cond)
+}
+
+func (s slowStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	<-s.release
+	return s.DataStorage.ListNames(prefix, cursor, limit)
+}
+
+func (s slowStorage) ApplyBatch(ops []datastorage.BatchOp) ([]datastorage.Metadata, error) {
+	<-s.release
+	return s.DataStorage.ApplyBatch(ops)
+}
+
+func TestDataStorage_Timeout(t *testing.T) {
+	// Init test server + client
+	release := make(chan struct{})
+	storage := slowStorage{
+		DataStorage: datastorage.MemStorage{}.Initialize(),
+		release:     release,
+	}
+	require.NoError(t, storage.StoreData("a", []byte("test data")))
+	dsh := DataStorageHandler{}.Initialize(storage)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/datastorage", TimeoutWrapper(dsh.HandleClientRequest(), 20*time.Millisecond))
+	mux.HandleFunc("/datastorage/metadata", TimeoutWrapper(dsh.HandleMetadataRequest(), 20*time.Millisecond))
+	mux.HandleFunc("/datastorage/batch", TimeoutWrapper(dsh.HandleBatchRequest(), 20*time.Millisecond))
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+	defer close(release)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/datastorage?name=a", ""},
+		{http.MethodGet, "/datastorage?raw&name=a", ""},
+		{http.MethodGet, "/datastorage?list", ""},
+		{http.MethodDelete, "/datastorage?name=a", ""},
+		{http.MethodGet, "/datastorage/metadata?name=a", ""},
+		{http.MethodPost, "/datastorage/batch", `{"operations": [{"op": "delete", "name": "a"}]}`},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, testServer.URL+tc.path, strings.NewReader(tc.body))
+			require.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+			var rcvMsg customerrors.ClientErrorMessage
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&rcvMsg))
+			assert.Contains(t, rcvMsg.Error, "deadline exceeded")
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/replication"
+)
+
+// HandleReplicationStream will parse and execute on any follower requests to
+// stream the changes of a `replication.Primary`.
+//
+// The supported request method is GET, with the optional param `since`: the
+// last change the follower applied, see `replication.FormatSince`. The
+// response streams indefinitely, see `replication.Record`.
+//
+// To use, assign to your `http.Handler` at `replication.StreamRoute`.
+func HandleReplicationStream(primary *replication.Primary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		var epoch, since uint64
+		if sinceParam := r.URL.Query().Get("since"); len(sinceParam) > 0 {
+			var err error
+			if epoch, since, err = replication.ParseSince(sinceParam); err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				cErr := customerrors.ClientErrorBadParam{
+					Param:  "since",
+					Value:  sinceParam,
+					Reason: "must be an epoch and change number",
+				}
+				writeErrorResponse(w, cErr.StatusCode(), cErr)
+				return
+			}
+		}
+
+		log.Printf("DataStorageHandler - streaming changes after %d to follower: %s", since, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		flush := func() {}
+		if flusher, ok := w.(http.Flusher); ok {
+			flush = flusher.Flush
+		}
+
+		if err := primary.Stream(r.Context(), w, flush, epoch, since); err != nil {
+			log.Printf("DataStorageHandler - stopped streaming changes to follower: %s - %v", r.RemoteAddr, err)
+		}
+	}
+}
+
+// FollowerWrapper is a function wrapper for the route handlers of a follower,
+// serving reads (GET and HEAD requests) with `h` while every other request is
+// refused - or, if `forward`, proxied to the `primary`.
+func FollowerWrapper(h http.HandlerFunc, primary *url.URL, forward bool) http.HandlerFunc {
+	proxy := httputil.NewSingleHostReverseProxy(primary)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			h.ServeHTTP(w, r)
+
+		case forward:
+			proxy.ServeHTTP(w, r)
+
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			cErr := customerrors.ClientErrorFollower{
+				RequestMethod: r.Method,
+				Primary:       primary.String(),
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/services/replication"
+	"github.com/dvo-dev/go-get-started/utils/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReplicationStream(t *testing.T) {
+	feed := datastorage.ChangeFeed{}.Initialize(datastorage.MemStorage{}.Initialize(), 0)
+	primary := replication.Primary{}.Initialize(feed, replication.PrimaryConfig{})
+	mux := http.NewServeMux()
+	mux.Handle(replication.StreamRoute, HandleReplicationStream(primary))
+	testServer := httptest.NewServer(mux)
+	t.Cleanup(testServer.Close)
+	testURL := testServer.URL + replication.StreamRoute
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := http.Post(testURL, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("bad since", func(t *testing.T) {
+		resp, err := http.Get(testURL + "?since=latest")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("follower", func(t *testing.T) {
+		require.NoError(t, feed.StoreData("a", []byte("test data a")))
+		storage := datastorage.MemStorage{}.Initialize()
+		follower := replication.Follower{}.Initialize(storage, replication.FollowerConfig{
+			Primary: testServer.URL,
+		})
+		t.Cleanup(follower.Stop)
+
+		require.Eventually(t, func() bool {
+			data, err := storage.RetrieveData("a")
+			return err == nil && string(data) == "test data a"
+		}, 5*time.Second, 5*time.Millisecond)
+		assert.Equal(t, 1, primary.Status().Followers)
+	})
+}
+
+func TestFollowerWrapper(t *testing.T) {
+	primaryStorage := datastorage.MemStorage{}.Initialize()
+	primaryServer := httptest.NewServer(
+		DataStorageHandler{}.Initialize(primaryStorage).HandleClientRequest(),
+	)
+	t.Cleanup(primaryServer.Close)
+	primaryURL, err := url.Parse(primaryServer.URL)
+	require.NoError(t, err)
+
+	followerStorage := datastorage.MemStorage{}.Initialize()
+	require.NoError(t, followerStorage.StoreData("local", []byte("test data")))
+	handler := DataStorageHandler{}.Initialize(followerStorage).HandleClientRequest()
+
+	store := func(t *testing.T, testURL string) *http.Response {
+		params := map[string]string{"name": "written"}
+		uploadData := map[string][]byte{"data": []byte("test data")}
+		resp, err := requests.PostRequest(testURL, "multipart/form-data", &params, &uploadData, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		testServer := httptest.NewServer(FollowerWrapper(handler, primaryURL, false))
+		t.Cleanup(testServer.Close)
+
+		// Reads are served locally
+		resp, err := http.Get(testServer.URL + "?name=local")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = store(t, testServer.URL)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		rcvMsg := customerrors.ClientErrorMessage{}
+		require.NoError(t, json.Unmarshal(data, &rcvMsg))
+		expMsg := customerrors.ClientErrorFollower{
+			RequestMethod: http.MethodPost,
+			Primary:       primaryServer.URL,
+		}.ClientErrorMsg()
+		assert.Equal(t, expMsg.Error, rcvMsg.Error)
+
+		_, err = primaryStorage.RetrieveData("written")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		testServer := httptest.NewServer(FollowerWrapper(handler, primaryURL, true))
+		t.Cleanup(testServer.Close)
+
+		resp := store(t, testServer.URL)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		data, err := primaryStorage.RetrieveData("written")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		_, err = followerStorage.RetrieveData("written")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
@@ -0,0 +1,234 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// watchBatchSize is the number of changes read from a `datastorage.ChangeFeed`
+// at a time when streaming them to a watcher.
+const watchBatchSize = 256
+
+// watchHeartbeat is how often a watcher is sent a comment while there are no
+// changes, so idle connections are not dropped by proxies.
+var watchHeartbeat = 15 * time.Second
+
+// WatchEvent is the data of each event streamed by `HandleWatchRequest`.
+type WatchEvent struct {
+	// Revision numbers the changes to the storage from 1, increasing on every
+	// change - afresh whenever the storage restarts unless its changes are
+	// journaled, so the ID of the event is "<epoch>-<revision>", see
+	// `datastorage.ChangeFeed.Epoch`.
+	Revision uint64 `json:"revision"`
+
+	Op     datastorage.ChangeOp `json:"op"`
+	Bucket string               `json:"bucket,omitempty"`
+	Name   string               `json:"name"`
+
+	// ETag is the ETag of the data written by a store.
+	ETag string `json:"etag,omitempty"`
+
+	Time time.Time `json:"time"`
+}
+
+// HandleWatchRequest will parse and execute on any client requests to watch
+// the changes recorded by `feed`, which must be beneath any
+// `datastorage.BucketStorage`.
+//
+// The supported request method is GET, with the optional params `prefix`, to
+// only watch the names beginning with it, and `bucket`, to watch the names of
+// that bucket instead. The response streams indefinitely as Server-Sent
+// Events: a "store" or "delete" event for every change, with a `WatchEvent`
+// as its data and "<epoch>-<revision>" as its ID - the epoch changing
+// whenever the storage restarts, and revisions with it, unless `feed` is
+// journaled (see `datastorage.ChangeFeedConfig`).
+//
+// Clients resume from the last event they received by its ID, with the
+// `Last-Event-ID` header (as `EventSource` reconnects) or the `since` param,
+// and otherwise only receive the changes made after connecting. Should the
+// changes since then no longer be kept, or the ID be of another epoch as the
+// storage has restarted since, a "reset" event is sent instead - after which
+// clients must reread the names they watch.
+//
+// To use, assign to your `http.Handler` at "/datastorage/watch".
+func HandleWatchRequest(feed *datastorage.ChangeFeed) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			cErr := customerrors.ClientErrorBadMethod{
+				RequestMethod: r.Method,
+			}
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+
+		epoch, since, resumed, err := parseWatchSince(r)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			cErr := err.(customerrors.ClientErrorBadParam)
+			writeErrorResponse(w, cErr.StatusCode(), cErr)
+			return
+		}
+		if !resumed {
+			// Before responding, so no change made once connected is missed
+			epoch, since = feed.Epoch(), feed.Seq()
+		}
+		bucket := r.URL.Query().Get("bucket")
+		prefix := r.URL.Query().Get("prefix")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flush := func() {}
+		if flusher, ok := w.(http.Flusher); ok {
+			flush = flusher.Flush
+		}
+
+		if err = streamWatchEvents(r, w, flush, feed, epoch, since, bucket, prefix); err != nil {
+			log.Printf("DataStorageHandler - stopped streaming changes to watcher: %s - %v", r.RemoteAddr, err)
+		}
+	}
+}
+
+// streamWatchEvents writes the changes of `feed` after `since` of `epoch`
+// with a name in `bucket` beginning with `prefix` to `w` as Server-Sent
+// Events, until the request `r` is done.
+func streamWatchEvents(
+	r *http.Request, w io.Writer, flush func(), feed *datastorage.ChangeFeed,
+	epoch, since uint64, bucket, prefix string,
+) error {
+	if latest := feed.Seq(); epoch != feed.Epoch() || since > latest {
+		// The changes were numbered before the storage restarted
+		if err := writeWatchReset(w, feed.Epoch(), latest, "revision is of a previous run of the storage"); err != nil {
+			return err
+		}
+		since = latest
+	}
+	epoch = feed.Epoch()
+	flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		changes, err := feed.Changes(since, watchBatchSize)
+		if truncated, ok := err.(customerrors.DataStorageChangesTruncated); ok {
+			since = feed.Seq()
+			if err = writeWatchReset(w, epoch, since, truncated.Error()); err != nil {
+				return err
+			}
+			flush()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			since = change.Seq
+			changeBucket, name, isData := datastorage.ParseBucketKey(change.Name)
+			if !isData || changeBucket != bucket || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			event := WatchEvent{
+				Revision: change.Seq,
+				Op:       change.Op,
+				Bucket:   changeBucket,
+				Name:     name,
+				Time:     change.Time,
+			}
+			if change.Revision != 0 {
+				event.ETag = formatETag(change.Revision)
+			}
+			if err = writeWatchEvent(w, watchEventID(epoch, event.Revision), string(event.Op), event); err != nil {
+				return err
+			}
+		}
+		if len(changes) > 0 {
+			flush()
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil
+
+		case <-feed.Wait(since):
+
+		case <-heartbeat.C:
+			// Advances the last event ID past any changes filtered out, so
+			// resuming does not reread them
+			if _, err = fmt.Fprintf(w, ": heartbeat\nid: %s\n\n", watchEventID(epoch, since)); err != nil {
+				return err
+			}
+			flush()
+		}
+	}
+}
+
+// watchEventID returns the ID of the event of the change `seq` of `epoch`.
+func watchEventID(epoch, seq uint64) string {
+	return fmt.Sprintf("%d-%d", epoch, seq)
+}
+
+// writeWatchEvent writes a Server-Sent Event of type `event`, with the ID
+// `id` and `data` as JSON.
+func writeWatchEvent(w io.Writer, id, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, encoded)
+	return err
+}
+
+// writeWatchReset writes a "reset" event, resuming after the change `latest`
+// of `epoch`, as the changes since the last event received are unknown.
+func writeWatchReset(w io.Writer, epoch, latest uint64, reason string) error {
+	return writeWatchEvent(w, watchEventID(epoch, latest), "reset", map[string]any{
+		"revision": latest,
+		"reason":   reason,
+	})
+}
+
+// parseWatchSince parses the epoch and revision a watcher resumes from, the
+// `Last-Event-ID` header or else the `since` param - returning whether either
+// was given. A bare revision has no epoch, so is always reset.
+//
+// Returns a `customerrors.ClientErrorBadParam` if the ID is invalid.
+func parseWatchSince(r *http.Request) (uint64, uint64, bool, error) {
+	param, value := "Last-Event-ID", r.Header.Get("Last-Event-ID")
+	if len(value) == 0 {
+		param, value = "since", r.URL.Query().Get("since")
+	}
+	if len(value) == 0 {
+		return 0, 0, false, nil
+	}
+
+	var (
+		epoch uint64
+		err   error
+	)
+	revision := strings.TrimSpace(value)
+	if epochValue, rest, found := strings.Cut(revision, "-"); found {
+		revision = rest
+		epoch, err = strconv.ParseUint(epochValue, 10, 64)
+	}
+	since, sErr := strconv.ParseUint(revision, 10, 64)
+	if err != nil || sErr != nil {
+		return 0, 0, false, customerrors.ClientErrorBadParam{
+			Param:  param,
+			Value:  value,
+			Reason: "must be an event ID",
+		}
+	}
+	return epoch, since, true, nil
+}
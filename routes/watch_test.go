@@ -0,0 +1,227 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWatchEvent is a single Server-Sent Event streamed by `HandleWatchRequest`.
+type testWatchEvent struct {
+	id    string
+	event string
+	data  WatchEvent
+}
+
+// testWatch watches `testURL` with the `Last-Event-ID` header `lastEventID`,
+// if given, returning a function returning the next event streamed.
+func testWatch(t *testing.T, testURL, lastEventID string) func() testWatchEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, testURL, nil)
+	require.NoError(t, err)
+	if len(lastEventID) > 0 {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan testWatchEvent)
+	go func() {
+		defer close(events)
+		var event testWatchEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				_ = json.Unmarshal([]byte(value), &event.data)
+			case "":
+				if len(event.event) > 0 {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+				event = testWatchEvent{}
+			}
+		}
+	}()
+
+	return func() testWatchEvent {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "stream ended")
+			return event
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for event")
+			return testWatchEvent{}
+		}
+	}
+}
+
+func TestHandleWatchRequest(t *testing.T) {
+	heartbeat := watchHeartbeat
+	watchHeartbeat = 10 * time.Millisecond
+	t.Cleanup(func() { watchHeartbeat = heartbeat })
+
+	feed := datastorage.ChangeFeed{}.Initialize(datastorage.MemStorage{}.Initialize(), 4)
+	storage, err := datastorage.BucketStorage{}.Initialize(feed)
+	require.NoError(t, err)
+	testServer := httptest.NewServer(HandleWatchRequest(feed))
+	t.Cleanup(testServer.Close)
+
+	t.Run("bad method", func(t *testing.T) {
+		resp, err := http.Post(testServer.URL, "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+
+	t.Run("bad since", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "?since=latest")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("store and delete", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("before", []byte("test data")))
+		next := testWatch(t, testServer.URL, "")
+
+		require.NoError(t, storage.StoreData("a", []byte("test data a")))
+		require.NoError(t, storage.DeleteData("a"))
+
+		event := next()
+		assert.Equal(t, "store", event.event)
+		assert.Equal(t, watchEventID(feed.Epoch(), feed.Seq()-1), event.id)
+		assert.Equal(t, feed.Seq()-1, event.data.Revision)
+		assert.Equal(t, datastorage.ChangeStore, event.data.Op)
+		assert.Equal(t, "a", event.data.Name)
+		assert.NotEmpty(t, event.data.ETag)
+
+		event = next()
+		assert.Equal(t, "delete", event.event)
+		assert.Equal(t, watchEventID(feed.Epoch(), feed.Seq()), event.id)
+		assert.Equal(t, "a", event.data.Name)
+		assert.Empty(t, event.data.ETag)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		next := testWatch(t, testServer.URL+"?prefix=img/", "")
+
+		require.NoError(t, storage.StoreData("doc/a", []byte("test data")))
+		require.NoError(t, storage.StoreData("img/a", []byte("test data")))
+
+		event := next()
+		assert.Equal(t, "img/a", event.data.Name)
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		next := testWatch(t, testServer.URL+"?bucket=pics", "")
+
+		require.NoError(t, storage.CreateBucket("pics", datastorage.BucketConfig{}))
+		require.NoError(t, storage.StoreData("a", []byte("test data")))
+		bucket, err := storage.Bucket("pics")
+		require.NoError(t, err)
+		require.NoError(t, bucket.StoreData("a", []byte("test data")))
+
+		event := next()
+		assert.Equal(t, "store", event.event)
+		assert.Equal(t, "pics", event.data.Bucket)
+		assert.Equal(t, "a", event.data.Name)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("b", []byte("test data b")))
+		resumeFrom := feed.Seq()
+		require.NoError(t, storage.StoreData("c", []byte("test data c")))
+
+		next := testWatch(t, testServer.URL, watchEventID(feed.Epoch(), resumeFrom))
+		event := next()
+		assert.Equal(t, watchEventID(feed.Epoch(), resumeFrom+1), event.id)
+		assert.Equal(t, "c", event.data.Name)
+
+		next = testWatch(t, testServer.URL+"?since="+watchEventID(feed.Epoch(), resumeFrom), "")
+		event = next()
+		assert.Equal(t, "c", event.data.Name)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		resumeFrom := feed.Seq()
+		for i := 0; i < 5; i++ {
+			require.NoError(t, storage.StoreData("d", []byte("test data d")))
+		}
+
+		next := testWatch(t, testServer.URL, watchEventID(feed.Epoch(), resumeFrom))
+		event := next()
+		assert.Equal(t, "reset", event.event)
+		assert.Equal(t, watchEventID(feed.Epoch(), feed.Seq()), event.id)
+
+		require.NoError(t, storage.StoreData("e", []byte("test data e")))
+		event = next()
+		assert.Equal(t, "e", event.data.Name)
+
+		// Ahead of the feed, as if it restarted
+		next = testWatch(t, testServer.URL, watchEventID(feed.Epoch(), feed.Seq()+100))
+		event = next()
+		assert.Equal(t, "reset", event.event)
+		assert.Equal(t, watchEventID(feed.Epoch(), feed.Seq()), event.id)
+
+		// Without an epoch
+		next = testWatch(t, testServer.URL, strconv.FormatUint(feed.Seq(), 10))
+		event = next()
+		assert.Equal(t, "reset", event.event)
+	})
+
+	t.Run("restarted", func(t *testing.T) {
+		// The restarted feed has as many changes again, so the revision
+		// alone would miss them
+		lastEventID := watchEventID(feed.Epoch(), 2)
+		restarted := datastorage.ChangeFeed{}.Initialize(datastorage.MemStorage{}.Initialize(), 4)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, restarted.StoreData("g", []byte("test data g")))
+		}
+		restartedServer := httptest.NewServer(HandleWatchRequest(restarted))
+		t.Cleanup(restartedServer.Close)
+
+		next := testWatch(t, restartedServer.URL, lastEventID)
+		event := next()
+		assert.Equal(t, "reset", event.event)
+		assert.Equal(t, watchEventID(restarted.Epoch(), 3), event.id)
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		resp, err := http.Get(testServer.URL + "?prefix=none/")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.NoError(t, storage.StoreData("f", []byte("test data f")))
+
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			if line == "id: "+watchEventID(feed.Epoch(), feed.Seq())+"\n" {
+				break
+			}
+		}
+	})
+}
@@ -0,0 +1,378 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+const (
+	// EntriesRoute is the URL path each node accepts the entries moved to it
+	// by rebalancing at.
+	EntriesRoute = "/cluster/entries"
+
+	// StatusRoute is the URL path each node reports its `Status` at.
+	StatusRoute = "/cluster"
+
+	// ForwardedHeader is set, to the node sending it, on every request sent
+	// from one node to another - which the receiving node serves itself,
+	// rather than proxying it again should the nodes disagree on the owner.
+	ForwardedHeader = "X-Webapp-Forwarded"
+
+	// ExpiresHeader holds when the entry moved by a request to `EntriesRoute`
+	// expires, in RFC 3339 format.
+	ExpiresHeader = "X-Webapp-Expires"
+
+	// RevisionHeader, CreatedHeader and UpdatedHeader hold the revision, and
+	// when the entry moved by a request to `EntriesRoute` was created and last
+	// updated, in RFC 3339 format - which the entry keeps, so its ETag still
+	// matches once moved.
+	RevisionHeader = "X-Webapp-Revision"
+	CreatedHeader  = "X-Webapp-Created"
+	UpdatedHeader  = "X-Webapp-Updated"
+
+	// IfOlderHeader, when set on a request to `EntriesRoute`, writes the
+	// entry only if the node does not hold it or holds one last updated before
+	// `UpdatedHeader` - so bucket configs copied to every node converge on the
+	// latest.
+	IfOlderHeader = "X-Webapp-If-Older"
+
+	// defaultReloadInterval is how often the membership is reloaded when
+	// `Config.ReloadInterval` is unset.
+	defaultReloadInterval = 5 * time.Second
+)
+
+// Membership configures the nodes of a cluster. It is read from a JSON file
+// such as:
+//
+//	{"nodes": ["http://localhost:8080", "http://localhost:8081"], "vnodes": 128}
+//
+// Every node must be configured with the same membership.
+type Membership struct {
+	// Nodes are the base URLs of the nodes, as they reach each other.
+	Nodes []string `json:"nodes"`
+
+	// VNodes is the number of virtual nodes of each node, see `Ring`,
+	// defaulting to 128.
+	VNodes int `json:"vnodes,omitempty"`
+}
+
+// ReadMembership reads the `Membership` JSON file at `path`, returning an
+// error unless it configures at least one node.
+func ReadMembership(path string) (Membership, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return Membership{}, err
+	}
+
+	var membership Membership
+	if err = json.Unmarshal(contents, &membership); err != nil {
+		return Membership{}, fmt.Errorf("invalid cluster membership file '%s': %w", path, err)
+	}
+	if len(membership.Nodes) == 0 {
+		return Membership{}, fmt.Errorf("cluster membership file '%s' has no nodes", path)
+	}
+	if membership.VNodes < 0 {
+		return Membership{}, fmt.Errorf("cluster membership file '%s' has negative vnodes", path)
+	}
+	if membership.VNodes == 0 {
+		membership.VNodes = defaultVNodes
+	}
+	for i, node := range membership.Nodes {
+		if membership.Nodes[i], err = NormalizeNode(node); err != nil {
+			return Membership{}, fmt.Errorf("cluster membership file '%s': %w", path, err)
+		}
+	}
+	sort.Strings(membership.Nodes)
+
+	return membership, nil
+}
+
+// NormalizeNode returns the base URL of a node, `node`, in the form the nodes
+// of a `Membership` are compared in.
+func NormalizeNode(node string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(node))
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return "", fmt.Errorf("invalid node URL: '%s'", node)
+	}
+	return parsed.Scheme + "://" + parsed.Host + strings.TrimSuffix(parsed.Path, "/"), nil
+}
+
+// Config configures a `Cluster`.
+type Config struct {
+	// Self is the base URL of this node, as the others reach it.
+	Self string
+
+	// MembershipFile is the path of the `Membership` JSON file.
+	MembershipFile string
+
+	// ReloadInterval is how often the membership file is reloaded, defaults
+	// to 5s.
+	ReloadInterval time.Duration
+
+	// Client sends requests to the other nodes, defaults to a client without
+	// a timeout, as entries may be large.
+	Client *http.Client
+}
+
+// Status is the status of a node of a `Cluster`.
+type Status struct {
+	Self   string   `json:"self"`
+	Nodes  []string `json:"nodes"`
+	VNodes int      `json:"vnodes"`
+
+	// Rebalancing reports whether entries are being moved to their owners.
+	Rebalancing bool `json:"rebalancing"`
+
+	// Moved counts the entries moved to other nodes, and Failed those which
+	// could not be in the last rebalance - they are retried.
+	Moved  int `json:"moved"`
+	Failed int `json:"failed"`
+
+	LastRebalance *time.Time `json:"last_rebalance,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Cluster is this node of a cluster, placing names on the nodes configured by
+// a `Membership` file by a `Ring`.
+//
+// The membership file is reloaded periodically. Whenever it changes, and on
+// initialization, the entries of its `DataStorage` this node does not own are
+// moved to their owners - see `Rebalance`.
+type Cluster struct {
+	storage datastorage.DataStorage
+	cfg     Config
+
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	// rebalance requests a rebalance, if one is not already requested
+	rebalance chan struct{}
+
+	// mu guards the membership and status
+	mu          *sync.Mutex
+	membership  Membership
+	ring        *Ring
+	previous    *Ring
+	rebalancing bool
+	moved       int
+	failed      int
+	lastRun     time.Time
+	lastErr     error
+}
+
+// Initialize initializes and starts a `Cluster` of the node `cfg.Self` holding
+// `storage`, which must be the storage beneath any `BucketStorage` - so
+// bucket configs, which belong on every node, are moved too.
+func (c Cluster) Initialize(storage datastorage.DataStorage, cfg Config) (*Cluster, error) {
+	self, err := NormalizeNode(cfg.Self)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Self = self
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = defaultReloadInterval
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	membership, err := ReadMembership(cfg.MembershipFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cluster := &Cluster{
+		storage:    storage,
+		cfg:        cfg,
+		cancel:     cancel,
+		wg:         &sync.WaitGroup{},
+		rebalance:  make(chan struct{}, 1),
+		mu:         &sync.Mutex{},
+		membership: membership,
+		ring:       Ring{}.Initialize(membership.Nodes, membership.VNodes),
+	}
+	cluster.logMembership()
+
+	// Entries may have been written while the membership was different
+	cluster.Rebalance()
+	cluster.wg.Add(1)
+	go cluster.loop(ctx)
+
+	return cluster, nil
+}
+
+// Stop stops the `Cluster`, waiting for any entry being moved.
+func (c *Cluster) Stop() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// Self returns the base URL of this node.
+func (c *Cluster) Self() string {
+	return c.cfg.Self
+}
+
+// Ring returns the current `Ring` of the cluster.
+//
+// This method is thread safe.
+func (c *Cluster) Ring() *Ring {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ring
+}
+
+// PreviousOwner returns the node which owned `key` before the membership last
+// changed, or "" if it is the current owner or the membership has not changed
+// - as the entry of `key` may still be held there, until it is moved.
+//
+// This method is thread safe.
+func (c *Cluster) PreviousOwner(key string) string {
+	c.mu.Lock()
+	ring, previous := c.ring, c.previous
+	c.mu.Unlock()
+
+	if previous == nil {
+		return ""
+	}
+	if owner := previous.Owner(key); owner != ring.Owner(key) {
+		return owner
+	}
+	return ""
+}
+
+// Client returns the client requests are sent to the other nodes with.
+func (c *Cluster) Client() *http.Client {
+	return c.cfg.Client
+}
+
+// Nodes returns every node of the cluster, including this one even if it is
+// no longer a member.
+//
+// This method is thread safe.
+func (c *Cluster) Nodes() []string {
+	nodes := c.Ring().Nodes()
+	if contains(nodes, c.cfg.Self) {
+		return nodes
+	}
+	return append(nodes, c.cfg.Self)
+}
+
+// Reload rereads the membership file, rebalancing if the membership changed.
+//
+// This method is thread safe.
+func (c *Cluster) Reload() error {
+	membership, err := ReadMembership(c.cfg.MembershipFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if reflect.DeepEqual(membership, c.membership) {
+		c.mu.Unlock()
+		return nil
+	}
+	c.membership = membership
+	c.previous = c.ring
+	c.ring = Ring{}.Initialize(membership.Nodes, membership.VNodes)
+	c.mu.Unlock()
+
+	c.logMembership()
+	c.Rebalance()
+	return nil
+}
+
+// Rebalance requests that the entries this node holds but does not own are
+// moved to their owners, returning immediately.
+//
+// This method is thread safe.
+func (c *Cluster) Rebalance() {
+	select {
+	case c.rebalance <- struct{}{}:
+	default:
+		// Already requested
+	}
+}
+
+// Status returns the membership of the cluster, and the progress of
+// rebalancing.
+//
+// This method is thread safe.
+func (c *Cluster) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := Status{
+		Self:        c.cfg.Self,
+		Nodes:       c.ring.Nodes(),
+		VNodes:      c.ring.VNodes(),
+		Rebalancing: c.rebalancing,
+		Moved:       c.moved,
+		Failed:      c.failed,
+	}
+	if !c.lastRun.IsZero() {
+		lastRun := c.lastRun
+		status.LastRebalance = &lastRun
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	return status
+}
+
+func (c *Cluster) loop(ctx context.Context) {
+	defer c.wg.Done()
+
+	reload := time.NewTicker(c.cfg.ReloadInterval)
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-reload.C:
+			if err := c.Reload(); err != nil {
+				log.Printf("Cluster - failed to reload membership: %v", err)
+			}
+			c.mu.Lock()
+			retry := c.failed > 0
+			c.mu.Unlock()
+			if retry {
+				c.Rebalance()
+			}
+
+		case <-c.rebalance:
+			c.rebalanceEntries(ctx)
+		}
+	}
+}
+
+// logMembership logs the current membership.
+func (c *Cluster) logMembership() {
+	nodes := c.Ring().Nodes()
+	log.Printf("Cluster - membership of %d nodes: %s", len(nodes), strings.Join(nodes, ", "))
+	if !contains(nodes, c.cfg.Self) {
+		log.Printf("Cluster - this node, '%s', is not a member - it owns no names", c.cfg.Self)
+	}
+}
+
+func contains(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
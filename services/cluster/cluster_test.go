@@ -0,0 +1,293 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testNode is a node of a test cluster, accepting the entries moved to it.
+type testNode struct {
+	url     string
+	storage *datastorage.MemStorage
+
+	// onStore, if set, is called with the name of each entry written
+	onStore func(name string)
+}
+
+func initTestNode(t *testing.T) *testNode {
+	t.Helper()
+	node := &testNode{storage: datastorage.MemStorage{}.Initialize()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, EntriesRoute, r.URL.Path)
+		require.NotEmpty(t, r.Header.Get(ForwardedHeader))
+		name := r.URL.Query().Get("name")
+
+		if r.Method == http.MethodDelete {
+			revision, err := strconv.ParseUint(strings.Trim(r.Header.Get("If-Match"), `"`), 10, 64)
+			require.NoError(t, err)
+			err = node.storage.CompareAndDelete(name, datastorage.Precondition{IfMatch: []uint64{revision}})
+			if err != nil {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		opts := datastorage.StoreOptions{ContentType: r.Header.Get("Content-Type")}
+		if expires := r.Header.Get(ExpiresHeader); len(expires) > 0 {
+			expiresAt, err := time.Parse(time.RFC3339Nano, expires)
+			require.NoError(t, err)
+			opts.TTL = time.Until(expiresAt)
+		}
+		var err error
+		opts.Revision, err = strconv.ParseUint(r.Header.Get(RevisionHeader), 10, 64)
+		require.NoError(t, err)
+		opts.UpdatedAt, err = time.Parse(time.RFC3339Nano, r.Header.Get(UpdatedHeader))
+		require.NoError(t, err)
+		cond := datastorage.Precondition{MustNotExist: r.Header.Get("If-None-Match") == "*"}
+		if len(r.Header.Get(IfOlderHeader)) > 0 {
+			meta, err := node.storage.RetrieveMetadata(name)
+			if err == nil && !meta.UpdatedAt.Before(opts.UpdatedAt) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			if cond.MustNotExist = err != nil; err == nil {
+				cond.IfMatch = []uint64{meta.Revision}
+			}
+		}
+
+		meta, err := datastorage.StoreStream(node.storage, name, r.Body, opts, cond)
+		if _, failed := err.(customerrors.DataStoragePreconditionFailed); failed {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		require.NoError(t, err)
+		if node.onStore != nil {
+			node.onStore(name)
+		}
+		w.Header().Set("ETag", `"`+strconv.FormatUint(meta.Revision, 10)+`"`)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	node.url = server.URL
+	return node
+}
+
+// writeMembership writes a membership file of `nodes` to `path`.
+func writeMembership(t *testing.T, path string, nodes ...*testNode) {
+	t.Helper()
+	membership := Membership{VNodes: 16}
+	for _, node := range nodes {
+		membership.Nodes = append(membership.Nodes, node.url)
+	}
+	contents, err := json.Marshal(membership)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, contents, 0o600))
+}
+
+func TestReadMembership(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"invalid json":    `{"nodes": [`,
+		"no nodes":        `{"nodes": []}`,
+		"invalid url":     `{"nodes": ["localhost:8080"]}`,
+		"negative vnodes": `{"nodes": ["http://localhost:8080"], "vnodes": -1}`,
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		_, err := ReadMembership(path)
+		assert.Error(t, err, name)
+	}
+
+	path := filepath.Join(dir, "valid")
+	require.NoError(t, os.WriteFile(path, []byte(`{"nodes": ["http://b:8081/", " http://a:8080"]}`), 0o600))
+	membership, err := ReadMembership(path)
+	require.NoError(t, err)
+	assert.Equal(t, Membership{
+		Nodes:  []string{"http://a:8080", "http://b:8081"},
+		VNodes: defaultVNodes,
+	}, membership)
+}
+
+func TestCluster_Rebalance(t *testing.T) {
+	first, second := initTestNode(t), initTestNode(t)
+	membershipFile := filepath.Join(t.TempDir(), "membership.json")
+	writeMembership(t, membershipFile, first)
+
+	// Every entry is first held by the only node
+	buckets, err := datastorage.BucketStorage{}.Initialize(first.storage)
+	require.NoError(t, err)
+	require.NoError(t, buckets.CreateBucket("bucket", datastorage.BucketConfig{ReadOnly: true}))
+	bucket, err := buckets.Bucket("bucket")
+	require.NoError(t, err)
+	require.NoError(t, buckets.ConfigureBucket("bucket", datastorage.BucketConfig{}))
+	for i := 0; i < 50; i++ {
+		name := "name-" + strconv.Itoa(i)
+		require.NoError(t, buckets.StoreDataWithOptions(name, []byte(name), datastorage.StoreOptions{
+			TTL:         time.Hour,
+			ContentType: "text/plain",
+		}))
+		require.NoError(t, bucket.StoreData(name, []byte(name)))
+	}
+	require.NoError(t, buckets.ConfigureBucket("bucket", datastorage.BucketConfig{ReadOnly: true}))
+
+	c, err := Cluster{}.Initialize(first.storage, Config{
+		Self:           first.url + "/",
+		MembershipFile: membershipFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Stop)
+	assert.Equal(t, first.url, c.Self())
+
+	// The second node joins
+	writeMembership(t, membershipFile, first, second)
+	require.Eventually(t, func() bool {
+		status := c.Status()
+		return len(status.Nodes) == 2 && status.LastRebalance != nil && status.Moved > 0 && !status.Rebalancing
+	}, 5*time.Second, 5*time.Millisecond)
+	status := c.Status()
+	assert.Zero(t, status.Failed)
+	assert.Equal(t, 16, status.VNodes)
+
+	ring := c.Ring()
+	for _, b := range []string{"", "bucket"} {
+		for i := 0; i < 50; i++ {
+			name := "name-" + strconv.Itoa(i)
+			key := name
+			if len(b) > 0 {
+				key = "\x00bucket\x00data\x00" + b + "\x00" + name
+			}
+			owner, other := first, second
+			if ring.Owner(Key(b, name)) == second.url {
+				owner, other = second, first
+			}
+
+			data, meta, err := owner.storage.RetrieveEntry(key)
+			require.NoError(t, err, key)
+			assert.Equal(t, []byte(name), data)
+			_, err = other.storage.RetrieveData(key)
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{}, key)
+			if len(b) == 0 {
+				assert.Equal(t, "text/plain", meta.ContentType)
+				assert.False(t, meta.ExpiresAt.IsZero())
+			}
+		}
+	}
+
+	// Bucket configs are copied to every node, read only or not
+	moved, err := datastorage.BucketStorage{}.Initialize(second.storage)
+	require.NoError(t, err)
+	infos, err := moved.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []datastorage.BucketInfo{{Name: "bucket", Config: datastorage.BucketConfig{ReadOnly: true}}}, infos)
+
+	// The first node leaves
+	writeMembership(t, membershipFile, second)
+	require.Eventually(t, func() bool {
+		names, _, err := buckets.ListNames("", "", 0)
+		return err == nil && len(names) == 0 && !c.Status().Rebalancing
+	}, 5*time.Second, 5*time.Millisecond)
+	names, _, err := moved.ListNames("", "", 0)
+	require.NoError(t, err)
+	assert.Len(t, names, 50)
+	assert.ElementsMatch(t, []string{first.url, second.url}, c.Nodes())
+}
+
+func TestCluster_MoveUndone(t *testing.T) {
+	first, second := initTestNode(t), initTestNode(t)
+	membershipFile := filepath.Join(t.TempDir(), "membership.json")
+	writeMembership(t, membershipFile, first)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, first.storage.StoreData("name-"+strconv.Itoa(i), []byte("test data")))
+	}
+
+	c, err := Cluster{}.Initialize(first.storage, Config{
+		Self:           first.url,
+		MembershipFile: membershipFile,
+		ReloadInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Stop)
+	require.Eventually(t, func() bool {
+		return c.Status().LastRebalance != nil
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Every entry is deleted from the first node while being moved
+	second.onStore = func(name string) {
+		_ = first.storage.DeleteData(name)
+	}
+	writeMembership(t, membershipFile, first, second)
+	require.Eventually(t, func() bool {
+		status := c.Status()
+		return len(status.Nodes) == 2 && status.Moved > 0 && !status.Rebalancing
+	}, 5*time.Second, 5*time.Millisecond)
+
+	ring := c.Ring()
+	moved := 0
+	for i := 0; i < 20; i++ {
+		name := "name-" + strconv.Itoa(i)
+		if ring.Owner(name) != second.url {
+			continue
+		}
+		moved++
+		for _, node := range []*testNode{first, second} {
+			_, err = node.storage.RetrieveData(name)
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{}, name)
+		}
+	}
+	assert.NotZero(t, moved)
+	assert.Zero(t, c.Status().Failed)
+}
+
+func TestCluster_BucketConfigs(t *testing.T) {
+	first, second := initTestNode(t), initTestNode(t)
+	membershipFile := filepath.Join(t.TempDir(), "membership.json")
+	writeMembership(t, membershipFile, first, second)
+	firstBuckets, err := datastorage.BucketStorage{}.Initialize(first.storage)
+	require.NoError(t, err)
+	secondBuckets, err := datastorage.BucketStorage{}.Initialize(second.storage)
+	require.NoError(t, err)
+
+	// The second node holds the latest config of "newer", but an outdated
+	// config of "older"
+	require.NoError(t, firstBuckets.CreateBucket("newer", datastorage.BucketConfig{ReadOnly: true}))
+	require.NoError(t, secondBuckets.CreateBucket("older", datastorage.BucketConfig{}))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, secondBuckets.CreateBucket("newer", datastorage.BucketConfig{}))
+	require.NoError(t, firstBuckets.CreateBucket("older", datastorage.BucketConfig{ReadOnly: true}))
+
+	c, err := Cluster{}.Initialize(first.storage, Config{
+		Self:           first.url,
+		MembershipFile: membershipFile,
+	})
+	require.NoError(t, err)
+	t.Cleanup(c.Stop)
+	require.Eventually(t, func() bool {
+		status := c.Status()
+		return status.LastRebalance != nil && !status.Rebalancing
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.Zero(t, c.Status().Failed)
+
+	copied, err := datastorage.BucketStorage{}.Initialize(second.storage)
+	require.NoError(t, err)
+	infos, err := copied.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []datastorage.BucketInfo{
+		{Name: "newer", Config: datastorage.BucketConfig{}},
+		{Name: "older", Config: datastorage.BucketConfig{ReadOnly: true}},
+	}, infos)
+}
@@ -0,0 +1,219 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// rebalanceBatchSize is the number of names listed at a time when rebalancing.
+const rebalanceBatchSize = 256
+
+// rebalanceEntries moves every entry this node holds but does not own to its
+// owner, and copies every bucket config to every other node.
+//
+// Entries are moved by writing them to their owner only if it does not hold
+// them already - an entry the owner holds was written since the membership
+// changed, so is newer - then deleting them here, or from the owner again
+// should they be deleted or written here meanwhile. Bucket configs are copied
+// only to nodes holding none, or an older one. Previous versions of an entry
+// are not moved.
+func (c *Cluster) rebalanceEntries(ctx context.Context) {
+	ring := c.Ring()
+	c.mu.Lock()
+	c.rebalancing = true
+	c.mu.Unlock()
+
+	var (
+		moved, failed int
+		lastErr       error
+	)
+	fail := func(name string, err error) {
+		log.Printf("Cluster - failed to move %q: %v", name, err)
+		failed++
+		lastErr = err
+	}
+
+	cursor := ""
+	for ctx.Err() == nil {
+		names, next, err := c.storage.ListNames("", cursor, rebalanceBatchSize)
+		if err != nil {
+			fail("", err)
+			break
+		}
+		for _, name := range names {
+			if ctx.Err() != nil {
+				break
+			}
+
+			bucket, bucketName, isData := datastorage.ParseBucketKey(name)
+			if !isData {
+				// Bucket configs belong on every node
+				for _, node := range ring.Nodes() {
+					if node == c.cfg.Self {
+						continue
+					}
+					if _, err = c.transfer(ctx, node, name, true); err != nil {
+						fail(name, err)
+					}
+				}
+				continue
+			}
+
+			owner := ring.Owner(Key(bucket, bucketName))
+			if owner == c.cfg.Self {
+				continue
+			}
+			if err = c.move(ctx, owner, name); err != nil {
+				fail(name, err)
+				continue
+			}
+			moved++
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	if moved > 0 || failed > 0 {
+		log.Printf("Cluster - rebalanced: moved %d entries, failed to move %d", moved, failed)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebalancing = false
+	c.moved += moved
+	c.failed = failed
+	c.lastRun = time.Now()
+	c.lastErr = lastErr
+}
+
+// move moves the entry of `name` to `owner`, deleting it here.
+func (c *Cluster) move(ctx context.Context, owner, name string) error {
+	moved, err := c.transfer(ctx, owner, name, false)
+	if err != nil {
+		return err
+	}
+
+	err = c.storage.CompareAndDelete(name, datastorage.Precondition{
+		IfMatch: []uint64{moved.revision},
+	})
+	switch err.(type) {
+	case nil:
+		return nil
+	case customerrors.DataStorageNameNotFound, customerrors.DataStoragePreconditionFailed:
+		// Deleted, or written, here while being moved - so the copy written
+		// to the owner would resurrect the entry, or is stale
+		if len(moved.etag) > 0 {
+			if uErr := c.undoTransfer(ctx, owner, name, moved.etag); uErr != nil {
+				return fmt.Errorf("changed while being moved, and failed to undo: %w", uErr)
+			}
+		}
+		if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+			return nil
+		}
+		return fmt.Errorf("written while being moved, will retry")
+	default:
+		return err
+	}
+}
+
+// transferred is an entry written to another node by `transfer`.
+type transferred struct {
+	// revision is that of the entry here
+	revision uint64
+
+	// etag is that of the entry written to the node, or "" if it held the
+	// entry already
+	etag string
+}
+
+// transfer writes the entry of `name` to `node` unless it holds it already -
+// or, if `ifOlder`, unless it holds one updated since.
+func (c *Cluster) transfer(ctx context.Context, node, name string, ifOlder bool) (transferred, error) {
+	stream, meta, err := datastorage.RetrieveStream(c.storage, name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		// Deleted, or expired, since listed
+		return transferred{}, nil
+	}
+	if err != nil {
+		return transferred{}, err
+	}
+	defer stream.Close()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, node+EntriesRoute+"?name="+url.QueryEscape(name), stream,
+	)
+	if err != nil {
+		return transferred{}, err
+	}
+	if len(meta.ContentType) > 0 {
+		req.Header.Set("Content-Type", meta.ContentType)
+	}
+	if !meta.ExpiresAt.IsZero() {
+		req.Header.Set(ExpiresHeader, meta.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	req.Header.Set(RevisionHeader, strconv.FormatUint(meta.Revision, 10))
+	req.Header.Set(CreatedHeader, meta.CreatedAt.Format(time.RFC3339Nano))
+	req.Header.Set(UpdatedHeader, meta.UpdatedAt.Format(time.RFC3339Nano))
+	if ifOlder {
+		req.Header.Set(IfOlderHeader, "true")
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	req.Header.Set(ForwardedHeader, c.cfg.Self)
+
+	resp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return transferred{}, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return transferred{revision: meta.Revision, etag: resp.Header.Get("ETag")}, nil
+	case http.StatusPreconditionFailed:
+		// Already held
+		return transferred{revision: meta.Revision}, nil
+	default:
+		return transferred{}, fmt.Errorf("node '%s' responded %d", node, resp.StatusCode)
+	}
+}
+
+// undoTransfer deletes the entry of `name` written to `node` by `transfer`,
+// unless it has been written since - its ETag no longer being `etag`.
+func (c *Cluster) undoTransfer(ctx context.Context, node, name, etag string) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodDelete, node+EntriesRoute+"?name="+url.QueryEscape(name), nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("If-Match", etag)
+	req.Header.Set(ForwardedHeader, c.cfg.Self)
+
+	resp, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusPreconditionFailed:
+		// Deleted, or deleted or written since
+		return nil
+	default:
+		return fmt.Errorf("node '%s' responded %d", node, resp.StatusCode)
+	}
+}
@@ -0,0 +1,116 @@
+// Package cluster partitions the names of a `datastorage.DataStorage` across
+// the nodes of a cluster of webapp instances by consistent hashing, each node
+// holding the entries of the names it owns.
+//
+// Nodes proxy requests for names they do not own to the owner, and move any
+// entries they hold but no longer own to their owners whenever the membership
+// of the cluster changes.
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// defaultVNodes is the number of virtual nodes of each node on a `Ring` when
+// not given.
+const defaultVNodes = 128
+
+// Key returns the key `name` in `bucket` is placed on a `Ring` by, `bucket`
+// being empty for unbucketed names.
+func Key(bucket, name string) string {
+	if len(bucket) == 0 {
+		return name
+	}
+	return bucket + "/" + name
+}
+
+// Ring places keys on nodes by consistent hashing: each node is hashed onto a
+// ring at many points, its virtual nodes, and owns the keys hashed between its
+// points and the previous ones. Adding or removing a node only moves the keys
+// of the points it gains or loses.
+//
+// A `Ring` is immutable, so is thread safe.
+type Ring struct {
+	nodes  []string
+	vnodes int
+
+	// points are the virtual nodes, in ascending order of hash
+	points []ringPoint
+}
+
+// ringPoint is a single virtual node of a `Ring`.
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// Initialize initializes and returns a pointer to a `Ring` of `nodes`, each
+// with `vnodes` virtual nodes - or 128 if `vnodes` is not positive.
+func (r Ring) Initialize(nodes []string, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = defaultVNodes
+	}
+
+	ring := &Ring{
+		vnodes: vnodes,
+	}
+	seen := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		ring.nodes = append(ring.nodes, node)
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash: ringHash(node + "#" + strconv.Itoa(i)),
+				node: node,
+			})
+		}
+	}
+	sort.Strings(ring.nodes)
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash != ring.points[j].hash {
+			return ring.points[i].hash < ring.points[j].hash
+		}
+		return ring.points[i].node < ring.points[j].node
+	})
+
+	return ring
+}
+
+// Owner returns the node owning `key`, or "" if the `Ring` has no nodes.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		// Wrap around the ring
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes of the `Ring`, in ascending order.
+func (r *Ring) Nodes() []string {
+	return append([]string{}, r.nodes...)
+}
+
+// VNodes returns the number of virtual nodes of each node.
+func (r *Ring) VNodes() int {
+	return r.vnodes
+}
+
+// ringHash hashes `s` onto a `Ring`.
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
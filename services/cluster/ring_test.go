@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner(t *testing.T) {
+	assert.Empty(t, Ring{}.Initialize(nil, 0).Owner("name"))
+
+	nodes := []string{"http://c:8080", "http://a:8080", "http://b:8080", "http://a:8080"}
+	ring := Ring{}.Initialize(nodes, 0)
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080", "http://c:8080"}, ring.Nodes())
+	assert.Equal(t, defaultVNodes, ring.VNodes())
+
+	// Placement only depends on the nodes, not their order
+	reordered := Ring{}.Initialize([]string{"http://b:8080", "http://c:8080", "http://a:8080"}, 0)
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "name-" + strconv.Itoa(i)
+		owner := ring.Owner(key)
+		assert.Equal(t, owner, reordered.Owner(key))
+		counts[owner]++
+	}
+
+	// Virtual nodes spread names evenly
+	for _, node := range ring.Nodes() {
+		assert.InDelta(t, 1000, counts[node], 250, node)
+	}
+}
+
+func TestRing_Rebalance(t *testing.T) {
+	before := Ring{}.Initialize([]string{"http://a:8080", "http://b:8080", "http://c:8080"}, 64)
+	after := Ring{}.Initialize([]string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}, 64)
+
+	// Only names moving to the new node move, about a quarter of them
+	moved := 0
+	for i := 0; i < 4000; i++ {
+		key := "name-" + strconv.Itoa(i)
+		if owner := after.Owner(key); owner != before.Owner(key) {
+			assert.Equal(t, "http://d:8080", owner)
+			moved++
+		}
+	}
+	assert.InDelta(t, 1000, moved, 300)
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "name", Key("", "name"))
+	assert.Equal(t, "bucket/name", Key("bucket", "name"))
+}
@@ -0,0 +1,423 @@
+package datastorage
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// backupFormat is the version of the archives written by `Backup`.
+	backupFormat = 1
+
+	// backupManifestPath is the path of the `BackupManifest` within an
+	// archive, its last file.
+	backupManifestPath = "manifest.json"
+
+	// backupEntryRecord is the PAX record of each data file of an archive
+	// holding its `BackupEntry` as JSON.
+	backupEntryRecord = "WEBAPP.entry"
+
+	// backupPageSize is the number of names listed at a time while backing up.
+	backupPageSize = 1000
+)
+
+// BackupEntry describes an entry of a `DataStorage` kept in a backup archive.
+type BackupEntry struct {
+	Name string `json:"name"`
+
+	// Path is the path of the data file of the entry within the archive.
+	Path string `json:"path"`
+
+	Size int64 `json:"size"`
+
+	// Checksum is the hex encoded SHA-256 hash of the data.
+	Checksum string `json:"checksum"`
+
+	ContentType string    `json:"content_type,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"`
+}
+
+// BackupManifest lists the entries of a backup archive, and is its last file.
+type BackupManifest struct {
+	Format    int           `json:"format"`
+	CreatedAt time.Time     `json:"created_at"`
+	Entries   []BackupEntry `json:"entries"`
+
+	// Bytes is the total size of the data of every entry.
+	Bytes int64 `json:"bytes"`
+}
+
+// Backup writes every unexpired entry of `storage` to `w` as a tar archive,
+// streaming the data of one entry at a time, and returns its manifest.
+//
+// Each entry is a data file described by a `BackupEntry` - kept in a PAX
+// record of its header, and again in the `BackupManifest` which ends the
+// archive. Entries written while backing up may or may not be included.
+//
+// The archive may be restored into any `DataStorage` with `Restore`.
+func Backup(ctx context.Context, storage DataStorage, w io.Writer) (BackupManifest, error) {
+	tw := tar.NewWriter(w)
+	manifest := BackupManifest{
+		Format:    backupFormat,
+		CreatedAt: timeNow().UTC(),
+		Entries:   []BackupEntry{},
+	}
+
+	cursor := ""
+	for {
+		names, next, err := WithContext(storage).ListNamesContext(ctx, "", cursor, backupPageSize)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		for _, name := range names {
+			path := fmt.Sprintf("entries/%08d", len(manifest.Entries))
+			entry, err := backupEntry(ctx, storage, tw, name, path)
+			if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+				// Deleted or expired since it was listed
+				continue
+			}
+			if err != nil {
+				return BackupManifest{}, err
+			}
+			manifest.Entries = append(manifest.Entries, entry)
+			manifest.Bytes += entry.Size
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     backupManifestPath,
+		Mode:     0o644,
+		Size:     int64(len(encoded)),
+		ModTime:  manifest.CreatedAt,
+	}); err != nil {
+		return BackupManifest{}, err
+	}
+	if _, err = tw.Write(encoded); err != nil {
+		return BackupManifest{}, err
+	}
+
+	return manifest, tw.Close()
+}
+
+// backupEntry writes the data of `name` in `storage` to `tw` as the file at
+// `path`, returning its `BackupEntry`.
+func backupEntry(ctx context.Context, storage DataStorage, tw *tar.Writer, name, path string) (BackupEntry, error) {
+	stream, meta, err := RetrieveStreamContext(ctx, storage, name)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	defer stream.Close()
+
+	var data io.Reader = stream
+	size, checksum := int64(meta.Size), meta.Checksum
+	if len(checksum) == 0 {
+		// Written before checksums were kept, so must be measured first
+		spooled, err := spool("", "backup-", stream)
+		if err != nil {
+			return BackupEntry{}, err
+		}
+		defer spooled.Close()
+		data, size, checksum = spooled, spooled.size, spooled.checksum
+	}
+
+	entry := BackupEntry{
+		Name:        name,
+		Path:        path,
+		Size:        size,
+		Checksum:    checksum,
+		ContentType: meta.ContentType,
+		ExpiresAt:   meta.ExpiresAt,
+		CreatedAt:   meta.CreatedAt,
+		UpdatedAt:   meta.UpdatedAt,
+	}
+	record, err := json.Marshal(entry)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	modTime := meta.UpdatedAt
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       path,
+		Mode:       0o644,
+		Size:       size,
+		ModTime:    modTime,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{backupEntryRecord: string(record)},
+	}); err != nil {
+		return BackupEntry{}, err
+	}
+
+	hash := sha256.New()
+	written, err := io.Copy(tw, io.TeeReader(data, hash))
+	if err == nil && (written != size || hex.EncodeToString(hash.Sum(nil)) != checksum) {
+		err = errors.New("data does not match its metadata")
+	}
+	if err != nil {
+		return BackupEntry{}, fmt.Errorf("backing up '%s': %w", name, err)
+	}
+
+	return entry, nil
+}
+
+// RestoreMode determines which of the entries of a backup archive are
+// restored, where their names are already held by the `DataStorage`.
+type RestoreMode int
+
+const (
+	// RestoreMerge keeps whichever of the two entries was written last.
+	RestoreMerge RestoreMode = iota
+
+	// RestoreOverwrite always restores the entry of the archive.
+	RestoreOverwrite
+
+	// RestoreSkip always keeps the entry of the storage.
+	RestoreSkip
+)
+
+// ParseRestoreMode parses a `RestoreMode` from its name: "merge", "overwrite"
+// or "skip".
+func ParseRestoreMode(mode string) (RestoreMode, error) {
+	switch mode {
+	case "merge":
+		return RestoreMerge, nil
+	case "overwrite":
+		return RestoreOverwrite, nil
+	case "skip":
+		return RestoreSkip, nil
+	default:
+		return 0, fmt.Errorf("unknown restore mode: '%s'", mode)
+	}
+}
+
+// RestoreOptions are optional settings of `Restore`.
+type RestoreOptions struct {
+	// Mode determines which entries are restored where their names are
+	// already held, defaults to `RestoreMerge`.
+	Mode RestoreMode
+
+	// OnRestore, if set, is called with the name of each entry once restored.
+	OnRestore func(name string) error
+}
+
+// RestoreResult counts the entries of a backup archive by what `Restore` did
+// with them.
+type RestoreResult struct {
+	Restored int `json:"restored"`
+
+	// Skipped entries were kept out by the `RestoreMode`.
+	Skipped int `json:"skipped"`
+
+	// Expired entries expired after being backed up.
+	Expired int `json:"expired"`
+}
+
+// Restore writes the entries of the backup archive read from `r`, written by
+// `Backup`, into `storage` - with the remainder of their time to live, and
+// subject to `opts.Mode` where their names are already held.
+//
+// Entries are restored as they are read, each only once its data matches its
+// checksum. Returns `customerrors.DataStorageBackupInvalid` if the archive is
+// corrupt, truncated or does not match its manifest, in which case the
+// entries before the fault are already restored.
+func Restore(ctx context.Context, storage DataStorage, r io.Reader, opts RestoreOptions) (RestoreResult, error) {
+	var (
+		result RestoreResult
+		read   []BackupEntry
+		tr     = tar.NewReader(r)
+	)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return result, customerrors.DataStorageBackupInvalid{
+				Reason: "archive ended before its manifest",
+			}
+		}
+		if err != nil {
+			return result, restoreReadErr(ctx, err)
+		}
+		if header.Name == backupManifestPath {
+			return result, checkBackupManifest(tr, read)
+		}
+
+		record, ok := header.PAXRecords[backupEntryRecord]
+		if !ok {
+			return result, customerrors.DataStorageBackupInvalid{
+				Reason: fmt.Sprintf("unexpected file in archive: %s", header.Name),
+			}
+		}
+		var entry BackupEntry
+		if err = json.Unmarshal([]byte(record), &entry); err != nil || entry.Size != header.Size {
+			return result, customerrors.DataStorageBackupInvalid{
+				Reason: fmt.Sprintf("file in archive is not described: %s", header.Name),
+			}
+		}
+		read = append(read, entry)
+
+		restored, err := restoreEntry(ctx, storage, tr, entry, opts.Mode)
+		if err != nil {
+			return result, err
+		}
+		switch restored {
+		case restoreRestored:
+			result.Restored++
+			if opts.OnRestore != nil {
+				if err = opts.OnRestore(entry.Name); err != nil {
+					return result, err
+				}
+			}
+		case restoreSkipped:
+			result.Skipped++
+		case restoreExpired:
+			result.Expired++
+		}
+	}
+}
+
+// restoreOutcome is what `restoreEntry` did with an entry.
+type restoreOutcome int
+
+const (
+	restoreRestored restoreOutcome = iota
+	restoreSkipped
+	restoreExpired
+)
+
+// restoreEntry restores `entry` into `storage` with its data read from `r`,
+// subject to `mode`.
+func restoreEntry(ctx context.Context, storage DataStorage, r io.Reader, entry BackupEntry, mode RestoreMode) (restoreOutcome, error) {
+	now := timeNow()
+	expiry := Metadata{ExpiresAt: entry.ExpiresAt}
+	if expiry.Expired(now) {
+		return restoreExpired, nil
+	}
+
+	var cond Precondition
+	switch mode {
+	case RestoreOverwrite:
+	case RestoreSkip:
+		cond.MustNotExist = true
+	default:
+		meta, err := WithContext(storage).RetrieveMetadataContext(ctx, entry.Name)
+		if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+			cond.MustNotExist = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !entry.UpdatedAt.After(meta.UpdatedAt) {
+			return restoreSkipped, nil
+		}
+		// Unless written again since
+		cond.IfMatch = []uint64{meta.Revision}
+	}
+
+	_, err := StoreStreamContext(ctx, storage, entry.Name, &checksumReader{
+		r:     r,
+		hash:  sha256.New(),
+		entry: entry,
+	}, StoreOptions{
+		TTL:         expiry.TTL(now),
+		ContentType: entry.ContentType,
+	}, cond)
+	switch err.(type) {
+	case nil:
+		return restoreRestored, nil
+	case customerrors.DataStoragePreconditionFailed:
+		return restoreSkipped, nil
+	default:
+		return 0, restoreReadErr(ctx, err)
+	}
+}
+
+// checkBackupManifest reads the manifest of an archive from `r`, checking it
+// lists exactly the entries `read` from the archive.
+func checkBackupManifest(r io.Reader, read []BackupEntry) error {
+	var manifest BackupManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return customerrors.DataStorageBackupInvalid{
+			Reason: fmt.Sprintf("unreadable manifest: %v", err),
+		}
+	}
+	if manifest.Format != backupFormat {
+		return customerrors.DataStorageBackupInvalid{
+			Reason: fmt.Sprintf("unsupported format: %d", manifest.Format),
+		}
+	}
+
+	mismatch := customerrors.DataStorageBackupInvalid{
+		Reason: "manifest does not match the entries of the archive",
+	}
+	if len(manifest.Entries) != len(read) {
+		return mismatch
+	}
+	for i, entry := range manifest.Entries {
+		if entry.Name != read[i].Name || entry.Checksum != read[i].Checksum {
+			return mismatch
+		}
+	}
+	return nil
+}
+
+// restoreReadErr returns the error of `ctx` if done, `err` if it is already a
+// `customerrors.DataStorageBackupInvalid` or otherwise unrelated to reading
+// the archive, else `err` as a `customerrors.DataStorageBackupInvalid`.
+func restoreReadErr(ctx context.Context, err error) error {
+	if cErr := ctx.Err(); cErr != nil {
+		return cErr
+	}
+	var invalid customerrors.DataStorageBackupInvalid
+	if errors.As(err, &invalid) {
+		return invalid
+	}
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return customerrors.DataStorageBackupInvalid{
+			Reason: fmt.Sprintf("corrupt archive: %v", err),
+		}
+	}
+	return err
+}
+
+// checksumReader reads the data of `entry`, failing at EOF if it does not
+// match its checksum - so it is never stored.
+type checksumReader struct {
+	r     io.Reader
+	hash  hash.Hash
+	entry BackupEntry
+}
+
+// Read reads the data, checking it once it is all read.
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(cr.hash.Sum(nil)) != cr.entry.Checksum {
+		return n, customerrors.DataStorageBackupInvalid{
+			Reason: fmt.Sprintf("data of '%s' does not match its checksum", cr.entry.Name),
+		}
+	}
+	return n, err
+}
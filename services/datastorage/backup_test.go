@@ -0,0 +1,308 @@
+package datastorage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackup backs up `storage`, returning the archive.
+func testBackup(t *testing.T, storage DataStorage) ([]byte, BackupManifest) {
+	t.Helper()
+
+	var archive bytes.Buffer
+	manifest, err := Backup(context.Background(), storage, &archive)
+	require.NoError(t, err)
+	return archive.Bytes(), manifest
+}
+
+// testArchiveFiles reads the files of a backup `archive`, in order.
+func testArchiveFiles(t *testing.T, archive []byte) ([]*tar.Header, [][]byte) {
+	t.Helper()
+
+	var (
+		headers  []*tar.Header
+		contents [][]byte
+	)
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers, contents
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers = append(headers, header)
+		contents = append(contents, content)
+	}
+}
+
+// testWriteArchive writes the files of a backup archive.
+func testWriteArchive(t *testing.T, headers []*tar.Header, contents [][]byte) []byte {
+	t.Helper()
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for i, header := range headers {
+		header.Size = int64(len(contents[i]))
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write(contents[i])
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return archive.Bytes()
+}
+
+// legacyStorage is a `DataStorage` whose entries lack checksums, as if
+// written by an older version.
+type legacyStorage struct {
+	DataStorage
+}
+
+func (s legacyStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	data, meta, err := s.DataStorage.RetrieveEntry(name)
+	meta.Checksum = ""
+	return data, meta, err
+}
+
+func TestBackup(t *testing.T) {
+	now := fakeClock(t)
+	storage := MemStorage{}.Initialize()
+	_, err := storage.CompareAndSwap("a", []byte("test data a"), StoreOptions{
+		ContentType: "text/plain",
+	}, Precondition{})
+	require.NoError(t, err)
+	require.NoError(t, storage.StoreDataWithOptions("b", []byte("test data b"), StoreOptions{
+		TTL: time.Hour,
+	}))
+	require.NoError(t, storage.StoreData("c/d", []byte{}))
+	require.NoError(t, storage.StoreDataWithOptions("expired", []byte("test data"), StoreOptions{
+		TTL: time.Second,
+	}))
+	*now = now.Add(time.Minute)
+
+	archive, manifest := testBackup(t, storage)
+	assert.Equal(t, backupFormat, manifest.Format)
+	assert.Equal(t, int64(len("test data a")+len("test data b")), manifest.Bytes)
+	require.Len(t, manifest.Entries, 3)
+	for i, name := range []string{"a", "b", "c/d"} {
+		_, meta, err := storage.RetrieveEntry(name)
+		require.NoError(t, err)
+		entry := manifest.Entries[i]
+		assert.Equal(t, name, entry.Name)
+		assert.Equal(t, int64(meta.Size), entry.Size)
+		assert.Equal(t, meta.Checksum, entry.Checksum)
+		assert.Equal(t, meta.ContentType, entry.ContentType)
+		assert.Equal(t, meta.ExpiresAt, entry.ExpiresAt)
+		assert.Equal(t, meta.UpdatedAt, entry.UpdatedAt)
+	}
+
+	// Data files described in their headers, then the manifest
+	headers, contents := testArchiveFiles(t, archive)
+	require.Len(t, headers, 4)
+	for i, entry := range manifest.Entries {
+		assert.Equal(t, entry.Path, headers[i].Name)
+		var described BackupEntry
+		require.NoError(t, json.Unmarshal([]byte(headers[i].PAXRecords[backupEntryRecord]), &described))
+		assert.Equal(t, entry, described)
+	}
+	assert.Equal(t, []byte("test data a"), contents[0])
+	assert.Equal(t, backupManifestPath, headers[3].Name)
+	var written BackupManifest
+	require.NoError(t, json.Unmarshal(contents[3], &written))
+	assert.Equal(t, manifest.Entries, written.Entries)
+
+	t.Run("without checksums", func(t *testing.T) {
+		_, legacy := testBackup(t, legacyStorage{storage})
+		assert.Equal(t, manifest.Entries, legacy.Entries)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		archive, manifest := testBackup(t, MemStorage{}.Initialize())
+		assert.Empty(t, manifest.Entries)
+
+		result, err := Restore(context.Background(), MemStorage{}.Initialize(), bytes.NewReader(archive), RestoreOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, RestoreResult{}, result)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Backup(ctx, storage, io.Discard)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestRestore(t *testing.T) {
+	now := fakeClock(t)
+	source := MemStorage{}.Initialize()
+	_, err := source.CompareAndSwap("a", []byte("test data a"), StoreOptions{
+		ContentType: "text/plain",
+	}, Precondition{})
+	require.NoError(t, err)
+	require.NoError(t, source.StoreDataWithOptions("b", []byte("test data b"), StoreOptions{
+		TTL: time.Hour,
+	}))
+	archive, _ := testBackup(t, source)
+
+	t.Run("into any storage", func(t *testing.T) {
+		fs, err := FileStorage{}.Initialize(t.TempDir())
+		require.NoError(t, err)
+
+		for name, storage := range map[string]DataStorage{
+			"memory":     MemStorage{}.Initialize(),
+			"file":       fs,
+			"compressed": initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}),
+			"encrypted":  initTestEncryptedStorage(t, MemStorage{}.Initialize()),
+		} {
+			t.Run(name, func(t *testing.T) {
+				var restored []string
+				result, err := Restore(context.Background(), storage, bytes.NewReader(archive), RestoreOptions{
+					OnRestore: func(name string) error {
+						restored = append(restored, name)
+						return nil
+					},
+				})
+				require.NoError(t, err)
+				assert.Equal(t, RestoreResult{Restored: 2}, result)
+				assert.Equal(t, []string{"a", "b"}, restored)
+
+				data, meta, err := storage.RetrieveEntry("a")
+				require.NoError(t, err)
+				assert.Equal(t, []byte("test data a"), data)
+				assert.Equal(t, "text/plain", meta.ContentType)
+				_, meta, err = storage.RetrieveEntry("b")
+				require.NoError(t, err)
+				assert.Equal(t, time.Hour, meta.TTL(*now))
+
+				// And backed up again as it was
+				again, _ := testBackup(t, storage)
+				_, first := testArchiveFiles(t, archive)
+				_, second := testArchiveFiles(t, again)
+				assert.Equal(t, first[:2], second[:2])
+			})
+		}
+	})
+
+	t.Run("modes", func(t *testing.T) {
+		// "a" is written before the backup, "b" after
+		*now = now.Add(time.Minute)
+		for _, tc := range []struct {
+			mode   RestoreMode
+			result RestoreResult
+			a, b   string
+		}{
+			{RestoreMerge, RestoreResult{Restored: 1, Skipped: 1}, "test data a", "newer b"},
+			{RestoreOverwrite, RestoreResult{Restored: 2}, "test data a", "test data b"},
+			{RestoreSkip, RestoreResult{Skipped: 2}, "older a", "newer b"},
+		} {
+			storage := MemStorage{}.Initialize()
+			*now = now.Add(-2 * time.Minute)
+			require.NoError(t, storage.StoreData("a", []byte("older a")))
+			*now = now.Add(2 * time.Minute)
+			require.NoError(t, storage.StoreData("b", []byte("newer b")))
+
+			result, err := Restore(context.Background(), storage, bytes.NewReader(archive), RestoreOptions{
+				Mode: tc.mode,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tc.result, result, tc.mode)
+
+			data, err := storage.RetrieveData("a")
+			require.NoError(t, err)
+			assert.Equal(t, tc.a, string(data), tc.mode)
+			data, err = storage.RetrieveData("b")
+			require.NoError(t, err)
+			assert.Equal(t, tc.b, string(data), tc.mode)
+		}
+	})
+
+	t.Run("expired since", func(t *testing.T) {
+		*now = now.Add(2 * time.Hour)
+		defer func() { *now = now.Add(-2 * time.Hour) }()
+
+		storage := MemStorage{}.Initialize()
+		result, err := Restore(context.Background(), storage, bytes.NewReader(archive), RestoreOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, RestoreResult{Restored: 1, Expired: 1}, result)
+		_, err = storage.RetrieveData("b")
+		assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		headers, contents := testArchiveFiles(t, archive)
+		tampered := append([][]byte{}, contents...)
+		tampered[1] = []byte("test data c")
+		var manifest BackupManifest
+		require.NoError(t, json.Unmarshal(contents[2], &manifest))
+		manifest.Entries = manifest.Entries[:1]
+		shortManifest, err := json.Marshal(manifest)
+		require.NoError(t, err)
+		manifest.Format = backupFormat + 1
+		futureManifest, err := json.Marshal(manifest)
+		require.NoError(t, err)
+
+		for name, tc := range map[string]struct {
+			archive  []byte
+			restored int
+		}{
+			"not an archive": {[]byte(strings.Repeat("test data ", 100)), 0},
+			"truncated":      {archive[:bytes.Index(archive, []byte("test data b"))+4], 1},
+			"no manifest":    {testWriteArchive(t, headers[:2], contents[:2]), 2},
+			"tampered data":  {testWriteArchive(t, headers, tampered), 1},
+			"manifest mismatch": {testWriteArchive(t, headers, [][]byte{
+				contents[0], contents[1], shortManifest,
+			}), 2},
+			"unsupported format": {testWriteArchive(t, headers, [][]byte{
+				contents[0], contents[1], futureManifest,
+			}), 2},
+			"undescribed file": {testWriteArchive(t, []*tar.Header{
+				{Typeflag: tar.TypeReg, Name: "a", Mode: 0o644},
+			}, [][]byte{[]byte("test data")}), 0},
+		} {
+			t.Run(name, func(t *testing.T) {
+				storage := MemStorage{}.Initialize()
+				result, err := Restore(context.Background(), storage, bytes.NewReader(tc.archive), RestoreOptions{})
+				assert.IsType(t, customerrors.DataStorageBackupInvalid{}, err)
+				assert.Equal(t, tc.restored, result.Restored)
+
+				names, _, err := storage.ListNames("", "", 0)
+				require.NoError(t, err)
+				assert.Len(t, names, tc.restored)
+			})
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Restore(ctx, MemStorage{}.Initialize(), bytes.NewReader(archive), RestoreOptions{})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestParseRestoreMode(t *testing.T) {
+	for name, mode := range map[string]RestoreMode{
+		"merge":     RestoreMerge,
+		"overwrite": RestoreOverwrite,
+		"skip":      RestoreSkip,
+	} {
+		parsed, err := ParseRestoreMode(name)
+		require.NoError(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	_, err := ParseRestoreMode("replace")
+	assert.Error(t, err)
+}
@@ -0,0 +1,1168 @@
+package datastorage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// bucketKeyPrefix begins the names a `BucketStorage` keeps buckets under
+	// within the backing storage - unbucketed names may not begin with it.
+	bucketKeyPrefix = reservedNamePrefix + "bucket\x00"
+
+	// bucketConfigPrefix begins the names holding each bucket's JSON encoded
+	// `BucketConfig`.
+	bucketConfigPrefix = bucketKeyPrefix + "config\x00"
+
+	// bucketDataPrefix begins the names holding the data of every bucket.
+	bucketDataPrefix = bucketKeyPrefix + "data\x00"
+
+	// maxBucketNameLength is the longest valid bucket name.
+	maxBucketNameLength = 63
+
+	// bucketSpoolPrefix names the temporary files streams are spooled to.
+	bucketSpoolPrefix = "bucket-spool-"
+)
+
+// BucketManager is implemented by `DataStorage`s which hold named buckets,
+// each an isolated set of names, such as `BucketStorage`.
+type BucketManager interface {
+	// CreateBucket creates an empty bucket named `bucket` with the given
+	// `cfg`.
+	//
+	// Returns `customerrors.DataStorageBucketExists` if it already exists, or
+	// `customerrors.DataStorageBucketInvalid` if `bucket` is not a valid name.
+	CreateBucket(bucket string, cfg BucketConfig) error
+
+	// ConfigureBucket replaces the `BucketConfig` of `bucket`, which applies
+	// to writes from then on.
+	ConfigureBucket(bucket string, cfg BucketConfig) error
+
+	// DeleteBucket deletes `bucket`, which must be empty.
+	//
+	// Returns `customerrors.DataStorageBucketNotEmpty` if it holds data.
+	DeleteBucket(bucket string) error
+
+	// ListBuckets lists every bucket, ordered by name.
+	ListBuckets() ([]BucketInfo, error)
+
+	// Bucket returns the `DataStorage` of the names in `bucket`.
+	//
+	// Returns `customerrors.DataStorageBucketNotFound` if it does not exist.
+	Bucket(bucket string) (DataStorage, error)
+}
+
+// BucketConfig configures the writes accepted by a bucket.
+type BucketConfig struct {
+	// MaxObjectSize is the largest data in bytes the bucket accepts, unlimited
+	// if zero.
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+
+	// DefaultTTL is the TTL of data written without one, never expiring if
+	// zero.
+	DefaultTTL time.Duration `json:"default_ttl,omitempty"`
+
+	// ReadOnly refuses all writes and deletions.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// BucketInfo describes a single bucket.
+type BucketInfo struct {
+	Name   string       `json:"name"`
+	Config BucketConfig `json:"config"`
+}
+
+// BucketStorage is a decorator that implements the `DataStorage` and
+// `BucketManager` interfaces, holding named buckets alongside the unbucketed
+// names of its backing `DataStorage`.
+//
+// Bucket configs and data are stored in the backing storage under names
+// prefixed with an unprintable `bucketKeyPrefix`, so the backing storage (and
+// any decorators in between) need no knowledge of buckets. Unbucketed names
+// beginning with it are refused with `customerrors.DataStorageNameReserved`,
+// else they could reach buckets past their configs.
+//
+// It implements `ContextStorage`, passing contexts on to the backing storage
+// if it honours them natively.
+type BucketStorage struct {
+	backing DataStorage
+
+	// Bucket configs, kept in sync with the backing storage by their writers
+	rwMu    *sync.RWMutex
+	buckets map[string]BucketConfig
+}
+
+// Initialize initializes and returns a pointer to a `BucketStorage` in front
+// of `backing`, loading any buckets previously created in it.
+//
+// The returned `BucketStorage` takes ownership of `backing` - `Close` closes
+// `backing` if it is an `io.Closer`.
+func (bs BucketStorage) Initialize(backing DataStorage) (*BucketStorage, error) {
+	storage := &BucketStorage{
+		backing: backing,
+		rwMu:    &sync.RWMutex{},
+		buckets: make(map[string]BucketConfig),
+	}
+
+	cursor := ""
+	for {
+		names, next, err := backing.ListNames(bucketConfigPrefix, cursor, listBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			data, err := backing.RetrieveData(name)
+			if _, ok := err.(customerrors.DataStorageNameNotFound); ok {
+				// Deleted since listed
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			var cfg BucketConfig
+			if err = json.Unmarshal(data, &cfg); err != nil {
+				return nil, err
+			}
+			storage.buckets[name[len(bucketConfigPrefix):]] = cfg
+		}
+
+		if len(next) == 0 {
+			return storage, nil
+		}
+		cursor = next
+	}
+}
+
+// RetrieveData retrieves the unbucketed data associated with a given `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveData(name string) ([]byte, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return []byte{}, err
+	}
+	return bs.backing.RetrieveData(name)
+}
+
+// RetrieveEntry retrieves the unbucketed data and `Metadata` associated with
+// a given `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return bs.retrieveEntry(bs.backing, name)
+}
+
+// retrieveEntry behaves as `RetrieveEntry`, reading from `backing`.
+func (bs *BucketStorage) retrieveEntry(backing DataStorage, name string) ([]byte, Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadata retrieves the `Metadata` of the unbucketed data associated
+// with a given `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return bs.retrieveMetadata(bs.backing, name)
+}
+
+// retrieveMetadata behaves as `RetrieveMetadata`, reading from `backing`.
+func (bs *BucketStorage) retrieveMetadata(backing DataStorage, name string) (Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	return backing.RetrieveMetadata(name)
+}
+
+// StoreData writes unbucketed data `[]byte`, mapping it to the given `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) StoreData(name string, data []byte) error {
+	return bs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (bs *BucketStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return err
+	}
+	return bs.backing.StoreDataWithOptions(name, data, opts)
+}
+
+// DeleteData removes the unbucketed data associated with the given `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) DeleteData(name string) error {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return err
+	}
+	return bs.backing.DeleteData(name)
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return bs.compareAndSwap(bs.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (bs *BucketStorage) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	return backing.CompareAndSwap(name, data, opts, cond)
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) CompareAndDelete(name string, cond Precondition) error {
+	return bs.compareAndDelete(bs.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (bs *BucketStorage) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return err
+	}
+	return backing.CompareAndDelete(name, cond)
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return bs.applyBatch(bs.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (bs *BucketStorage) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	if err := checkBatchNames(ops, bucketKeyPrefix); err != nil {
+		return nil, err
+	}
+	return backing.ApplyBatch(ops)
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// if the backing storage can, see `StreamingStorage`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	return StoreStream(bs.backing, name, r, opts, cond)
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, streaming the data if the
+// backing storage can, see `StreamingStorage`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return nil, Metadata{}, err
+	}
+	return RetrieveStream(bs.backing, name)
+}
+
+// ListNames lists the unbucketed names beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return bs.listNames(bs.backing, prefix, cursor, limit)
+}
+
+// listNames behaves as `ListNames`, listing the names of `backing`.
+func (bs *BucketStorage) listNames(backing DataStorage, prefix, cursor string, limit int) ([]string, string, error) {
+	return listNamesExcept(backing, bucketKeyPrefix, prefix, cursor, limit)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.RetrieveEntryContext(ctx, name)
+	}
+	return bs.retrieveEntry(backing, name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.RetrieveMetadataContext(ctx, name)
+	}
+	return bs.retrieveMetadata(backing, name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return bs.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return bs.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return bs.listNames(backing, prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, bs.backing)
+	if !ok {
+		return contextAdapter{bs}.ApplyBatchContext(ctx, ops)
+	}
+	return bs.applyBatch(backing, ops)
+}
+
+func (bs *BucketStorage) contextNative() bool {
+	_, ok := nativeContext(bs.backing)
+	return ok
+}
+
+// PurgeExpired removes all expired entries of the backing storage, in every
+// bucket.
+//
+// This method is thread safe.
+func (bs *BucketStorage) PurgeExpired() (int, error) {
+	return bs.backing.PurgeExpired()
+}
+
+// RetrieveVersion retrieves a previous `version` of the unbucketed data of
+// `name`, if the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RetrieveVersion(name string, version int) ([]byte, Metadata, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	history, err := versionHistory(bs.backing)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return history.RetrieveVersion(name, version)
+}
+
+// ListVersions lists the kept versions of the unbucketed data of `name`, if
+// the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ListVersions(name string) ([]VersionInfo, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return nil, err
+	}
+	history, err := versionHistory(bs.backing)
+	if err != nil {
+		return nil, err
+	}
+	return history.ListVersions(name)
+}
+
+// RestoreVersion restores the unbucketed data of `name` to a previous
+// `version`, if the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) RestoreVersion(name string, version int) (int, error) {
+	if err := checkName(name, bucketKeyPrefix); err != nil {
+		return 0, err
+	}
+	history, err := versionHistory(bs.backing)
+	if err != nil {
+		return 0, err
+	}
+	return history.RestoreVersion(name, version)
+}
+
+// CreateBucket creates an empty bucket named `bucket` with the given `cfg`.
+//
+// Bucket names are 1 to 63 lowercase letters, digits, '.', '-' or '_',
+// beginning with a letter or digit.
+//
+// This method is thread safe.
+func (bs *BucketStorage) CreateBucket(bucket string, cfg BucketConfig) error {
+	if err := validateBucketName(bucket); err != nil {
+		return err
+	}
+
+	bs.rwMu.Lock()
+	defer bs.rwMu.Unlock()
+
+	if _, found := bs.buckets[bucket]; found {
+		return customerrors.DataStorageBucketExists{
+			Bucket: bucket,
+		}
+	}
+
+	return bs.writeConfig(bucket, cfg)
+}
+
+// ConfigureBucket replaces the `BucketConfig` of `bucket`.
+//
+// Data already in the bucket is unaffected, even if larger than a new
+// `MaxObjectSize`.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ConfigureBucket(bucket string, cfg BucketConfig) error {
+	bs.rwMu.Lock()
+	defer bs.rwMu.Unlock()
+
+	if _, found := bs.buckets[bucket]; !found {
+		return customerrors.DataStorageBucketNotFound{
+			Bucket: bucket,
+		}
+	}
+
+	return bs.writeConfig(bucket, cfg)
+}
+
+// DeleteBucket deletes `bucket`, which must be empty.
+//
+// This method is thread safe.
+func (bs *BucketStorage) DeleteBucket(bucket string) error {
+	bs.rwMu.Lock()
+	defer bs.rwMu.Unlock()
+
+	if _, found := bs.buckets[bucket]; !found {
+		return customerrors.DataStorageBucketNotFound{
+			Bucket: bucket,
+		}
+	}
+
+	// Writers to the bucket hold a read lock, so it cannot fill meanwhile
+	names, _, err := bs.backing.ListNames(bucketDataKey(bucket, ""), "", 1)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return customerrors.DataStorageBucketNotEmpty{
+			Bucket: bucket,
+		}
+	}
+
+	err = bs.backing.DeleteData(bucketConfigPrefix + bucket)
+	if _, ok := err.(customerrors.DataStorageNameNotFound); err != nil && !ok {
+		return err
+	}
+	delete(bs.buckets, bucket)
+
+	return nil
+}
+
+// ListBuckets lists every bucket, ordered by name.
+//
+// This method is thread safe.
+func (bs *BucketStorage) ListBuckets() ([]BucketInfo, error) {
+	bs.rwMu.RLock()
+	defer bs.rwMu.RUnlock()
+
+	buckets := make([]BucketInfo, 0, len(bs.buckets))
+	for name, cfg := range bs.buckets {
+		buckets = append(buckets, BucketInfo{
+			Name:   name,
+			Config: cfg,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+
+	return buckets, nil
+}
+
+// Bucket returns the `DataStorage` of the names in `bucket`.
+//
+// The returned `DataStorage` applies the current `BucketConfig` on every
+// write, and fails with `customerrors.DataStorageBucketNotFound` once the
+// bucket is deleted.
+//
+// This method is thread safe.
+func (bs *BucketStorage) Bucket(bucket string) (DataStorage, error) {
+	bs.rwMu.RLock()
+	defer bs.rwMu.RUnlock()
+
+	if _, found := bs.buckets[bucket]; !found {
+		return nil, customerrors.DataStorageBucketNotFound{
+			Bucket: bucket,
+		}
+	}
+
+	return &Bucket{
+		storage: bs,
+		name:    bucket,
+	}, nil
+}
+
+// Refresh reloads the config of a bucket from the backing storage, if `name`
+// is the name a bucket config is kept under in the backing storage - for when
+// the backing storage is written other than through this `BucketStorage`,
+// such as by replication.
+//
+// This method is thread safe.
+func (bs *BucketStorage) Refresh(name string) error {
+	if !strings.HasPrefix(name, bucketConfigPrefix) {
+		return nil
+	}
+	bucket := name[len(bucketConfigPrefix):]
+
+	bs.rwMu.Lock()
+	defer bs.rwMu.Unlock()
+
+	data, err := bs.backing.RetrieveData(name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		delete(bs.buckets, bucket)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cfg BucketConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	bs.buckets[bucket] = cfg
+
+	return nil
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (bs *BucketStorage) Close() error {
+	if closer, ok := bs.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeConfig persists `cfg` as the config of `bucket` - callers must hold
+// the write lock.
+func (bs *BucketStorage) writeConfig(bucket string, cfg BucketConfig) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err = bs.backing.StoreDataWithOptions(
+		bucketConfigPrefix+bucket, data, StoreOptions{ContentType: "application/json"},
+	); err != nil {
+		return err
+	}
+	bs.buckets[bucket] = cfg
+
+	return nil
+}
+
+// Bucket is the `DataStorage` of the names in a single bucket of a
+// `BucketStorage`, see `BucketStorage.Bucket`.
+//
+// It implements `VersionHistory` too, if the backing storage does, and
+// `ContextStorage`, passing contexts on to the backing storage if it honours
+// them natively.
+type Bucket struct {
+	storage *BucketStorage
+	name    string
+}
+
+// RetrieveData retrieves the data associated with `name` in the bucket.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveData(name string) ([]byte, error) {
+	data, _, err := b.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with `name` in
+// the bucket.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return b.retrieveEntry(b.storage.backing, name)
+}
+
+// retrieveEntry behaves as `RetrieveEntry`, reading from `backing`.
+func (b *Bucket) retrieveEntry(backing DataStorage, name string) ([]byte, Metadata, error) {
+	var (
+		data []byte
+		meta Metadata
+	)
+	err := b.read(backing, name, func(backing DataStorage, key string) (err error) {
+		data, meta, err = backing.RetrieveEntry(key)
+		return err
+	})
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	return data, meta, nil
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with `name` in the
+// bucket.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveMetadata(name string) (Metadata, error) {
+	return b.retrieveMetadata(b.storage.backing, name)
+}
+
+// retrieveMetadata behaves as `RetrieveMetadata`, reading from `backing`.
+func (b *Bucket) retrieveMetadata(backing DataStorage, name string) (Metadata, error) {
+	var meta Metadata
+	err := b.read(backing, name, func(backing DataStorage, key string) (err error) {
+		meta, err = backing.RetrieveMetadata(key)
+		return err
+	})
+
+	return meta, err
+}
+
+// StoreData writes data `[]byte` to the bucket, mapping it to the given
+// `name`.
+//
+// This method is thread safe.
+func (b *Bucket) StoreData(name string, data []byte) error {
+	return b.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry -
+// and the bucket's `DefaultTTL` if `opts` has none.
+//
+// This method is thread safe.
+func (b *Bucket) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := b.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// DeleteData removes data associated with `name` in the bucket.
+//
+// This method is thread safe.
+func (b *Bucket) DeleteData(name string) error {
+	return b.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`.
+//
+// Returns `customerrors.DataStorageReadOnly` if the bucket is read only, or
+// `customerrors.DataStorageEntryTooLarge` if `data` exceeds its
+// `MaxObjectSize`.
+//
+// This method is thread safe.
+func (b *Bucket) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return b.compareAndSwap(b.storage.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (b *Bucket) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	var meta Metadata
+	err := b.write(backing, name, func(backing DataStorage, key string, cfg BucketConfig) (err error) {
+		if cfg.MaxObjectSize > 0 && int64(len(data)) > cfg.MaxObjectSize {
+			return customerrors.DataStorageEntryTooLarge{
+				Name:  name,
+				Size:  int64(len(data)),
+				Limit: cfg.MaxObjectSize,
+			}
+		}
+		if opts.TTL == 0 {
+			opts.TTL = cfg.DefaultTTL
+		}
+
+		meta, err = backing.CompareAndSwap(key, data, opts, cond)
+		return err
+	})
+
+	return meta, err
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (b *Bucket) CompareAndDelete(name string, cond Precondition) error {
+	return b.compareAndDelete(b.storage.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (b *Bucket) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	return b.write(backing, name, func(backing DataStorage, key string, _ BucketConfig) error {
+		return backing.CompareAndDelete(key, cond)
+	})
+}
+
+// ApplyBatch atomically applies every operation of `ops` within the bucket or
+// none of them, see `DataStorage`.
+//
+// Returns `customerrors.DataStorageReadOnly` if the bucket is read only, or
+// `customerrors.DataStorageEntryTooLarge` if any stored data exceeds its
+// `MaxObjectSize`.
+//
+// This method is thread safe.
+func (b *Bucket) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return b.applyBatch(b.storage.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (b *Bucket) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	first := ""
+	if len(ops) > 0 {
+		first = ops[0].Name
+	}
+	var metas []Metadata
+	err := b.write(backing, first, func(backing DataStorage, _ string, cfg BucketConfig) (err error) {
+		keyed := make([]BatchOp, len(ops))
+		for i, op := range ops {
+			if !op.Delete && cfg.MaxObjectSize > 0 && int64(len(op.Data)) > cfg.MaxObjectSize {
+				return customerrors.DataStorageEntryTooLarge{
+					Name:  op.Name,
+					Size:  int64(len(op.Data)),
+					Limit: cfg.MaxObjectSize,
+				}
+			}
+			if !op.Delete && op.Options.TTL == 0 {
+				op.Options.TTL = cfg.DefaultTTL
+			}
+			op.Name = bucketDataKey(b.name, op.Name)
+			keyed[i] = op
+		}
+
+		metas, err = backing.ApplyBatch(keyed)
+		return err
+	})
+
+	return metas, err
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// if the backing storage can, see `StreamingStorage`.
+//
+// The data is first spooled to a temporary file, so that changes to the
+// bucket need not wait for it to be read - nor, while they wait, the bucket's
+// other operations. Fails with `customerrors.DataStorageEntryTooLarge` as soon
+// as more than the bucket's `MaxObjectSize` is read.
+//
+// This method is thread safe.
+func (b *Bucket) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	var limit int64
+	err := b.write(b.storage.backing, name, func(_ DataStorage, _ string, cfg BucketConfig) error {
+		limit = cfg.MaxObjectSize
+		return nil
+	})
+	if err != nil {
+		return Metadata{}, err
+	}
+	if limit > 0 {
+		r = &sizeLimitedReader{
+			reader: r,
+			name:   name,
+			limit:  limit,
+		}
+	}
+	spooled, err := spool("", bucketSpoolPrefix, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	// The bucket may have been reconfigured meanwhile
+	var meta Metadata
+	err = b.write(b.storage.backing, name, func(backing DataStorage, key string, cfg BucketConfig) (err error) {
+		if cfg.MaxObjectSize > 0 && spooled.size > cfg.MaxObjectSize {
+			return customerrors.DataStorageEntryTooLarge{
+				Name:  name,
+				Size:  spooled.size,
+				Limit: cfg.MaxObjectSize,
+			}
+		}
+		if opts.TTL == 0 {
+			opts.TTL = cfg.DefaultTTL
+		}
+
+		meta, err = StoreStream(backing, key, spooled, opts, cond)
+		return err
+	})
+
+	return meta, err
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, streaming the data if the
+// backing storage can, see `StreamingStorage`.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	var (
+		stream io.ReadCloser
+		meta   Metadata
+	)
+	err := b.read(b.storage.backing, name, func(backing DataStorage, key string) (err error) {
+		stream, meta, err = RetrieveStream(backing, key)
+		return err
+	})
+
+	return stream, meta, err
+}
+
+// ListNames lists the names in the bucket beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (b *Bucket) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return b.listNames(b.storage.backing, prefix, cursor, limit)
+}
+
+// listNames behaves as `ListNames`, listing the names of `backing`.
+func (b *Bucket) listNames(backing DataStorage, prefix, cursor string, limit int) ([]string, string, error) {
+	var (
+		names []string
+		next  string
+	)
+	err := b.read(backing, "", func(backing DataStorage, keyPrefix string) (err error) {
+		keyCursor := ""
+		if len(cursor) > 0 {
+			keyCursor = keyPrefix + cursor
+		}
+		names, next, err = backing.ListNames(keyPrefix+prefix, keyCursor, limit)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i, key := range names {
+		names[i] = key[len(bucketDataKey(b.name, "")):]
+	}
+	if len(next) > 0 {
+		next = next[len(bucketDataKey(b.name, "")):]
+	}
+	return names, next, nil
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.RetrieveEntryContext(ctx, name)
+	}
+	return b.retrieveEntry(backing, name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.RetrieveMetadataContext(ctx, name)
+	}
+	return b.retrieveMetadata(backing, name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return b.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return b.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return b.listNames(backing, prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (b *Bucket) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, b.storage.backing)
+	if !ok {
+		return contextAdapter{b}.ApplyBatchContext(ctx, ops)
+	}
+	return b.applyBatch(backing, ops)
+}
+
+func (b *Bucket) contextNative() bool {
+	_, ok := nativeContext(b.storage.backing)
+	return ok
+}
+
+// PurgeExpired removes all expired entries of the backing storage, in every
+// bucket.
+//
+// This method is thread safe.
+func (b *Bucket) PurgeExpired() (int, error) {
+	return b.storage.PurgeExpired()
+}
+
+// RetrieveVersion retrieves a previous `version` of the data associated with
+// `name` in the bucket, if the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (b *Bucket) RetrieveVersion(name string, version int) ([]byte, Metadata, error) {
+	var (
+		data []byte
+		meta Metadata
+	)
+	err := b.read(b.storage.backing, name, func(backing DataStorage, key string) error {
+		history, err := versionHistory(backing)
+		if err != nil {
+			return err
+		}
+		data, meta, err = history.RetrieveVersion(key, version)
+		return err
+	})
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	return data, meta, nil
+}
+
+// ListVersions lists the kept versions of the data associated with `name` in
+// the bucket, if the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (b *Bucket) ListVersions(name string) ([]VersionInfo, error) {
+	var versions []VersionInfo
+	err := b.read(b.storage.backing, name, func(backing DataStorage, key string) error {
+		history, err := versionHistory(backing)
+		if err != nil {
+			return err
+		}
+		versions, err = history.ListVersions(key)
+		return err
+	})
+
+	return versions, err
+}
+
+// RestoreVersion restores the data associated with `name` in the bucket to a
+// previous `version`, if the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (b *Bucket) RestoreVersion(name string, version int) (int, error) {
+	var restored int
+	err := b.write(b.storage.backing, name, func(backing DataStorage, key string, _ BucketConfig) error {
+		history, err := versionHistory(backing)
+		if err != nil {
+			return err
+		}
+		restored, err = history.RestoreVersion(key, version)
+		return err
+	})
+
+	return restored, err
+}
+
+// read calls `fn` with `backing` and the key of `name`, if the bucket
+// still exists.
+func (b *Bucket) read(backing DataStorage, name string, fn func(backing DataStorage, key string) error) error {
+	b.storage.rwMu.RLock()
+	defer b.storage.rwMu.RUnlock()
+
+	if _, found := b.storage.buckets[b.name]; !found {
+		return customerrors.DataStorageBucketNotFound{
+			Bucket: b.name,
+		}
+	}
+
+	return b.unkeyError(fn(backing, bucketDataKey(b.name, name)))
+}
+
+// write calls `fn` with `backing` and the key of `name` and the current
+// config, if the bucket still exists and is not read only.
+//
+// The bucket cannot be deleted or reconfigured until `fn` returns.
+func (b *Bucket) write(backing DataStorage, name string, fn func(backing DataStorage, key string, cfg BucketConfig) error) error {
+	b.storage.rwMu.RLock()
+	defer b.storage.rwMu.RUnlock()
+
+	cfg, found := b.storage.buckets[b.name]
+	if !found {
+		return customerrors.DataStorageBucketNotFound{
+			Bucket: b.name,
+		}
+	}
+	if cfg.ReadOnly {
+		return customerrors.DataStorageReadOnly{
+			Bucket: b.name,
+			Name:   name,
+		}
+	}
+
+	return b.unkeyError(fn(backing, bucketDataKey(b.name, name), cfg))
+}
+
+// unkeyError returns `err` of the backing storage naming the name within the
+// bucket, rather than the key it is stored under - which callers never see.
+func (b *Bucket) unkeyError(err error) error {
+	prefix := bucketDataKey(b.name, "")
+	switch e := err.(type) {
+	case customerrors.DataStorageNameNotFound:
+		e.Name = strings.TrimPrefix(e.Name, prefix)
+		return e
+	case customerrors.DataStorageEntryTooLarge:
+		e.Name = strings.TrimPrefix(e.Name, prefix)
+		return e
+	case customerrors.DataStorageVersionNotFound:
+		e.Name = strings.TrimPrefix(e.Name, prefix)
+		return e
+	case customerrors.DataStoragePreconditionFailed:
+		e.Name = strings.TrimPrefix(e.Name, prefix)
+		return e
+	case customerrors.DataStorageQuotaExceeded:
+		e.Name = strings.TrimPrefix(e.Name, prefix)
+		return e
+	default:
+		return err
+	}
+}
+
+// bucketDataKey returns the name `name` in `bucket` is stored under in the
+// backing storage.
+func bucketDataKey(bucket, name string) string {
+	return bucketDataPrefix + bucket + "\x00" + name
+}
+
+// ParseBucketKey parses `key`, a name within the backing storage of a
+// `BucketStorage`, returning the bucket and name it holds the data of -
+// `bucket` is empty for unbucketed names.
+//
+// Returns false if `key` holds the config of a bucket rather than data.
+func ParseBucketKey(key string) (bucket, name string, isData bool) {
+	if !strings.HasPrefix(key, bucketKeyPrefix) {
+		return "", key, true
+	}
+	if !strings.HasPrefix(key, bucketDataPrefix) {
+		return "", "", false
+	}
+
+	bucket, name, _ = strings.Cut(key[len(bucketDataPrefix):], "\x00")
+	return bucket, name, true
+}
+
+// validateBucketName returns a `customerrors.DataStorageBucketInvalid` unless
+// `bucket` is a valid bucket name, see `BucketStorage.CreateBucket`.
+func validateBucketName(bucket string) error {
+	invalid := func(reason string) error {
+		return customerrors.DataStorageBucketInvalid{
+			Bucket: bucket,
+			Reason: reason,
+		}
+	}
+
+	if len(bucket) == 0 || len(bucket) > maxBucketNameLength {
+		return invalid("must be 1 to 63 characters")
+	}
+	for i, c := range bucket {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '-' || c == '_'):
+		default:
+			return invalid("must be lowercase letters, digits, '.', '-' or '_', beginning with a letter or digit")
+		}
+	}
+
+	return nil
+}
+
+// versionHistory returns `storage` as a `VersionHistory`, or a
+// `customerrors.DataStorageUnsupported` if it keeps no history.
+func versionHistory(storage DataStorage) (VersionHistory, error) {
+	history, ok := storage.(VersionHistory)
+	if !ok {
+		return nil, customerrors.DataStorageUnsupported{
+			Operation: "version history",
+		}
+	}
+	return history, nil
+}
+
+// sizeLimitedReader reads from `reader`, failing with
+// `customerrors.DataStorageEntryTooLarge` once more than `limit` bytes of the
+// data of `name` are read.
+type sizeLimitedReader struct {
+	reader io.Reader
+	name   string
+	limit  int64
+	read   int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n, customerrors.DataStorageEntryTooLarge{
+			Name:  r.name,
+			Size:  r.read,
+			Limit: r.limit,
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,432 @@
+package datastorage
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initTestBucket returns a `BucketStorage` in front of `backing`, and its
+// bucket named "test" created with `cfg`.
+func initTestBucket(t *testing.T, backing DataStorage, cfg BucketConfig) (*BucketStorage, DataStorage) {
+	t.Helper()
+
+	bs, err := BucketStorage{}.Initialize(backing)
+	require.NoError(t, err)
+	require.NoError(t, bs.CreateBucket("test", cfg))
+	bucket, err := bs.Bucket("test")
+	require.NoError(t, err)
+
+	return bs, bucket
+}
+
+func TestBucketStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &BucketStorage{}
+	var _ VersionHistory = &BucketStorage{}
+	var _ BucketManager = &BucketStorage{}
+	var _ StreamingStorage = &BucketStorage{}
+	var _ DataStorage = &Bucket{}
+	var _ VersionHistory = &Bucket{}
+	var _ StreamingStorage = &Bucket{}
+}
+
+func TestBucketStorage_Isolation(t *testing.T) {
+	bs, first := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	require.NoError(t, bs.CreateBucket("other", BucketConfig{}))
+	second, err := bs.Bucket("other")
+	require.NoError(t, err)
+
+	dataName := "shared"
+	require.NoError(t, bs.StoreData(dataName, []byte("root")))
+	require.NoError(t, first.StoreData(dataName, []byte("first")))
+	require.NoError(t, second.StoreData(dataName, []byte("second")))
+
+	for storage, expected := range map[DataStorage]string{
+		bs:     "root",
+		first:  "first",
+		second: "second",
+	} {
+		data, err := storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(expected), data)
+
+		names, next, err := storage.ListNames("", "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{dataName}, names)
+		assert.Empty(t, next)
+	}
+
+	require.NoError(t, first.DeleteData(dataName))
+	_, err = first.RetrieveData(dataName)
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	data, err := second.RetrieveData(dataName)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+
+	t.Run("errors name the name in the bucket", func(t *testing.T) {
+		_, err := first.RetrieveData("missing")
+		assert.Equal(t, customerrors.DataStorageNameNotFound{Name: "missing"}, err)
+
+		_, err = first.CompareAndSwap("exists", []byte("test data"), StoreOptions{}, Precondition{})
+		require.NoError(t, err)
+		_, err = first.CompareAndSwap("exists", []byte("test data"), StoreOptions{}, Precondition{MustNotExist: true})
+		var failed customerrors.DataStoragePreconditionFailed
+		require.ErrorAs(t, err, &failed)
+		assert.Equal(t, "exists", failed.Name)
+	})
+}
+
+func TestBucketStorage_ReservedNames(t *testing.T) {
+	bs, _ := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	require.NoError(t, bs.CreateBucket("ro", BucketConfig{ReadOnly: true}))
+	readOnly, err := bs.Bucket("ro")
+	require.NoError(t, err)
+	reserved := &customerrors.DataStorageNameReserved{}
+
+	// Writing the key of data in a read only bucket
+	key := "\x00bucket\x00data\x00ro\x00x"
+	assert.ErrorAs(t, bs.StoreData(key, []byte("test data")), reserved)
+	_, err = bs.CompareAndSwap(key, []byte("test data"), StoreOptions{}, Precondition{})
+	assert.ErrorAs(t, err, reserved)
+	_, err = bs.StoreStream(key, strings.NewReader("test data"), StoreOptions{}, Precondition{})
+	assert.ErrorAs(t, err, reserved)
+	_, err = bs.ApplyBatch([]BatchOp{
+		{Name: "unbucketed", Data: []byte("test data")},
+		{Name: key, Data: []byte("test data")},
+	})
+	assert.ErrorAs(t, err, reserved)
+	_, err = readOnly.RetrieveData("x")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	_, err = bs.RetrieveData("unbucketed")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+	// Reading or deleting the config of a bucket
+	configKey := "\x00bucket\x00config\x00ro"
+	_, err = bs.RetrieveData(configKey)
+	assert.ErrorAs(t, err, reserved)
+	_, err = bs.RetrieveMetadata(configKey)
+	assert.ErrorAs(t, err, reserved)
+	_, _, err = bs.RetrieveStream(configKey)
+	assert.ErrorAs(t, err, reserved)
+	assert.ErrorAs(t, bs.DeleteData(configKey), reserved)
+	assert.ErrorAs(t, bs.CompareAndDelete(configKey, Precondition{}), reserved)
+	buckets, err := bs.ListBuckets()
+	require.NoError(t, err)
+	assert.Len(t, buckets, 2)
+
+	// Names merely containing NUL bytes are fine
+	require.NoError(t, bs.StoreData("a\x00bucket\x00", []byte("test data")))
+}
+
+func TestBucketStorage_Config(t *testing.T) {
+	t.Run("max object size", func(t *testing.T) {
+		_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{MaxObjectSize: 4})
+
+		require.NoError(t, bucket.StoreData("small", []byte("1234")))
+		err := bucket.StoreData("large", []byte("12345"))
+		assert.ErrorAs(t, err, &customerrors.DataStorageEntryTooLarge{})
+		_, err = bucket.RetrieveData("large")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("default ttl", func(t *testing.T) {
+		now := fakeClock(t)
+		_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{DefaultTTL: time.Minute})
+
+		require.NoError(t, bucket.StoreData("default", []byte("test data")))
+		require.NoError(t, bucket.StoreDataWithOptions(
+			"explicit", []byte("test data"), StoreOptions{TTL: time.Hour},
+		))
+		*now = now.Add(2 * time.Minute)
+
+		_, err := bucket.RetrieveData("default")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		_, err = bucket.RetrieveData("explicit")
+		assert.NoError(t, err)
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+		require.NoError(t, bucket.StoreData("kept", []byte("test data")))
+		require.NoError(t, bs.ConfigureBucket("test", BucketConfig{ReadOnly: true}))
+
+		readOnly := &customerrors.DataStorageReadOnly{}
+		assert.ErrorAs(t, bucket.StoreData("new", []byte("test data")), readOnly)
+		assert.ErrorAs(t, bucket.DeleteData("kept"), readOnly)
+		data, err := bucket.RetrieveData("kept")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+
+		// Writable again once reconfigured
+		require.NoError(t, bs.ConfigureBucket("test", BucketConfig{}))
+		assert.NoError(t, bucket.DeleteData("kept"))
+	})
+}
+
+func TestBucketStorage_ManageBuckets(t *testing.T) {
+	bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+
+	t.Run("create", func(t *testing.T) {
+		err := bs.CreateBucket("test", BucketConfig{})
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketExists{})
+
+		for _, name := range []string{"", "Upper", "-leading", "has/slash", string(make([]byte, 64))} {
+			err = bs.CreateBucket(name, BucketConfig{})
+			assert.ErrorAs(t, err, &customerrors.DataStorageBucketInvalid{}, name)
+		}
+		require.NoError(t, bs.CreateBucket("a.b-c_1", BucketConfig{ReadOnly: true}))
+	})
+
+	t.Run("list", func(t *testing.T) {
+		buckets, err := bs.ListBuckets()
+		require.NoError(t, err)
+		assert.Equal(t, []BucketInfo{
+			{Name: "a.b-c_1", Config: BucketConfig{ReadOnly: true}},
+			{Name: "test"},
+		}, buckets)
+	})
+
+	t.Run("configure missing", func(t *testing.T) {
+		err := bs.ConfigureBucket("missing", BucketConfig{})
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+		_, err = bs.Bucket("missing")
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, bucket.StoreData("data", []byte("test data")))
+		err := bs.DeleteBucket("test")
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotEmpty{})
+
+		require.NoError(t, bucket.DeleteData("data"))
+		require.NoError(t, bs.DeleteBucket("test"))
+		err = bs.DeleteBucket("test")
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+
+		// Views of the deleted bucket fail too
+		_, err = bucket.RetrieveData("data")
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+		err = bucket.StoreData("data", []byte("test data"))
+		assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+	})
+}
+
+func TestBucketStorage_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	_, bucket := initTestBucket(t, fs, BucketConfig{MaxObjectSize: 10})
+	require.NoError(t, bucket.StoreData("kept", []byte("test data")))
+
+	// Reinitialized over the same files
+	fs, err = FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	bs, err := BucketStorage{}.Initialize(fs)
+	require.NoError(t, err)
+
+	buckets, err := bs.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []BucketInfo{{Name: "test", Config: BucketConfig{MaxObjectSize: 10}}}, buckets)
+	bucket, err = bs.Bucket("test")
+	require.NoError(t, err)
+	data, err := bucket.RetrieveData("kept")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test data"), data)
+}
+
+func TestBucketStorage_Refresh(t *testing.T) {
+	backing := MemStorage{}.Initialize()
+	bs, err := BucketStorage{}.Initialize(backing)
+	require.NoError(t, err)
+
+	// Bucket configs written beneath the `BucketStorage`, as by replication
+	other, err := BucketStorage{}.Initialize(MemStorage{}.Initialize())
+	require.NoError(t, err)
+	require.NoError(t, other.CreateBucket("test", BucketConfig{ReadOnly: true}))
+	configName := bucketConfigPrefix + "test"
+	config, err := other.backing.RetrieveData(configName)
+	require.NoError(t, err)
+	require.NoError(t, backing.StoreData(configName, config))
+
+	_, err = bs.Bucket("test")
+	assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+	require.NoError(t, bs.Refresh(configName))
+	buckets, err := bs.ListBuckets()
+	require.NoError(t, err)
+	assert.Equal(t, []BucketInfo{{Name: "test", Config: BucketConfig{ReadOnly: true}}}, buckets)
+
+	require.NoError(t, backing.DeleteData(configName))
+	require.NoError(t, bs.Refresh(configName))
+	_, err = bs.Bucket("test")
+	assert.ErrorAs(t, err, &customerrors.DataStorageBucketNotFound{})
+
+	// Other names are not bucket configs
+	assert.NoError(t, bs.Refresh("data"))
+}
+
+func TestBucketStorage_Versions(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+		_, err := bs.ListVersions("test")
+		assert.ErrorAs(t, err, &customerrors.DataStorageUnsupported{})
+		_, err = bucket.(VersionHistory).ListVersions("test")
+		assert.ErrorAs(t, err, &customerrors.DataStorageUnsupported{})
+	})
+
+	t.Run("per bucket", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 5), BucketConfig{})
+		history := bucket.(VersionHistory)
+		dataName := "versioned"
+		require.NoError(t, bucket.StoreData(dataName, []byte("v1")))
+		require.NoError(t, bucket.StoreData(dataName, []byte("v2")))
+		require.NoError(t, bs.StoreData(dataName, []byte("root")))
+
+		versions, err := history.ListVersions(dataName)
+		require.NoError(t, err)
+		assert.Len(t, versions, 2)
+
+		restored, err := history.RestoreVersion(dataName, 1)
+		require.NoError(t, err)
+		assert.Equal(t, 3, restored)
+		data, err := bucket.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v1"), data)
+
+		versions, err = bs.ListVersions(dataName)
+		require.NoError(t, err)
+		assert.Len(t, versions, 1)
+	})
+}
+
+func TestBucketStorage_TTL(t *testing.T) {
+	_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	testStorageTTL(t, bucket)
+}
+
+func TestBucketStorage_ConditionalWrites(t *testing.T) {
+	_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	testStorageConditionalWrites(t, bucket)
+}
+
+func TestBucketStorage_Metadata(t *testing.T) {
+	_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	testStorageMetadata(t, bucket)
+}
+
+func TestBucketStorage_ListNames(t *testing.T) {
+	t.Run("bucket", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+		// Names in the root storage are not listed
+		require.NoError(t, bs.StoreData("list/root", []byte("test data")))
+		testStorageListNames(t, bucket)
+	})
+
+	t.Run("root", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+		// Bucket data and configs are not listed
+		require.NoError(t, bucket.StoreData("list/bucket", []byte("test data")))
+		testStorageListNames(t, bs)
+	})
+}
+
+func TestBucketStorage_Batch(t *testing.T) {
+	bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	testStorageBatch(t, bucket)
+	testStorageBatch(t, bs)
+
+	t.Run("config", func(t *testing.T) {
+		_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{MaxObjectSize: 4})
+		_, err := bucket.ApplyBatch([]BatchOp{
+			{Name: "small", Data: []byte("1234")},
+			{Name: "large", Data: []byte("12345")},
+		})
+		assert.ErrorAs(t, err, &customerrors.DataStorageEntryTooLarge{})
+		_, err = bucket.RetrieveData("small")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		backing := MemStorage{}.Initialize()
+		_, bucket = initTestBucket(t, backing, BucketConfig{ReadOnly: true})
+		_, err = bucket.ApplyBatch([]BatchOp{{Name: "small", Data: []byte("1234")}})
+		assert.ErrorAs(t, err, &customerrors.DataStorageReadOnly{})
+		_, err = backing.RetrieveData(bucketDataKey("test", "small"))
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestBucketStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+	dataName := "test"
+	testData := []byte("test data")
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			switch itr % 5 {
+			case 0:
+				_ = bucket.StoreData(dataName, testData)
+			case 1:
+				_, _ = bucket.RetrieveData(dataName)
+			case 2:
+				_ = bs.ConfigureBucket("test", BucketConfig{ReadOnly: itr%2 == 0})
+			case 3:
+				_, _, _ = bucket.ListNames("", "", 0)
+			default:
+				_ = bucket.DeleteData(dataName)
+			}
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+func TestBucketStorage_Streaming(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	bs, bucket := initTestBucket(t, fs, BucketConfig{})
+	testStorageStreaming(t, bucket)
+	testStorageStreaming(t, bs)
+
+	t.Run("max object size", func(t *testing.T) {
+		_, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{MaxObjectSize: 4})
+		_, err := StoreStream(bucket, "large", strings.NewReader("12345"), StoreOptions{}, Precondition{})
+		assert.ErrorAs(t, err, &customerrors.DataStorageEntryTooLarge{})
+		_, err = bucket.RetrieveData("large")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+	t.Run("unblocked", func(t *testing.T) {
+		bs, bucket := initTestBucket(t, MemStorage{}.Initialize(), BucketConfig{})
+		r, w := io.Pipe()
+		stored := make(chan error, 1)
+		go func() {
+			_, err := StoreStream(bucket, "streamed", r, StoreOptions{}, Precondition{})
+			stored <- err
+		}()
+		_, err := w.Write([]byte("test "))
+		require.NoError(t, err)
+
+		// The bucket may be reconfigured while the stream is read
+		require.NoError(t, bs.ConfigureBucket("test", BucketConfig{MaxObjectSize: 4}))
+		require.NoError(t, bucket.StoreData("other", []byte("data")))
+
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		assert.ErrorAs(t, <-stored, &customerrors.DataStorageEntryTooLarge{})
+		_, err = bucket.RetrieveData("streamed")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
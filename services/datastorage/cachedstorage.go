@@ -0,0 +1,866 @@
+package datastorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// defaultNegativeMaxEntries bounds the names remembered as not found when
+// `CachedStorageConfig.NegativeMaxEntries` is unset.
+const defaultNegativeMaxEntries = 1024
+
+// CacheMode determines when writes to a `CachedStorage` reach its backing
+// `DataStorage`.
+type CacheMode int
+
+const (
+	// CacheWriteThrough writes to the backing storage before acknowledging -
+	// the cache never holds data the backing storage does not.
+	CacheWriteThrough CacheMode = iota
+
+	// CacheWriteBack acknowledges writes once cached, flushing them to the
+	// backing storage every `CachedStorageConfig.FlushInterval` - at most that
+	// window of writes may be lost to a crash.
+	CacheWriteBack
+)
+
+// ParseCacheMode parses a `CacheMode` from its name: "writethrough" or
+// "writeback".
+func ParseCacheMode(mode string) (CacheMode, error) {
+	switch mode {
+	case "writethrough":
+		return CacheWriteThrough, nil
+	case "writeback":
+		return CacheWriteBack, nil
+	default:
+		return 0, fmt.Errorf("unknown cache mode: '%s'", mode)
+	}
+}
+
+// CachedStorageConfig configures a `CachedStorage`.
+type CachedStorageConfig struct {
+	// Mode determines when writes reach the backing storage.
+	Mode CacheMode
+
+	// MaxBytes and MaxEntries bound the cache as per `MemStorageConfig`, at
+	// least one should be set.
+	MaxBytes   int64
+	MaxEntries int
+
+	// Eviction chooses which entries leave the cache once full, defaults to an
+	// `LRUPolicy`.
+	Eviction EvictionPolicy
+
+	// NegativeTTL is how long a name not found in the backing storage is
+	// remembered as such, negative caching is disabled when zero.
+	NegativeTTL time.Duration
+
+	// NegativeMaxEntries bounds the number of names remembered as not found,
+	// defaults to 1024.
+	NegativeMaxEntries int
+
+	// FlushInterval is how often pending writes are flushed in
+	// `CacheWriteBack` mode, defaults to one second.
+	FlushInterval time.Duration
+}
+
+// CachedStorageStats is a point in time summary of a `CachedStorage`.
+type CachedStorageStats struct {
+	// Hits are reads served without the backing storage, including
+	// `NegativeHits` of names remembered as not found.
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	Misses       int64 `json:"misses"`
+
+	// Dirty is the number of writes not yet flushed to the backing storage.
+	Dirty       int   `json:"dirty"`
+	Flushes     int64 `json:"flushes"`
+	FlushErrors int64 `json:"flush_errors"`
+
+	Cache MemStorageStats `json:"cache"`
+}
+
+// cachedWrite is a write not yet flushed to the backing storage.
+type cachedWrite struct {
+	data    []byte
+	meta    Metadata
+	deleted bool
+
+	// seq identifies the write, so a flush does not discard a newer one
+	seq uint64
+}
+
+// CachedStorage is a decorator that implements the `DataStorage` interface by
+// placing a bounded `MemStorage` cache in front of a slower backing
+// `DataStorage`, such as a `FileStorage` or `PostgresStorage`.
+//
+// Reads are served from the cache where possible, otherwise from the backing
+// storage and then cached. Names not found may also be cached for a while,
+// sparing the backing storage repeated lookups of missing data.
+//
+// The backing storage must not be written to other than through the
+// `CachedStorage`, else the cache may serve stale data.
+//
+// It implements `ContextStorage`, passing contexts on to the backing storage
+// if it honours them natively.
+type CachedStorage struct {
+	backing DataStorage
+	cache   *MemStorage
+	cfg     CachedStorageConfig
+
+	// Readers may fill the cache concurrently, writers hold the write lock so
+	// a fill never races a write of the same name
+	rwMu *sync.RWMutex
+
+	// mu guards everything below, which readers update too
+	mu       *sync.Mutex
+	negative map[string]time.Time
+	dirty    map[string]cachedWrite
+	seq      uint64
+	stats    CachedStorageStats
+
+	flushMu   *sync.Mutex
+	done      chan struct{}
+	wg        *sync.WaitGroup
+	closeOnce *sync.Once
+}
+
+// Initialize initializes and returns a pointer to a `CachedStorage` in front
+// of `backing`, configured by `cfg`.
+//
+// The returned `CachedStorage` takes ownership of `backing` - `Close` must be
+// called to flush pending writes, and closes `backing` if it is an
+// `io.Closer`.
+func (cs CachedStorage) Initialize(backing DataStorage, cfg CachedStorageConfig) (*CachedStorage, error) {
+	if cfg.NegativeMaxEntries <= 0 {
+		cfg.NegativeMaxEntries = defaultNegativeMaxEntries
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	cache, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{
+		MaxBytes:   cfg.MaxBytes,
+		MaxEntries: cfg.MaxEntries,
+		Eviction:   cfg.Eviction,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &CachedStorage{
+		backing:   backing,
+		cache:     cache,
+		cfg:       cfg,
+		rwMu:      &sync.RWMutex{},
+		mu:        &sync.Mutex{},
+		negative:  make(map[string]time.Time),
+		dirty:     make(map[string]cachedWrite),
+		flushMu:   &sync.Mutex{},
+		done:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+		closeOnce: &sync.Once{},
+	}
+
+	if cfg.Mode == CacheWriteBack {
+		storage.wg.Add(1)
+		go storage.flushLoop()
+	}
+
+	return storage, nil
+}
+
+// RetrieveData checks the `CachedStorage` for data associated with a given
+// `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := cs.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry checks the cache, then the backing storage, for data and
+// `Metadata` associated with a given `name`.
+//
+// If the `name` is found (and not expired), returns the data (`[]byte`) and
+// metadata, elsewise returns error.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return cs.retrieveEntry(cs.backing, name)
+}
+
+// retrieveEntry behaves as `RetrieveEntry`, reading from `backing`.
+func (cs *CachedStorage) retrieveEntry(backing DataStorage, name string) ([]byte, Metadata, error) {
+	cs.rwMu.RLock()
+	defer cs.rwMu.RUnlock()
+
+	now := timeNow()
+	if data, meta, hit, err := cs.lookup(name, now); hit {
+		return data, meta, err
+	}
+
+	data, meta, err := backing.RetrieveEntry(name)
+	switch err.(type) {
+	case nil:
+		cs.fill(name, data, meta)
+		return data, meta, nil
+	case customerrors.DataStorageNameNotFound:
+		cs.rememberNotFound(name, now)
+		return []byte{}, Metadata{}, err
+	default:
+		return []byte{}, Metadata{}, err
+	}
+}
+
+// RetrieveMetadata checks the `CachedStorage` for the `Metadata` associated
+// with a given `name`.
+//
+// On a cache miss only the metadata is read from the backing storage, and is
+// not itself cached.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return cs.retrieveMetadata(cs.backing, name)
+}
+
+// retrieveMetadata behaves as `RetrieveMetadata`, reading from `backing`.
+func (cs *CachedStorage) retrieveMetadata(backing DataStorage, name string) (Metadata, error) {
+	cs.rwMu.RLock()
+	defer cs.rwMu.RUnlock()
+
+	now := timeNow()
+	notFound := customerrors.DataStorageNameNotFound{
+		Name: name,
+	}
+
+	cs.mu.Lock()
+	if write, found := cs.dirty[name]; found {
+		cs.stats.Hits++
+		cs.mu.Unlock()
+		if write.deleted || write.meta.Expired(now) {
+			return Metadata{}, notFound
+		}
+		return write.meta, nil
+	}
+	if expiresAt, found := cs.negative[name]; found && now.Before(expiresAt) {
+		cs.stats.Hits++
+		cs.stats.NegativeHits++
+		cs.mu.Unlock()
+		return Metadata{}, notFound
+	}
+	cs.mu.Unlock()
+
+	if meta, err := cs.cache.RetrieveMetadata(name); err == nil {
+		cs.mu.Lock()
+		cs.stats.Hits++
+		cs.mu.Unlock()
+		return meta, nil
+	}
+
+	cs.mu.Lock()
+	cs.stats.Misses++
+	cs.mu.Unlock()
+
+	return backing.RetrieveMetadata(name)
+}
+
+// StoreData writes data `[]byte` to the `CachedStorage`, mapping it to the
+// given `name`.
+//
+// If the `name` already exists, it will overwrite the previous data values.
+//
+// Returns an error if writing fails.
+//
+// This method is thread safe.
+func (cs *CachedStorage) StoreData(name string, data []byte) error {
+	return cs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// In `CacheWriteBack` mode the write is acknowledged before reaching the
+// backing storage.
+//
+// This method is thread safe.
+func (cs *CachedStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := cs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// In `CacheWriteBack` mode the revision is assigned by the `CachedStorage`,
+// and kept by the backing storage once the write is flushed.
+//
+// This method is thread safe.
+func (cs *CachedStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return cs.compareAndSwap(cs.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (cs *CachedStorage) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	cs.rwMu.Lock()
+	defer cs.rwMu.Unlock()
+
+	var meta Metadata
+	if cs.cfg.Mode == CacheWriteBack {
+		prev, exists, err := cs.current(backing, name)
+		if err != nil {
+			return Metadata{}, err
+		}
+		if err = cond.Check(name, prev, exists); err != nil {
+			return Metadata{}, err
+		}
+
+		meta = opts.metadata(data, prev, exists, timeNow())
+		meta.Revision = opts.revision(prev.Revision, prev.Revision)
+		cs.markDirty(name, cachedWrite{data: data, meta: meta})
+	} else {
+		var err error
+		if meta, err = backing.CompareAndSwap(name, data, opts, cond); err != nil {
+			// The backing storage may or may not hold the write, so forget it
+			_ = cs.cache.DeleteData(name)
+			return Metadata{}, err
+		}
+	}
+
+	cs.mu.Lock()
+	delete(cs.negative, name)
+	cs.mu.Unlock()
+	cs.fill(name, data, meta)
+
+	return meta, nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// to the backing storage without caching it.
+//
+// In `CacheWriteBack` mode the data must be held until flushed, so is read
+// into memory and written as by `CompareAndSwap`. In `CacheWriteThrough` mode
+// the stream is stored without blocking other operations, the cached entry
+// being invalidated once it has been.
+//
+// This method is thread safe.
+func (cs *CachedStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if cs.cfg.Mode == CacheWriteBack {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return Metadata{}, err
+		}
+		return cs.CompareAndSwap(name, data, opts, cond)
+	}
+
+	meta, err := StoreStream(cs.backing, name, r, opts, cond)
+
+	// Whether or not the write succeeded, reads meanwhile may have cached an
+	// entry which is now stale - and they hold the read lock until cached
+	cs.rwMu.Lock()
+	defer cs.rwMu.Unlock()
+	_ = cs.cache.DeleteData(name)
+	cs.mu.Lock()
+	delete(cs.negative, name)
+	cs.mu.Unlock()
+
+	if err != nil {
+		return Metadata{}, err
+	}
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the data
+// which the caller must close.
+//
+// On a cache miss the data is streamed from the backing storage, and is not
+// itself cached.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	cs.rwMu.RLock()
+	defer cs.rwMu.RUnlock()
+
+	now := timeNow()
+	if data, meta, hit, err := cs.lookup(name, now); hit {
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), meta, nil
+	}
+
+	stream, meta, err := RetrieveStream(cs.backing, name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		cs.rememberNotFound(name, now)
+	}
+	return stream, meta, err
+}
+
+// DeleteData removes data in the `CachedStorage` associated with the given
+// `name`.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (cs *CachedStorage) DeleteData(name string) error {
+	return cs.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) CompareAndDelete(name string, cond Precondition) error {
+	return cs.compareAndDelete(cs.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (cs *CachedStorage) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	cs.rwMu.Lock()
+	defer cs.rwMu.Unlock()
+
+	if cs.cfg.Mode == CacheWriteThrough {
+		_ = cs.cache.DeleteData(name)
+		err := backing.CompareAndDelete(name, cond)
+		if _, notFound := err.(customerrors.DataStorageNameNotFound); err == nil || notFound {
+			cs.rememberNotFound(name, timeNow())
+		}
+		return err
+	}
+
+	// Deletes are flushed later, so must be checked up front
+	prev, exists, err := cs.current(backing, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	if err = cond.Check(name, prev, true); err != nil {
+		return err
+	}
+
+	cs.markDirty(name, cachedWrite{deleted: true})
+	_ = cs.cache.DeleteData(name)
+
+	return nil
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// Batches always write through to the backing storage, which alone can apply
+// them atomically - in `CacheWriteBack` mode pending writes are flushed first,
+// failing the batch if any cannot be. Preconditions are then checked against
+// the revisions assigned by the `CachedStorage`, as for `CompareAndSwap`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return cs.applyBatch(cs.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (cs *CachedStorage) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	cs.rwMu.Lock()
+	defer cs.rwMu.Unlock()
+
+	if cs.cfg.Mode == CacheWriteBack {
+		checked := make([]BatchOp, len(ops))
+		for i, op := range ops {
+			prev, exists, err := cs.current(backing, op.Name)
+			if err != nil {
+				return nil, err
+			}
+			if err = op.check(prev, exists); err != nil {
+				return nil, err
+			}
+			op.Precondition = Precondition{}
+			checked[i] = op
+		}
+		ops = checked
+
+		if err := cs.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	metas, err := backing.ApplyBatch(ops)
+	if err != nil {
+		// The backing storage may or may not hold the writes, so forget them
+		for _, op := range ops {
+			_ = cs.cache.DeleteData(op.Name)
+		}
+		return nil, err
+	}
+
+	now := timeNow()
+	for i, op := range ops {
+		if op.Delete {
+			_ = cs.cache.DeleteData(op.Name)
+			cs.rememberNotFound(op.Name, now)
+			continue
+		}
+		cs.mu.Lock()
+		delete(cs.negative, op.Name)
+		cs.mu.Unlock()
+		cs.fill(op.Name, op.Data, metas[i])
+	}
+
+	return metas, nil
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.RetrieveEntryContext(ctx, name)
+	}
+	return cs.retrieveEntry(backing, name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.RetrieveMetadataContext(ctx, name)
+	}
+	return cs.retrieveMetadata(backing, name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return cs.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return cs.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return cs.listNames(backing, prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (cs *CachedStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, cs.backing)
+	if !ok {
+		return contextAdapter{cs}.ApplyBatchContext(ctx, ops)
+	}
+	return cs.applyBatch(backing, ops)
+}
+
+func (cs *CachedStorage) contextNative() bool {
+	_, ok := nativeContext(cs.backing)
+	return ok
+}
+
+// PurgeExpired removes all expired entries from the backing storage and the
+// cache, returning how many were removed from the backing storage - or, in
+// `CacheWriteBack` mode, expired before they were ever flushed to it.
+//
+// This method is thread safe.
+func (cs *CachedStorage) PurgeExpired() (int, error) {
+	if _, err := cs.cache.PurgeExpired(); err != nil {
+		return 0, err
+	}
+
+	now := timeNow()
+	purged := 0
+	cs.mu.Lock()
+	for name, expiresAt := range cs.negative {
+		if !now.Before(expiresAt) {
+			delete(cs.negative, name)
+		}
+	}
+	for _, write := range cs.dirty {
+		if !write.deleted && write.meta.Expired(now) {
+			purged++
+		}
+	}
+	cs.mu.Unlock()
+
+	if purged > 0 {
+		// Flushing deletes them from the backing storage
+		if err := cs.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	backingPurged, err := cs.backing.PurgeExpired()
+	return purged + backingPurged, err
+}
+
+// ListNames lists the names of entries beginning with `prefix` in the backing
+// storage, see `DataStorage`.
+//
+// In `CacheWriteBack` mode pending writes are flushed first, so are listed.
+//
+// This method is thread safe.
+func (cs *CachedStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return cs.listNames(cs.backing, prefix, cursor, limit)
+}
+
+// listNames behaves as `ListNames`, listing the names of `backing`.
+func (cs *CachedStorage) listNames(backing DataStorage, prefix, cursor string, limit int) ([]string, string, error) {
+	if cs.cfg.Mode == CacheWriteBack {
+		if err := cs.Flush(); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return backing.ListNames(prefix, cursor, limit)
+}
+
+// Flush writes any pending `CacheWriteBack` writes to the backing storage,
+// returning the first error encountered - failed writes are retried by the
+// next flush.
+//
+// This method is thread safe.
+func (cs *CachedStorage) Flush() error {
+	// Flushes must not overlap, else an older write could land last
+	cs.flushMu.Lock()
+	defer cs.flushMu.Unlock()
+
+	cs.mu.Lock()
+	pending := make(map[string]cachedWrite, len(cs.dirty))
+	for name, write := range cs.dirty {
+		pending[name] = write
+	}
+	cs.mu.Unlock()
+
+	var firstErr error
+	for name, write := range pending {
+		err := cs.flushWrite(name, write)
+		cs.mu.Lock()
+		if err != nil {
+			cs.stats.FlushErrors++
+		} else if current := cs.dirty[name]; current.seq == write.seq {
+			// Still the latest write, so now safely in the backing storage
+			delete(cs.dirty, name)
+		}
+		cs.mu.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to flush '%s': %w", name, err)
+		}
+	}
+
+	cs.mu.Lock()
+	cs.stats.Flushes++
+	cs.mu.Unlock()
+
+	return firstErr
+}
+
+// Stats returns the hit/miss counters and current size of the cache.
+//
+// This method is thread safe.
+func (cs *CachedStorage) Stats() CachedStorageStats {
+	cs.mu.Lock()
+	stats := cs.stats
+	stats.Dirty = len(cs.dirty)
+	cs.mu.Unlock()
+
+	stats.Cache = cs.cache.Stats()
+	return stats
+}
+
+// Close stops background flushing, flushes any pending writes, then closes
+// the backing storage if it is an `io.Closer`.
+//
+// Subsequent calls are a no-op.
+func (cs *CachedStorage) Close() error {
+	var err error
+	cs.closeOnce.Do(func() {
+		close(cs.done)
+		cs.wg.Wait()
+
+		err = cs.Flush()
+		if closer, ok := cs.backing.(io.Closer); ok {
+			if cErr := closer.Close(); err == nil {
+				err = cErr
+			}
+		}
+	})
+
+	return err
+}
+
+// current returns the `Metadata` of the current entry of `name`, reporting
+// whether it exists - checking pending writes, the cache, then the backing
+// storage. Callers must hold the write lock.
+func (cs *CachedStorage) current(backing DataStorage, name string) (Metadata, bool, error) {
+	now := timeNow()
+	cs.mu.Lock()
+	write, pending := cs.dirty[name]
+	cs.mu.Unlock()
+	if pending {
+		if write.deleted || write.meta.Expired(now) {
+			return Metadata{}, false, nil
+		}
+		return write.meta, true, nil
+	}
+
+	if _, meta, err := cs.cache.RetrieveEntry(name); err == nil {
+		return meta, true, nil
+	}
+
+	_, meta, err := backing.RetrieveEntry(name)
+	switch err.(type) {
+	case nil:
+		return meta, true, nil
+	case customerrors.DataStorageNameNotFound:
+		return Metadata{}, false, nil
+	default:
+		return Metadata{}, false, err
+	}
+}
+
+// lookup serves `name` from pending writes, names remembered as not found,
+// then the cache - reporting whether it was a hit, and counting it either way.
+// Callers must hold at least a read lock.
+func (cs *CachedStorage) lookup(name string, now time.Time) ([]byte, Metadata, bool, error) {
+	notFound := customerrors.DataStorageNameNotFound{
+		Name: name,
+	}
+
+	cs.mu.Lock()
+	if write, found := cs.dirty[name]; found {
+		cs.stats.Hits++
+		cs.mu.Unlock()
+		if write.deleted || write.meta.Expired(now) {
+			return []byte{}, Metadata{}, true, notFound
+		}
+		return write.data, write.meta, true, nil
+	}
+	if expiresAt, found := cs.negative[name]; found && now.Before(expiresAt) {
+		cs.stats.Hits++
+		cs.stats.NegativeHits++
+		cs.mu.Unlock()
+		return []byte{}, Metadata{}, true, notFound
+	}
+	cs.mu.Unlock()
+
+	if data, meta, err := cs.cache.RetrieveEntry(name); err == nil {
+		cs.mu.Lock()
+		cs.stats.Hits++
+		cs.mu.Unlock()
+		return data, meta, true, nil
+	}
+
+	cs.mu.Lock()
+	cs.stats.Misses++
+	cs.mu.Unlock()
+
+	return nil, Metadata{}, false, nil
+}
+
+// fill caches an entry read from or written to the backing storage.
+func (cs *CachedStorage) fill(name string, data []byte, meta Metadata) {
+	if err := cs.cache.storeEntry(name, data, meta); err != nil {
+		// Too large to cache, make sure no stale value is left behind
+		_ = cs.cache.DeleteData(name)
+	}
+}
+
+// rememberNotFound negatively caches `name` if enabled and there is room.
+func (cs *CachedStorage) rememberNotFound(name string, now time.Time) {
+	if cs.cfg.NegativeTTL <= 0 {
+		return
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.negative) < cs.cfg.NegativeMaxEntries {
+		cs.negative[name] = now.Add(cs.cfg.NegativeTTL)
+	}
+}
+
+// markDirty records a write to be flushed to the backing storage.
+func (cs *CachedStorage) markDirty(name string, write cachedWrite) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.seq++
+	write.seq = cs.seq
+	cs.dirty[name] = write
+}
+
+// flushWrite applies a single pending write to the backing storage.
+func (cs *CachedStorage) flushWrite(name string, write cachedWrite) error {
+	if write.deleted || write.meta.Expired(timeNow()) {
+		err := cs.backing.DeleteData(name)
+		if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+			return nil
+		}
+		return err
+	}
+
+	// Keep the revision, so ETags given out before the flush still match
+	return cs.backing.StoreDataWithOptions(name, write.data, StoreOptions{
+		TTL:         write.meta.TTL(timeNow()),
+		ContentType: write.meta.ContentType,
+		Revision:    write.meta.Revision,
+		CreatedAt:   write.meta.CreatedAt,
+		UpdatedAt:   write.meta.UpdatedAt,
+	})
+}
+
+// flushLoop periodically flushes pending writes until `Close` is called.
+func (cs *CachedStorage) flushLoop() {
+	defer cs.wg.Done()
+
+	ticker := time.NewTicker(cs.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.done:
+			return
+		case <-ticker.C:
+			if err := cs.Flush(); err != nil {
+				log.Printf("CachedStorage - flush failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package datastorage
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage is a backing `DataStorage` which counts its reads.
+type countingStorage struct {
+	*MemStorage
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countingStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+
+	return s.MemStorage.RetrieveEntry(name)
+}
+
+func (s *countingStorage) readCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reads
+}
+
+func initTestCachedStorage(t *testing.T, cfg CachedStorageConfig) (*CachedStorage, *countingStorage) {
+	t.Helper()
+
+	backing := &countingStorage{MemStorage: MemStorage{}.Initialize()}
+	cs, err := CachedStorage{}.Initialize(backing, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { cs.Close() })
+
+	return cs, backing
+}
+
+func TestCachedStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &CachedStorage{}
+	var _ StreamingStorage = &CachedStorage{}
+}
+
+func TestParseCacheMode(t *testing.T) {
+	for name, expected := range map[string]CacheMode{
+		"writethrough": CacheWriteThrough,
+		"writeback":    CacheWriteBack,
+	} {
+		mode, err := ParseCacheMode(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+
+	_, err := ParseCacheMode("writearound")
+	assert.Error(t, err)
+}
+
+func TestCachedStorage_ReadThrough(t *testing.T) {
+	cs, backing := initTestCachedStorage(t, CachedStorageConfig{MaxEntries: 1})
+	require.NoError(t, backing.StoreData("first", []byte("1")))
+	require.NoError(t, backing.StoreData("second", []byte("2")))
+
+	t.Run("miss then hit", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			data, err := cs.RetrieveData("first")
+			require.NoError(t, err)
+			assert.Equal(t, []byte("1"), data)
+		}
+		assert.Equal(t, 1, backing.readCount())
+
+		stats := cs.Stats()
+		assert.Equal(t, int64(2), stats.Hits)
+		assert.Equal(t, int64(1), stats.Misses)
+		assert.Equal(t, 1, stats.Cache.Entries)
+	})
+
+	t.Run("evicted entries are reread", func(t *testing.T) {
+		_, err := cs.RetrieveData("second")
+		require.NoError(t, err)
+		_, err = cs.RetrieveData("first")
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, backing.readCount())
+		assert.Equal(t, int64(2), cs.Stats().Cache.Evictions)
+	})
+}
+
+func TestCachedStorage_WriteThrough(t *testing.T) {
+	cs, backing := initTestCachedStorage(t, CachedStorageConfig{MaxEntries: 10})
+	dataName := "test"
+
+	t.Run("store", func(t *testing.T) {
+		require.NoError(t, cs.StoreData(dataName, []byte("test data")))
+
+		data, err := backing.MemStorage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+
+		data, err = cs.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		assert.Zero(t, backing.readCount())
+		assert.Zero(t, cs.Stats().Dirty)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, cs.DeleteData(dataName))
+
+		_, err := backing.MemStorage.RetrieveData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		_, err = cs.RetrieveData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		err = cs.DeleteData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("too large to cache", func(t *testing.T) {
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{MaxBytes: 8})
+		require.NoError(t, cs.StoreData(dataName, []byte("small")))
+		require.NoError(t, cs.StoreData(dataName, []byte("much too large")))
+
+		data, err := cs.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("much too large"), data)
+		assert.Equal(t, 1, backing.readCount())
+	})
+}
+
+func TestCachedStorage_WriteBack(t *testing.T) {
+	cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+		Mode:          CacheWriteBack,
+		MaxEntries:    1,
+		FlushInterval: time.Hour,
+	})
+	require.NoError(t, backing.StoreData("deleted", []byte("gone")))
+
+	require.NoError(t, cs.StoreData("first", []byte("1")))
+	require.NoError(t, cs.StoreData("second", []byte("2")))
+	require.NoError(t, cs.DeleteData("deleted"))
+	assert.Equal(t, 3, cs.Stats().Dirty)
+
+	t.Run("pending writes are served", func(t *testing.T) {
+		// "first" has been evicted from the cache, but is still pending
+		data, err := cs.RetrieveData("first")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("1"), data)
+
+		_, err = cs.RetrieveData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		err = cs.DeleteData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		// Nothing has reached the backing storage yet
+		_, err = backing.MemStorage.RetrieveData("first")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		_, err = backing.MemStorage.RetrieveData("deleted")
+		require.NoError(t, err)
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		pending, err := cs.RetrieveMetadata("first")
+		require.NoError(t, err)
+
+		require.NoError(t, cs.Flush())
+		assert.Zero(t, cs.Stats().Dirty)
+
+		// Flushed as written, so ETags given out before still match
+		flushed, err := backing.MemStorage.RetrieveMetadata("first")
+		require.NoError(t, err)
+		assert.Equal(t, pending.Revision, flushed.Revision)
+		assert.True(t, pending.CreatedAt.Equal(flushed.CreatedAt))
+		assert.True(t, pending.UpdatedAt.Equal(flushed.UpdatedAt))
+
+		for name, expected := range map[string][]byte{"first": []byte("1"), "second": []byte("2")} {
+			data, err := backing.MemStorage.RetrieveData(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, data)
+		}
+		_, err = backing.MemStorage.RetrieveData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("delete checks backing storage", func(t *testing.T) {
+		err := cs.DeleteData("nonexistent")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Zero(t, cs.Stats().Dirty)
+	})
+
+	t.Run("close flushes", func(t *testing.T) {
+		require.NoError(t, cs.StoreData("closed", []byte("flushed")))
+		require.NoError(t, cs.Close())
+
+		data, err := backing.MemStorage.RetrieveData("closed")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("flushed"), data)
+	})
+
+	t.Run("periodic", func(t *testing.T) {
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          CacheWriteBack,
+			MaxEntries:    10,
+			FlushInterval: 5 * time.Millisecond,
+		})
+		require.NoError(t, cs.StoreData("test", []byte("test data")))
+
+		assert.Eventually(t, func() bool {
+			_, err := backing.MemStorage.RetrieveData("test")
+			return err == nil
+		}, time.Second, 5*time.Millisecond)
+	})
+}
+
+func TestCachedStorage_NegativeCaching(t *testing.T) {
+	cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+		MaxEntries:         10,
+		NegativeTTL:        time.Hour,
+		NegativeMaxEntries: 1,
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := cs.RetrieveData("missing")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	}
+	assert.Equal(t, 1, backing.readCount())
+	assert.Equal(t, int64(2), cs.Stats().NegativeHits)
+
+	t.Run("bounded", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			_, err := cs.RetrieveData("also missing")
+			assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		}
+		assert.Equal(t, 3, backing.readCount())
+	})
+
+	t.Run("cleared by store", func(t *testing.T) {
+		require.NoError(t, cs.StoreData("missing", []byte("found")))
+
+		data, err := cs.RetrieveData("missing")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("found"), data)
+	})
+}
+
+func TestCachedStorage_TTL(t *testing.T) {
+	cs, _ := initTestCachedStorage(t, CachedStorageConfig{MaxEntries: 10})
+	testStorageTTL(t, cs)
+
+	t.Run("write back purges pending writes", func(t *testing.T) {
+		now := fakeClock(t)
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          CacheWriteBack,
+			MaxEntries:    10,
+			FlushInterval: time.Hour,
+		})
+		require.NoError(t, cs.StoreDataWithOptions(
+			"expiring", []byte("test data"), StoreOptions{TTL: time.Minute},
+		))
+		*now = now.Add(time.Hour)
+
+		purged, err := cs.PurgeExpired()
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+		assert.Zero(t, cs.Stats().Dirty)
+		_, err = backing.RetrieveData("expiring")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		purged, err = cs.PurgeExpired()
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+	})
+}
+
+func TestCachedStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+
+		cs, _ := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    1,
+			NegativeTTL:   time.Millisecond,
+			FlushInterval: time.Millisecond,
+		})
+		dataName := "test"
+		testData := []byte("test data")
+
+		for i := 0; i < 69; i++ {
+			wg.Add(1)
+
+			go func(itr int) {
+				defer wg.Done()
+				<-start
+				if itr%3 == 0 {
+					_ = cs.StoreData(dataName, testData)
+				} else if itr%3 == 1 {
+					_, _ = cs.RetrieveData(dataName)
+				} else {
+					_ = cs.DeleteData(dataName)
+				}
+			}(i)
+		}
+
+		close(start) // Start after all workers created
+		wg.Wait()    // Wait for workers to complete
+	}
+}
+
+func TestCachedStorage_ConditionalWrites(t *testing.T) {
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		cs, _ := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    10,
+			NegativeTTL:   time.Hour,
+			FlushInterval: time.Hour,
+		})
+		testStorageConditionalWrites(t, cs)
+	}
+}
+
+func TestCachedStorage_Metadata(t *testing.T) {
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		cs, _ := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    10,
+			FlushInterval: time.Hour,
+		})
+		testStorageMetadata(t, cs)
+	}
+
+	t.Run("miss reads backing metadata", func(t *testing.T) {
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{MaxEntries: 10})
+		require.NoError(t, backing.StoreDataWithOptions(
+			"uncached", []byte("test data"), StoreOptions{ContentType: "text/plain"},
+		))
+
+		meta, err := cs.RetrieveMetadata("uncached")
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", meta.ContentType)
+		assert.Equal(t, 9, meta.Size)
+	})
+
+	t.Run("write back flushes metadata", func(t *testing.T) {
+		now := fakeClock(t)
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          CacheWriteBack,
+			MaxEntries:    10,
+			FlushInterval: time.Hour,
+		})
+		require.NoError(t, cs.StoreDataWithOptions(
+			"pending", []byte("test data"), StoreOptions{ContentType: "text/plain", TTL: time.Hour},
+		))
+		require.NoError(t, cs.Flush())
+
+		meta, err := backing.MemStorage.RetrieveMetadata("pending")
+		require.NoError(t, err)
+		assert.Equal(t, "text/plain", meta.ContentType)
+		assert.Equal(t, 9, meta.Size)
+		assert.True(t, now.Add(time.Hour).Equal(meta.ExpiresAt))
+	})
+}
+
+func TestCachedStorage_ListNames(t *testing.T) {
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		cs, _ := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    10,
+			FlushInterval: time.Hour,
+		})
+		testStorageListNames(t, cs)
+	}
+}
+
+func TestCachedStorage_Batch(t *testing.T) {
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		cs, backing := initTestCachedStorage(t, CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    10,
+			NegativeTTL:   time.Hour,
+			FlushInterval: time.Hour,
+		})
+		testStorageBatch(t, cs)
+
+		// Pending writes are flushed ahead of the batch
+		require.NoError(t, cs.StoreData("pending", []byte("test data")))
+		_, err := cs.ApplyBatch([]BatchOp{{Name: "pending", Data: []byte("batched")}})
+		require.NoError(t, err)
+		assert.Zero(t, cs.Stats().Dirty)
+		data, err := backing.RetrieveData("pending")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("batched"), data)
+	}
+}
+
+func TestCachedStorage_Streaming(t *testing.T) {
+	for _, mode := range []CacheMode{CacheWriteThrough, CacheWriteBack} {
+		cs, err := CachedStorage{}.Initialize(MemStorage{}.Initialize(), CachedStorageConfig{
+			Mode:          mode,
+			MaxEntries:    10,
+			FlushInterval: time.Hour,
+		})
+		require.NoError(t, err)
+		testStorageStreaming(t, cs)
+		require.NoError(t, cs.Close())
+	}
+
+	t.Run("streams the backing storage", func(t *testing.T) {
+		fs, err := FileStorage{}.Initialize(t.TempDir())
+		require.NoError(t, err)
+		cs, err := CachedStorage{}.Initialize(fs, CachedStorageConfig{MaxEntries: 10})
+		require.NoError(t, err)
+		defer cs.Close()
+		testStorageStreaming(t, cs)
+	})
+}
+
+func TestCachedStorage_StreamingUnblocked(t *testing.T) {
+	cs, _ := initTestCachedStorage(t, CachedStorageConfig{MaxEntries: 10})
+	require.NoError(t, cs.StoreData("streamed", []byte("old data")))
+	_, err := cs.RetrieveData("streamed")
+	require.NoError(t, err)
+
+	// Other operations proceed while the stream is being stored
+	r, w := io.Pipe()
+	stored := make(chan error, 1)
+	go func() {
+		_, err := cs.StoreStream("streamed", r, StoreOptions{}, Precondition{})
+		stored <- err
+	}()
+	_, err = w.Write([]byte("new "))
+	require.NoError(t, err)
+	require.NoError(t, cs.StoreData("other", []byte("test data")))
+	data, err := cs.RetrieveData("streamed")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old data"), data)
+
+	_, err = w.Write([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, <-stored)
+
+	// The entry cached meanwhile is not served
+	data, err = cs.RetrieveData("streamed")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new data"), data)
+}
@@ -0,0 +1,628 @@
+package datastorage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// defaultChangeFeedCapacity is the number of changes a `ChangeFeed` keeps when
+// not given a capacity.
+const defaultChangeFeedCapacity = 1 << 16
+
+// ChangeOp is the kind of a `Change`.
+type ChangeOp string
+
+const (
+	// ChangeStore is the write of an entry.
+	ChangeStore ChangeOp = "store"
+
+	// ChangeDelete is the deletion of an entry.
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is a single write or deletion recorded by a `ChangeFeed`.
+type Change struct {
+	// Seq numbers the changes of a `ChangeFeed` from 1, increasing by 1 on
+	// every change - afresh on every start unless journaled, see
+	// `ChangeFeed.Epoch`.
+	Seq uint64 `json:"seq"`
+
+	Op   ChangeOp `json:"op"`
+	Name string   `json:"name"`
+
+	// Revision is the revision written by a store.
+	Revision uint64 `json:"revision,omitempty"`
+
+	// Time is when the change was recorded.
+	Time time.Time `json:"time"`
+}
+
+// ChangeFeed is a decorator that implements the `DataStorage` interface by
+// recording every successful write and deletion made through it, in order,
+// to its backing `DataStorage` - so the changes made since some point can be
+// followed, such as to replicate them.
+//
+// Only the most recent changes are kept. Changes record which name changed
+// rather than the data written: a follower reads the current entry of a
+// changed name, and so may see a later write than the change records -
+// applying every change in order converges on the current state regardless.
+// Expiry is not a change, as entries expire by their `Metadata` alone.
+//
+// Changes are kept in memory only unless journaled (see `ChangeFeedConfig`),
+// so are numbered afresh whenever a `ChangeFeed` is initialized - followers
+// must check the `Epoch` they resume from is still the current one. A journaled
+// feed resumes its epoch, and the changes it kept, on every start: a write
+// interrupted by a crash is recorded as a change of its names once started
+// again, whether or not it was applied.
+//
+// It implements `ContextStorage`, passing contexts on to the backing storage
+// if it honours them natively.
+type ChangeFeed struct {
+	backing DataStorage
+	epoch   uint64
+
+	mu *sync.Mutex
+	// changes is a ring of the last `count` changes, the oldest at `start`
+	changes []Change
+	start   int
+	count   int
+	seq     uint64
+	// updated is closed, and replaced, on the next change
+	updated chan struct{}
+	// journal is nil unless journaled
+	journal *changeJournal
+}
+
+// ChangeFeedConfig configures a `ChangeFeed`.
+type ChangeFeedConfig struct {
+	// Capacity is the number of changes kept, defaults to 65536.
+	Capacity int
+
+	// JournalDir, if set, is the directory the changes are journaled to, so
+	// they are kept across restarts. The backing storage must be durable too,
+	// else its entries are lost while the changes of them are kept.
+	JournalDir string
+
+	// SyncJournal fsyncs the journal before every write, so no change is lost
+	// to a crash of the machine rather than only of the process.
+	SyncJournal bool
+}
+
+// Initialize initializes and returns a pointer to a `ChangeFeed` in front of
+// `backing`, keeping the last `capacity` changes - or 65536 if `capacity` is
+// not positive.
+//
+// The returned `ChangeFeed` takes ownership of `backing` - `Close` closes
+// `backing` if it is an `io.Closer`.
+func (cf ChangeFeed) Initialize(backing DataStorage, capacity int) *ChangeFeed {
+	if capacity <= 0 {
+		capacity = defaultChangeFeedCapacity
+	}
+
+	return &ChangeFeed{
+		backing: backing,
+		epoch:   uint64(time.Now().UnixNano()),
+		mu:      &sync.Mutex{},
+		changes: make([]Change, capacity),
+		updated: make(chan struct{}),
+	}
+}
+
+// InitializeWithConfig initializes and returns a pointer to a `ChangeFeed` in
+// front of `backing` configured by `cfg`.
+//
+// If journaled, the epoch and changes of the journal are resumed, recording a
+// change of every name of the writes interrupted by a crash - as read from
+// `backing`.
+func (cf ChangeFeed) InitializeWithConfig(backing DataStorage, cfg ChangeFeedConfig) (*ChangeFeed, error) {
+	feed := ChangeFeed{}.Initialize(backing, cfg.Capacity)
+	if len(cfg.JournalDir) == 0 {
+		return feed, nil
+	}
+
+	journal, state, err := openChangeJournal(cfg.JournalDir, cfg.SyncJournal)
+	if err != nil {
+		return nil, err
+	}
+	if state.epoch != 0 {
+		feed.epoch, feed.seq = state.epoch, state.seq
+		feed.keep(state.changes...)
+	}
+
+	// The interrupted writes may or may not have been applied, so their
+	// names changed regardless
+	ids := make([]uint64, 0, len(state.pending))
+	for id := range state.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	var interrupted []Change
+	for _, id := range ids {
+		for _, name := range state.pending[id] {
+			change := Change{Op: ChangeDelete, Name: name}
+			meta, err := backing.RetrieveMetadata(name)
+			if err == nil {
+				change = Change{Op: ChangeStore, Name: name, Revision: meta.Revision}
+			} else if _, notFound := err.(customerrors.DataStorageNameNotFound); !notFound {
+				journal.close()
+				return nil, fmt.Errorf("failed to recover the change of '%s': %w", name, err)
+			}
+			interrupted = append(interrupted, change)
+		}
+	}
+	feed.number(interrupted)
+	feed.keep(interrupted...)
+
+	if err = journal.rewrite(feed.epoch, feed.seq, feed.kept()); err != nil {
+		journal.close()
+		return nil, err
+	}
+	feed.journal = journal
+	return feed, nil
+}
+
+// RetrieveData retrieves the data associated with a given `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveData(name string) ([]byte, error) {
+	return cf.backing.RetrieveData(name)
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with a given
+// `name`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return cf.backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with a given `name`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveMetadata(name string) (Metadata, error) {
+	return cf.backing.RetrieveMetadata(name)
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the data -
+// streamed if the backing storage streams.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	return RetrieveStream(cf.backing, name)
+}
+
+// StoreData stores data `[]byte` with an associated `name`, recording the
+// change.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) StoreData(name string, data []byte) error {
+	return cf.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := cf.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return cf.compareAndSwap(cf.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (cf *ChangeFeed) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	id, err := cf.begin(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta, err := backing.CompareAndSwap(name, data, opts, cond)
+	if err != nil {
+		cf.abort(id)
+		return Metadata{}, err
+	}
+	cf.record(id, Change{Op: ChangeStore, Name: name, Revision: meta.Revision})
+	return meta, nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, storing the data read from `r` -
+// streamed if the backing storage streams.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	id, err := cf.begin(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta, err := StoreStream(cf.backing, name, r, opts, cond)
+	if err != nil {
+		cf.abort(id)
+		return Metadata{}, err
+	}
+	cf.record(id, Change{Op: ChangeStore, Name: name, Revision: meta.Revision})
+	return meta, nil
+}
+
+// DeleteData deletes data associated with a given `name`, recording the
+// change.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) DeleteData(name string) error {
+	return cf.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) CompareAndDelete(name string, cond Precondition) error {
+	return cf.compareAndDelete(cf.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (cf *ChangeFeed) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	id, err := cf.begin(name)
+	if err != nil {
+		return err
+	}
+	if err = backing.CompareAndDelete(name, cond); err != nil {
+		cf.abort(id)
+		return err
+	}
+	cf.record(id, Change{Op: ChangeDelete, Name: name})
+	return nil
+}
+
+// ApplyBatch atomically applies every operation of `ops`, or none of them, as
+// per `DataStorage` - recording a change for each.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return cf.applyBatch(cf.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (cf *ChangeFeed) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Name
+	}
+	id, err := cf.begin(names...)
+	if err != nil {
+		return nil, err
+	}
+	metas, err := backing.ApplyBatch(ops)
+	if err != nil {
+		cf.abort(id)
+		return nil, err
+	}
+
+	changes := make([]Change, len(ops))
+	for i, op := range ops {
+		changes[i] = Change{Op: ChangeStore, Name: op.Name, Revision: metas[i].Revision}
+		if op.Delete {
+			changes[i] = Change{Op: ChangeDelete, Name: op.Name}
+		}
+	}
+	cf.record(id, changes...)
+
+	return metas, nil
+}
+
+// PurgeExpired permanently removes all expired entries from the backing
+// storage, returning how many were removed. Expired entries are not changes.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) PurgeExpired() (int, error) {
+	return cf.backing.PurgeExpired()
+}
+
+// ListNames lists the names of entries beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return cf.backing.ListNames(prefix, cursor, limit)
+}
+
+// RetrieveVersion retrieves a previous `version` of the data of `name`, if
+// the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveVersion(name string, version int) ([]byte, Metadata, error) {
+	history, err := versionHistory(cf.backing)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return history.RetrieveVersion(name, version)
+}
+
+// ListVersions lists the kept versions of the data of `name`, if the backing
+// storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) ListVersions(name string) ([]VersionInfo, error) {
+	history, err := versionHistory(cf.backing)
+	if err != nil {
+		return nil, err
+	}
+	return history.ListVersions(name)
+}
+
+// RestoreVersion restores the data of `name` to a previous `version`, if the
+// backing storage implements `VersionHistory`, recording the change.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RestoreVersion(name string, version int) (int, error) {
+	history, err := versionHistory(cf.backing)
+	if err != nil {
+		return 0, err
+	}
+	id, err := cf.begin(name)
+	if err != nil {
+		return 0, err
+	}
+	restored, err := history.RestoreVersion(name, version)
+	if err != nil {
+		cf.abort(id)
+		return 0, err
+	}
+	cf.record(id, Change{Op: ChangeStore, Name: name})
+	return restored, nil
+}
+
+// Epoch identifies this run of the feed, as the time it was initialized in
+// nanoseconds - a `Seq` of another epoch numbers other changes entirely. A
+// journaled feed keeps its epoch across restarts, see `ChangeFeedConfig`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) Epoch() uint64 {
+	return cf.epoch
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.RetrieveEntryContext(ctx, name)
+	}
+	return backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.RetrieveMetadataContext(ctx, name)
+	}
+	return backing.RetrieveMetadata(name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return cf.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return cf.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return backing.ListNames(prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, cf.backing)
+	if !ok {
+		return contextAdapter{cf}.ApplyBatchContext(ctx, ops)
+	}
+	return cf.applyBatch(backing, ops)
+}
+
+func (cf *ChangeFeed) contextNative() bool {
+	_, ok := nativeContext(cf.backing)
+	return ok
+}
+
+// Seq returns the `Seq` of the latest change, zero before any.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) Seq() uint64 {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	return cf.seq
+}
+
+// Changes returns up to `limit` of the changes after `since`, oldest first -
+// or all of them if `limit` is not positive. Returns no changes if there are
+// none yet, see `Wait`.
+//
+// Returns `customerrors.DataStorageChangesTruncated` if changes after `since`
+// are no longer kept.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) Changes(since uint64, limit int) ([]Change, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	oldest := cf.seq - uint64(cf.count) + 1
+	if since+1 < oldest {
+		return nil, customerrors.DataStorageChangesTruncated{
+			Since:  since,
+			Oldest: oldest,
+		}
+	}
+	if since >= cf.seq {
+		return []Change{}, nil
+	}
+
+	n := int(cf.seq - since)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	changes := make([]Change, n)
+	first := cf.start + int(since+1-oldest)
+	for i := range changes {
+		changes[i] = cf.changes[(first+i)%len(cf.changes)]
+	}
+	return changes, nil
+}
+
+// Wait returns a channel closed once there are changes after `since`, which
+// is already closed if there are.
+//
+// This method is thread safe.
+func (cf *ChangeFeed) Wait(since uint64) <-chan struct{} {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if cf.seq > since {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return cf.updated
+}
+
+// Close closes the journal, if any, and the backing storage if it is an
+// `io.Closer`.
+func (cf *ChangeFeed) Close() error {
+	if cf.journal != nil {
+		cf.mu.Lock()
+		err := cf.journal.close()
+		cf.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if closer, ok := cf.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// begin journals the intent of a write changing `names`, if journaled,
+// returning the ID to `record` or `abort` it with.
+func (cf *ChangeFeed) begin(names ...string) (uint64, error) {
+	if cf.journal == nil {
+		return 0, nil
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	return cf.journal.begin(names)
+}
+
+// abort journals that the write of `id` failed, if journaled.
+func (cf *ChangeFeed) abort(id uint64) {
+	if cf.journal == nil {
+		return
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if err := cf.journal.end(id, nil); err != nil {
+		log.Printf("ChangeFeed - failed to journal the end of a failed write: %v", err)
+	}
+}
+
+// record appends `changes` made by the write of `id`, numbering them, and
+// wakes any waiters.
+//
+// Should journaling them fail, they are recorded regardless - the intent of
+// the write remaining journaled, so they are recovered once started again.
+func (cf *ChangeFeed) record(id uint64, changes ...Change) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	cf.number(changes)
+	cf.keep(changes...)
+	if cf.journal != nil {
+		err := cf.journal.end(id, changes)
+		if err == nil && cf.journal.records > len(cf.changes) {
+			err = cf.journal.rewrite(cf.epoch, cf.seq, cf.kept())
+		}
+		if err != nil {
+			log.Printf("ChangeFeed - failed to journal changes: %v", err)
+		}
+	}
+
+	close(cf.updated)
+	cf.updated = make(chan struct{})
+}
+
+// number numbers `changes` as the next changes, made now - callers must hold
+// the lock.
+func (cf *ChangeFeed) number(changes []Change) {
+	now := timeNow()
+	for i := range changes {
+		cf.seq++
+		changes[i].Seq = cf.seq
+		changes[i].Time = now
+	}
+}
+
+// keep appends the numbered `changes` to those kept, dropping the oldest -
+// callers must hold the lock.
+func (cf *ChangeFeed) keep(changes ...Change) {
+	for _, change := range changes {
+		if cf.count < len(cf.changes) {
+			cf.changes[(cf.start+cf.count)%len(cf.changes)] = change
+			cf.count++
+		} else {
+			cf.changes[cf.start] = change
+			cf.start = (cf.start + 1) % len(cf.changes)
+		}
+	}
+}
+
+// kept returns the changes kept, oldest first - callers must hold the lock.
+func (cf *ChangeFeed) kept() []Change {
+	changes := make([]Change, cf.count)
+	for i := range changes {
+		changes[i] = cf.changes[(cf.start+i)%len(cf.changes)]
+	}
+	return changes
+}
@@ -0,0 +1,278 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeFeed_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &ChangeFeed{}
+	var _ StreamingStorage = &ChangeFeed{}
+	var _ VersionHistory = &ChangeFeed{}
+}
+
+func TestChangeFeed_Changes(t *testing.T) {
+	feed := ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0)
+	assert.Zero(t, feed.Seq())
+	changes, err := feed.Changes(0, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	require.NoError(t, feed.StoreData("a", []byte("test data a")))
+	require.NoError(t, feed.StoreData("b", []byte("test data b")))
+	require.NoError(t, feed.DeleteData("a"))
+	_, err = feed.ApplyBatch([]BatchOp{
+		{Name: "c", Data: []byte("test data c")},
+		{Name: "b", Delete: true},
+	})
+	require.NoError(t, err)
+
+	// Failed writes are not changes
+	_, err = feed.CompareAndSwap("c", []byte("test data"), StoreOptions{}, Precondition{MustNotExist: true})
+	assert.Error(t, err)
+	assert.Error(t, feed.DeleteData("a"))
+	// Neither is expiry
+	_, err = feed.PurgeExpired()
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(5), feed.Seq())
+	changes, err = feed.Changes(0, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 5)
+	for i, want := range []struct {
+		op   ChangeOp
+		name string
+	}{
+		{ChangeStore, "a"},
+		{ChangeStore, "b"},
+		{ChangeDelete, "a"},
+		{ChangeStore, "c"},
+		{ChangeDelete, "b"},
+	} {
+		assert.Equal(t, uint64(i+1), changes[i].Seq)
+		assert.Equal(t, want.op, changes[i].Op)
+		assert.Equal(t, want.name, changes[i].Name)
+	}
+	assert.NotZero(t, changes[0].Revision)
+	assert.Zero(t, changes[2].Revision)
+
+	changes, err = feed.Changes(2, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, uint64(3), changes[0].Seq)
+	assert.Equal(t, uint64(4), changes[1].Seq)
+
+	changes, err = feed.Changes(5, 0)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+
+	// A restarted feed numbers its changes afresh, in another epoch
+	restarted := ChangeFeed{}.Initialize(feed.backing, 0)
+	assert.Zero(t, restarted.Seq())
+	assert.NotZero(t, feed.Epoch())
+	assert.NotEqual(t, feed.Epoch(), restarted.Epoch())
+}
+
+func TestChangeFeed_Truncated(t *testing.T) {
+	feed := ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 3)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, feed.StoreData(name, []byte("test data")))
+	}
+
+	_, err := feed.Changes(1, 0)
+	assert.Equal(t, customerrors.DataStorageChangesTruncated{Since: 1, Oldest: 3}, err)
+
+	changes, err := feed.Changes(2, 0)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	for i, name := range []string{"c", "d", "e"} {
+		assert.Equal(t, uint64(i+3), changes[i].Seq)
+		assert.Equal(t, name, changes[i].Name)
+	}
+}
+
+// initTestJournaledFeed initializes a `ChangeFeed` in front of `backing`
+// journaled to `dir`, closing it once the test is done.
+func initTestJournaledFeed(t *testing.T, backing DataStorage, dir string) *ChangeFeed {
+	t.Helper()
+	feed, err := ChangeFeed{}.InitializeWithConfig(backing, ChangeFeedConfig{
+		Capacity:   3,
+		JournalDir: dir,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { feed.Close() })
+	return feed
+}
+
+func TestChangeFeed_Journal(t *testing.T) {
+	dir := t.TempDir()
+	backing := MemStorage{}.Initialize()
+	feed := initTestJournaledFeed(t, backing, dir)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, feed.StoreData(name, []byte("test data")))
+	}
+	require.NoError(t, feed.DeleteData("a"))
+	// Failed writes are not changes, nor interrupted
+	_, err := feed.CompareAndSwap("b", []byte("test data"), StoreOptions{}, Precondition{MustNotExist: true})
+	assert.Error(t, err)
+	require.NoError(t, feed.Close())
+
+	t.Run("resumed", func(t *testing.T) {
+		restarted := initTestJournaledFeed(t, backing, dir)
+		assert.Equal(t, feed.Epoch(), restarted.Epoch())
+		assert.Equal(t, uint64(5), restarted.Seq())
+
+		_, err := restarted.Changes(1, 0)
+		assert.Equal(t, customerrors.DataStorageChangesTruncated{Since: 1, Oldest: 3}, err)
+		changes, err := restarted.Changes(2, 0)
+		require.NoError(t, err)
+		want, err := feed.Changes(2, 0)
+		require.NoError(t, err)
+		require.Len(t, changes, 3)
+		for i := range want {
+			assert.Equal(t, want[i].Seq, changes[i].Seq)
+			assert.Equal(t, want[i].Op, changes[i].Op)
+			assert.Equal(t, want[i].Name, changes[i].Name)
+			assert.Equal(t, want[i].Revision, changes[i].Revision)
+		}
+
+		require.NoError(t, restarted.StoreData("e", []byte("test data")))
+		assert.Equal(t, uint64(6), restarted.Seq())
+		require.NoError(t, restarted.Close())
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		// As if crashed writing "b" and "x", then mid-record
+		journal, err := os.OpenFile(filepath.Join(dir, changeJournalFile), os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = journal.WriteString(`{"id":1000,"names":["b","x"]}` + "\n" + `{"id":1000,"do`)
+		require.NoError(t, err)
+		require.NoError(t, journal.Close())
+
+		restarted := initTestJournaledFeed(t, backing, dir)
+		assert.Equal(t, feed.Epoch(), restarted.Epoch())
+		changes, err := restarted.Changes(6, 0)
+		require.NoError(t, err)
+		require.Len(t, changes, 2)
+		meta, err := backing.RetrieveMetadata("b")
+		require.NoError(t, err)
+		assert.Equal(t, Change{Seq: 7, Op: ChangeStore, Name: "b", Revision: meta.Revision, Time: changes[0].Time}, changes[0])
+		assert.Equal(t, Change{Seq: 8, Op: ChangeDelete, Name: "x", Time: changes[1].Time}, changes[1])
+		require.NoError(t, restarted.Close())
+
+		// Recovered once only
+		restarted = initTestJournaledFeed(t, backing, dir)
+		assert.Equal(t, uint64(8), restarted.Seq())
+		require.NoError(t, restarted.Close())
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		corrupt := t.TempDir()
+		require.NoError(t, os.WriteFile(
+			filepath.Join(corrupt, changeJournalFile),
+			[]byte(`{"epoch":1}`+"\n"+`not a record`+"\n"+`{"done":true}`+"\n"),
+			0o644,
+		))
+		_, err := ChangeFeed{}.InitializeWithConfig(backing, ChangeFeedConfig{JournalDir: corrupt})
+		assert.Error(t, err)
+	})
+}
+
+func TestChangeFeed_Wait(t *testing.T) {
+	feed := ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0)
+
+	wait := feed.Wait(0)
+	select {
+	case <-wait:
+		t.Fatal("wait returned before any change")
+	default:
+	}
+
+	require.NoError(t, feed.StoreData("a", []byte("test data")))
+	select {
+	case <-wait:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after a change")
+	}
+
+	// Already changed since
+	select {
+	case <-feed.Wait(0):
+	default:
+		t.Fatal("wait did not return for past changes")
+	}
+}
+
+func TestChangeFeed_RestoreVersion(t *testing.T) {
+	feed := ChangeFeed{}.Initialize(VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 5), 0)
+	require.NoError(t, feed.StoreData("a", []byte("first")))
+	require.NoError(t, feed.StoreData("a", []byte("second")))
+
+	_, err := feed.RestoreVersion("a", 1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), feed.Seq())
+	data, err := feed.RetrieveData("a")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), data)
+
+	unversioned := ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0)
+	_, err = unversioned.ListVersions("a")
+	assert.IsType(t, customerrors.DataStorageUnsupported{}, err)
+}
+
+func TestChangeFeed_ThreadSafe(t *testing.T) {
+	feed := ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 16)
+
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			switch itr % 4 {
+			case 0:
+				_ = feed.StoreData("a", []byte("test data"))
+			case 1:
+				_ = feed.DeleteData("a")
+			case 2:
+				_, _ = feed.Changes(feed.Seq()/2, 0)
+			case 3:
+				<-feed.Wait(0)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestChangeFeed_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
+
+func TestChangeFeed_Metadata(t *testing.T) {
+	testStorageMetadata(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
+
+func TestChangeFeed_ListNames(t *testing.T) {
+	testStorageListNames(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
+
+func TestChangeFeed_Batch(t *testing.T) {
+	testStorageBatch(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
+
+func TestChangeFeed_TTL(t *testing.T) {
+	testStorageTTL(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
+
+func TestChangeFeed_Streaming(t *testing.T) {
+	testStorageStreaming(t, ChangeFeed{}.Initialize(MemStorage{}.Initialize(), 0))
+}
@@ -0,0 +1,251 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// changeJournalFile is the name of the journal within
+// `ChangeFeedConfig.JournalDir`.
+const changeJournalFile = "changes.log"
+
+// changeRecord is a single line of a `changeJournal`, one of:
+//
+// - a header, with the `Epoch` of the feed and its `Seq` when the journal was
+// last rewritten
+//
+// - an intent, with the `ID` of a write about to change `Names`
+//
+// - the end of the write of `ID` (zero if none), with the `Changes` it made -
+// none if it failed
+type changeRecord struct {
+	Epoch   uint64   `json:"epoch,omitempty"`
+	Seq     uint64   `json:"seq,omitempty"`
+	ID      uint64   `json:"id,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Done    bool     `json:"done,omitempty"`
+	Changes []Change `json:"changes,omitempty"`
+}
+
+// changeJournal persists the changes of a `ChangeFeed` as JSON lines, so they
+// are kept across restarts.
+//
+// Every write is journaled as an intent before it is made, and its changes
+// once it is: an intent without an end is of a write interrupted by a crash,
+// which may or may not have been applied - see `openChangeJournal`. The
+// journal is rewritten with only the changes kept by the feed whenever it
+// holds more records than that.
+//
+// A `changeJournal` is not thread safe, its feed guards it.
+type changeJournal struct {
+	path string
+	sync bool
+	file *os.File
+	size int64
+	// records is the number of records appended since the last rewrite
+	records int
+	// broken is why the journal can no longer be appended to, if it cannot
+	broken error
+
+	lastID uint64
+	// pending are the names of the writes begun but not yet ended, by ID
+	pending map[uint64][]string
+}
+
+// changeJournalState is the state of a `ChangeFeed` read from its journal.
+type changeJournalState struct {
+	epoch, seq uint64
+	changes    []Change
+
+	// pending are the names of the writes interrupted, by ID
+	pending map[uint64][]string
+}
+
+// openChangeJournal opens (or creates) the journal in `dir`, returning it
+// along with the state it holds - a zero epoch if it holds none.
+//
+// A torn last record, as left by a crash, is discarded. Fails on any other
+// record which cannot be read, as the changes it held would be missed.
+func openChangeJournal(dir string, sync bool) (*changeJournal, changeJournalState, error) {
+	state := changeJournalState{pending: map[uint64][]string{}}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, state, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, changeJournalFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, state, err
+	}
+
+	var (
+		offset int64
+		lastID uint64
+		reader = bufio.NewReader(file)
+	)
+	for {
+		line, rErr := reader.ReadBytes('\n')
+		if errors.Is(rErr, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("ChangeFeed - discarding torn journal record at offset %d", offset)
+			}
+			break
+		}
+		if rErr != nil {
+			file.Close()
+			return nil, state, rErr
+		}
+
+		var rec changeRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			file.Close()
+			return nil, state, fmt.Errorf("corrupt change journal record at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+
+		switch {
+		case rec.Epoch != 0:
+			state.epoch, state.seq = rec.Epoch, rec.Seq
+		case rec.Done:
+			delete(state.pending, rec.ID)
+			state.changes = append(state.changes, rec.Changes...)
+		default:
+			state.pending[rec.ID] = rec.Names
+		}
+		if rec.ID > lastID {
+			lastID = rec.ID
+		}
+	}
+	if n := len(state.changes); n > 0 && state.changes[n-1].Seq > state.seq {
+		state.seq = state.changes[n-1].Seq
+	}
+
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, state, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, state, err
+	}
+
+	return &changeJournal{
+		path:    file.Name(),
+		sync:    sync,
+		file:    file,
+		size:    offset,
+		lastID:  lastID,
+		pending: map[uint64][]string{},
+	}, state, nil
+}
+
+// begin journals the intent of a write changing `names`, returning its ID.
+func (j *changeJournal) begin(names []string) (uint64, error) {
+	j.lastID++
+	id := j.lastID
+	if err := j.append(changeRecord{ID: id, Names: names}); err != nil {
+		return 0, fmt.Errorf("failed to journal change: %w", err)
+	}
+	j.pending[id] = names
+	return id, nil
+}
+
+// end journals the `changes` made by the write of `id`, none if it failed.
+func (j *changeJournal) end(id uint64, changes []Change) error {
+	delete(j.pending, id)
+	return j.append(changeRecord{ID: id, Done: true, Changes: changes})
+}
+
+// append writes `rec` to the end of the journal, syncing if configured to.
+func (j *changeJournal) append(rec changeRecord) error {
+	if j.broken != nil {
+		return j.broken
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err = j.file.Write(line); err != nil {
+		// Drop whatever part of the record made it to disk
+		if tErr := j.file.Truncate(j.size); tErr == nil {
+			_, _ = j.file.Seek(j.size, io.SeekStart)
+		}
+		return err
+	}
+	j.size += int64(len(line))
+	j.records++
+
+	if j.sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// rewrite atomically replaces the journal with a header of `epoch` and
+// `seq`, the `changes` and the intents of the writes yet to end.
+func (j *changeJournal) rewrite(epoch, seq uint64, changes []Change) error {
+	var buf bytes.Buffer
+	recs := []changeRecord{{Epoch: epoch, Seq: seq}}
+	if len(changes) > 0 {
+		recs = append(recs, changeRecord{Done: true, Changes: changes})
+	}
+	ids := make([]uint64, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	for _, id := range ids {
+		recs = append(recs, changeRecord{ID: id, Names: j.pending[id]})
+	}
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	err := atomicWriteFile(j.path, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The journal has been replaced, so appending to the old file would lose
+	// the records
+	file, err := os.OpenFile(j.path, os.O_RDWR, 0o644)
+	if err == nil {
+		if _, err = file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		j.broken = fmt.Errorf("failed to reopen change journal: %w", err)
+		return j.broken
+	}
+
+	j.file.Close()
+	j.file = file
+	j.size = int64(buf.Len())
+	j.records = 0
+	return nil
+}
+
+// close syncs and closes the journal.
+func (j *changeJournal) close() error {
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,87 @@
+package datastorage
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// gearTable maps every byte to a random value for the rolling hash of a
+// `chunker`.
+//
+// The table is generated from a fixed seed - were it to change, chunk
+// boundaries would move and stored data would no longer deduplicate against
+// new writes.
+var gearTable = func() [256]uint64 {
+	var (
+		table [256]uint64
+		state uint64
+	)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content defined chunks, cutting wherever a
+// gear rolling hash of the last 64 bytes has its top bits clear (as FastCDC).
+//
+// As boundaries depend only on nearby content, inserting or removing bytes
+// changes only the chunks around the edit - where fixed size chunks would all
+// shift.
+type chunker struct {
+	reader   *bufio.Reader
+	min, max int
+	mask     uint64
+}
+
+// newChunker returns a `chunker` of `r`, whose chunks are `minSize` to
+// `maxSize` bytes long and average around `avgSize`.
+func newChunker(r io.Reader, minSize, avgSize, maxSize int) *chunker {
+	// A cut is expected once every 2^n bytes past the minimum
+	var mask uint64
+	if avgSize > minSize {
+		n := bits.Len(uint(avgSize-minSize)) - 1
+		mask = (1<<n - 1) << (64 - n)
+	}
+
+	return &chunker{
+		reader: bufio.NewReaderSize(r, maxSize),
+		min:    minSize,
+		max:    maxSize,
+		mask:   mask,
+	}
+}
+
+// next returns the next chunk, or `io.EOF` once there are no more.
+func (c *chunker) next() ([]byte, error) {
+	var (
+		chunk = make([]byte, 0, c.min)
+		hash  uint64
+	)
+	for len(chunk) < c.max {
+		b, err := c.reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+		hash = hash<<1 + gearTable[b]
+		if len(chunk) >= c.min && hash&c.mask == 0 {
+			return chunk, nil
+		}
+	}
+
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
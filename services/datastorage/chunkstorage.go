@@ -0,0 +1,847 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// chunkKeyPrefix begins the names a `ChunkStorage` keeps chunks under within
+// the backing storage, followed by the hex encoded SHA-256 hash of the chunk -
+// names beginning with it are refused.
+const chunkKeyPrefix = reservedNamePrefix + "chunk\x00"
+
+// Default chunk sizes of a `ChunkStorage`, see `ChunkStorageConfig`.
+const (
+	defaultMinChunkSize = 16 << 10
+	defaultAvgChunkSize = 64 << 10
+	defaultMaxChunkSize = 256 << 10
+)
+
+// ChunkStorageConfig configures a `ChunkStorage`.
+type ChunkStorageConfig struct {
+	// MinChunkSize and MaxChunkSize bound the length of chunks, whose lengths
+	// average around AvgChunkSize - defaulting to 16KiB, 64KiB and 256KiB.
+	//
+	// Changing any of these moves chunk boundaries, so data written before
+	// no longer deduplicates against data written after.
+	MinChunkSize int
+	AvgChunkSize int
+	MaxChunkSize int
+}
+
+// ChunkStorageStats is a point in time summary of a `ChunkStorage`.
+type ChunkStorageStats struct {
+	// Chunks is the number of distinct chunks stored.
+	Chunks int `json:"chunks"`
+
+	// StoredBytes is the size of all distinct chunks, and ReferencedBytes the
+	// size of all data made of them - their ratio is the saving made by
+	// deduplication.
+	StoredBytes     int64 `json:"stored_bytes"`
+	ReferencedBytes int64 `json:"referenced_bytes"`
+}
+
+// chunkManifest represents the entry of a name as the chunks of its data in
+// order, stored as JSON under the name itself.
+type chunkManifest struct {
+	Meta   Metadata        `json:"meta"`
+	Chunks []manifestChunk `json:"chunks"`
+
+	// plain is the data of an entry stored as is rather than as a manifest,
+	// such as before chunking was enabled - nil for a manifest
+	plain []byte
+}
+
+// manifestChunk is a single chunk of a `chunkManifest`.
+type manifestChunk struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// chunkRef counts the references to a stored chunk.
+type chunkRef struct {
+	refs int
+	size int
+
+	// stored is closed once the chunk is stored, or failed to be, by the
+	// write which first referenced it - nil once it has been
+	stored chan struct{}
+	failed bool
+}
+
+// ChunkStorage is a decorator that implements the `DataStorage` interface by
+// splitting data into content defined chunks, each stored once in its backing
+// `DataStorage` however many entries share it - near identical data, such as
+// successive builds of an artifact, costs little more than one copy.
+//
+// Chunks are stored under their SHA-256 hash, beneath names prefixed with an
+// unprintable `chunkKeyPrefix` which callers may not use, and each name is
+// stored as a manifest of its chunks. Chunks are counted by the manifests and
+// readers referencing them, and deleted once unreferenced.
+//
+// The backing storage must not be written to other than through the
+// `ChunkStorage`, and expiry is kept in the manifests rather than by the
+// backing storage. Entries of the backing storage which are not manifests,
+// such as those written before chunking was enabled, are served as they are
+// until overwritten.
+type ChunkStorage struct {
+	backing DataStorage
+	cfg     ChunkStorageConfig
+
+	// mu guards everything below, and serializes writes of manifests so the
+	// references they hold are counted exactly
+	mu       *sync.Mutex
+	chunks   map[string]*chunkRef
+	expiring map[string]time.Time
+}
+
+// Initialize initializes and returns a pointer to a `ChunkStorage` in front of
+// `backing`, configured by `cfg`.
+//
+// References to chunks are counted from the manifests in `backing`, and any
+// chunks left unreferenced (e.g. by a crash mid-write) are deleted. Other
+// entries of `backing` are kept as plain values.
+//
+// The returned `ChunkStorage` takes ownership of `backing` - `Close` closes
+// `backing` if it is an `io.Closer`.
+func (cs ChunkStorage) Initialize(backing DataStorage, cfg ChunkStorageConfig) (*ChunkStorage, error) {
+	if cfg.MinChunkSize <= 0 {
+		cfg.MinChunkSize = defaultMinChunkSize
+	}
+	if cfg.AvgChunkSize <= 0 {
+		cfg.AvgChunkSize = defaultAvgChunkSize
+	}
+	if cfg.MaxChunkSize <= 0 {
+		cfg.MaxChunkSize = defaultMaxChunkSize
+	}
+	if cfg.MinChunkSize > cfg.AvgChunkSize || cfg.AvgChunkSize > cfg.MaxChunkSize {
+		return nil, fmt.Errorf(
+			"chunk sizes must be ordered min <= avg <= max, got %d, %d, %d",
+			cfg.MinChunkSize, cfg.AvgChunkSize, cfg.MaxChunkSize,
+		)
+	}
+
+	storage := &ChunkStorage{
+		backing:  backing,
+		cfg:      cfg,
+		mu:       &sync.Mutex{},
+		chunks:   map[string]*chunkRef{},
+		expiring: map[string]time.Time{},
+	}
+	if err := storage.countReferences(); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// RetrieveData retrieves the data associated with a given `name`, reassembled
+// from its chunks.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := cs.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with a given
+// `name`.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	if err := checkName(name, chunkKeyPrefix); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	manifest, err := cs.pin(name)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	defer cs.unpin(manifest.Chunks)
+	if manifest.plain != nil {
+		return manifest.plain, manifest.Meta, nil
+	}
+
+	data := make([]byte, 0, manifest.Meta.Size)
+	for _, chunk := range manifest.Chunks {
+		chunkData, err := cs.readChunk(chunk.Hash)
+		if err != nil {
+			return []byte{}, Metadata{}, err
+		}
+		data = append(data, chunkData...)
+	}
+
+	return data, manifest.Meta, nil
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with a given `name`,
+// from its manifest alone.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) RetrieveMetadata(name string) (Metadata, error) {
+	if err := checkName(name, chunkKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	manifest, present, err := cs.readManifest(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !present || manifest.Meta.Expired(timeNow()) {
+		return Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	return manifest.Meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the data
+// which reads a chunk at a time.
+//
+// The chunks are referenced until the reader is closed, so it yields the data
+// as of the call even if `name` is written meanwhile.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	if err := checkName(name, chunkKeyPrefix); err != nil {
+		return nil, Metadata{}, err
+	}
+	manifest, err := cs.pin(name)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if manifest.plain != nil {
+		return io.NopCloser(bytes.NewReader(manifest.plain)), manifest.Meta, nil
+	}
+	return &chunkReader{
+		storage: cs,
+		chunks:  manifest.Chunks,
+	}, manifest.Meta, nil
+}
+
+// StoreData stores data `[]byte` with an associated `name`, storing only the
+// chunks not already stored.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) StoreData(name string, data []byte) error {
+	return cs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := cs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return cs.StoreStream(name, bytes.NewReader(data), opts, cond)
+}
+
+// StoreStream behaves as `CompareAndSwap`, chunking the data read from `r` as
+// it is streamed - only a chunk at a time is held in memory.
+//
+// Chunks are stored as they are read, then the manifest only once `r` is
+// exhausted and if `cond` holds.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := checkName(name, chunkKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	// Fail early rather than after chunking, `cond` is checked again below
+	if err := cs.checkCurrent(name, cond); err != nil {
+		return Metadata{}, err
+	}
+
+	chunks, size, checksum, err := cs.putChunks(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	prev, present, err := cs.readManifest(name)
+	if err != nil {
+		cs.release(chunks)
+		return Metadata{}, err
+	}
+	now := timeNow()
+	exists := present && !prev.Meta.Expired(now)
+	if err = cond.Check(name, prev.Meta, exists); err != nil {
+		cs.release(chunks)
+		return Metadata{}, err
+	}
+
+	manifest := chunkManifest{
+		Meta:   opts.streamMetadata(size, checksum, prev.Meta, exists, now),
+		Chunks: chunks,
+	}
+	manifest.Meta.Revision = opts.revision(prev.Meta.Revision, prev.Meta.Revision)
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		cs.release(chunks)
+		return Metadata{}, err
+	}
+	if err = cs.backing.StoreData(name, encoded); err != nil {
+		cs.release(chunks)
+		return Metadata{}, err
+	}
+
+	if present {
+		cs.release(prev.Chunks)
+	}
+	cs.setExpiry(name, manifest.Meta)
+
+	return manifest.Meta, nil
+}
+
+// DeleteData deletes the manifest associated with a given `name`, and any of
+// its chunks no longer referenced.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) DeleteData(name string) error {
+	return cs.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) CompareAndDelete(name string, cond Precondition) error {
+	if err := checkName(name, chunkKeyPrefix); err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	manifest, present, err := cs.readManifest(name)
+	if err != nil {
+		return err
+	}
+	if !present || manifest.Meta.Expired(timeNow()) {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	if err = cond.Check(name, manifest.Meta, true); err != nil {
+		return err
+	}
+
+	if err = cs.backing.DeleteData(name); err != nil {
+		return err
+	}
+	cs.release(manifest.Chunks)
+	delete(cs.expiring, name)
+
+	return nil
+}
+
+// ApplyBatch atomically applies every operation of `ops`, or none of them, as
+// per `DataStorage` - the chunks of stored data are stored first, then the
+// manifests as a batch of the backing storage.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+	if err := checkBatchNames(ops, chunkKeyPrefix); err != nil {
+		return nil, err
+	}
+
+	type stagedOp struct {
+		chunks   []manifestChunk
+		size     int64
+		checksum string
+	}
+	staged := make([]stagedOp, len(ops))
+	stagedChunks := func() []manifestChunk {
+		var chunks []manifestChunk
+		for _, s := range staged {
+			chunks = append(chunks, s.chunks...)
+		}
+		return chunks
+	}
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		chunks, size, checksum, err := cs.putChunks(bytes.NewReader(op.Data))
+		if err != nil {
+			cs.unpin(stagedChunks())
+			return nil, err
+		}
+		staged[i] = stagedOp{chunks: chunks, size: size, checksum: checksum}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var (
+		now        = timeNow()
+		prevs      = make([]chunkManifest, len(ops))
+		present    = make([]bool, len(ops))
+		metas      = make([]Metadata, len(ops))
+		backingOps = make([]BatchOp, len(ops))
+	)
+	for i, op := range ops {
+		var err error
+		if prevs[i], present[i], err = cs.readManifest(op.Name); err != nil {
+			cs.release(stagedChunks())
+			return nil, err
+		}
+		exists := present[i] && !prevs[i].Meta.Expired(now)
+		if err = op.check(prevs[i].Meta, exists); err != nil {
+			cs.release(stagedChunks())
+			return nil, err
+		}
+
+		if op.Delete {
+			backingOps[i] = BatchOp{Name: op.Name, Delete: true}
+			continue
+		}
+		manifest := chunkManifest{
+			Meta:   op.Options.streamMetadata(staged[i].size, staged[i].checksum, prevs[i].Meta, exists, now),
+			Chunks: staged[i].chunks,
+		}
+		manifest.Meta.Revision = op.Options.revision(prevs[i].Meta.Revision, prevs[i].Meta.Revision)
+		encoded, err := json.Marshal(manifest)
+		if err != nil {
+			cs.release(stagedChunks())
+			return nil, err
+		}
+		metas[i] = manifest.Meta
+		backingOps[i] = BatchOp{Name: op.Name, Data: encoded}
+	}
+
+	if _, err := cs.backing.ApplyBatch(backingOps); err != nil {
+		cs.release(stagedChunks())
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if present[i] {
+			cs.release(prevs[i].Chunks)
+		}
+		if op.Delete {
+			delete(cs.expiring, op.Name)
+		} else {
+			cs.setExpiry(op.Name, metas[i])
+		}
+	}
+
+	return metas, nil
+}
+
+// PurgeExpired permanently removes all expired entries, and any of their
+// chunks no longer referenced, returning how many entries were removed.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) PurgeExpired() (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := timeNow()
+	purged := 0
+	for name, expiresAt := range cs.expiring {
+		if now.Before(expiresAt) {
+			continue
+		}
+
+		manifest, present, err := cs.readManifest(name)
+		if err != nil {
+			return purged, err
+		}
+		if present {
+			if err = cs.backing.DeleteData(name); err != nil {
+				return purged, err
+			}
+			cs.release(manifest.Chunks)
+			purged++
+		}
+		delete(cs.expiring, name)
+	}
+
+	// Plain values expire by the backing storage
+	plain, err := cs.backing.PurgeExpired()
+	return purged + plain, err
+}
+
+// ListNames lists the names of entries beginning with `prefix`, see
+// `DataStorage` - the chunks kept in the backing storage are not listed.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return listNamesWhere(cs.backing, func(name string) bool {
+		if strings.HasPrefix(name, chunkKeyPrefix) {
+			return false
+		}
+
+		cs.mu.Lock()
+		expiresAt, expiring := cs.expiring[name]
+		cs.mu.Unlock()
+		return !expiring || timeNow().Before(expiresAt)
+	}, prefix, cursor, limit)
+}
+
+// Stats returns the number and size of stored chunks, and of the data
+// referencing them.
+//
+// This method is thread safe.
+func (cs *ChunkStorage) Stats() ChunkStorageStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	stats := ChunkStorageStats{
+		Chunks: len(cs.chunks),
+	}
+	for _, ref := range cs.chunks {
+		stats.StoredBytes += int64(ref.size)
+		stats.ReferencedBytes += int64(ref.refs) * int64(ref.size)
+	}
+	return stats
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (cs *ChunkStorage) Close() error {
+	if closer, ok := cs.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// countReferences counts the references of every manifest in the backing
+// storage to its chunks, and deletes the chunks left unreferenced.
+func (cs *ChunkStorage) countReferences() error {
+	var (
+		stored []string
+		cursor string
+	)
+	for {
+		names, next, err := cs.backing.ListNames("", cursor, listBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, chunkKeyPrefix) {
+				stored = append(stored, strings.TrimPrefix(name, chunkKeyPrefix))
+				continue
+			}
+
+			manifest, present, err := cs.readManifest(name)
+			if err != nil {
+				return err
+			}
+			if !present {
+				continue
+			}
+			for _, chunk := range manifest.Chunks {
+				cs.reference(chunk)
+			}
+			cs.setExpiry(name, manifest.Meta)
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	orphaned := 0
+	for _, hash := range stored {
+		if _, ok := cs.chunks[hash]; ok {
+			continue
+		}
+		if err := cs.backing.DeleteData(chunkKey(hash)); err != nil {
+			return err
+		}
+		orphaned++
+	}
+	if orphaned > 0 {
+		log.Printf("ChunkStorage - deleted %d unreferenced chunks", orphaned)
+	}
+
+	return nil
+}
+
+// readManifest reads the manifest of `name`, reporting whether it is present
+// - even if expired. An entry which is not a manifest is read as a plain
+// value, see `chunkManifest`.
+func (cs *ChunkStorage) readManifest(name string) (chunkManifest, bool, error) {
+	encoded, meta, err := cs.backing.RetrieveEntry(name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		return chunkManifest{}, false, nil
+	}
+	if err != nil {
+		return chunkManifest{}, false, err
+	}
+
+	manifest, ok := decodeManifest(encoded)
+	if !ok {
+		return chunkManifest{Meta: meta, plain: encoded}, true, nil
+	}
+	return manifest, true, nil
+}
+
+// decodeManifest decodes the manifest `encoded`, reporting false if it is not
+// one - having any other field, or a chunk not named by a SHA-256 hash.
+func decodeManifest(encoded []byte) (chunkManifest, bool) {
+	var manifest chunkManifest
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&manifest); err != nil || decoder.More() || manifest.Meta.Revision == 0 {
+		return chunkManifest{}, false
+	}
+	for _, chunk := range manifest.Chunks {
+		if hash, err := hex.DecodeString(chunk.Hash); err != nil || len(hash) != sha256.Size {
+			return chunkManifest{}, false
+		}
+	}
+	return manifest, true
+}
+
+// checkCurrent checks `cond` against the current entry of `name`.
+func (cs *ChunkStorage) checkCurrent(name string, cond Precondition) error {
+	manifest, present, err := cs.readManifest(name)
+	if err != nil {
+		return err
+	}
+	return cond.Check(name, manifest.Meta, present && !manifest.Meta.Expired(timeNow()))
+}
+
+// putChunks splits the data read from `r` into chunks, storing each not
+// already stored and referencing all of them.
+//
+// Returns the chunks in order, and the size and hex encoded SHA-256 checksum
+// of the whole data. If reading or storing fails, no chunks are referenced.
+func (cs *ChunkStorage) putChunks(r io.Reader) ([]manifestChunk, int64, string, error) {
+	var (
+		chunks  []manifestChunk
+		size    int64
+		hash    = sha256.New()
+		chunker = newChunker(
+			io.TeeReader(r, hash), cs.cfg.MinChunkSize, cs.cfg.AvgChunkSize, cs.cfg.MaxChunkSize,
+		)
+	)
+	for {
+		data, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		var chunk manifestChunk
+		if err == nil {
+			chunk, err = cs.putChunk(data)
+		}
+		if err != nil {
+			cs.unpin(chunks)
+			return nil, 0, "", err
+		}
+
+		chunks = append(chunks, chunk)
+		size += int64(len(data))
+	}
+
+	return chunks, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// putChunk references the chunk of `data`, storing it first if it is not
+// already stored - without holding the lock, so chunks are stored
+// concurrently. A chunk being stored by another write is waited on.
+func (cs *ChunkStorage) putChunk(data []byte) (manifestChunk, error) {
+	checksum := sha256.Sum256(data)
+	chunk := manifestChunk{
+		Hash: hex.EncodeToString(checksum[:]),
+		Size: len(data),
+	}
+
+	for {
+		cs.mu.Lock()
+		ref, ok := cs.chunks[chunk.Hash]
+		if !ok {
+			ref = &chunkRef{refs: 1, size: chunk.Size, stored: make(chan struct{})}
+			cs.chunks[chunk.Hash] = ref
+			cs.mu.Unlock()
+			return chunk, cs.storeChunk(chunk, ref, data)
+		}
+		ref.refs++
+		stored := ref.stored
+		cs.mu.Unlock()
+
+		if stored == nil {
+			return chunk, nil
+		}
+		<-stored
+		cs.mu.Lock()
+		failed := ref.failed
+		cs.mu.Unlock()
+		if !failed {
+			return chunk, nil
+		}
+		// Stored again, its reference gone with the failed write
+	}
+}
+
+// storeChunk stores the `data` of `chunk`, newly referenced by `ref` -
+// forgetting `ref` should it fail, so writes waiting on it store it again.
+func (cs *ChunkStorage) storeChunk(chunk manifestChunk, ref *chunkRef, data []byte) error {
+	err := cs.backing.StoreData(chunkKey(chunk.Hash), data)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	close(ref.stored)
+	ref.stored = nil
+	if err != nil {
+		ref.failed = true
+		if cs.chunks[chunk.Hash] == ref {
+			delete(cs.chunks, chunk.Hash)
+		}
+	}
+	return err
+}
+
+// readChunk reads the stored chunk of `hash`, verifying its content.
+func (cs *ChunkStorage) readChunk(hash string) ([]byte, error) {
+	data, err := cs.backing.RetrieveData(chunkKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %w", hash, err)
+	}
+	if checksum := sha256.Sum256(data); hex.EncodeToString(checksum[:]) != hash {
+		return nil, fmt.Errorf("chunk %s is corrupt", hash)
+	}
+	return data, nil
+}
+
+// pin reads the current manifest of `name`, referencing its chunks so they
+// outlive any overwrite until unpinned.
+func (cs *ChunkStorage) pin(name string) (chunkManifest, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	manifest, present, err := cs.readManifest(name)
+	if err != nil {
+		return chunkManifest{}, err
+	}
+	if !present || manifest.Meta.Expired(timeNow()) {
+		return chunkManifest{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	for _, chunk := range manifest.Chunks {
+		cs.reference(chunk)
+	}
+
+	return manifest, nil
+}
+
+// unpin releases references taken by `pin` or `putChunks`.
+func (cs *ChunkStorage) unpin(chunks []manifestChunk) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.release(chunks)
+}
+
+// reference counts a reference to `chunk` - callers must hold the lock.
+func (cs *ChunkStorage) reference(chunk manifestChunk) {
+	if ref, ok := cs.chunks[chunk.Hash]; ok {
+		ref.refs++
+		return
+	}
+	cs.chunks[chunk.Hash] = &chunkRef{refs: 1, size: chunk.Size}
+}
+
+// release releases a reference to each of `chunks`, deleting those no longer
+// referenced - callers must hold the lock.
+//
+// A chunk which fails to delete is left for `Initialize` to delete.
+func (cs *ChunkStorage) release(chunks []manifestChunk) {
+	for _, chunk := range chunks {
+		ref, ok := cs.chunks[chunk.Hash]
+		if !ok {
+			continue
+		}
+		if ref.refs--; ref.refs > 0 {
+			continue
+		}
+
+		delete(cs.chunks, chunk.Hash)
+		if err := cs.backing.DeleteData(chunkKey(chunk.Hash)); err != nil {
+			log.Printf("ChunkStorage - failed to delete chunk %s: %v", chunk.Hash, err)
+		}
+	}
+}
+
+// setExpiry records when the entry of `name` with `meta` expires, if ever -
+// callers must hold the lock.
+func (cs *ChunkStorage) setExpiry(name string, meta Metadata) {
+	if meta.ExpiresAt.IsZero() {
+		delete(cs.expiring, name)
+		return
+	}
+	cs.expiring[name] = meta.ExpiresAt
+}
+
+// chunkKey returns the name of the chunk with the hex encoded SHA-256 `hash`
+// within the backing storage.
+func chunkKey(hash string) string {
+	return chunkKeyPrefix + hash
+}
+
+// chunkReader reads the chunks of an entry pinned by a `ChunkStorage` in
+// order, unpinning them once closed.
+type chunkReader struct {
+	storage *ChunkStorage
+	chunks  []manifestChunk
+	next    int
+	current []byte
+	closed  bool
+}
+
+// Read reads the data of the current chunk, reading the next once it is
+// exhausted.
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, fmt.Errorf("read of closed chunk reader")
+	}
+	for len(r.current) == 0 {
+		if r.next == len(r.chunks) {
+			return 0, io.EOF
+		}
+		data, err := r.storage.readChunk(r.chunks[r.next].Hash)
+		if err != nil {
+			return 0, err
+		}
+		r.current = data
+		r.next++
+	}
+
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close unpins the chunks of the entry, subsequent calls are a no-op.
+func (r *chunkReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.storage.unpin(r.chunks)
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChunkConfig uses small chunks, so small test data spans many.
+var testChunkConfig = ChunkStorageConfig{
+	MinChunkSize: 256,
+	AvgChunkSize: 1024,
+	MaxChunkSize: 4096,
+}
+
+func initTestChunkStorage(t *testing.T, backing DataStorage) *ChunkStorage {
+	t.Helper()
+	cs, err := ChunkStorage{}.Initialize(backing, testChunkConfig)
+	require.NoError(t, err)
+	return cs
+}
+
+// randomData returns `size` bytes of reproducible random data.
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &ChunkStorage{}
+	var _ StreamingStorage = &ChunkStorage{}
+}
+
+func TestChunkStorage_Initialize(t *testing.T) {
+	_, err := ChunkStorage{}.Initialize(MemStorage{}.Initialize(), ChunkStorageConfig{
+		MinChunkSize: 4096,
+		AvgChunkSize: 1024,
+	})
+	assert.Error(t, err)
+
+	t.Run("plain values", func(t *testing.T) {
+		mem := MemStorage{}.Initialize()
+		require.NoError(t, mem.StoreData("foo", []byte("not a manifest")))
+		require.NoError(t, mem.StoreData("json", []byte(`{"meta":{"revision":1},"chunks":[{"hash":"a"}]}`)))
+		require.NoError(t, mem.StoreDataWithOptions("expiring", []byte("test data"), StoreOptions{TTL: time.Hour}))
+		cs, err := ChunkStorage{}.Initialize(mem, ChunkStorageConfig{})
+		require.NoError(t, err)
+
+		// Served as they are
+		data, meta, err := cs.RetrieveEntry("foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("not a manifest"), data)
+		stored, err := mem.RetrieveMetadata("foo")
+		require.NoError(t, err)
+		assert.Equal(t, stored, meta)
+		stream, _, err := cs.RetrieveStream("json")
+		require.NoError(t, err)
+		data, err = io.ReadAll(stream)
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+		assert.Equal(t, `{"meta":{"revision":1},"chunks":[{"hash":"a"}]}`, string(data))
+		names, _, err := cs.ListNames("", "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"expiring", "foo", "json"}, names)
+
+		// Until overwritten, or deleted
+		_, err = cs.CompareAndSwap("foo", []byte("chunked"), StoreOptions{}, Precondition{
+			IfMatch: []uint64{meta.Revision},
+		})
+		require.NoError(t, err)
+		data, err = cs.RetrieveData("foo")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("chunked"), data)
+		require.NoError(t, cs.DeleteData("json"))
+		_, err = mem.RetrieveData("json")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestChunkStorage_Chunker(t *testing.T) {
+	data := randomData(1, 256<<10)
+	split := func(data []byte) []string {
+		c := newChunker(bytes.NewReader(data), 256, 1024, 4096)
+		var chunks []string
+		for {
+			chunk, err := c.next()
+			if err == io.EOF {
+				return chunks
+			}
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(chunk), 4096)
+			chunks = append(chunks, string(chunk))
+		}
+	}
+
+	chunks := split(data)
+	assert.Equal(t, data, []byte(join(chunks)))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), 256)
+	}
+	mean := len(data) / len(chunks)
+	assert.True(t, mean > 1024/2 && mean < 1024*3/2, "mean chunk size %d", mean)
+
+	// An insertion only changes the chunks around it
+	edited := append(append(append([]byte{}, data[:100_000]...), "inserted"...), data[100_000:]...)
+	editedChunks := split(edited)
+	shared := 0
+	seen := map[string]bool{}
+	for _, chunk := range chunks {
+		seen[chunk] = true
+	}
+	for _, chunk := range editedChunks {
+		if seen[chunk] {
+			shared++
+		}
+	}
+	assert.GreaterOrEqual(t, shared, len(chunks)-3)
+}
+
+func join(chunks []string) string {
+	var joined bytes.Buffer
+	for _, chunk := range chunks {
+		joined.WriteString(chunk)
+	}
+	return joined.String()
+}
+
+func TestChunkStorage_Deduplication(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	cs := initTestChunkStorage(t, mem)
+
+	build := randomData(2, 512<<10)
+	nextBuild := append(append([]byte{}, build...), "appended"...)
+	copy(nextBuild[200_000:], "patched")
+	require.NoError(t, cs.StoreData("build-1", build))
+	require.NoError(t, cs.StoreData("build-2", nextBuild))
+	require.NoError(t, cs.StoreData("build-2-copy", nextBuild))
+
+	stats := cs.Stats()
+	assert.Equal(t, int64(len(build)+2*len(nextBuild)), stats.ReferencedBytes)
+	assert.Less(t, stats.StoredBytes, int64(len(build)+20<<10))
+
+	t.Run("retrieve", func(t *testing.T) {
+		for name, expected := range map[string][]byte{
+			"build-1":      build,
+			"build-2":      nextBuild,
+			"build-2-copy": nextBuild,
+		} {
+			data, meta, err := cs.RetrieveEntry(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, data)
+			assert.Equal(t, len(expected), meta.Size)
+		}
+	})
+
+	t.Run("chunks are not listed", func(t *testing.T) {
+		names, _, err := cs.ListNames("", "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"build-1", "build-2", "build-2-copy"}, names)
+	})
+
+	t.Run("shared chunks outlive a delete", func(t *testing.T) {
+		require.NoError(t, cs.DeleteData("build-1"))
+		data, err := cs.RetrieveData("build-2")
+		require.NoError(t, err)
+		assert.Equal(t, nextBuild, data)
+		assert.Equal(t, int64(2*len(nextBuild)), cs.Stats().ReferencedBytes)
+	})
+
+	t.Run("unreferenced chunks are deleted", func(t *testing.T) {
+		require.NoError(t, cs.StoreData("build-2", []byte("overwritten")))
+		require.NoError(t, cs.DeleteData("build-2-copy"))
+		require.NoError(t, cs.DeleteData("build-2"))
+
+		assert.Equal(t, ChunkStorageStats{}, cs.Stats())
+		assert.Zero(t, mem.Stats().Entries)
+	})
+}
+
+func TestChunkStorage_Restart(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	cs := initTestChunkStorage(t, fs)
+
+	data := randomData(3, 64<<10)
+	require.NoError(t, cs.StoreData("a", data))
+	require.NoError(t, cs.StoreData("b", data))
+	stats := cs.Stats()
+
+	// As left by a write interrupted before its manifest
+	require.NoError(t, fs.StoreData(chunkKey("orphan"), []byte("orphaned chunk")))
+
+	fs, err = FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	cs = initTestChunkStorage(t, fs)
+	assert.Equal(t, stats, cs.Stats())
+	_, err = fs.RetrieveData(chunkKey("orphan"))
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+	retrieved, err := cs.RetrieveData("b")
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+}
+
+func TestChunkStorage_Corruption(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	cs := initTestChunkStorage(t, mem)
+	require.NoError(t, cs.StoreData("test", randomData(4, 16<<10)))
+
+	names, _, err := mem.ListNames(chunkKeyPrefix, "", 1)
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	require.NoError(t, mem.StoreData(names[0], []byte("bit rot")))
+
+	_, err = cs.RetrieveData("test")
+	assert.ErrorContains(t, err, "corrupt")
+}
+
+func TestChunkStorage_ReservedNames(t *testing.T) {
+	cs := initTestChunkStorage(t, MemStorage{}.Initialize())
+	data := []byte(`{"note":"json payload"}`)
+	require.NoError(t, cs.StoreData("a", data))
+
+	// A chunk may not be overwritten through the storage, however its data
+	// looks
+	sum := sha256.Sum256(data)
+	key := chunkKey(hex.EncodeToString(sum[:]))
+	err := cs.StoreData(key, []byte("evil"))
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = cs.StoreStream(key, strings.NewReader("evil"), StoreOptions{}, Precondition{})
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = cs.ApplyBatch([]BatchOp{{Name: key, Data: []byte("evil")}})
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, cs.DeleteData(key))
+	_, err = cs.RetrieveData(key)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = cs.RetrieveMetadata(key)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+
+	retrieved, err := cs.RetrieveData("a")
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+}
+
+func TestChunkStorage_FailedWrites(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	cs := initTestChunkStorage(t, mem)
+	data := randomData(5, 16<<10)
+
+	// Neither a failed precondition nor a failed batch leaves chunks behind
+	_, err := cs.CompareAndSwap("test", data, StoreOptions{}, Precondition{MustExist: true})
+	assert.ErrorAs(t, err, &customerrors.DataStoragePreconditionFailed{})
+	_, err = cs.ApplyBatch([]BatchOp{
+		{Name: "test", Data: data},
+		{Name: "missing", Delete: true},
+	})
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+	assert.Equal(t, ChunkStorageStats{}, cs.Stats())
+	assert.Zero(t, mem.Stats().Entries)
+}
+
+// gatedChunkStorage is a `DataStorage` whose first store of a chunk signals
+// `entered`, then blocks until `release` is closed and fails.
+type gatedChunkStorage struct {
+	DataStorage
+	entered chan struct{}
+	release chan struct{}
+	once    *sync.Once
+}
+
+func (s gatedChunkStorage) StoreData(name string, data []byte) error {
+	failed := false
+	if strings.HasPrefix(name, chunkKeyPrefix) {
+		s.once.Do(func() {
+			close(s.entered)
+			<-s.release
+			failed = true
+		})
+	}
+	if failed {
+		return customerrors.DataStorageUnsupported{Operation: "test"}
+	}
+	return s.DataStorage.StoreData(name, data)
+}
+
+func TestChunkStorage_StoringChunks(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	require.NoError(t, initTestChunkStorage(t, mem).StoreData("existing", []byte("test data")))
+	gated := gatedChunkStorage{mem, make(chan struct{}), make(chan struct{}), &sync.Once{}}
+	cs := initTestChunkStorage(t, gated)
+	data := randomData(8, 1<<10)
+
+	first, second := make(chan error), make(chan error)
+	go func() {
+		first <- cs.StoreData("first", data)
+	}()
+	<-gated.entered
+	go func() {
+		second <- cs.StoreData("second", data)
+	}()
+
+	// Nothing else waits on the chunk being stored
+	retrieved, err := cs.RetrieveData("existing")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test data"), retrieved)
+
+	// A write waiting on a chunk which fails to store stores it itself
+	close(gated.release)
+	assert.Error(t, <-first)
+	require.NoError(t, <-second)
+	retrieved, err = cs.RetrieveData("second")
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+	_, err = cs.RetrieveData("first")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	stats := cs.Stats()
+	assert.Equal(t, int64(9+1<<10), stats.StoredBytes)
+	assert.Equal(t, stats.StoredBytes, stats.ReferencedBytes)
+}
+
+func TestChunkStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	cs := initTestChunkStorage(t, MemStorage{}.Initialize())
+	dataName := "test"
+	versions := [][]byte{randomData(6, 8<<10), randomData(7, 8<<10)}
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			switch itr % 4 {
+			case 0:
+				_ = cs.StoreData(dataName, versions[itr%2])
+			case 1:
+				_ = cs.DeleteData(dataName)
+			default:
+				// Reads never see a mix of versions, or a missing chunk
+				data, err := cs.RetrieveData(dataName)
+				if err == nil {
+					assert.True(t, bytes.Equal(data, versions[0]) || bytes.Equal(data, versions[1]))
+				} else {
+					assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestChunkStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, initTestChunkStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestChunkStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, initTestChunkStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestChunkStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, initTestChunkStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestChunkStorage_Batch(t *testing.T) {
+	testStorageBatch(t, initTestChunkStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestChunkStorage_TTL(t *testing.T) {
+	testStorageTTL(t, initTestChunkStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestChunkStorage_Streaming(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	cs, err := ChunkStorage{}.Initialize(fs, ChunkStorageConfig{})
+	require.NoError(t, err)
+	testStorageStreaming(t, cs)
+}
@@ -0,0 +1,592 @@
+package datastorage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// CompressionAlgorithm is the algorithm a `CompressedStorage` compresses data
+// with.
+type CompressionAlgorithm byte
+
+// The values of `CompressionAlgorithm` are written with the data, so must
+// never change.
+const (
+	// CompressGzip compresses data as gzip, the default.
+	CompressGzip CompressionAlgorithm = iota + 1
+
+	// CompressFlate compresses data as raw DEFLATE, without the gzip header
+	// and checksum.
+	CompressFlate
+)
+
+// ParseCompressionAlgorithm parses a `CompressionAlgorithm` from its name:
+// "gzip" or "flate".
+func ParseCompressionAlgorithm(algorithm string) (CompressionAlgorithm, error) {
+	switch algorithm {
+	case "gzip":
+		return CompressGzip, nil
+	case "flate":
+		return CompressFlate, nil
+	default:
+		return 0, fmt.Errorf("unknown compression algorithm: '%s'", algorithm)
+	}
+}
+
+const (
+	// compressionMagic begins every value a `CompressedStorage` writes to its
+	// backing storage, followed by:
+	// algorithm (1, zero if stored as is) | size (8) | SHA-256 checksum (32)
+	//
+	// Both the size and checksum are of the data before compression.
+	compressionMagic = "\x00cmp"
+
+	// compressionHeaderSize is the size of the header preceding the data.
+	compressionHeaderSize = len(compressionMagic) + 1 + 8 + sha256.Size
+
+	// defaultCompressMinSize is the smallest data compressed when
+	// `CompressedStorageConfig.MinSize` is unset.
+	defaultCompressMinSize = 512
+
+	// compressSpoolPrefix names the temporary files streams are spooled to.
+	compressSpoolPrefix = "compress-spool-"
+)
+
+// defaultIncompressibleTypes are the content types stored as is when
+// `CompressedStorageConfig.SkipContentTypes` is unset - their data is already
+// compressed.
+var defaultIncompressibleTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+	"video/*", "audio/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-bzip2", "application/x-xz",
+	"application/x-7z-compressed", "application/vnd.rar",
+}
+
+// CompressedStorageConfig configures a `CompressedStorage`.
+type CompressedStorageConfig struct {
+	// Algorithm compresses the data, defaults to `CompressGzip`.
+	Algorithm CompressionAlgorithm
+
+	// Level is the compression level, from `flate.BestSpeed` to
+	// `flate.BestCompression` or `flate.HuffmanOnly`, defaults to
+	// `flate.DefaultCompression` when zero.
+	Level int
+
+	// MinSize is the smallest data compressed, smaller data is stored as is -
+	// defaults to 512 bytes.
+	MinSize int
+
+	// SkipContentTypes are content types stored as is, being already
+	// compressed. A type ending in "/*" matches any subtype. Defaults to
+	// common image, audio, video and archive types.
+	SkipContentTypes []string
+
+	// SpoolDir holds the temporary files streamed data is compressed from,
+	// defaults to `os.TempDir`.
+	SpoolDir string
+}
+
+// CompressedStorageStats is a point in time summary of a `CompressedStorage`.
+type CompressedStorageStats struct {
+	// Compressed and Skipped count the writes stored compressed, and as is -
+	// being too small, already compressed or not compressing smaller.
+	Compressed int64 `json:"compressed"`
+	Skipped    int64 `json:"skipped"`
+
+	// UncompressedBytes and CompressedBytes total the size of compressed
+	// writes, before and after compression.
+	UncompressedBytes int64 `json:"uncompressed_bytes"`
+	CompressedBytes   int64 `json:"compressed_bytes"`
+
+	// Ratio is `CompressedBytes` over `UncompressedBytes`, the lower the
+	// better - zero before any compressed write.
+	Ratio float64 `json:"ratio"`
+}
+
+// compressionHeader is the header of a value written by a
+// `CompressedStorage`, see `compressionMagic`.
+type compressionHeader struct {
+	algorithm CompressionAlgorithm
+	size      int64
+	checksum  [sha256.Size]byte
+}
+
+// encode serializes the header.
+func (h compressionHeader) encode() []byte {
+	header := make([]byte, compressionHeaderSize)
+	pos := copy(header, compressionMagic)
+	header[pos] = byte(h.algorithm)
+	binary.BigEndian.PutUint64(header[pos+1:pos+9], uint64(h.size))
+	copy(header[pos+9:], h.checksum[:])
+	return header
+}
+
+// decodeCompressionHeader parses the header at the start of `value`,
+// reporting false if there is none - such as for data written to the backing
+// storage before it was decorated.
+func decodeCompressionHeader(value []byte) (compressionHeader, bool) {
+	if len(value) < compressionHeaderSize || !bytes.HasPrefix(value, []byte(compressionMagic)) {
+		return compressionHeader{}, false
+	}
+
+	pos := len(compressionMagic)
+	h := compressionHeader{
+		algorithm: CompressionAlgorithm(value[pos]),
+		size:      int64(binary.BigEndian.Uint64(value[pos+1 : pos+9])),
+	}
+	copy(h.checksum[:], value[pos+9:compressionHeaderSize])
+	return h, true
+}
+
+// metadata returns `meta` of the stored value, describing the data before
+// compression instead.
+func (h compressionHeader) metadata(meta Metadata) Metadata {
+	meta.Size = int(h.size)
+	meta.Checksum = hex.EncodeToString(h.checksum[:])
+	return meta
+}
+
+// CompressedStorage is a decorator that implements the `DataStorage` interface
+// by compressing data before storing it in its backing `DataStorage`, and
+// decompressing it when retrieved - any backing storage holds more in less.
+//
+// Data which is small, of an already compressed content type, or which does
+// not compress smaller is stored as is. Every value is prefixed with a small
+// header, so `Metadata` describes the data as written rather than as stored.
+type CompressedStorage struct {
+	backing DataStorage
+	cfg     CompressedStorageConfig
+
+	// mu guards the stats
+	mu    *sync.Mutex
+	stats CompressedStorageStats
+}
+
+// Initialize initializes and returns a pointer to a `CompressedStorage` in
+// front of `backing`, configured by `cfg`.
+//
+// The returned `CompressedStorage` takes ownership of `backing` - `Close`
+// closes `backing` if it is an `io.Closer`.
+func (cs CompressedStorage) Initialize(backing DataStorage, cfg CompressedStorageConfig) (*CompressedStorage, error) {
+	if cfg.Algorithm == 0 {
+		cfg.Algorithm = CompressGzip
+	}
+	if cfg.Level == 0 {
+		cfg.Level = flate.DefaultCompression
+	}
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = defaultCompressMinSize
+	}
+	if cfg.SkipContentTypes == nil {
+		cfg.SkipContentTypes = defaultIncompressibleTypes
+	}
+
+	storage := &CompressedStorage{
+		backing: backing,
+		cfg:     cfg,
+		mu:      &sync.Mutex{},
+	}
+
+	// Fail now on an invalid algorithm or level, rather than on every write
+	if _, err := storage.compress(io.Discard, bytes.NewReader(nil)); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// RetrieveData retrieves the data associated with a given `name`,
+// decompressed.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := cs.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with a given
+// `name`, decompressed.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	value, meta, err := cs.backing.RetrieveEntry(name)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return cs.decode(name, value, meta)
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with a given `name`,
+// reading only the header of its data where the backing storage streams.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) RetrieveMetadata(name string) (Metadata, error) {
+	stream, meta, err := RetrieveStream(cs.backing, name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer stream.Close()
+
+	value := make([]byte, compressionHeaderSize)
+	n, err := io.ReadFull(stream, value)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Metadata{}, err
+	}
+	if header, ok := decodeCompressionHeader(value[:n]); ok {
+		meta = header.metadata(meta)
+	}
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader which
+// decompresses the data as it is streamed from the backing storage.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	stream, meta, err := RetrieveStream(cs.backing, name)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	value := make([]byte, compressionHeaderSize)
+	n, err := io.ReadFull(stream, value)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		stream.Close()
+		return nil, Metadata{}, err
+	}
+	header, ok := decodeCompressionHeader(value[:n])
+	if !ok {
+		// Stored before compression, the header read is data
+		return readCloser{io.MultiReader(bytes.NewReader(value[:n]), stream), stream}, meta, nil
+	}
+
+	data, err := cs.decompressor(name, header.algorithm, stream)
+	if err != nil {
+		stream.Close()
+		return nil, Metadata{}, err
+	}
+	return readCloser{data, stream}, header.metadata(meta), nil
+}
+
+// StoreData compresses data `[]byte` and stores it with an associated `name`.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) StoreData(name string, data []byte) error {
+	return cs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry -
+// data of a `ContentType` already compressed is stored as is.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := cs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	value, header, err := cs.encode(data, opts.ContentType)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta, err := cs.backing.CompareAndSwap(name, value, opts, cond)
+	if err != nil {
+		return Metadata{}, err
+	}
+	cs.record(header, len(value))
+
+	return header.metadata(meta), nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, spooling the data read from `r` to
+// a temporary file to measure it, then streaming it compressed to the backing
+// storage.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	spooled, err := spool(cs.cfg.SpoolDir, compressSpoolPrefix, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	header := compressionHeader{size: spooled.size}
+	if _, err = hex.Decode(header.checksum[:], []byte(spooled.checksum)); err != nil {
+		return Metadata{}, err
+	}
+
+	// Streamed data is compressed even if it does not compress smaller, which
+	// is only known once written
+	var data io.Reader = spooled
+	if cs.shouldCompress(spooled.size, opts.ContentType) {
+		header.algorithm = cs.cfg.Algorithm
+
+		compressed, pipe := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := cs.compress(pipe, spooled)
+			pipe.CloseWithError(err)
+		}()
+		defer func() {
+			// Stop compressing should the backing storage stop reading
+			compressed.Close()
+			<-done
+		}()
+		data = compressed
+	}
+
+	meta, err := StoreStream(
+		cs.backing, name, io.MultiReader(bytes.NewReader(header.encode()), data), opts, cond,
+	)
+	if err != nil {
+		return Metadata{}, err
+	}
+	cs.record(header, meta.Size)
+
+	return header.metadata(meta), nil
+}
+
+// DeleteData deletes data associated with a given `name`.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) DeleteData(name string) error {
+	return cs.backing.DeleteData(name)
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) CompareAndDelete(name string, cond Precondition) error {
+	return cs.backing.CompareAndDelete(name, cond)
+}
+
+// ApplyBatch atomically applies every operation of `ops`, or none of them, as
+// per `DataStorage` - compressing the data of each store.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	var (
+		encoded = make([]BatchOp, len(ops))
+		headers = make([]compressionHeader, len(ops))
+	)
+	for i, op := range ops {
+		encoded[i] = op
+		if op.Delete {
+			continue
+		}
+
+		var err error
+		if encoded[i].Data, headers[i], err = cs.encode(op.Data, op.Options.ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	metas, err := cs.backing.ApplyBatch(encoded)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		cs.record(headers[i], len(encoded[i].Data))
+		metas[i] = headers[i].metadata(metas[i])
+	}
+
+	return metas, nil
+}
+
+// PurgeExpired permanently removes all expired entries from the backing
+// storage, returning how many were removed.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) PurgeExpired() (int, error) {
+	return cs.backing.PurgeExpired()
+}
+
+// ListNames lists the names of entries beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return cs.backing.ListNames(prefix, cursor, limit)
+}
+
+// Stats returns the number of writes compressed and skipped, and the ratio
+// compressed data was stored at.
+//
+// This method is thread safe.
+func (cs *CompressedStorage) Stats() CompressedStorageStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	stats := cs.stats
+	if stats.UncompressedBytes > 0 {
+		stats.Ratio = float64(stats.CompressedBytes) / float64(stats.UncompressedBytes)
+	}
+	return stats
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (cs *CompressedStorage) Close() error {
+	if closer, ok := cs.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// shouldCompress reports whether data of `size` bytes and `contentType` is
+// worth compressing.
+func (cs *CompressedStorage) shouldCompress(size int64, contentType string) bool {
+	if size < int64(cs.cfg.MinSize) {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	for _, skipped := range cs.cfg.SkipContentTypes {
+		if mediaType == skipped {
+			return false
+		}
+		if strings.HasSuffix(skipped, "/*") && strings.HasPrefix(mediaType, skipped[:len(skipped)-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// encode returns the value stored in the backing storage for `data` of
+// `contentType`, compressed if worthwhile, and its header.
+func (cs *CompressedStorage) encode(data []byte, contentType string) ([]byte, compressionHeader, error) {
+	header := compressionHeader{
+		size:     int64(len(data)),
+		checksum: sha256.Sum256(data),
+	}
+
+	if cs.shouldCompress(header.size, contentType) {
+		header.algorithm = cs.cfg.Algorithm
+		value := bytes.NewBuffer(header.encode())
+		if _, err := cs.compress(value, bytes.NewReader(data)); err != nil {
+			return nil, compressionHeader{}, err
+		}
+		if value.Len()-compressionHeaderSize < len(data) {
+			return value.Bytes(), header, nil
+		}
+	}
+
+	header.algorithm = 0
+	value := make([]byte, compressionHeaderSize+len(data))
+	copy(value[copy(value, header.encode()):], data)
+	return value, header, nil
+}
+
+// decode returns the data and `Metadata` of a `value` with `meta` read from
+// the backing storage for `name`.
+func (cs *CompressedStorage) decode(name string, value []byte, meta Metadata) ([]byte, Metadata, error) {
+	header, ok := decodeCompressionHeader(value)
+	if !ok {
+		// Stored before compression
+		return value, meta, nil
+	}
+
+	data := value[compressionHeaderSize:]
+	if header.algorithm != 0 {
+		decompressor, err := cs.decompressor(name, header.algorithm, bytes.NewReader(data))
+		if err != nil {
+			return []byte{}, Metadata{}, err
+		}
+		decompressed := bytes.NewBuffer(make([]byte, 0, header.size))
+		if _, err = io.Copy(decompressed, decompressor); err != nil {
+			return []byte{}, Metadata{}, fmt.Errorf("failed to decompress '%s': %w", name, err)
+		}
+		data = decompressed.Bytes()
+	}
+	if int64(len(data)) != header.size {
+		return []byte{}, Metadata{}, fmt.Errorf(
+			"decompressed '%s' to %d bytes, expected %d", name, len(data), header.size,
+		)
+	}
+
+	return data, header.metadata(meta), nil
+}
+
+// compress writes the data read from `r` to `w` compressed, returning the
+// number of bytes read.
+func (cs *CompressedStorage) compress(w io.Writer, r io.Reader) (int64, error) {
+	var (
+		compressor io.WriteCloser
+		err        error
+	)
+	switch cs.cfg.Algorithm {
+	case CompressGzip:
+		compressor, err = gzip.NewWriterLevel(w, cs.cfg.Level)
+	case CompressFlate:
+		compressor, err = flate.NewWriter(w, cs.cfg.Level)
+	default:
+		err = fmt.Errorf("unknown compression algorithm: %d", cs.cfg.Algorithm)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(compressor, r)
+	if err != nil {
+		return n, err
+	}
+	return n, compressor.Close()
+}
+
+// decompressor returns a reader decompressing the data of `name` read from
+// `r`, compressed with `algorithm`.
+func (cs *CompressedStorage) decompressor(name string, algorithm CompressionAlgorithm, r io.Reader) (io.Reader, error) {
+	switch algorithm {
+	case 0:
+		return r, nil
+	case CompressGzip:
+		decompressor, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress '%s': %w", name, err)
+		}
+		return decompressor, nil
+	case CompressFlate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("'%s' is compressed with unknown algorithm: %d", name, algorithm)
+	}
+}
+
+// record counts a write of data with `header`, stored as `storedSize` bytes
+// including the header.
+func (cs *CompressedStorage) record(header compressionHeader, storedSize int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if header.algorithm == 0 {
+		cs.stats.Skipped++
+		return
+	}
+	cs.stats.Compressed++
+	cs.stats.UncompressedBytes += header.size
+	cs.stats.CompressedBytes += int64(storedSize - compressionHeaderSize)
+}
@@ -0,0 +1,193 @@
+package datastorage
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initTestCompressedStorage(t *testing.T, backing DataStorage, cfg CompressedStorageConfig) *CompressedStorage {
+	t.Helper()
+	cs, err := CompressedStorage{}.Initialize(backing, cfg)
+	require.NoError(t, err)
+	return cs
+}
+
+func TestCompressedStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &CompressedStorage{}
+	var _ StreamingStorage = &CompressedStorage{}
+}
+
+func TestCompressedStorage_Initialize(t *testing.T) {
+	_, err := CompressedStorage{}.Initialize(MemStorage{}.Initialize(), CompressedStorageConfig{
+		Level: 42,
+	})
+	assert.Error(t, err)
+	_, err = CompressedStorage{}.Initialize(MemStorage{}.Initialize(), CompressedStorageConfig{
+		Algorithm: 42,
+	})
+	assert.Error(t, err)
+
+	algorithm, err := ParseCompressionAlgorithm("flate")
+	require.NoError(t, err)
+	assert.Equal(t, CompressFlate, algorithm)
+	_, err = ParseCompressionAlgorithm("zip")
+	assert.Error(t, err)
+}
+
+func TestCompressedStorage_StoreData(t *testing.T) {
+	data := []byte(strings.Repeat("highly compressible test data ", 2000))
+	checksum := sha256.Sum256(data)
+
+	for _, algorithm := range []CompressionAlgorithm{CompressGzip, CompressFlate} {
+		mem := MemStorage{}.Initialize()
+		cs := initTestCompressedStorage(t, mem, CompressedStorageConfig{
+			Algorithm: algorithm,
+			Level:     flate.BestCompression,
+		})
+
+		meta, err := cs.CompareAndSwap("test", data, StoreOptions{ContentType: "text/plain"}, Precondition{})
+		require.NoError(t, err)
+		assert.Equal(t, len(data), meta.Size)
+		assert.Equal(t, hex.EncodeToString(checksum[:]), meta.Checksum)
+
+		// Stored compressed
+		stored, err := mem.RetrieveData("test")
+		require.NoError(t, err)
+		assert.Less(t, len(stored), len(data)/20)
+
+		retrieved, meta, err := cs.RetrieveEntry("test")
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+		assert.Equal(t, len(data), meta.Size)
+		assert.Equal(t, hex.EncodeToString(checksum[:]), meta.Checksum)
+		assert.Equal(t, "text/plain", meta.ContentType)
+
+		meta, err = cs.RetrieveMetadata("test")
+		require.NoError(t, err)
+		assert.Equal(t, len(data), meta.Size)
+
+		stats := cs.Stats()
+		assert.Equal(t, int64(1), stats.Compressed)
+		assert.Equal(t, int64(len(data)), stats.UncompressedBytes)
+		assert.Equal(t, int64(len(stored)-compressionHeaderSize), stats.CompressedBytes)
+		assert.Less(t, stats.Ratio, 0.05)
+	}
+}
+
+func TestCompressedStorage_Skipped(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	cs := initTestCompressedStorage(t, mem, CompressedStorageConfig{
+		SkipContentTypes: []string{"image/png", "video/*"},
+	})
+	compressible := []byte(strings.Repeat("test data ", 1000))
+
+	for name, write := range map[string]struct {
+		data        []byte
+		contentType string
+	}{
+		"small":          {data: []byte("test data")},
+		"png":            {data: compressible, contentType: "image/png"},
+		"video":          {data: compressible, contentType: "video/mp4; codecs=avc1"},
+		"incompressible": {data: randomData(8, 4096)},
+	} {
+		require.NoError(t, cs.StoreDataWithOptions(name, write.data, StoreOptions{
+			ContentType: write.contentType,
+		}))
+
+		// Stored as is
+		stored, err := mem.RetrieveData(name)
+		require.NoError(t, err)
+		assert.Equal(t, write.data, stored[compressionHeaderSize:])
+
+		data, err := cs.RetrieveData(name)
+		require.NoError(t, err)
+		assert.Equal(t, write.data, data)
+	}
+
+	assert.Equal(t, CompressedStorageStats{Skipped: 4}, cs.Stats())
+}
+
+func TestCompressedStorage_UncompressedData(t *testing.T) {
+	// Data stored before the backing storage was decorated is read as is
+	mem := MemStorage{}.Initialize()
+	require.NoError(t, mem.StoreData("before", []byte("test data")))
+	cs := initTestCompressedStorage(t, mem, CompressedStorageConfig{})
+
+	data, meta, err := cs.RetrieveEntry("before")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test data"), data)
+	assert.Equal(t, 9, meta.Size)
+
+	stream, _, err := cs.RetrieveStream("before")
+	require.NoError(t, err)
+	defer stream.Close()
+	data, err = io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test data"), data)
+}
+
+func TestCompressedStorage_StoreStream(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	spoolDir := t.TempDir()
+	cs := initTestCompressedStorage(t, fs, CompressedStorageConfig{SpoolDir: spoolDir})
+
+	data := []byte(strings.Repeat("streamed test data ", 100_000))
+	meta, err := cs.StoreStream("test", bytes.NewReader(data), StoreOptions{}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, len(data), meta.Size)
+
+	stored, err := fs.RetrieveMetadata("test")
+	require.NoError(t, err)
+	assert.Less(t, stored.Size, len(data)/20)
+	assert.Equal(t, int64(1), cs.Stats().Compressed)
+
+	stream, _, err := cs.RetrieveStream("test")
+	require.NoError(t, err)
+	defer stream.Close()
+	retrieved, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+
+	// The spooled data is removed
+	spooled, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+}
+
+func TestCompressedStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+}
+
+func TestCompressedStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+}
+
+func TestCompressedStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+}
+
+func TestCompressedStorage_Batch(t *testing.T) {
+	testStorageBatch(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+}
+
+func TestCompressedStorage_TTL(t *testing.T) {
+	testStorageTTL(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+}
+
+func TestCompressedStorage_Streaming(t *testing.T) {
+	testStorageStreaming(t, initTestCompressedStorage(t, MemStorage{}.Initialize(), CompressedStorageConfig{}))
+
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testStorageStreaming(t, initTestCompressedStorage(t, fs, CompressedStorageConfig{}))
+}
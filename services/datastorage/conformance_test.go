@@ -0,0 +1,212 @@
+package datastorage_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/services/datastorage/storagetest"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+// closeOnCleanup closes `storage` once the test is done with it.
+func closeOnCleanup(tb testing.TB, storage interface{ Close() error }) {
+	tb.Cleanup(func() { storage.Close() })
+}
+
+// conformingStorages lists a constructor of every storage of this package,
+// in each configuration the webapp may run it in.
+func conformingStorages() []struct {
+	name string
+	new  func(tb testing.TB) datastorage.DataStorage
+} {
+	storages := []struct {
+		name string
+		new  func(tb testing.TB) datastorage.DataStorage
+	}{
+		{"MemStorage", func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.MemStorage{}.Initialize()
+		}},
+		{"MemStorage/WAL", func(tb testing.TB) datastorage.DataStorage {
+			mem, err := datastorage.MemStorage{}.InitializeWithConfig(datastorage.MemStorageConfig{
+				WAL: &datastorage.WALConfig{Dir: tb.TempDir()},
+			})
+			require.NoError(tb, err)
+			closeOnCleanup(tb, mem)
+			return mem
+		}},
+		{"ShardedMemStorage", func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.ShardedMemStorage{}.Initialize(4)
+		}},
+		{"FileStorage", func(tb testing.TB) datastorage.DataStorage {
+			fs, err := datastorage.FileStorage{}.Initialize(tb.TempDir())
+			require.NoError(tb, err)
+			return fs
+		}},
+		{"LogStorage", func(tb testing.TB) datastorage.DataStorage {
+			ls, err := datastorage.LogStorage{}.Initialize(tb.TempDir(), datastorage.LogStorageOptions{})
+			require.NoError(tb, err)
+			closeOnCleanup(tb, ls)
+			return ls
+		}},
+		{"CompressedStorage", func(tb testing.TB) datastorage.DataStorage {
+			cs, err := datastorage.CompressedStorage{}.Initialize(
+				datastorage.MemStorage{}.Initialize(), datastorage.CompressedStorageConfig{},
+			)
+			require.NoError(tb, err)
+			return cs
+		}},
+		{"EncryptedStorage", func(tb testing.TB) datastorage.DataStorage {
+			path := filepath.Join(tb.TempDir(), "keyring.json")
+			require.NoError(tb, datastorage.AddKeyringKey(path, "test"))
+			keyring, err := datastorage.Keyring{}.Initialize(path)
+			require.NoError(tb, err)
+			return datastorage.EncryptedStorage{}.Initialize(
+				datastorage.MemStorage{}.Initialize(), keyring, datastorage.EncryptedStorageConfig{},
+			)
+		}},
+		{"ChunkStorage", func(tb testing.TB) datastorage.DataStorage {
+			cs, err := datastorage.ChunkStorage{}.Initialize(datastorage.MemStorage{}.Initialize(), datastorage.ChunkStorageConfig{
+				MinChunkSize: 256,
+				AvgChunkSize: 1024,
+				MaxChunkSize: 4096,
+			})
+			require.NoError(tb, err)
+			return cs
+		}},
+		{"ChunkStorage/FileStorage", func(tb testing.TB) datastorage.DataStorage {
+			fs, err := datastorage.FileStorage{}.Initialize(tb.TempDir())
+			require.NoError(tb, err)
+			cs, err := datastorage.ChunkStorage{}.Initialize(fs, datastorage.ChunkStorageConfig{})
+			require.NoError(tb, err)
+			return cs
+		}},
+		{"VersionedStorage", func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.VersionedStorage{}.Initialize(datastorage.MemStorage{}.Initialize(), 2)
+		}},
+		{"QuotaStorage", func(tb testing.TB) datastorage.DataStorage {
+			qs, err := datastorage.QuotaStorage{}.Initialize(datastorage.MemStorage{}.Initialize(), datastorage.QuotaStorageConfig{
+				Quotas: []datastorage.Quota{
+					{MaxBytes: 1 << 30, MaxEntrySize: 1 << 28, MaxEntries: 1 << 20},
+				},
+				SpoolDir: tb.TempDir(),
+			})
+			require.NoError(tb, err)
+			return qs
+		}},
+		{"ChangeFeed", func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.ChangeFeed{}.Initialize(datastorage.MemStorage{}.Initialize(), 0)
+		}},
+		{"BucketStorage", func(tb testing.TB) datastorage.DataStorage {
+			bs, err := datastorage.BucketStorage{}.Initialize(datastorage.MemStorage{}.Initialize())
+			require.NoError(tb, err)
+			return bs
+		}},
+		{"BucketStorage/Bucket", func(tb testing.TB) datastorage.DataStorage {
+			fs, err := datastorage.FileStorage{}.Initialize(tb.TempDir())
+			require.NoError(tb, err)
+			bs, err := datastorage.BucketStorage{}.Initialize(fs)
+			require.NoError(tb, err)
+			require.NoError(tb, bs.CreateBucket("test", datastorage.BucketConfig{}))
+			bucket, err := bs.Bucket("test")
+			require.NoError(tb, err)
+			return bucket
+		}},
+	}
+
+	for _, mode := range []struct {
+		name string
+		mode datastorage.CacheMode
+	}{
+		{"CachedStorage/WriteThrough", datastorage.CacheWriteThrough},
+		{"CachedStorage/WriteBack", datastorage.CacheWriteBack},
+	} {
+		mode := mode
+		storages = append(storages, struct {
+			name string
+			new  func(tb testing.TB) datastorage.DataStorage
+		}{mode.name, func(tb testing.TB) datastorage.DataStorage {
+			cs, err := datastorage.CachedStorage{}.Initialize(datastorage.MemStorage{}.Initialize(), datastorage.CachedStorageConfig{
+				Mode:          mode.mode,
+				MaxEntries:    10,
+				FlushInterval: time.Hour,
+			})
+			require.NoError(tb, err)
+			closeOnCleanup(tb, cs)
+			return cs
+		}})
+	}
+
+	if dsn := os.Getenv("WEBAPP_TEST_POSTGRES_DSN"); len(dsn) > 0 {
+		newPostgres := func(tb testing.TB) *datastorage.PostgresStorage {
+			db, err := sql.Open("postgres", dsn)
+			require.NoError(tb, err)
+			ps, err := datastorage.PostgresStorage{}.Initialize(db)
+			require.NoError(tb, err)
+			closeOnCleanup(tb, ps)
+
+			_, err = db.Exec(`TRUNCATE datastorage`)
+			require.NoError(tb, err)
+			return ps
+		}
+
+		// Decorators keep their internal names, beginning with a NUL byte, in
+		// the backing storage too
+		storages = append(storages, []struct {
+			name string
+			new  func(tb testing.TB) datastorage.DataStorage
+		}{
+			{"PostgresStorage", func(tb testing.TB) datastorage.DataStorage {
+				return newPostgres(tb)
+			}},
+			{"BucketStorage/PostgresStorage", func(tb testing.TB) datastorage.DataStorage {
+				bs, err := datastorage.BucketStorage{}.Initialize(newPostgres(tb))
+				require.NoError(tb, err)
+				require.NoError(tb, bs.CreateBucket("test", datastorage.BucketConfig{}))
+				bucket, err := bs.Bucket("test")
+				require.NoError(tb, err)
+				return bucket
+			}},
+			{"VersionedStorage/PostgresStorage", func(tb testing.TB) datastorage.DataStorage {
+				return datastorage.VersionedStorage{}.Initialize(newPostgres(tb), 2)
+			}},
+			{"ChunkStorage/PostgresStorage", func(tb testing.TB) datastorage.DataStorage {
+				cs, err := datastorage.ChunkStorage{}.Initialize(newPostgres(tb), datastorage.ChunkStorageConfig{
+					MinChunkSize: 256,
+					AvgChunkSize: 1024,
+					MaxChunkSize: 4096,
+				})
+				require.NoError(tb, err)
+				return cs
+			}},
+		}...)
+	}
+
+	return storages
+}
+
+func TestConformance(t *testing.T) {
+	for _, storage := range conformingStorages() {
+		t.Run(storage.name, func(t *testing.T) {
+			storagetest.Run(t, storagetest.Harness{
+				New:   storage.new,
+				Clock: datastorage.FakeClock,
+			})
+		})
+	}
+}
+
+// Compare with e.g.
+//
+//	go test ./services/datastorage -run '^$' -bench Conformance/.*/StoreData -benchmem
+func BenchmarkConformance(b *testing.B) {
+	for _, storage := range conformingStorages() {
+		b.Run(storage.name, func(b *testing.B) {
+			storagetest.Benchmark(b, storagetest.Harness{New: storage.new})
+		})
+	}
+}
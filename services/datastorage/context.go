@@ -0,0 +1,386 @@
+package datastorage
+
+import (
+	"context"
+	"io"
+)
+
+// ContextStorage is implemented by a `DataStorage` whose operations accept a
+// `context.Context`, abandoning them once it is cancelled or its deadline
+// passes - returning `ctx.Err()`, or an error wrapping it.
+//
+// A write can only be abandoned until it is committed: one whose context is
+// done while it is being committed may be applied regardless, so a write
+// failing with the error of its context may yet have been applied.
+//
+// Use `WithContext` to call any `DataStorage` with a context, adapting those
+// which do not implement this interface natively.
+type ContextStorage interface {
+	DataStorage
+
+	// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+	RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error)
+
+	// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+	RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error)
+
+	// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+	CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error)
+
+	// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+	CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error
+
+	// ListNamesContext behaves as `ListNames`, within `ctx`.
+	ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error)
+
+	// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+	ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error)
+}
+
+// WithContext returns `storage` as a `ContextStorage`.
+//
+// If `storage` does not implement `ContextStorage`, it is adapted: each
+// operation fails early if its context is already done, and is otherwise run
+// in the background - returning the context error as soon as it is done,
+// without waiting for the operation. An abandoned write may therefore still
+// be applied, just as if the client had disconnected the moment it finished.
+//
+// The decorators of this package implement `ContextStorage` themselves,
+// adapting each of their operations likewise unless their backing storage
+// honours contexts natively.
+func WithContext(storage DataStorage) ContextStorage {
+	if cs, ok := storage.(ContextStorage); ok {
+		return cs
+	}
+	return contextAdapter{storage}
+}
+
+// contextDecorator is implemented by the decorators which pass the context of
+// each operation on to their backing storage - natively only if the backing
+// storage honours contexts natively, and otherwise adapting each of their
+// operations whole, as `WithContext` would.
+type contextDecorator interface {
+	ContextStorage
+
+	// contextNative reports whether the backing storage honours contexts
+	// natively, see `nativeContext`.
+	contextNative() bool
+}
+
+// nativeContext returns `storage` as a `ContextStorage` if it honours
+// contexts natively, abandoning work once they are done - rather than only
+// ceasing to wait for it, as adapted by `WithContext`.
+func nativeContext(storage DataStorage) (ContextStorage, bool) {
+	switch s := storage.(type) {
+	case contextDecorator:
+		return s, s.contextNative()
+	case ContextStorage:
+		return s, true
+	}
+	return nil, false
+}
+
+// bindContext returns the `backing` storage of a decorator with every
+// operation within `ctx`, for the decorator to run an operation against - or
+// false if `backing` does not honour contexts natively, in which case the
+// decorator must adapt the operation whole instead. Otherwise an abandoned
+// write of the backing storage might yet be applied, unbeknownst to the
+// decorator.
+func bindContext(ctx context.Context, backing DataStorage) (DataStorage, bool) {
+	native, ok := nativeContext(backing)
+	if !ok {
+		return nil, false
+	}
+	return contextBound{ContextStorage: native, ctx: ctx}, true
+}
+
+// contextBound adapts a `ContextStorage` back to a `DataStorage` whose every
+// operation is within `ctx`, see `bindContext`.
+type contextBound struct {
+	ContextStorage
+	ctx context.Context
+}
+
+func (b contextBound) RetrieveData(name string) ([]byte, error) {
+	data, _, err := b.RetrieveEntryContext(b.ctx, name)
+	return data, err
+}
+
+func (b contextBound) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return b.RetrieveEntryContext(b.ctx, name)
+}
+
+func (b contextBound) RetrieveMetadata(name string) (Metadata, error) {
+	return b.RetrieveMetadataContext(b.ctx, name)
+}
+
+func (b contextBound) StoreData(name string, data []byte) error {
+	return b.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+func (b contextBound) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := b.CompareAndSwapContext(b.ctx, name, data, opts, Precondition{})
+	return err
+}
+
+func (b contextBound) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return b.CompareAndSwapContext(b.ctx, name, data, opts, cond)
+}
+
+func (b contextBound) DeleteData(name string) error {
+	return b.CompareAndDeleteContext(b.ctx, name, Precondition{})
+}
+
+func (b contextBound) CompareAndDelete(name string, cond Precondition) error {
+	return b.CompareAndDeleteContext(b.ctx, name, cond)
+}
+
+func (b contextBound) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return b.ListNamesContext(b.ctx, prefix, cursor, limit)
+}
+
+func (b contextBound) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return b.ApplyBatchContext(b.ctx, ops)
+}
+
+func (b contextBound) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return StoreStreamContext(b.ctx, b.ContextStorage, name, r, opts, cond)
+}
+
+func (b contextBound) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	return RetrieveStreamContext(b.ctx, b.ContextStorage, name)
+}
+
+// contextAdapter adapts a `DataStorage` to a `ContextStorage`, see
+// `WithContext`.
+type contextAdapter struct {
+	DataStorage
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	var (
+		data []byte
+		meta Metadata
+		err  error
+	)
+	if cErr := runContext(ctx, func() {
+		data, meta, err = a.RetrieveEntry(name)
+	}); cErr != nil {
+		return []byte{}, Metadata{}, cErr
+	}
+	return data, meta, err
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	var (
+		meta Metadata
+		err  error
+	)
+	if cErr := runContext(ctx, func() {
+		meta, err = a.RetrieveMetadata(name)
+	}); cErr != nil {
+		return Metadata{}, cErr
+	}
+	return meta, err
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	var (
+		meta Metadata
+		err  error
+	)
+	if cErr := runContext(ctx, func() {
+		meta, err = a.CompareAndSwap(name, data, opts, cond)
+	}); cErr != nil {
+		return Metadata{}, cErr
+	}
+	return meta, err
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	var err error
+	if cErr := runContext(ctx, func() {
+		err = a.CompareAndDelete(name, cond)
+	}); cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	var (
+		names []string
+		next  string
+		err   error
+	)
+	if cErr := runContext(ctx, func() {
+		names, next, err = a.ListNames(prefix, cursor, limit)
+	}); cErr != nil {
+		return nil, "", cErr
+	}
+	return names, next, err
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (a contextAdapter) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	var (
+		metas []Metadata
+		err   error
+	)
+	if cErr := runContext(ctx, func() {
+		metas, err = a.ApplyBatch(ops)
+	}); cErr != nil {
+		return nil, cErr
+	}
+	return metas, err
+}
+
+// runContext runs `fn`, returning `ctx.Err()` if `ctx` is done before or while
+// it runs - in which case `fn` is left to finish in the background, and
+// nothing it sets may be read.
+func runContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		// Can never be cancelled, so there is no need for a goroutine
+		fn()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StoreStreamContext behaves as `StoreStream`, within `ctx`.
+//
+// Reading `r` fails once `ctx` is done, so the storage gives up on the data
+// and nothing is stored.
+func StoreStreamContext(ctx context.Context, storage DataStorage, name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	r = contextReader{ctx: ctx, r: r}
+	if _, ok := storage.(StreamingStorage); !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return Metadata{}, err
+		}
+		return WithContext(storage).CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+
+	meta, err := StoreStream(storage, name, r, opts, cond)
+	if err != nil {
+		if cErr := ctx.Err(); cErr != nil {
+			return Metadata{}, cErr
+		}
+	}
+	return meta, err
+}
+
+// RetrieveVersionContext behaves as `VersionHistory.RetrieveVersion`, within
+// `ctx` - adapted as by `WithContext`.
+//
+// Returns `customerrors.DataStorageUnsupported` unless `storage` implements
+// `VersionHistory`.
+func RetrieveVersionContext(ctx context.Context, storage DataStorage, name string, version int) ([]byte, Metadata, error) {
+	history, err := versionHistory(storage)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	var (
+		data []byte
+		meta Metadata
+	)
+	if cErr := runContext(ctx, func() {
+		data, meta, err = history.RetrieveVersion(name, version)
+	}); cErr != nil {
+		return []byte{}, Metadata{}, cErr
+	}
+	return data, meta, err
+}
+
+// RetrieveStreamContext behaves as `RetrieveStream`, within `ctx`.
+//
+// Reading the returned reader fails once `ctx` is done.
+func RetrieveStreamContext(ctx context.Context, storage DataStorage, name string) (io.ReadCloser, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	var (
+		stream io.ReadCloser
+		meta   Metadata
+		err    error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stream, meta, err = RetrieveStream(storage, name)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Close the stream once opened, as nobody else will
+		go func() {
+			<-done
+			if err == nil {
+				stream.Close()
+			}
+		}()
+		return nil, Metadata{}, ctx.Err()
+	}
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return readCloser{
+		Reader: contextReader{ctx: ctx, r: stream},
+		Closer: stream,
+	}, meta, nil
+}
+
+// contextReader reads from `r` until `ctx` is done, after which every read
+// fails with `ctx.Err()`.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read reads from the underlying reader, unless the context is done.
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
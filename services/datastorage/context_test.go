@@ -0,0 +1,330 @@
+package datastorage
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingStorage is a `DataStorage` whose reads block until `release` is
+// closed.
+type blockingStorage struct {
+	DataStorage
+	release chan struct{}
+}
+
+func (s blockingStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	<-s.release
+	return s.DataStorage.RetrieveEntry(name)
+}
+
+func (s blockingStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	<-s.release
+	return s.DataStorage.ListNames(prefix, cursor, limit)
+}
+
+// cancellingReader cancels its context once read from, yielding `r` after.
+type cancellingReader struct {
+	cancel context.CancelFunc
+	r      io.Reader
+}
+
+func (cr *cancellingReader) Read(p []byte) (int, error) {
+	cr.cancel()
+	return cr.r.Read(p)
+}
+
+func TestWithContext(t *testing.T) {
+	t.Run("native", func(t *testing.T) {
+		for _, storage := range []DataStorage{&PostgresStorage{}, &FileStorage{}, &LogStorage{}} {
+			assert.Same(t, storage, WithContext(storage))
+		}
+	})
+
+	t.Run("adapted", func(t *testing.T) {
+		storage := WithContext(MemStorage{}.Initialize())
+		ctx := context.Background()
+
+		meta, err := storage.CompareAndSwapContext(ctx, "a", []byte("test data"), StoreOptions{}, Precondition{})
+		require.NoError(t, err)
+		data, got, err := storage.RetrieveEntryContext(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		assert.Equal(t, meta, got)
+		got, err = storage.RetrieveMetadataContext(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, meta, got)
+
+		names, next, err := storage.ListNamesContext(ctx, "", "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, names)
+		assert.Empty(t, next)
+
+		metas, err := storage.ApplyBatchContext(ctx, []BatchOp{
+			{Name: "b", Data: []byte("test data b")},
+		})
+		require.NoError(t, err)
+		assert.Len(t, metas, 1)
+
+		require.NoError(t, storage.CompareAndDeleteContext(ctx, "a", Precondition{}))
+		_, _, err = storage.RetrieveEntryContext(ctx, "a")
+		assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		backing := MemStorage{}.Initialize()
+		storage := WithContext(backing)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := storage.CompareAndSwapContext(ctx, "a", []byte("test data"), StoreOptions{}, Precondition{})
+		assert.ErrorIs(t, err, context.Canceled)
+		_, err = storage.ApplyBatchContext(ctx, []BatchOp{{Name: "b"}})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// Neither was applied
+		names, _, err := backing.ListNames("", "", 0)
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		storage := WithContext(blockingStorage{
+			DataStorage: MemStorage{}.Initialize(),
+			release:     release,
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := storage.RetrieveEntryContext(ctx, "a")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		_, _, err = storage.ListNamesContext(ctx, "", "", 0)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestNativeContext_Abandoned(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	ls, err := LogStorage{}.Initialize(t.TempDir(), LogStorageOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { ls.Close() })
+
+	for name, storage := range map[string]ContextStorage{"FileStorage": fs, "LogStorage": ls} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, storage.StoreData("kept", []byte("test data")))
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := storage.CompareAndSwapContext(ctx, "a", []byte("test data"), StoreOptions{}, Precondition{})
+			assert.ErrorIs(t, err, context.Canceled)
+			_, err = storage.ApplyBatchContext(ctx, []BatchOp{{Name: "b"}})
+			assert.ErrorIs(t, err, context.Canceled)
+			err = storage.CompareAndDeleteContext(ctx, "kept", Precondition{})
+			assert.ErrorIs(t, err, context.Canceled)
+			_, _, err = storage.ListNamesContext(ctx, "", "", 0)
+			assert.ErrorIs(t, err, context.Canceled)
+
+			// None was applied
+			names, _, err := storage.ListNames("", "", 0)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"kept"}, names)
+		})
+	}
+}
+
+func TestStoreStreamContext(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+
+	for name, storage := range map[string]DataStorage{
+		"streaming":     fs,
+		"not streaming": MemStorage{}.Initialize(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			meta, err := StoreStreamContext(context.Background(), storage, "a",
+				strings.NewReader("test data"), StoreOptions{}, Precondition{})
+			require.NoError(t, err)
+			assert.Equal(t, len("test data"), meta.Size)
+
+			// Cancelled while reading the data
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, err = StoreStreamContext(ctx, storage, "b", &cancellingReader{
+				cancel: cancel,
+				r:      strings.NewReader(strings.Repeat("test data ", 1<<12)),
+			}, StoreOptions{}, Precondition{})
+			assert.ErrorIs(t, err, context.Canceled)
+
+			_, err = storage.RetrieveMetadata("b")
+			assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+		})
+	}
+}
+
+func TestRetrieveStreamContext(t *testing.T) {
+	storage := MemStorage{}.Initialize()
+	require.NoError(t, storage.StoreData("a", []byte("test data")))
+
+	stream, meta, err := RetrieveStreamContext(context.Background(), storage, "a")
+	require.NoError(t, err)
+	data, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	assert.Equal(t, []byte("test data"), data)
+	assert.Equal(t, len(data), meta.Size)
+
+	_, _, err = RetrieveStreamContext(context.Background(), storage, "b")
+	assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+
+	// Reads fail once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, _, err = RetrieveStreamContext(ctx, storage, "a")
+	require.NoError(t, err)
+	defer stream.Close()
+	cancel()
+	_, err = io.ReadAll(stream)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, _, err = RetrieveStreamContext(ctx, storage, "a")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// contextKey keys the value `contextRecorder` checks contexts for.
+type contextKey struct{}
+
+// contextRecorder is a `ContextStorage` recording the contexts its operations
+// are called within.
+type contextRecorder struct {
+	ContextStorage
+	mu   *sync.Mutex
+	ctxs *[]context.Context
+}
+
+func (r contextRecorder) record(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.ctxs = append(*r.ctxs, ctx)
+}
+
+func (r contextRecorder) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	r.record(ctx)
+	return r.ContextStorage.RetrieveEntryContext(ctx, name)
+}
+
+func (r contextRecorder) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	r.record(ctx)
+	return r.ContextStorage.RetrieveMetadataContext(ctx, name)
+}
+
+func (r contextRecorder) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	r.record(ctx)
+	return r.ContextStorage.CompareAndSwapContext(ctx, name, data, opts, cond)
+}
+
+func (r contextRecorder) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	r.record(ctx)
+	return r.ContextStorage.CompareAndDeleteContext(ctx, name, cond)
+}
+
+func (r contextRecorder) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	r.record(ctx)
+	return r.ContextStorage.ListNamesContext(ctx, prefix, cursor, limit)
+}
+
+func (r contextRecorder) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	r.record(ctx)
+	return r.ContextStorage.ApplyBatchContext(ctx, ops)
+}
+
+func TestDecoratorContext(t *testing.T) {
+	decorators := map[string]func(t *testing.T, backing DataStorage) ContextStorage{
+		"BucketStorage": func(t *testing.T, backing DataStorage) ContextStorage {
+			bs, err := BucketStorage{}.Initialize(backing)
+			require.NoError(t, err)
+			return bs
+		},
+		"Bucket": func(t *testing.T, backing DataStorage) ContextStorage {
+			bs, err := BucketStorage{}.Initialize(backing)
+			require.NoError(t, err)
+			require.NoError(t, bs.CreateBucket("bucket", BucketConfig{}))
+			bucket, err := bs.Bucket("bucket")
+			require.NoError(t, err)
+			return bucket.(ContextStorage)
+		},
+		"CachedStorage": func(t *testing.T, backing DataStorage) ContextStorage {
+			cs, err := CachedStorage{}.Initialize(backing, CachedStorageConfig{MaxEntries: 10})
+			require.NoError(t, err)
+			return cs
+		},
+		"ChangeFeed": func(t *testing.T, backing DataStorage) ContextStorage {
+			return ChangeFeed{}.Initialize(backing, 0)
+		},
+		"QuotaStorage": func(t *testing.T, backing DataStorage) ContextStorage {
+			qs, err := QuotaStorage{}.Initialize(backing, QuotaStorageConfig{})
+			require.NoError(t, err)
+			return qs
+		},
+		"VersionedStorage": func(t *testing.T, backing DataStorage) ContextStorage {
+			return VersionedStorage{}.Initialize(backing, 5)
+		},
+	}
+
+	for name, decorate := range decorators {
+		decorate := decorate
+		t.Run(name, func(t *testing.T) {
+			t.Run("native", func(t *testing.T) {
+				var ctxs []context.Context
+				storage := decorate(t, contextRecorder{
+					ContextStorage: WithContext(MemStorage{}.Initialize()),
+					mu:             &sync.Mutex{},
+					ctxs:           &ctxs,
+				})
+				assert.Same(t, storage, WithContext(storage))
+				ctx := context.WithValue(context.Background(), contextKey{}, name)
+
+				_, err := storage.CompareAndSwapContext(ctx, "a", []byte("test data"), StoreOptions{}, Precondition{})
+				require.NoError(t, err)
+				_, _, err = storage.RetrieveEntryContext(ctx, "a")
+				require.NoError(t, err)
+				_, err = storage.RetrieveMetadataContext(ctx, "a")
+				require.NoError(t, err)
+				_, _, err = storage.ListNamesContext(ctx, "", "", 0)
+				require.NoError(t, err)
+				_, err = storage.ApplyBatchContext(ctx, []BatchOp{
+					{Name: "b", Data: []byte("test data b")},
+				})
+				require.NoError(t, err)
+				require.NoError(t, storage.CompareAndDeleteContext(ctx, "a", Precondition{}))
+
+				// Every operation reached the backing storage within `ctx`
+				require.NotEmpty(t, ctxs)
+				for _, got := range ctxs {
+					assert.Equal(t, name, got.Value(contextKey{}))
+				}
+			})
+
+			t.Run("adapted", func(t *testing.T) {
+				storage := decorate(t, MemStorage{}.Initialize())
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := storage.CompareAndSwapContext(ctx, "a", []byte("test data"), StoreOptions{}, Precondition{})
+				assert.ErrorIs(t, err, context.Canceled)
+				_, _, err = storage.RetrieveEntry("a")
+				assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+			})
+		})
+	}
+}
@@ -1,5 +1,16 @@
 package datastorage
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
 // DataStorage is an interface to be satisified by any storage implementation,
 // regardless of whether it is in memory, drive, etc.
 type DataStorage interface {
@@ -21,6 +32,24 @@ type DataStorage interface {
 	// Callers may assume this method is thread safe.
 	StoreData(name string, data []byte) error
 
+	// StoreDataWithOptions behaves as `StoreData`, additionally applying the
+	// given `opts` to the entry - e.g. an expiry.
+	//
+	// Callers may assume this method is thread safe.
+	StoreDataWithOptions(name string, data []byte, opts StoreOptions) error
+
+	// RetrieveEntry behaves as `RetrieveData`, additionally returning the
+	// `Metadata` of the entry.
+	//
+	// This method is thread safe.
+	RetrieveEntry(name string) ([]byte, Metadata, error)
+
+	// RetrieveMetadata behaves as `RetrieveEntry`, returning only the
+	// `Metadata` - without reading the data where the storage allows.
+	//
+	// This method is thread safe.
+	RetrieveMetadata(name string) (Metadata, error)
+
 	// DeleteData allows uers to delete data associated with a given `name`.
 	//
 	// This method returns an error if there is no data associated with `name`,
@@ -28,4 +57,372 @@ type DataStorage interface {
 	//
 	// Callers may assume this method is thread safe.
 	DeleteData(name string) error
+
+	// CompareAndSwap atomically checks `cond` against the current entry of
+	// `name`, and only if it holds behaves as `StoreDataWithOptions` -
+	// returning the `Metadata` of the new entry.
+	//
+	// Returns `customerrors.DataStoragePreconditionFailed` if `cond` does not
+	// hold.
+	//
+	// Callers may assume this method is thread safe.
+	CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error)
+
+	// CompareAndDelete atomically checks `cond` against the current entry of
+	// `name`, and only if it holds behaves as `DeleteData`.
+	//
+	// Callers may assume this method is thread safe.
+	CompareAndDelete(name string, cond Precondition) error
+
+	// ListNames lists the names of entries beginning with `prefix`, in
+	// ascending byte order, starting after `cursor` and returning at most
+	// `limit` names (all if not positive).
+	//
+	// Also returns the cursor of the next page, empty once there are no more.
+	// Pages are stable under concurrent writes: a name is never listed twice,
+	// and names present throughout are always listed.
+	//
+	// Callers may assume this method is thread safe.
+	ListNames(prefix, cursor string, limit int) ([]string, string, error)
+
+	// ApplyBatch atomically applies every operation of `ops`, or none of them.
+	//
+	// Each operation is checked against the current entry of its name as if by
+	// `CompareAndSwap` or `CompareAndDelete`, and only if every check passes
+	// are they all applied - returning the `Metadata` of each new entry in
+	// order, zero for deletions. Otherwise returns the error of the first
+	// operation to fail its check, e.g. `customerrors.DataStoragePreconditionFailed`.
+	//
+	// Returns `customerrors.DataStorageBatchInvalid` if a name appears more
+	// than once.
+	//
+	// Callers may assume this method is thread safe.
+	ApplyBatch(ops []BatchOp) ([]Metadata, error)
+
+	// PurgeExpired permanently removes all expired entries, returning how many
+	// were removed.
+	//
+	// Expired entries are already treated as not found by every other method,
+	// this only reclaims their space - see `Reaper`.
+	//
+	// Callers may assume this method is thread safe.
+	PurgeExpired() (int, error)
+}
+
+// StoreOptions are optional settings applied to an entry when it is stored.
+type StoreOptions struct {
+	// TTL is how long the entry lives before expiring, never expires if zero.
+	TTL time.Duration
+
+	// ContentType is the MIME type of the data, if known.
+	ContentType string
+
+	// Revision, CreatedAt and UpdatedAt are kept as the `Metadata` of the
+	// entry where set, rather than assigned by the storage - so an entry can
+	// be copied as it is, keeping its ETag. A `Revision` lower than that of
+	// the entry it overwrites is ignored, as revisions never go backwards.
+	Revision  uint64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Metadata describes an entry held by a `DataStorage`.
+//
+// Entries written by older versions of the storage may lack any field other
+// than `Revision` and `ExpiresAt`.
+type Metadata struct {
+	// Revision identifies this write of the entry, changing on every write -
+	// see `nextRevision`.
+	Revision uint64 `json:"revision,omitempty"`
+
+	// ExpiresAt is when the entry expires, zero if it never does.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// ContentType is the MIME type of the data, empty if unknown.
+	ContentType string `json:"content_type,omitempty"`
+
+	// Size is the length of the data in bytes.
+	Size int `json:"size"`
+
+	// Checksum is the hex encoded SHA-256 hash of the data.
+	Checksum string `json:"checksum,omitempty"`
+
+	// CreatedAt is when the name was first written, kept across overwrites
+	// but not deletion or expiry.
+	CreatedAt time.Time `json:"created_at,omitempty"`
+
+	// UpdatedAt is when the entry was last written.
+	UpdatedAt time.Time `json:"updated_at,omitempty"`
+}
+
+// Expired reports whether the entry has expired as of `now`.
+func (m Metadata) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// TTL returns the time remaining before the entry expires as of `now`, zero if
+// it never expires.
+func (m Metadata) TTL(now time.Time) time.Duration {
+	if m.ExpiresAt.IsZero() {
+		return 0
+	}
+	if ttl := m.ExpiresAt.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// metadata returns the `Metadata` of `data` stored at `now` with `opts`,
+// overwriting an entry with `prev` if it `exists` (and has not expired).
+//
+// The revision is left to the caller.
+func (opts StoreOptions) metadata(data []byte, prev Metadata, exists bool, now time.Time) Metadata {
+	checksum := sha256.Sum256(data)
+	return opts.streamMetadata(int64(len(data)), hex.EncodeToString(checksum[:]), prev, exists, now)
+}
+
+// streamMetadata behaves as `metadata`, for data of `size` bytes and the hex
+// encoded SHA-256 `checksum` measured as it was streamed.
+func (opts StoreOptions) streamMetadata(size int64, checksum string, prev Metadata, exists bool, now time.Time) Metadata {
+	now = now.UTC()
+	meta := Metadata{
+		ContentType: opts.ContentType,
+		Size:        int(size),
+		Checksum:    checksum,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if exists && !prev.CreatedAt.IsZero() {
+		meta.CreatedAt = prev.CreatedAt
+	}
+	if !opts.CreatedAt.IsZero() {
+		meta.CreatedAt = opts.CreatedAt.UTC()
+	}
+	if !opts.UpdatedAt.IsZero() {
+		meta.UpdatedAt = opts.UpdatedAt.UTC()
+	}
+	if opts.TTL > 0 {
+		meta.ExpiresAt = now.Add(opts.TTL)
+	}
+	return meta
+}
+
+// revision returns the revision of a write with `opts` of an entry
+// overwriting one at revision `prev` (zero if none), `last` being the latest
+// revision the storage assigned the name - `opts.Revision` if kept, see
+// `StoreOptions`, else `nextRevision(last)`.
+func (opts StoreOptions) revision(prev, last uint64) uint64 {
+	if opts.Revision > 0 && opts.Revision >= prev {
+		return opts.Revision
+	}
+	return nextRevision(last)
+}
+
+// nextRevision returns the revision of a write following one at revision
+// `last`.
+//
+// Revisions are the current time in nanoseconds where that is greater than
+// `last`, so a name deleted and written again (even across restarts) does not
+// reuse a revision an earlier client may hold.
+func nextRevision(last uint64) uint64 {
+	if now := uint64(timeNow().UnixNano()); now > last {
+		return now
+	}
+	return last + 1
+}
+
+// pageNames returns the page of `names` (in any order) beginning with `prefix`
+// and after `cursor`, as `ListNames` - reusing the storage of `names`.
+func pageNames(names []string, prefix, cursor string, limit int) ([]string, string) {
+	page := names[:0]
+	for _, name := range names {
+		if name > cursor && strings.HasPrefix(name, prefix) {
+			page = append(page, name)
+		}
+	}
+	sort.Strings(page)
+
+	if limit > 0 && len(page) > limit {
+		page = page[:limit]
+		return page, page[limit-1]
+	}
+	return page, ""
+}
+
+// listBatchSize is the fewest names `listNamesWhere` lists from its backing
+// storage at once.
+const listBatchSize = 256
+
+// listNamesExcept lists names in `backing` as `ListNames`, leaving out those
+// beginning with `hidden` - such as the internal names of a decorator.
+func listNamesExcept(backing DataStorage, hidden, prefix, cursor string, limit int) ([]string, string, error) {
+	return listNamesWhere(backing, func(name string) bool {
+		return !strings.HasPrefix(name, hidden)
+	}, prefix, cursor, limit)
+}
+
+// reservedNamePrefix begins the names every decorator keeps its internal
+// keys under in its backing storage, such as `bucketKeyPrefix`.
+const reservedNamePrefix = "\x00"
+
+// IsReservedName reports whether `name` begins as the internal keys of
+// decorators do - such names are never those of user data, so should be
+// refused wherever clients name data.
+func IsReservedName(name string) bool {
+	return strings.HasPrefix(name, reservedNamePrefix)
+}
+
+// checkName returns a `customerrors.DataStorageNameReserved` if `name` begins
+// with `reserved`, the prefix of a decorator's internal keys - which callers
+// must not read or write past it.
+func checkName(name, reserved string) error {
+	if strings.HasPrefix(name, reserved) {
+		return customerrors.DataStorageNameReserved{
+			Name: name,
+		}
+	}
+	return nil
+}
+
+// checkBatchNames behaves as `checkName` for the name of every operation of
+// `ops`.
+func checkBatchNames(ops []BatchOp, reserved string) error {
+	for _, op := range ops {
+		if err := checkName(op.Name, reserved); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listNamesWhere lists names in `backing` as `ListNames`, leaving out those
+// for which `listed` is false.
+func listNamesWhere(backing DataStorage, listed func(name string) bool, prefix, cursor string, limit int) ([]string, string, error) {
+	// List whole batches even for small limits, so a long run of unlisted
+	// names (such as adjacent internal names) is skipped in few calls
+	batchSize := limit
+	if batchSize > 0 && batchSize < listBatchSize {
+		batchSize = listBatchSize
+	}
+
+	names := []string{}
+	for {
+		batch, next, err := backing.ListNames(prefix, cursor, batchSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, name := range batch {
+			if !listed(name) {
+				continue
+			}
+			if limit > 0 && len(names) == limit {
+				// More remain after this page
+				return names, names[limit-1], nil
+			}
+			names = append(names, name)
+		}
+
+		if len(next) == 0 {
+			return names, "", nil
+		}
+		cursor = next
+	}
+}
+
+// Precondition is a condition on the current entry of a name, checked by
+// `CompareAndSwap` and `CompareAndDelete`, modelled on HTTP conditional
+// requests. Expired entries do not exist.
+//
+// The zero value always holds.
+type Precondition struct {
+	// MustExist requires the entry to exist, at any revision.
+	MustExist bool
+
+	// MustNotExist requires the entry to not exist.
+	MustNotExist bool
+
+	// IfMatch, unless empty, requires the entry to exist at one of these
+	// revisions.
+	IfMatch []uint64
+
+	// IfNoneMatch requires the entry to not exist at any of these revisions.
+	IfNoneMatch []uint64
+}
+
+// Check returns a `customerrors.DataStoragePreconditionFailed` unless `cond`
+// holds for an entry of `name` with `meta`, or no entry if not `exists`.
+func (cond Precondition) Check(name string, meta Metadata, exists bool) error {
+	failed := func(reason string) error {
+		return customerrors.DataStoragePreconditionFailed{
+			Name:   name,
+			Reason: reason,
+		}
+	}
+
+	if cond.MustExist && !exists {
+		return failed("data does not exist")
+	}
+	if cond.MustNotExist && exists {
+		return failed("data already exists")
+	}
+	if len(cond.IfMatch) > 0 && (!exists || !containsRevision(cond.IfMatch, meta.Revision)) {
+		return failed("revision does not match")
+	}
+	if exists && containsRevision(cond.IfNoneMatch, meta.Revision) {
+		return failed("revision matches")
+	}
+
+	return nil
+}
+
+func containsRevision(revisions []uint64, revision uint64) bool {
+	for _, r := range revisions {
+		if r == revision {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchOp is a single store or deletion of an `ApplyBatch`.
+type BatchOp struct {
+	// Name is the name written, unique within the batch.
+	Name string
+
+	// Delete deletes the entry of `Name`, which must exist, rather than
+	// storing `Data`.
+	Delete bool
+
+	// Data and Options are stored as per `StoreDataWithOptions`.
+	Data    []byte
+	Options StoreOptions
+
+	// Precondition must hold for the current entry of `Name`.
+	Precondition Precondition
+}
+
+// check returns the error of `op` against the current entry of its name with
+// `meta`, or no entry if not `exists`, nil if it may be applied.
+func (op BatchOp) check(meta Metadata, exists bool) error {
+	if op.Delete && !exists {
+		return customerrors.DataStorageNameNotFound{
+			Name: op.Name,
+		}
+	}
+	return op.Precondition.Check(op.Name, meta, exists)
+}
+
+// validateBatch returns a `customerrors.DataStorageBatchInvalid` if a name
+// appears more than once in `ops`.
+func validateBatch(ops []BatchOp) error {
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if seen[op.Name] {
+			return customerrors.DataStorageBatchInvalid{
+				Reason: fmt.Sprintf("name: %s appears more than once", op.Name),
+			}
+		}
+		seen[op.Name] = true
+	}
+	return nil
 }
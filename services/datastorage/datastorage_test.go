@@ -0,0 +1,433 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextRevision(t *testing.T) {
+	now := fakeClock(t)
+
+	rev := nextRevision(0)
+	assert.Equal(t, uint64(now.UnixNano()), rev)
+
+	// The clock has not moved on, or has gone backwards
+	assert.Equal(t, rev+1, nextRevision(rev))
+	*now = now.Add(-time.Hour)
+	assert.Equal(t, rev+1, nextRevision(rev))
+}
+
+func TestPrecondition_Check(t *testing.T) {
+	meta := Metadata{Revision: 7}
+
+	for name, tc := range map[string]struct {
+		cond    Precondition
+		exists  bool
+		holdsOK bool
+	}{
+		"zero value":              {Precondition{}, false, true},
+		"must exist, exists":      {Precondition{MustExist: true}, true, true},
+		"must exist, missing":     {Precondition{MustExist: true}, false, false},
+		"must not exist, exists":  {Precondition{MustNotExist: true}, true, false},
+		"must not exist, missing": {Precondition{MustNotExist: true}, false, true},
+		"if match, matches":       {Precondition{IfMatch: []uint64{3, 7}}, true, true},
+		"if match, differs":       {Precondition{IfMatch: []uint64{3}}, true, false},
+		"if match, missing":       {Precondition{IfMatch: []uint64{7}}, false, false},
+		"if none match, matches":  {Precondition{IfNoneMatch: []uint64{7}}, true, false},
+		"if none match, differs":  {Precondition{IfNoneMatch: []uint64{3}}, true, true},
+		"if none match, missing":  {Precondition{IfNoneMatch: []uint64{7}}, false, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cond.Check("test", meta, tc.exists)
+			if tc.holdsOK {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorAs(t, err, &customerrors.DataStoragePreconditionFailed{})
+			}
+		})
+	}
+}
+
+// testStorageConditionalWrites checks the revision and compare-and-swap
+// behaviour every `DataStorage` shares.
+func testStorageConditionalWrites(t *testing.T, storage DataStorage) {
+	t.Helper()
+	dataName := "conditional"
+	failed := &customerrors.DataStoragePreconditionFailed{}
+
+	created, err := storage.CompareAndSwap(
+		dataName, []byte("v1"), StoreOptions{}, Precondition{MustNotExist: true},
+	)
+	require.NoError(t, err)
+	assert.NotZero(t, created.Revision)
+
+	t.Run("revision is retrievable", func(t *testing.T) {
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, created.Revision, meta.Revision)
+	})
+
+	t.Run("create only once", func(t *testing.T) {
+		_, err := storage.CompareAndSwap(
+			dataName, []byte("v2"), StoreOptions{}, Precondition{MustNotExist: true},
+		)
+		assert.ErrorAs(t, err, failed)
+	})
+
+	t.Run("swap", func(t *testing.T) {
+		swapped, err := storage.CompareAndSwap(
+			dataName, []byte("v2"), StoreOptions{}, Precondition{IfMatch: []uint64{created.Revision}},
+		)
+		require.NoError(t, err)
+		assert.NotEqual(t, created.Revision, swapped.Revision)
+
+		// The first revision is now stale
+		_, err = storage.CompareAndSwap(
+			dataName, []byte("v3"), StoreOptions{}, Precondition{IfMatch: []uint64{created.Revision}},
+		)
+		assert.ErrorAs(t, err, failed)
+		data, err := storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+
+		// Unconditional writes also change the revision
+		require.NoError(t, storage.StoreData(dataName, []byte("v3")))
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+		assert.NotEqual(t, swapped.Revision, meta.Revision)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+
+		err = storage.CompareAndDelete(dataName, Precondition{IfMatch: []uint64{created.Revision}})
+		assert.ErrorAs(t, err, failed)
+		_, err = storage.RetrieveData(dataName)
+		require.NoError(t, err)
+
+		err = storage.CompareAndDelete(dataName, Precondition{IfMatch: []uint64{meta.Revision}})
+		require.NoError(t, err)
+		_, err = storage.RetrieveData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		err = storage.CompareAndDelete(dataName, Precondition{MustExist: true})
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("recreated names get new revisions", func(t *testing.T) {
+		recreated, err := storage.CompareAndSwap(
+			dataName, []byte("v1"), StoreOptions{}, Precondition{MustNotExist: true},
+		)
+		require.NoError(t, err)
+		assert.Greater(t, recreated.Revision, created.Revision)
+	})
+}
+
+// testStorageMetadata checks the entry `Metadata` every `DataStorage` keeps.
+func testStorageMetadata(t *testing.T, storage DataStorage) {
+	t.Helper()
+	now := fakeClock(t)
+	created := *now
+	dataName := "described"
+
+	stored, err := storage.CompareAndSwap(
+		dataName, []byte("hello"), StoreOptions{ContentType: "text/plain"}, Precondition{},
+	)
+	require.NoError(t, err)
+
+	t.Run("stored", func(t *testing.T) {
+		for _, retrieve := range []func() (Metadata, error){
+			func() (Metadata, error) {
+				_, meta, err := storage.RetrieveEntry(dataName)
+				return meta, err
+			},
+			func() (Metadata, error) { return storage.RetrieveMetadata(dataName) },
+		} {
+			meta, err := retrieve()
+			require.NoError(t, err)
+			assert.Equal(t, stored.Revision, meta.Revision)
+			assert.Equal(t, "text/plain", meta.ContentType)
+			assert.Equal(t, 5, meta.Size)
+			// sha256sum <<< "hello" without the trailing newline
+			assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", meta.Checksum)
+			assert.WithinDuration(t, created, meta.CreatedAt, time.Millisecond)
+			assert.WithinDuration(t, created, meta.UpdatedAt, time.Millisecond)
+		}
+	})
+
+	t.Run("overwritten", func(t *testing.T) {
+		*now = now.Add(time.Hour)
+		require.NoError(t, storage.StoreData(dataName, []byte("")))
+
+		meta, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.Empty(t, meta.ContentType)
+		assert.Zero(t, meta.Size)
+		assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", meta.Checksum)
+		assert.WithinDuration(t, created, meta.CreatedAt, time.Millisecond)
+		assert.WithinDuration(t, *now, meta.UpdatedAt, time.Millisecond)
+	})
+
+	t.Run("recreated", func(t *testing.T) {
+		require.NoError(t, storage.DeleteData(dataName))
+		_, err := storage.RetrieveMetadata(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		require.NoError(t, storage.StoreData(dataName, []byte("hello")))
+		meta, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.WithinDuration(t, *now, meta.CreatedAt, time.Millisecond)
+	})
+}
+
+func TestPageNames(t *testing.T) {
+	names := []string{"b", "a/2", "c", "a/1", "a/3"}
+
+	page, next := pageNames(append([]string{}, names...), "", "", 2)
+	assert.Equal(t, []string{"a/1", "a/2"}, page)
+	assert.Equal(t, "a/2", next)
+
+	page, next = pageNames(append([]string{}, names...), "a/", "a/2", 0)
+	assert.Equal(t, []string{"a/3"}, page)
+	assert.Empty(t, next)
+
+	// A full last page has no next page
+	page, next = pageNames(append([]string{}, names...), "a/", "", 3)
+	assert.Len(t, page, 3)
+	assert.Empty(t, next)
+}
+
+// testStorageListNames checks the name listing every `DataStorage` shares.
+func testStorageListNames(t *testing.T, storage DataStorage) {
+	t.Helper()
+	now := fakeClock(t)
+
+	for _, name := range []string{"list/b", "list/a", "list/d", "lists", "other"} {
+		require.NoError(t, storage.StoreData(name, []byte("test data")))
+	}
+	require.NoError(t, storage.StoreDataWithOptions(
+		"list/expired", []byte("test data"), StoreOptions{TTL: time.Minute},
+	))
+	*now = now.Add(time.Hour)
+
+	listAll := func(t *testing.T, prefix string, limit int) []string {
+		var (
+			all    []string
+			cursor string
+		)
+		for pages := 0; ; pages++ {
+			require.Less(t, pages, 10, "pagination does not terminate")
+			page, next, err := storage.ListNames(prefix, cursor, limit)
+			require.NoError(t, err)
+			require.NotNil(t, page)
+			if limit > 0 {
+				assert.LessOrEqual(t, len(page), limit)
+			}
+			all = append(all, page...)
+			if len(next) == 0 {
+				return all
+			}
+			cursor = next
+		}
+	}
+
+	t.Run("everything", func(t *testing.T) {
+		assert.Equal(t, []string{"list/a", "list/b", "list/d", "lists", "other"}, listAll(t, "", 0))
+	})
+
+	t.Run("prefix pages", func(t *testing.T) {
+		for limit := 1; limit <= 4; limit++ {
+			assert.Equal(t, []string{"list/a", "list/b", "list/d"}, listAll(t, "list/", limit))
+		}
+
+		page, next, err := storage.ListNames("nothing", "", 10)
+		require.NoError(t, err)
+		assert.Empty(t, page)
+		assert.Empty(t, next)
+	})
+
+	t.Run("stable under writes", func(t *testing.T) {
+		page, next, err := storage.ListNames("list/", "", 1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"list/a"}, page)
+
+		// Written before and after the cursor, and the next name deleted
+		require.NoError(t, storage.StoreData("list/0", []byte("test data")))
+		require.NoError(t, storage.StoreData("list/c", []byte("test data")))
+		require.NoError(t, storage.DeleteData("list/b"))
+
+		page, _, err = storage.ListNames("list/", next, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"list/c", "list/d"}, page)
+	})
+}
+
+// testStorageBatch tests the atomicity of `ApplyBatch` against any
+// `DataStorage`.
+func testStorageBatch(t *testing.T, storage DataStorage) {
+	t.Helper()
+	failed := &customerrors.DataStoragePreconditionFailed{}
+
+	require.NoError(t, storage.StoreData("batch/old", []byte("old")))
+	_, old, err := storage.RetrieveEntry("batch/old")
+	require.NoError(t, err)
+
+	metas, err := storage.ApplyBatch([]BatchOp{
+		{Name: "batch/a", Data: []byte("a1"), Options: StoreOptions{ContentType: "text/plain"}},
+		{Name: "batch/b", Data: []byte("b1"), Precondition: Precondition{MustNotExist: true}},
+		{Name: "batch/old", Delete: true, Precondition: Precondition{IfMatch: []uint64{old.Revision}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+
+	t.Run("applied", func(t *testing.T) {
+		data, meta, err := storage.RetrieveEntry("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		assert.Equal(t, "text/plain", meta.ContentType)
+		assert.Equal(t, metas[0].Revision, meta.Revision)
+
+		data, meta, err = storage.RetrieveEntry("batch/b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("b1"), data)
+		assert.Equal(t, metas[1].Revision, meta.Revision)
+
+		_, err = storage.RetrieveData("batch/old")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("failed precondition applies nothing", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]BatchOp{
+			{Name: "batch/a", Data: []byte("a2")},
+			{Name: "batch/c", Data: []byte("c1")},
+			{Name: "batch/b", Data: []byte("b2"), Precondition: Precondition{IfMatch: []uint64{old.Revision}}},
+		})
+		assert.ErrorAs(t, err, failed)
+
+		data, err := storage.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		_, err = storage.RetrieveData("batch/c")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("missing delete applies nothing", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]BatchOp{
+			{Name: "batch/a", Delete: true},
+			{Name: "batch/missing", Delete: true},
+		})
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		_, err = storage.RetrieveData("batch/a")
+		assert.NoError(t, err)
+	})
+
+	t.Run("duplicate names are invalid", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]BatchOp{
+			{Name: "batch/c", Data: []byte("c1")},
+			{Name: "batch/c", Delete: true},
+		})
+		assert.ErrorAs(t, err, &customerrors.DataStorageBatchInvalid{})
+
+		_, err = storage.RetrieveData("batch/c")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		metas, err := storage.ApplyBatch(nil)
+		require.NoError(t, err)
+		assert.Empty(t, metas)
+	})
+}
+
+// errReader fails with `err` once `data` is read.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// testStorageStreaming tests `StoreStream` and `RetrieveStream` against any
+// `DataStorage`, whether or not it streams natively.
+func testStorageStreaming(t *testing.T, storage DataStorage) {
+	t.Helper()
+	dataName := "stream"
+	data := bytes.Repeat([]byte("streamed data "), 100_000)
+
+	meta, err := StoreStream(storage, dataName, bytes.NewReader(data), StoreOptions{
+		ContentType: "text/plain",
+	}, Precondition{MustNotExist: true})
+	require.NoError(t, err)
+	checksum := sha256.Sum256(data)
+	assert.Equal(t, len(data), meta.Size)
+	assert.Equal(t, hex.EncodeToString(checksum[:]), meta.Checksum)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	t.Run("retrieve", func(t *testing.T) {
+		stream, streamed, err := RetrieveStream(storage, dataName)
+		require.NoError(t, err)
+		defer stream.Close()
+		assert.Equal(t, meta.Revision, streamed.Revision)
+		assert.Equal(t, meta.Checksum, streamed.Checksum)
+
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+
+		// Readable as a whole too
+		retrieved, err = storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+
+		_, _, err = RetrieveStream(storage, "missing")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("reads are isolated from later writes", func(t *testing.T) {
+		stream, _, err := RetrieveStream(storage, dataName)
+		require.NoError(t, err)
+		defer stream.Close()
+		require.NoError(t, storage.StoreData(dataName, []byte("overwritten")))
+
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+	})
+
+	t.Run("failed precondition", func(t *testing.T) {
+		_, err := StoreStream(
+			storage, dataName, bytes.NewReader(data), StoreOptions{}, Precondition{MustNotExist: true},
+		)
+		assert.ErrorAs(t, err, &customerrors.DataStoragePreconditionFailed{})
+	})
+
+	t.Run("failed read stores nothing", func(t *testing.T) {
+		failed := errors.New("connection reset")
+		_, err := StoreStream(storage, "torn", &errReader{
+			data: data[:1000],
+			err:  failed,
+		}, StoreOptions{}, Precondition{})
+		assert.ErrorIs(t, err, failed)
+
+		_, err = storage.RetrieveData("torn")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
@@ -0,0 +1,622 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// encryptionMagic begins every value an `EncryptedStorage` writes to its
+	// backing storage, followed by:
+	// key ID length (1) | key ID | nonce prefix (8) | sealed size (8) and
+	// SHA-256 checksum (32) | sealed data segments
+	//
+	// The data is sealed in segments of `encryptSegmentSize` bytes, so it can
+	// be streamed without ever holding it whole, each with the nonce:
+	// nonce prefix | segment number (4, big endian)
+	// The size and checksum, of the data before encryption, are segment zero.
+	// Every segment is authenticated with the name of the entry, so values
+	// cannot be swapped between names - and with the sealed size, segments
+	// cannot be dropped, reordered or repeated unnoticed.
+	encryptionMagic = "\x00enc"
+
+	// encryptNoncePrefixSize is the size of the random nonce prefix of a
+	// value, the rest of the 12 byte GCM nonce numbering its segments.
+	encryptNoncePrefixSize = 8
+
+	// encryptSegmentSize is the size of the data sealed in each segment, but
+	// the last.
+	encryptSegmentSize = 64 << 10
+
+	// encryptSizesSize is the size of the size and checksum before sealing.
+	encryptSizesSize = 8 + sha256.Size
+
+	// encryptSpoolPrefix names the temporary files encrypted streams are
+	// spooled to.
+	encryptSpoolPrefix = "encrypt-spool-"
+)
+
+// EncryptedStorageConfig configures an `EncryptedStorage`.
+type EncryptedStorageConfig struct {
+	// SpoolDir holds the temporary files streamed data is encrypted to,
+	// defaults to `os.TempDir`. Only encrypted data is ever spooled.
+	SpoolDir string
+}
+
+// encryptionHeader is the header of a value written by an `EncryptedStorage`,
+// see `encryptionMagic`.
+type encryptionHeader struct {
+	keyID       string
+	aead        cipher.AEAD
+	noncePrefix [encryptNoncePrefixSize]byte
+	size        int64
+	checksum    [sha256.Size]byte
+}
+
+// encode serializes the header of the value of `name`, sealing its size and
+// checksum.
+func (h encryptionHeader) encode(name string) []byte {
+	header := make([]byte, 0, len(encryptionMagic)+1+len(h.keyID)+encryptNoncePrefixSize+encryptSizesSize+h.aead.Overhead())
+	header = append(header, encryptionMagic...)
+	header = append(header, byte(len(h.keyID)))
+	header = append(header, h.keyID...)
+	header = append(header, h.noncePrefix[:]...)
+
+	sizes := make([]byte, encryptSizesSize)
+	binary.BigEndian.PutUint64(sizes, uint64(h.size))
+	copy(sizes[8:], h.checksum[:])
+	return h.aead.Seal(header, h.nonce(0), sizes, []byte(name))
+}
+
+// nonce returns the nonce of segment `segment`.
+func (h encryptionHeader) nonce(segment uint32) []byte {
+	nonce := make([]byte, encryptNoncePrefixSize+4)
+	copy(nonce, h.noncePrefix[:])
+	binary.BigEndian.PutUint32(nonce[encryptNoncePrefixSize:], segment)
+	return nonce
+}
+
+// metadata returns `meta` of the stored value, describing the data before
+// encryption instead.
+func (h encryptionHeader) metadata(meta Metadata) Metadata {
+	meta.Size = int(h.size)
+	meta.Checksum = hex.EncodeToString(h.checksum[:])
+	return meta
+}
+
+// EncryptedStorage is a decorator that implements the `DataStorage` interface
+// by encrypting data with AES-GCM before storing it in its backing
+// `DataStorage`, and decrypting it when retrieved - so no data is held in
+// plaintext by the backing storage. Names, and `Metadata` other than the size
+// and checksum, are not encrypted.
+//
+// Data is encrypted with the newest key of a `Keyring`, the ID of which is
+// stored with it, so data encrypted with older keys remains readable after
+// the keys are rotated - until re-encrypted with the newest by `Reencrypt`.
+// Data stored before the backing storage was decorated is read as is.
+type EncryptedStorage struct {
+	backing DataStorage
+	keyring *Keyring
+	cfg     EncryptedStorageConfig
+}
+
+// Initialize initializes and returns a pointer to an `EncryptedStorage` in
+// front of `backing`, encrypting with the keys of `keyring`, configured by
+// `cfg`.
+//
+// The returned `EncryptedStorage` takes ownership of `backing` - `Close`
+// closes `backing` if it is an `io.Closer`.
+func (es EncryptedStorage) Initialize(backing DataStorage, keyring *Keyring, cfg EncryptedStorageConfig) *EncryptedStorage {
+	return &EncryptedStorage{
+		backing: backing,
+		keyring: keyring,
+		cfg:     cfg,
+	}
+}
+
+// RetrieveData retrieves the data associated with a given `name`, decrypted.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := es.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with a given
+// `name`, decrypted.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	value, meta, err := es.backing.RetrieveEntry(name)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	r, header, err := es.open(name, bytes.NewReader(value))
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	if header == nil {
+		// Stored before encryption
+		return value, meta, nil
+	}
+
+	data := bytes.NewBuffer(make([]byte, 0, header.size))
+	if _, err = io.Copy(data, r); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return data.Bytes(), header.metadata(meta), nil
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with a given `name`,
+// reading only the header of its data where the backing storage streams.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) RetrieveMetadata(name string) (Metadata, error) {
+	stream, meta, err := RetrieveStream(es.backing, name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer stream.Close()
+
+	_, header, err := es.open(name, stream)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if header != nil {
+		meta = header.metadata(meta)
+	}
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader which
+// decrypts the data as it is streamed from the backing storage.
+//
+// A reader returns an error, rather than any data, for a segment which fails
+// authentication.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	stream, meta, err := RetrieveStream(es.backing, name)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	r, header, err := es.open(name, stream)
+	if err != nil {
+		stream.Close()
+		return nil, Metadata{}, err
+	}
+	if header != nil {
+		meta = header.metadata(meta)
+	}
+	return readCloser{r, stream}, meta, nil
+}
+
+// StoreData encrypts data `[]byte` and stores it with an associated `name`.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) StoreData(name string, data []byte) error {
+	return es.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := es.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	value, header, err := es.encrypt(name, data)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta, err := es.backing.CompareAndSwap(name, value, opts, cond)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return header.metadata(meta), nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, encrypting the data read from `r`
+// to a temporary file to measure it, then streaming it to the backing
+// storage.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	sealed, header, err := es.seal(name, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer sealed.Close()
+
+	meta, err := StoreStream(es.backing, name, sealed, opts, cond)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return header.metadata(meta), nil
+}
+
+// DeleteData deletes data associated with a given `name`.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) DeleteData(name string) error {
+	return es.backing.DeleteData(name)
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) CompareAndDelete(name string, cond Precondition) error {
+	return es.backing.CompareAndDelete(name, cond)
+}
+
+// ApplyBatch atomically applies every operation of `ops`, or none of them, as
+// per `DataStorage` - encrypting the data of each store.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	var (
+		encrypted = make([]BatchOp, len(ops))
+		headers   = make([]encryptionHeader, len(ops))
+	)
+	for i, op := range ops {
+		encrypted[i] = op
+		if op.Delete {
+			continue
+		}
+
+		var err error
+		if encrypted[i].Data, headers[i], err = es.encrypt(op.Name, op.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	metas, err := es.backing.ApplyBatch(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		if !op.Delete {
+			metas[i] = headers[i].metadata(metas[i])
+		}
+	}
+	return metas, nil
+}
+
+// PurgeExpired permanently removes all expired entries from the backing
+// storage, returning how many were removed.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) PurgeExpired() (int, error) {
+	return es.backing.PurgeExpired()
+}
+
+// ListNames lists the names of entries beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return es.backing.ListNames(prefix, cursor, limit)
+}
+
+// Reencrypt reloads the keyring, then re-encrypts every entry not encrypted
+// with its newest key - including any stored before encryption - returning
+// how many were re-encrypted. Once done, older keys may be removed from the
+// key file.
+//
+// Entries keep their content type, expiry, revision and timestamps - as their
+// data is unchanged, so are ETags cached above. An entry written or deleted
+// while being re-encrypted is left as written.
+//
+// This method is thread safe.
+func (es *EncryptedStorage) Reencrypt() (int, error) {
+	if err := es.keyring.Reload(); err != nil {
+		return 0, err
+	}
+	current, _ := es.keyring.Current()
+
+	var (
+		reencrypted int
+		cursor      string
+	)
+	for {
+		names, next, err := es.backing.ListNames("", cursor, listBatchSize)
+		if err != nil {
+			return reencrypted, err
+		}
+		for _, name := range names {
+			ok, err := es.reencrypt(name, current)
+			if err != nil {
+				return reencrypted, err
+			}
+			if ok {
+				reencrypted++
+			}
+		}
+
+		if len(next) == 0 {
+			return reencrypted, nil
+		}
+		cursor = next
+	}
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (es *EncryptedStorage) Close() error {
+	if closer, ok := es.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// reencrypt re-encrypts the entry of `name` unless already encrypted with the
+// key with ID `current`, reporting whether it was.
+func (es *EncryptedStorage) reencrypt(name, current string) (bool, error) {
+	stream, meta, err := RetrieveStream(es.backing, name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	data, header, err := es.open(name, stream)
+	if err != nil || (header != nil && header.keyID == current) {
+		stream.Close()
+		return false, err
+	}
+
+	sealed, _, err := es.seal(name, data)
+	stream.Close()
+	if err != nil {
+		return false, err
+	}
+	defer sealed.Close()
+
+	opts := StoreOptions{
+		TTL:         meta.TTL(timeNow()),
+		ContentType: meta.ContentType,
+		Revision:    meta.Revision,
+		CreatedAt:   meta.CreatedAt,
+		UpdatedAt:   meta.UpdatedAt,
+	}
+	if !meta.ExpiresAt.IsZero() && opts.TTL == 0 {
+		// Expired while re-encrypting
+		return false, nil
+	}
+
+	_, err = StoreStream(es.backing, name, sealed, opts, Precondition{
+		IfMatch: []uint64{meta.Revision},
+	})
+	if _, failed := err.(customerrors.DataStoragePreconditionFailed); failed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// newHeader returns the header of a new value, encrypted with the newest key.
+func (es *EncryptedStorage) newHeader() (encryptionHeader, error) {
+	header := encryptionHeader{}
+	header.keyID, header.aead = es.keyring.Current()
+	_, err := rand.Read(header.noncePrefix[:])
+	return header, err
+}
+
+// encrypt returns the value stored in the backing storage for the `data` of
+// `name`, and its header.
+func (es *EncryptedStorage) encrypt(name string, data []byte) ([]byte, encryptionHeader, error) {
+	header, err := es.newHeader()
+	if err != nil {
+		return nil, encryptionHeader{}, err
+	}
+	header.size = int64(len(data))
+	header.checksum = sha256.Sum256(data)
+
+	segments := (len(data) + encryptSegmentSize - 1) / encryptSegmentSize
+	value := header.encode(name)
+	value = append(make([]byte, 0, len(value)+len(data)+segments*header.aead.Overhead()), value...)
+	for segment := uint32(1); len(data) > 0; segment++ {
+		n := len(data)
+		if n > encryptSegmentSize {
+			n = encryptSegmentSize
+		}
+		value = header.aead.Seal(value, header.nonce(segment), data[:n], []byte(name))
+		data = data[n:]
+	}
+
+	return value, header, nil
+}
+
+// seal encrypts the data of `name` read from `r` to a temporary file, returning
+// a reader of the value to store in the backing storage, and its header.
+func (es *EncryptedStorage) seal(name string, r io.Reader) (io.ReadCloser, encryptionHeader, error) {
+	header, err := es.newHeader()
+	if err != nil {
+		return nil, encryptionHeader{}, err
+	}
+
+	sealer := &sealingReader{
+		header: header,
+		name:   []byte(name),
+		r:      r,
+		hash:   sha256.New(),
+		plain:  make([]byte, encryptSegmentSize),
+	}
+	spooled, err := spool(es.cfg.SpoolDir, encryptSpoolPrefix, sealer)
+	if err != nil {
+		return nil, encryptionHeader{}, err
+	}
+
+	header.size = sealer.size
+	copy(header.checksum[:], sealer.hash.Sum(nil))
+	value := io.MultiReader(bytes.NewReader(header.encode(name)), spooled)
+	return readCloser{value, spooled}, header, nil
+}
+
+// open reads the header of the value of `name` from `r`, returning a reader
+// decrypting the rest, and the header. The header is nil, and the reader
+// returns the value as is, if there is none - such as for data written to the
+// backing storage before it was decorated.
+func (es *EncryptedStorage) open(name string, r io.Reader) (io.Reader, *encryptionHeader, error) {
+	prefix := make([]byte, len(encryptionMagic)+1)
+	n, err := io.ReadFull(r, prefix)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !bytes.HasPrefix(prefix, []byte(encryptionMagic))) {
+		// Stored before encryption, the prefix read is data
+		return io.MultiReader(bytes.NewReader(prefix[:n]), r), nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyID := make([]byte, prefix[len(encryptionMagic)])
+	if _, err = io.ReadFull(r, keyID); err != nil {
+		return nil, nil, truncated(name, err)
+	}
+	header := &encryptionHeader{keyID: string(keyID)}
+
+	var ok bool
+	if header.aead, ok = es.keyring.Cipher(header.keyID); !ok {
+		return nil, nil, fmt.Errorf("'%s' is encrypted with unknown key: '%s'", name, header.keyID)
+	}
+
+	sealed := make([]byte, encryptNoncePrefixSize+encryptSizesSize+header.aead.Overhead())
+	if _, err = io.ReadFull(r, sealed); err != nil {
+		return nil, nil, truncated(name, err)
+	}
+	copy(header.noncePrefix[:], sealed)
+	sizes, err := header.aead.Open(nil, header.nonce(0), sealed[encryptNoncePrefixSize:], []byte(name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt '%s': %w", name, err)
+	}
+	header.size = int64(binary.BigEndian.Uint64(sizes))
+	copy(header.checksum[:], sizes[8:])
+
+	return &openingReader{
+		header:    *header,
+		name:      []byte(name),
+		r:         r,
+		remaining: header.size,
+		sealed:    make([]byte, encryptSegmentSize+header.aead.Overhead()),
+	}, header, nil
+}
+
+// truncated returns the error of a value of `name` ending early, as `err`
+// reading it.
+func truncated(name string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("'%s' is truncated: %w", name, err)
+}
+
+// sealingReader reads the data segments of a value encrypted with `header`,
+// sealing the data read from `r`.
+type sealingReader struct {
+	header encryptionHeader
+	name   []byte
+	r      io.Reader
+
+	// hash and size are of the data read so far
+	hash hash.Hash
+	size int64
+
+	segment uint32
+	plain   []byte
+	pending []byte
+	eof     bool
+}
+
+// Read reads sealed data segments.
+func (s *sealingReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(s.r, s.plain)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			s.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		if s.segment == math.MaxUint32 {
+			return 0, fmt.Errorf("data too large to encrypt")
+		}
+
+		s.hash.Write(s.plain[:n])
+		s.size += int64(n)
+		s.segment++
+		s.pending = s.header.aead.Seal(s.pending[:0], s.header.nonce(s.segment), s.plain[:n], s.name)
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// openingReader decrypts the data segments of a value with `header` read from
+// `r`.
+type openingReader struct {
+	header encryptionHeader
+	name   []byte
+	r      io.Reader
+
+	remaining int64
+	segment   uint32
+	sealed    []byte
+	pending   []byte
+}
+
+// Read reads decrypted data.
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.pending) == 0 {
+		if o.remaining == 0 {
+			return 0, io.EOF
+		}
+
+		n := int64(encryptSegmentSize)
+		if o.remaining < n {
+			n = o.remaining
+		}
+		sealed := o.sealed[:int(n)+o.header.aead.Overhead()]
+		if _, err := io.ReadFull(o.r, sealed); err != nil {
+			return 0, truncated(string(o.name), err)
+		}
+
+		o.segment++
+		plain, err := o.header.aead.Open(sealed[:0], o.header.nonce(o.segment), sealed, o.name)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt '%s': %w", o.name, err)
+		}
+		o.remaining -= n
+		o.pending = plain
+	}
+
+	n := copy(p, o.pending)
+	o.pending = o.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,384 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initTestKeyring returns a keyring, and the path of its key file, holding a
+// new key for each of `ids`.
+func initTestKeyring(t *testing.T, ids ...string) (*Keyring, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	for _, id := range ids {
+		require.NoError(t, AddKeyringKey(path, id))
+	}
+	keyring, err := Keyring{}.Initialize(path)
+	require.NoError(t, err)
+	return keyring, path
+}
+
+func initTestEncryptedStorage(t *testing.T, backing DataStorage) *EncryptedStorage {
+	t.Helper()
+	keyring, _ := initTestKeyring(t, "test")
+	return EncryptedStorage{}.Initialize(backing, keyring, EncryptedStorageConfig{})
+}
+
+func TestEncryptedStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &EncryptedStorage{}
+	var _ StreamingStorage = &EncryptedStorage{}
+}
+
+func TestKeyring_Initialize(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"invalid json":  `{"keys": [`,
+		"no keys":       `{"keys": []}`,
+		"no id":         `{"keys": [{"key": "MDEyMzQ1Njc4OWFiY2RlZg=="}]}`,
+		"not base64":    `{"keys": [{"id": "a", "key": "not base64!"}]}`,
+		"bad key size":  `{"keys": [{"id": "a", "key": "MDEyMzQ1Njc="}]}`,
+		"duplicate ids": `{"keys": [{"id": "a", "key": "MDEyMzQ1Njc4OWFiY2RlZg=="}, {"id": "a", "key": "MDEyMzQ1Njc4OWFiY2RlZg=="}]}`,
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "-"))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+		_, err := Keyring{}.Initialize(path)
+		assert.Error(t, err, name)
+	}
+
+	_, err := Keyring{}.Initialize(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	keyring, path := initTestKeyring(t, "first", "second")
+	current, _ := keyring.Current()
+	assert.Equal(t, "second", current)
+	_, ok := keyring.Cipher("first")
+	assert.True(t, ok)
+	_, ok = keyring.Cipher("third")
+	assert.False(t, ok)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.Error(t, AddKeyringKey(path, "second"))
+
+	require.NoError(t, AddKeyringKey(path, "third"))
+	require.NoError(t, keyring.Reload())
+	current, _ = keyring.Current()
+	assert.Equal(t, "third", current)
+
+	// The file was replaced whole, keeping its mode and no temporary files
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestEncryptedStorage_StoreData(t *testing.T) {
+	data := []byte(strings.Repeat("customer configuration ", 10_000))
+	checksum := sha256.Sum256(data)
+
+	mem := MemStorage{}.Initialize()
+	es := initTestEncryptedStorage(t, mem)
+
+	meta, err := es.CompareAndSwap("test", data, StoreOptions{ContentType: "text/plain"}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, len(data), meta.Size)
+	assert.Equal(t, hex.EncodeToString(checksum[:]), meta.Checksum)
+
+	// No plaintext is stored
+	stored, err := mem.RetrieveData("test")
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "customer configuration")
+
+	retrieved, meta, err := es.RetrieveEntry("test")
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+	assert.Equal(t, len(data), meta.Size)
+	assert.Equal(t, hex.EncodeToString(checksum[:]), meta.Checksum)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	meta, err = es.RetrieveMetadata("test")
+	require.NoError(t, err)
+	assert.Equal(t, len(data), meta.Size)
+
+	// Equal data encrypts differently
+	require.NoError(t, es.StoreData("copy", data))
+	copied, err := mem.RetrieveData("copy")
+	require.NoError(t, err)
+	assert.NotEqual(t, stored, copied)
+}
+
+func TestEncryptedStorage_Tampering(t *testing.T) {
+	data := randomData(10, 3*encryptSegmentSize+100)
+
+	for name, tamper := range map[string]func(value []byte) []byte{
+		"flipped bit": func(value []byte) []byte {
+			value[len(value)-encryptSegmentSize] ^= 1
+			return value
+		},
+		"flipped header bit": func(value []byte) []byte {
+			value[len(encryptionMagic)+6] ^= 1
+			return value
+		},
+		"truncated": func(value []byte) []byte {
+			return value[:len(value)-1000]
+		},
+		"dropped segment": func(value []byte) []byte {
+			segment := encryptSegmentSize + 16
+			end := len(value) - 100 - 16
+			return append(value[:end-segment:end-segment], value[end:]...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mem := MemStorage{}.Initialize()
+			es := initTestEncryptedStorage(t, mem)
+			require.NoError(t, es.StoreData("test", data))
+
+			value, err := mem.RetrieveData("test")
+			require.NoError(t, err)
+			require.NoError(t, mem.StoreData("test", tamper(value)))
+
+			_, err = es.RetrieveData("test")
+			assert.Error(t, err)
+
+			stream, _, err := es.RetrieveStream("test")
+			if err == nil {
+				_, err = io.ReadAll(stream)
+				stream.Close()
+			}
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("swapped names", func(t *testing.T) {
+		mem := MemStorage{}.Initialize()
+		es := initTestEncryptedStorage(t, mem)
+		require.NoError(t, es.StoreData("a", data))
+
+		value, err := mem.RetrieveData("a")
+		require.NoError(t, err)
+		require.NoError(t, mem.StoreData("b", value))
+		_, err = es.RetrieveData("b")
+		assert.Error(t, err)
+	})
+}
+
+func TestEncryptedStorage_Rotation(t *testing.T) {
+	now := fakeClock(t)
+
+	mem := MemStorage{}.Initialize()
+	keyring, path := initTestKeyring(t, "first")
+	es := EncryptedStorage{}.Initialize(mem, keyring, EncryptedStorageConfig{})
+
+	data := map[string][]byte{
+		"a":      []byte("test data a"),
+		"b":      randomData(11, 2*encryptSegmentSize),
+		"before": []byte("stored before encryption"),
+	}
+	require.NoError(t, es.StoreDataWithOptions("a", data["a"], StoreOptions{
+		TTL:         time.Hour,
+		ContentType: "text/plain",
+	}))
+	require.NoError(t, es.StoreData("b", data["b"]))
+	require.NoError(t, mem.StoreData("before", data["before"]))
+	created, err := es.RetrieveMetadata("a")
+	require.NoError(t, err)
+
+	// Data encrypted with the first key remains readable after a rotation
+	require.NoError(t, AddKeyringKey(path, "second"))
+	require.NoError(t, keyring.Reload())
+	require.NoError(t, es.StoreData("c", []byte("test data c")))
+	data["c"] = []byte("test data c")
+	for name, expected := range data {
+		retrieved, err := es.RetrieveData(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, retrieved)
+	}
+
+	// Re-encryption picks up a key added since
+	require.NoError(t, AddKeyringKey(path, "third"))
+	*now = now.Add(time.Minute)
+	reencrypted, err := es.Reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 4, reencrypted)
+	reencrypted, err = es.Reencrypt()
+	require.NoError(t, err)
+	assert.Zero(t, reencrypted)
+
+	// Only the third key is needed now
+	keys, err := readKeyringFile(path)
+	require.NoError(t, err)
+	keys.Keys = keys.Keys[2:]
+	rotated, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, json.NewEncoder(rotated).Encode(keys))
+	require.NoError(t, rotated.Close())
+	require.NoError(t, keyring.Reload())
+
+	for name, expected := range data {
+		retrieved, err := es.RetrieveData(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, retrieved)
+
+		stored, err := mem.RetrieveData(name)
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(stored, expected[:8]))
+	}
+
+	meta, err := es.RetrieveMetadata("a")
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, created.ExpiresAt, meta.ExpiresAt)
+	assert.Equal(t, created.CreatedAt, meta.CreatedAt)
+	assert.Equal(t, created.UpdatedAt, meta.UpdatedAt)
+	assert.Equal(t, created.Revision, meta.Revision)
+}
+
+func TestEncryptedStorage_ReencryptCached(t *testing.T) {
+	keyring, path := initTestKeyring(t, "first")
+	es := EncryptedStorage{}.Initialize(MemStorage{}.Initialize(), keyring, EncryptedStorageConfig{})
+	cs, err := CachedStorage{}.Initialize(es, CachedStorageConfig{MaxEntries: 10})
+	require.NoError(t, err)
+	require.NoError(t, cs.StoreData("test", []byte("test data")))
+	cached, err := cs.RetrieveMetadata("test")
+	require.NoError(t, err)
+
+	require.NoError(t, AddKeyringKey(path, "second"))
+	reencrypted, err := es.Reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 1, reencrypted)
+
+	// The ETag cached is still current
+	_, err = cs.CompareAndSwap("test", []byte("new data"), StoreOptions{}, Precondition{
+		IfMatch: []uint64{cached.Revision},
+	})
+	assert.NoError(t, err)
+}
+
+func TestEncryptedStorage_UnknownKey(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	es := initTestEncryptedStorage(t, mem)
+	require.NoError(t, es.StoreData("test", []byte("test data")))
+
+	keyring, _ := initTestKeyring(t, "other")
+	es = EncryptedStorage{}.Initialize(mem, keyring, EncryptedStorageConfig{})
+	_, err := es.RetrieveData("test")
+	assert.ErrorContains(t, err, "unknown key")
+	_, err = es.Reencrypt()
+	assert.Error(t, err)
+}
+
+func TestEncryptedStorage_StoreStream(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	spoolDir := t.TempDir()
+	keyring, _ := initTestKeyring(t, "test")
+	es := EncryptedStorage{}.Initialize(fs, keyring, EncryptedStorageConfig{SpoolDir: spoolDir})
+
+	data := []byte(strings.Repeat("streamed customer configuration ", 50_000))
+	meta, err := es.StoreStream("test", bytes.NewReader(data), StoreOptions{}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, len(data), meta.Size)
+
+	stored, err := fs.RetrieveData("test")
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored), "customer configuration")
+
+	// Streamed and whole values are read alike
+	retrieved, err := es.RetrieveData("test")
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+	require.NoError(t, es.StoreData("test", data))
+	stream, meta, err := es.RetrieveStream("test")
+	require.NoError(t, err)
+	defer stream.Close()
+	assert.Equal(t, len(data), meta.Size)
+	retrieved, err = io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, data, retrieved)
+
+	// The spooled data is removed
+	spooled, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+}
+
+func TestEncryptedStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	keyring, path := initTestKeyring(t, "first")
+	es := EncryptedStorage{}.Initialize(MemStorage{}.Initialize(), keyring, EncryptedStorageConfig{})
+	dataName := "test"
+	data := randomData(12, 8<<10)
+	require.NoError(t, AddKeyringKey(path, "second"))
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			switch itr % 4 {
+			case 0:
+				_ = es.StoreData(dataName, data)
+			case 1:
+				_, err := es.Reencrypt()
+				assert.NoError(t, err)
+			default:
+				retrieved, err := es.RetrieveData(dataName)
+				if err == nil {
+					assert.Equal(t, data, retrieved)
+				} else {
+					assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestEncryptedStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestEncryptedStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestEncryptedStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestEncryptedStorage_Batch(t *testing.T) {
+	testStorageBatch(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestEncryptedStorage_TTL(t *testing.T) {
+	testStorageTTL(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+}
+
+func TestEncryptedStorage_Streaming(t *testing.T) {
+	testStorageStreaming(t, initTestEncryptedStorage(t, MemStorage{}.Initialize()))
+
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testStorageStreaming(t, initTestEncryptedStorage(t, fs))
+}
@@ -0,0 +1,243 @@
+package datastorage
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// EvictionPolicy decides which entry a capacity bounded `MemStorage` evicts
+// once full.
+//
+// Implementations need not be thread safe - `MemStorage` serializes all calls.
+type EvictionPolicy interface {
+	// Added is called when a new `name` is stored.
+	Added(name string)
+
+	// Accessed is called when an existing `name` is read.
+	Accessed(name string)
+
+	// Removed is called when `name` is deleted, evicted or about to be
+	// overwritten (followed by `Added`).
+	Removed(name string)
+
+	// Victim returns the next `name` to evict, or false if there are none.
+	Victim() (string, bool)
+}
+
+// ParseEvictionPolicy returns a freshly initialized `EvictionPolicy` by its
+// name: "lru", "lfu", "fifo" or "random".
+func ParseEvictionPolicy(policy string) (EvictionPolicy, error) {
+	switch policy {
+	case "lru":
+		return LRUPolicy{}.Initialize(), nil
+	case "lfu":
+		return LFUPolicy{}.Initialize(), nil
+	case "fifo":
+		return FIFOPolicy{}.Initialize(), nil
+	case "random":
+		return RandomPolicy{}.Initialize(), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: '%s'", policy)
+	}
+}
+
+// LRUPolicy evicts the least recently stored or read entry.
+type LRUPolicy struct {
+	order    *list.List // front is most recent
+	elements map[string]*list.Element
+}
+
+// Initialize initializes and returns a pointer to an empty `LRUPolicy`.
+func (p LRUPolicy) Initialize() *LRUPolicy {
+	return &LRUPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (p *LRUPolicy) Added(name string) {
+	p.elements[name] = p.order.PushFront(name)
+}
+
+func (p *LRUPolicy) Accessed(name string) {
+	if elem, found := p.elements[name]; found {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *LRUPolicy) Removed(name string) {
+	if elem, found := p.elements[name]; found {
+		p.order.Remove(elem)
+		delete(p.elements, name)
+	}
+}
+
+func (p *LRUPolicy) Victim() (string, bool) {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(string), true
+	}
+	return "", false
+}
+
+// FIFOPolicy evicts the oldest stored entry, regardless of reads.
+type FIFOPolicy struct {
+	order    *list.List // front is newest
+	elements map[string]*list.Element
+}
+
+// Initialize initializes and returns a pointer to an empty `FIFOPolicy`.
+func (p FIFOPolicy) Initialize() *FIFOPolicy {
+	return &FIFOPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (p *FIFOPolicy) Added(name string) {
+	p.elements[name] = p.order.PushFront(name)
+}
+
+func (p *FIFOPolicy) Accessed(name string) {}
+
+func (p *FIFOPolicy) Removed(name string) {
+	if elem, found := p.elements[name]; found {
+		p.order.Remove(elem)
+		delete(p.elements, name)
+	}
+}
+
+func (p *FIFOPolicy) Victim() (string, bool) {
+	if back := p.order.Back(); back != nil {
+		return back.Value.(string), true
+	}
+	return "", false
+}
+
+// LFUPolicy evicts the least frequently read entry, with ties broken by
+// evicting the least recently added.
+type LFUPolicy struct {
+	entries lfuHeap
+	byName  map[string]*lfuEntry
+	seq     uint64
+}
+
+// Initialize initializes and returns a pointer to an empty `LFUPolicy`.
+func (p LFUPolicy) Initialize() *LFUPolicy {
+	return &LFUPolicy{
+		byName: make(map[string]*lfuEntry),
+	}
+}
+
+func (p *LFUPolicy) Added(name string) {
+	p.seq++
+	entry := &lfuEntry{name: name, seq: p.seq}
+	heap.Push(&p.entries, entry)
+	p.byName[name] = entry
+}
+
+func (p *LFUPolicy) Accessed(name string) {
+	if entry, found := p.byName[name]; found {
+		entry.hits++
+		heap.Fix(&p.entries, entry.index)
+	}
+}
+
+func (p *LFUPolicy) Removed(name string) {
+	if entry, found := p.byName[name]; found {
+		heap.Remove(&p.entries, entry.index)
+		delete(p.byName, name)
+	}
+}
+
+func (p *LFUPolicy) Victim() (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].name, true
+}
+
+// lfuEntry is a single name tracked by `LFUPolicy`.
+type lfuEntry struct {
+	name  string
+	hits  uint64
+	seq   uint64 // order added, for tie breaks
+	index int    // position within the heap
+}
+
+// lfuHeap is a min-heap of `lfuEntry` by hits then age, see `container/heap`.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	entry := x.(*lfuEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// RandomPolicy evicts a uniformly random entry.
+type RandomPolicy struct {
+	names   []string
+	indices map[string]int
+	rng     *rand.Rand
+}
+
+// Initialize initializes and returns a pointer to an empty `RandomPolicy`.
+func (p RandomPolicy) Initialize() *RandomPolicy {
+	return &RandomPolicy{
+		indices: make(map[string]int),
+		rng:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *RandomPolicy) Added(name string) {
+	p.indices[name] = len(p.names)
+	p.names = append(p.names, name)
+}
+
+func (p *RandomPolicy) Accessed(name string) {}
+
+func (p *RandomPolicy) Removed(name string) {
+	i, found := p.indices[name]
+	if !found {
+		return
+	}
+
+	// Swap with the last name to remove in O(1)
+	last := p.names[len(p.names)-1]
+	p.names[i] = last
+	p.indices[last] = i
+	p.names = p.names[:len(p.names)-1]
+	delete(p.indices, name)
+}
+
+func (p *RandomPolicy) Victim() (string, bool) {
+	if len(p.names) == 0 {
+		return "", false
+	}
+	return p.names[p.rng.Intn(len(p.names))], true
+}
@@ -0,0 +1,201 @@
+package datastorage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for name, expected := range map[string]EvictionPolicy{
+		"lru":    &LRUPolicy{},
+		"lfu":    &LFUPolicy{},
+		"fifo":   &FIFOPolicy{},
+		"random": &RandomPolicy{},
+	} {
+		policy, err := ParseEvictionPolicy(name)
+		require.NoError(t, err)
+		assert.IsType(t, expected, policy)
+	}
+
+	_, err := ParseEvictionPolicy("mru")
+	assert.Error(t, err)
+}
+
+func TestEvictionPolicy_Victim(t *testing.T) {
+	// Add a, b, c then read a twice, then c once
+	tests := map[string]struct {
+		policy EvictionPolicy
+		order  []string
+	}{
+		"lru":  {LRUPolicy{}.Initialize(), []string{"b", "a", "c"}},
+		"lfu":  {LFUPolicy{}.Initialize(), []string{"b", "c", "a"}},
+		"fifo": {FIFOPolicy{}.Initialize(), []string{"a", "b", "c"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, n := range []string{"a", "b", "c"} {
+				test.policy.Added(n)
+			}
+			test.policy.Accessed("a")
+			test.policy.Accessed("a")
+			test.policy.Accessed("c")
+
+			for _, expected := range test.order {
+				victim, found := test.policy.Victim()
+				require.True(t, found)
+				assert.Equal(t, expected, victim)
+				test.policy.Removed(victim)
+			}
+
+			_, found := test.policy.Victim()
+			assert.False(t, found)
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		policy := RandomPolicy{}.Initialize()
+		remaining := map[string]bool{"a": true, "b": true, "c": true}
+		for n := range remaining {
+			policy.Added(n)
+		}
+
+		for len(remaining) > 0 {
+			victim, found := policy.Victim()
+			require.True(t, found)
+			assert.True(t, remaining[victim])
+			delete(remaining, victim)
+			policy.Removed(victim)
+		}
+
+		_, found := policy.Victim()
+		assert.False(t, found)
+	})
+}
+
+func TestMemStorage_Capacity(t *testing.T) {
+	t.Run("max entries", func(t *testing.T) {
+		mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{
+			MaxEntries: 2,
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, mem.StoreData("a", []byte("1")))
+		require.NoError(t, mem.StoreData("b", []byte("2")))
+		_, err = mem.RetrieveData("a") // b is now least recently used
+		require.NoError(t, err)
+		require.NoError(t, mem.StoreData("c", []byte("3")))
+
+		assert.Len(t, mem.data, 2)
+		_, err = mem.RetrieveData("b")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		stats := mem.Stats()
+		assert.Equal(t, 2, stats.Entries)
+		assert.EqualValues(t, 1, stats.Evictions)
+		assert.EqualValues(t, 2, stats.EvictedBytes)
+	})
+
+	t.Run("max bytes", func(t *testing.T) {
+		mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{
+			MaxBytes: 10,
+			Eviction: FIFOPolicy{}.Initialize(),
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, mem.StoreData("a", []byte("1234"))) // 5 bytes
+		require.NoError(t, mem.StoreData("b", []byte("1234"))) // 10 bytes
+		require.NoError(t, mem.StoreData("c", []byte("12")))   // evicts a
+		assert.EqualValues(t, 8, mem.Stats().Bytes)
+		_, err = mem.RetrieveData("a")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		// Overwriting should account for the replaced value, not evict
+		require.NoError(t, mem.StoreData("b", []byte("1")))
+		assert.EqualValues(t, 5, mem.Stats().Bytes)
+		assert.EqualValues(t, 1, mem.Stats().Evictions)
+
+		// Deletes free capacity
+		require.NoError(t, mem.DeleteData("c"))
+		assert.EqualValues(t, 2, mem.Stats().Bytes)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{
+			MaxBytes: 4,
+		})
+		require.NoError(t, err)
+		require.NoError(t, mem.StoreData("a", []byte("1")))
+
+		err = mem.StoreData("b", []byte("too large"))
+		assert.ErrorAs(t, err, &customerrors.DataStorageEntryTooLarge{})
+
+		// Nothing should be evicted for a write that can never fit
+		assert.Len(t, mem.data, 1)
+		assert.Zero(t, mem.Stats().Evictions)
+	})
+
+	t.Run("policies", func(t *testing.T) {
+		for _, name := range []string{"lru", "lfu", "fifo", "random"} {
+			policy, err := ParseEvictionPolicy(name)
+			require.NoError(t, err)
+			mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{
+				MaxEntries: 10,
+				Eviction:   policy,
+			})
+			require.NoError(t, err)
+
+			for i := 0; i < 100; i++ {
+				dataName := fmt.Sprintf("test%d", i)
+				require.NoError(t, mem.StoreData(dataName, []byte("test data")))
+				_, err = mem.RetrieveData(dataName)
+				require.NoError(t, err)
+			}
+			assert.Len(t, mem.data, 10, name)
+			assert.EqualValues(t, 90, mem.Stats().Evictions, name)
+		}
+	})
+
+	t.Run("evictions survive restart", func(t *testing.T) {
+		cfg := MemStorageConfig{
+			WAL:        &WALConfig{Dir: filepath.Join(t.TempDir(), "wal")},
+			MaxEntries: 1,
+		}
+		mem, err := MemStorage{}.InitializeWithConfig(cfg)
+		require.NoError(t, err)
+		require.NoError(t, mem.StoreData("evicted", []byte("1")))
+		require.NoError(t, mem.StoreData("kept", []byte("2")))
+		require.NoError(t, mem.Close())
+
+		// Restarting with more capacity must not resurrect evicted data
+		cfg.MaxEntries = 10
+		mem, err = MemStorage{}.InitializeWithConfig(cfg)
+		require.NoError(t, err)
+		defer mem.Close()
+		assert.Equal(t, map[string][]byte{"kept": []byte("2")}, mem.data)
+	})
+
+	t.Run("shrunk capacity on restart", func(t *testing.T) {
+		cfg := MemStorageConfig{
+			WAL: &WALConfig{Dir: filepath.Join(t.TempDir(), "wal")},
+		}
+		mem, err := MemStorage{}.InitializeWithConfig(cfg)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, mem.StoreData(fmt.Sprintf("test%d", i), []byte("test data")))
+		}
+		require.NoError(t, mem.Close())
+
+		cfg.MaxEntries = 2
+		mem, err = MemStorage{}.InitializeWithConfig(cfg)
+		require.NoError(t, err)
+		defer mem.Close()
+		assert.Len(t, mem.data, 2)
+		assert.EqualValues(t, 3, mem.Stats().Evictions)
+	})
+}
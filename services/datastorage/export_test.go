@@ -0,0 +1,5 @@
+package datastorage
+
+// FakeClock exposes `fakeClock` to the external tests of this package, which
+// hand it to the `storagetest` suite.
+var FakeClock = fakeClock
@@ -0,0 +1,796 @@
+package datastorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// fileShardWidth is the number of hex characters of a name's hash used for
+	// each level of directory sharding.
+	fileShardWidth = 2
+
+	// fileShardDepth is the number of nested shard directories a data file is
+	// placed under, e.g. `ab/cd/abcd...`.
+	fileShardDepth = 2
+
+	// fileTempPrefix marks in-flight writes which have not yet been renamed into
+	// place - any left behind by a crash are cleaned up on `Initialize`.
+	fileTempPrefix = ".tmp-"
+
+	// fileBatchJournal is the file in the root recording the batch being
+	// applied by `ApplyBatch` - one left behind by a crash is redone on
+	// `Initialize`.
+	fileBatchJournal = fileTempPrefix + "batch"
+)
+
+// fileHeader is the JSON encoded first line of every data file written by
+// `FileStorage`, the raw data follows directly after it.
+type fileHeader struct {
+	Name     string   `json:"name"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// FileStorage is a durable storage solution that implements the `DataStorage`
+// interface.
+//
+// FileStorage persists each `name` as its own file beneath a root directory.
+// Files are named after the SHA-256 hash of their `name` and sharded into
+// nested directories, so no single directory grows too large. Writes are
+// atomic: data is written to a temporary file which is then renamed over the
+// previous version, so readers (and restarts) never observe partial data.
+//
+// It implements `ContextStorage`, checking the context of each write once it
+// holds the lock - a write is only applied once its context is done should
+// that be while it is being committed.
+type FileStorage struct {
+	root string
+	rwMu *sync.RWMutex
+}
+
+// Initialize initializes and returns a pointer to a `FileStorage` rooted at
+// the directory `root`, creating it if it does not exist.
+//
+// Any data previously written beneath `root` is kept, a batch interrupted
+// part way through is completed, and leftover temporary files from interrupted
+// writes are removed.
+func (fs FileStorage) Initialize(root string) (*FileStorage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	storage := &FileStorage{
+		root: root,
+		rwMu: &sync.RWMutex{},
+	}
+	if err := storage.redoBatch(); err != nil {
+		return nil, err
+	}
+	if err := storage.removeTempFiles(); err != nil {
+		return nil, err
+	}
+
+	return storage, nil
+}
+
+// RetrieveData reads the file associated with the given `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := fs.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry reads the data and `Metadata` from the file associated with
+// the given `name`.
+//
+// If the `name` is found (and not expired), returns the data (`[]byte`) and
+// metadata, elsewise returns error.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return fs.RetrieveEntryContext(context.Background(), name)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, failing if `ctx` is done.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	// Only block writers
+	fs.rwMu.RLock()
+	defer fs.rwMu.RUnlock()
+
+	data, header, err := fs.readFile(name)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	if header.Metadata.Expired(timeNow()) {
+		return []byte{}, Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	return data, header.Metadata, nil
+}
+
+// RetrieveMetadata reads the `Metadata` associated with a given `name` from
+// the header of its file, without reading its data.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return fs.RetrieveMetadataContext(context.Background(), name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, failing if `ctx` is
+// done.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	// Only block writers
+	fs.rwMu.RLock()
+	defer fs.rwMu.RUnlock()
+
+	header, found, err := fs.currentHeader(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if !found || header.Metadata.Expired(timeNow()) {
+		return Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	return header.Metadata, nil
+}
+
+// StoreData atomically writes data `[]byte` to the file associated with the
+// given `name`.
+//
+// If the `name` already exists, it will overwrite the previous data values.
+//
+// Returns an error if writing fails, in which case the previous data values
+// (if any) are left untouched.
+//
+// This method is thread safe.
+func (fs *FileStorage) StoreData(name string, data []byte) error {
+	return fs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (fs *FileStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := fs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (fs *FileStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return fs.CompareAndSwapContext(context.Background(), name, data, opts, cond)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, abandoning the write if
+// `ctx` is done by the time it is committed.
+//
+// This method is thread safe.
+func (fs *FileStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	fs.rwMu.Lock()
+	defer fs.rwMu.Unlock()
+
+	now := timeNow()
+	prev, found, err := fs.currentHeader(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	exists := found && !prev.Metadata.Expired(now)
+	if err = cond.Check(name, prev.Metadata, exists); err != nil {
+		return Metadata{}, err
+	}
+	if err = ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.metadata(data, prev.Metadata, exists, now)
+	meta.Revision = opts.revision(prev.Metadata.Revision, prev.Metadata.Revision)
+	if err = fs.writeFile(fileHeader{
+		Name:     name,
+		Metadata: meta,
+	}, data); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// to the file associated with `name`.
+//
+// The data is first spooled to a temporary file, so other writers are only
+// blocked while it is copied into place.
+//
+// This method is thread safe.
+func (fs *FileStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	spooled, err := spool(fs.root, fileTempPrefix, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	fs.rwMu.Lock()
+	defer fs.rwMu.Unlock()
+
+	now := timeNow()
+	prev, found, err := fs.currentHeader(name)
+	if err != nil {
+		return Metadata{}, err
+	}
+	exists := found && !prev.Metadata.Expired(now)
+	if err = cond.Check(name, prev.Metadata, exists); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.streamMetadata(spooled.size, spooled.checksum, prev.Metadata, exists, now)
+	meta.Revision = opts.revision(prev.Metadata.Revision, prev.Metadata.Revision)
+	if err = fs.writeFileFrom(fileHeader{
+		Name:     name,
+		Metadata: meta,
+	}, spooled); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the file
+// associated with `name` which the caller must close.
+//
+// Files are replaced rather than rewritten, so the reader is unaffected by
+// later writes.
+//
+// This method is thread safe.
+func (fs *FileStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	// Only block writers
+	fs.rwMu.RLock()
+	defer fs.rwMu.RUnlock()
+
+	notFound := customerrors.DataStorageNameNotFound{
+		Name: name,
+	}
+	f, err := os.Open(fs.pathFor(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, Metadata{}, notFound
+	}
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	reader := bufio.NewReader(f)
+	header, err := readFileHeader(reader)
+	if err != nil {
+		f.Close()
+		return nil, Metadata{}, err
+	}
+	// Guard against the (unlikely) event of a hash collision
+	if header.Name != name || header.Metadata.Expired(timeNow()) {
+		f.Close()
+		return nil, Metadata{}, notFound
+	}
+
+	return readCloser{Reader: reader, Closer: f}, header.Metadata, nil
+}
+
+// DeleteData removes the file associated with the given `name`.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (fs *FileStorage) DeleteData(name string) error {
+	return fs.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (fs *FileStorage) CompareAndDelete(name string, cond Precondition) error {
+	return fs.CompareAndDeleteContext(context.Background(), name, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, abandoning the delete
+// if `ctx` is done by the time it is committed.
+//
+// This method is thread safe.
+func (fs *FileStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	fs.rwMu.Lock()
+	defer fs.rwMu.Unlock()
+
+	header, found, err := fs.currentHeader(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	expired := header.Metadata.Expired(timeNow())
+	if !expired {
+		if err = cond.Check(name, header.Metadata, true); err != nil {
+			return err
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if err = fs.removeFile(fs.pathFor(name)); err != nil {
+		return err
+	}
+
+	// Expired data is purged, but was already considered gone
+	if expired {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	return nil
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// The batch is journaled before any file is written, so a crash part way
+// through is completed on `Initialize`, and a failure part way through is
+// rolled back.
+//
+// This method is thread safe.
+func (fs *FileStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return fs.ApplyBatchContext(context.Background(), ops)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, abandoning the batch if `ctx` is
+// done by the time it is journaled.
+//
+// This method is thread safe.
+func (fs *FileStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return []Metadata{}, nil
+	}
+
+	fs.rwMu.Lock()
+	defer fs.rwMu.Unlock()
+
+	// Keep the previous files, should the batch need rolling back
+	now := timeNow()
+	metas := make([]Metadata, len(ops))
+	prevs := make([]*fileHeader, len(ops))
+	prevData := make([][]byte, len(ops))
+	for i, op := range ops {
+		data, header, err := fs.readFile(op.Name)
+		_, notFound := err.(customerrors.DataStorageNameNotFound)
+		if err != nil && !notFound {
+			return nil, err
+		}
+		found := !notFound
+		exists := found && !header.Metadata.Expired(now)
+		if err = op.check(header.Metadata, exists); err != nil {
+			return nil, err
+		}
+
+		if found {
+			prevs[i], prevData[i] = &header, data
+		}
+		if !op.Delete {
+			metas[i] = op.Options.metadata(op.Data, header.Metadata, exists, now)
+			metas[i].Revision = op.Options.revision(header.Metadata.Revision, header.Metadata.Revision)
+		}
+	}
+
+	records, _, err := encodeLogBatch(ops, metas)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	journal := filepath.Join(fs.root, fileBatchJournal)
+	if err = atomicWriteFile(journal, func(w io.Writer) error {
+		_, err := w.Write(records)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		if err = fs.applyBatchOp(op, metas[i]); err == nil {
+			continue
+		}
+
+		// Restore the files already written, newest first
+		for j := i; j >= 0; j-- {
+			var rErr error
+			if prevs[j] != nil {
+				rErr = fs.writeFile(*prevs[j], prevData[j])
+			} else {
+				rErr = fs.applyBatchOp(BatchOp{Name: ops[j].Name, Delete: true}, Metadata{})
+			}
+			if rErr != nil {
+				// Leave the journal to complete the batch on restart instead
+				return nil, fmt.Errorf("%w (rolling back failed, the batch is completed on restart: %v)", err, rErr)
+			}
+		}
+		if rErr := fs.removeFile(journal); rErr != nil {
+			return nil, fmt.Errorf("%w (rolling back failed, the batch is completed on restart: %v)", err, rErr)
+		}
+		return nil, err
+	}
+
+	if err = fs.removeFile(journal); err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// ListNames lists the names of unexpired entries beginning with `prefix`, see
+// `DataStorage`.
+//
+// Files are named by hash, so every page walks and reads the header of every
+// data file.
+//
+// This method is thread safe.
+func (fs *FileStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return fs.ListNamesContext(context.Background(), prefix, cursor, limit)
+}
+
+// ListNamesContext behaves as `ListNames`, abandoning the walk once `ctx` is
+// done.
+//
+// This method is thread safe.
+func (fs *FileStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	// Only block writers
+	fs.rwMu.RLock()
+	defer fs.rwMu.RUnlock()
+
+	now := timeNow()
+	var names []string
+	err := fs.walkFiles(func(path string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := fs.readHeader(path)
+		if err != nil {
+			return err
+		}
+		if !header.Metadata.Expired(now) {
+			names = append(names, header.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	page, next := pageNames(names, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// PurgeExpired walks every data file, removing those which have expired.
+//
+// This method is thread safe.
+func (fs *FileStorage) PurgeExpired() (int, error) {
+	fs.rwMu.Lock()
+	defer fs.rwMu.Unlock()
+
+	now := timeNow()
+	purged := 0
+	err := fs.walkFiles(func(path string) error {
+		header, err := fs.readHeader(path)
+		if err != nil {
+			return err
+		}
+		if !header.Metadata.Expired(now) {
+			return nil
+		}
+		if err = fs.removeFile(path); err != nil {
+			return err
+		}
+		purged++
+		return nil
+	})
+
+	return purged, err
+}
+
+// pathFor returns the sharded file path for the given `name`.
+func (fs *FileStorage) pathFor(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	hashed := hex.EncodeToString(sum[:])
+
+	parts := make([]string, 0, fileShardDepth+2)
+	parts = append(parts, fs.root)
+	for i := 0; i < fileShardDepth; i++ {
+		parts = append(parts, hashed[i*fileShardWidth:(i+1)*fileShardWidth])
+	}
+	parts = append(parts, hashed)
+
+	return filepath.Join(parts...)
+}
+
+// readFile reads and decodes the data file for `name`, callers must hold at
+// least a read lock.
+func (fs *FileStorage) readFile(name string) ([]byte, fileHeader, error) {
+	f, err := os.Open(fs.pathFor(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return []byte{}, fileHeader{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	if err != nil {
+		return []byte{}, fileHeader{}, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header, err := readFileHeader(reader)
+	if err != nil {
+		return []byte{}, fileHeader{}, err
+	}
+
+	// Guard against the (unlikely) event of a hash collision
+	if header.Name != name {
+		return []byte{}, fileHeader{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	data, err := io.ReadAll(reader)
+	return data, header, err
+}
+
+// currentHeader reads the header of the data file for `name`, reporting
+// whether it exists - callers must hold at least a read lock.
+func (fs *FileStorage) currentHeader(name string) (fileHeader, bool, error) {
+	header, err := fs.readHeader(fs.pathFor(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fileHeader{}, false, nil
+	}
+	if err != nil {
+		return fileHeader{}, false, err
+	}
+
+	// Guard against the (unlikely) event of a hash collision
+	if header.Name != name {
+		return fileHeader{}, false, nil
+	}
+	return header, true, nil
+}
+
+// readHeader reads only the header of the data file at `path`, callers must
+// hold at least a read lock.
+func (fs *FileStorage) readHeader(path string) (fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	defer f.Close()
+
+	return readFileHeader(bufio.NewReader(f))
+}
+
+// writeFile atomically replaces the data file for `header.Name`, callers must
+// hold the write lock.
+func (fs *FileStorage) writeFile(header fileHeader, data []byte) error {
+	return fs.writeFileFrom(header, bytes.NewReader(data))
+}
+
+// writeFileFrom behaves as `writeFile`, with the data read from `data`.
+func (fs *FileStorage) writeFileFrom(header fileHeader, data io.Reader) error {
+	path := fs.pathFor(header.Name)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	return atomicWriteFile(path, func(w io.Writer) error {
+		if _, err := w.Write(append(encoded, '\n')); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, data)
+		return err
+	})
+}
+
+// removeFile durably removes the data file at `path`, callers must hold the
+// write lock.
+func (fs *FileStorage) removeFile(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// applyBatchOp writes or removes the data file of a single batch operation,
+// whose new entry has `meta` - callers must hold the write lock.
+//
+// Removing a file which does not exist succeeds, so redoing a batch is safe.
+func (fs *FileStorage) applyBatchOp(op BatchOp, meta Metadata) error {
+	if !op.Delete {
+		return fs.writeFile(fileHeader{
+			Name:     op.Name,
+			Metadata: meta,
+		}, op.Data)
+	}
+
+	err := fs.removeFile(fs.pathFor(op.Name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// redoBatch completes the batch recorded by a journal left behind by a crash,
+// if any.
+func (fs *FileStorage) redoBatch() error {
+	journal := filepath.Join(fs.root, fileBatchJournal)
+	f, err := os.Open(journal)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// The journal is written atomically, so is complete if it exists at all
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		record, err := readLogRecord(reader, offset, info.Size())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read batch journal: %w", err)
+		}
+		offset += record.entry.recordSize
+
+		op := BatchOp{
+			Name:   record.name,
+			Delete: record.tombstone(),
+			Data:   record.data,
+		}
+		if err = fs.applyBatchOp(op, record.entry.meta); err != nil {
+			return err
+		}
+	}
+
+	return fs.removeFile(journal)
+}
+
+// walkFiles calls `fn` with the path of every data file, callers must hold at
+// least a read lock.
+func (fs *FileStorage) walkFiles(fn func(path string) error) error {
+	return filepath.Walk(fs.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), fileTempPrefix) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// removeTempFiles walks the storage root and deletes any temporary files left
+// behind by writes that never completed.
+func (fs *FileStorage) removeTempFiles() error {
+	return filepath.Walk(fs.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(info.Name(), fileTempPrefix) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// readFileHeader decodes the JSON header line at the start of a data file.
+func readFileHeader(reader *bufio.Reader) (fileHeader, error) {
+	var header fileHeader
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return header, err
+	}
+	err = json.Unmarshal(bytes.TrimSuffix(line, []byte{'\n'}), &header)
+
+	return header, err
+}
+
+// atomicWriteFile writes to a temporary file in the same directory as `path`
+// using `write`, then renames it over `path`.
+//
+// The file and its directory are synced so the write survives a crash.
+func atomicWriteFile(path string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, fileTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+
+	// Clean up the temporary file should anything fail before the rename
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	committed = true
+
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entry changes (creates, renames, removes) to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
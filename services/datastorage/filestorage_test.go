@@ -0,0 +1,250 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &FileStorage{}
+	var _ StreamingStorage = &FileStorage{}
+	var _ ContextStorage = &FileStorage{}
+}
+
+func TestFileStorage_Initialize(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "storage")
+
+	t.Run("creates root", func(t *testing.T) {
+		fs, err := FileStorage{}.Initialize(root)
+		require.NoError(t, err)
+		assert.NotNil(t, fs)
+		assert.NotNil(t, fs.rwMu)
+		assert.DirExists(t, root)
+	})
+
+	t.Run("removes temp files", func(t *testing.T) {
+		// Simulate a write interrupted before its rename
+		shard := filepath.Join(root, "ab", "cd")
+		require.NoError(t, os.MkdirAll(shard, 0o755))
+		tmp := filepath.Join(shard, fileTempPrefix+"123")
+		require.NoError(t, os.WriteFile(tmp, []byte("partial"), 0o644))
+
+		_, err := FileStorage{}.Initialize(root)
+		require.NoError(t, err)
+		assert.NoFileExists(t, tmp)
+	})
+}
+
+func TestFileStorage_RetrieveData(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testData := []byte("test data")
+	require.NoError(t, fs.StoreData("test", testData))
+
+	t.Run("existing data", func(t *testing.T) {
+		data, err := fs.RetrieveData("test")
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+
+	t.Run("nonexistent key", func(t *testing.T) {
+		_, err := fs.RetrieveData("foo")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestFileStorage_StoreData(t *testing.T) {
+	root := t.TempDir()
+	fs, err := FileStorage{}.Initialize(root)
+	require.NoError(t, err)
+	dataName := "test"
+	testData := []byte("test data")
+
+	t.Run("first write", func(t *testing.T) {
+		err := fs.StoreData(dataName, testData)
+		require.NoError(t, err)
+
+		// File should be sharded beneath the root
+		path := fs.pathFor(dataName)
+		assert.FileExists(t, path)
+		rel, err := filepath.Rel(root, path)
+		require.NoError(t, err)
+		assert.Len(t, strings.Split(rel, string(filepath.Separator)), fileShardDepth+1)
+
+		data, err := fs.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		testData = []byte("foobar")
+		err := fs.StoreData(dataName, testData)
+		require.NoError(t, err)
+
+		data, err := fs.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+
+		// No temporary files should be left behind
+		entries, err := os.ReadDir(filepath.Dir(fs.pathFor(dataName)))
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("names with newlines", func(t *testing.T) {
+		name := "multi\nline"
+		err := fs.StoreData(name, []byte("line 1\nline 2"))
+		require.NoError(t, err)
+
+		data, err := fs.RetrieveData(name)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("line 1\nline 2"), data)
+	})
+
+	t.Run("survives restart", func(t *testing.T) {
+		restarted, err := FileStorage{}.Initialize(root)
+		require.NoError(t, err)
+
+		data, err := restarted.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+}
+
+func TestFileStorage_DeleteData(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	dataName := "test"
+	require.NoError(t, fs.StoreData(dataName, []byte("test data")))
+
+	t.Run("delete existing data", func(t *testing.T) {
+		err := fs.DeleteData(dataName)
+		require.NoError(t, err)
+		assert.NoFileExists(t, fs.pathFor(dataName))
+	})
+
+	t.Run("delete nonexistent data", func(t *testing.T) {
+		err := fs.DeleteData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestFileStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	dataName := "test"
+	testData := []byte("test data")
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			if itr%3 == 0 {
+				_ = fs.StoreData(dataName, testData)
+			} else if itr%3 == 1 {
+				_, _ = fs.RetrieveData(dataName)
+			} else {
+				_ = fs.DeleteData(dataName)
+			}
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+func TestFileStorage_TTL(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testStorageTTL(t, fs)
+}
+
+func TestFileStorage_ConditionalWrites(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testStorageConditionalWrites(t, fs)
+}
+
+func TestFileStorage_Metadata(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	testStorageMetadata(t, fs)
+
+	// Kept in the file header
+	before, err := fs.RetrieveMetadata("described")
+	require.NoError(t, err)
+	fs, err = FileStorage{}.Initialize(dir)
+	require.NoError(t, err)
+	after, err := fs.RetrieveMetadata("described")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestFileStorage_ListNames(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	testStorageListNames(t, fs)
+}
+
+func TestFileStorage_Batch(t *testing.T) {
+	root := t.TempDir()
+	fs, err := FileStorage{}.Initialize(root)
+	require.NoError(t, err)
+	testStorageBatch(t, fs)
+
+	t.Run("no journal is left behind", func(t *testing.T) {
+		assert.NoFileExists(t, filepath.Join(root, fileBatchJournal))
+	})
+
+	t.Run("redoes journaled batch", func(t *testing.T) {
+		// Simulate a crash after journaling a batch but before applying it
+		ops := []BatchOp{
+			{Name: "batch/a", Data: []byte("a2")},
+			{Name: "batch/b", Delete: true},
+		}
+		metas := []Metadata{{Revision: 100, ContentType: "text/plain"}, {}}
+		batch, _, err := encodeLogBatch(ops, metas)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, fileBatchJournal), batch, 0o644))
+
+		fs, err := FileStorage{}.Initialize(root)
+		require.NoError(t, err)
+		assert.NoFileExists(t, filepath.Join(root, fileBatchJournal))
+
+		data, meta, err := fs.RetrieveEntry("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a2"), data)
+		assert.Equal(t, metas[0], meta)
+		_, err = fs.RetrieveData("batch/b")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestFileStorage_Streaming(t *testing.T) {
+	root := t.TempDir()
+	fs, err := FileStorage{}.Initialize(root)
+	require.NoError(t, err)
+	testStorageStreaming(t, fs)
+
+	t.Run("no spooled data is left behind", func(t *testing.T) {
+		entries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasPrefix(entry.Name(), fileTempPrefix), entry.Name())
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package datastorage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+)
+
+// maxKeyIDLength is the longest key ID, as it is written with every value in a
+// single byte.
+const maxKeyIDLength = 255
+
+// keyringFile is the JSON layout of a key file, for instance:
+//
+//	{"keys": [{"id": "2024-01", "key": "<base64 encoded AES key>"}]}
+//
+// The last key is the newest.
+type keyringFile struct {
+	Keys []keyringKey `json:"keys"`
+}
+
+type keyringKey struct {
+	ID string `json:"id"`
+
+	// Key is the standard base64 encoding of a 16, 24 or 32 byte AES key.
+	Key string `json:"key"`
+}
+
+// Keyring holds the AES keys an `EncryptedStorage` encrypts with, loaded from
+// a local key file.
+//
+// Data is always encrypted with the newest key, while older keys are kept so
+// data encrypted before a rotation remains readable - a key must stay in the
+// file until no data is encrypted with it, see `EncryptedStorage.Reencrypt`.
+type Keyring struct {
+	path string
+
+	mu      *sync.RWMutex
+	ciphers map[string]cipher.AEAD
+	current string
+}
+
+// Initialize initializes and returns a pointer to a `Keyring` loaded from the
+// key file at `path`.
+func (k Keyring) Initialize(path string) (*Keyring, error) {
+	keyring := &Keyring{
+		path: path,
+		mu:   &sync.RWMutex{},
+	}
+	if err := keyring.Reload(); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// Reload reloads the key file, such as after a key was added to it. The
+// keyring is left as is if the file is invalid.
+//
+// This method is thread safe.
+func (k *Keyring) Reload() error {
+	keys, err := readKeyringFile(k.path)
+	if err != nil {
+		return err
+	}
+	if len(keys.Keys) == 0 {
+		return fmt.Errorf("key file '%s' holds no keys", k.path)
+	}
+
+	ciphers := make(map[string]cipher.AEAD, len(keys.Keys))
+	for _, key := range keys.Keys {
+		if len(key.ID) == 0 || len(key.ID) > maxKeyIDLength {
+			return fmt.Errorf("key ID '%s' must be 1 to %d bytes", key.ID, maxKeyIDLength)
+		}
+		if _, ok := ciphers[key.ID]; ok {
+			return fmt.Errorf("duplicate key ID: '%s'", key.ID)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return fmt.Errorf("key '%s' is not base64 encoded: %w", key.ID, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return fmt.Errorf("key '%s' is invalid: %w", key.ID, err)
+		}
+		if ciphers[key.ID], err = cipher.NewGCM(block); err != nil {
+			return err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.ciphers = ciphers
+	k.current = keys.Keys[len(keys.Keys)-1].ID
+	return nil
+}
+
+// Current returns the ID of the newest key and its cipher, which data is
+// encrypted with.
+//
+// This method is thread safe.
+func (k *Keyring) Current() (string, cipher.AEAD) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current, k.ciphers[k.current]
+}
+
+// Cipher returns the cipher of the key with ID `id`, reporting false if there
+// is no such key.
+//
+// This method is thread safe.
+func (k *Keyring) Cipher(id string) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.ciphers[id]
+	return aead, ok
+}
+
+// AddKeyringKey adds a new random 256 bit key with ID `id` to the key file at
+// `path`, becoming the newest key. The file is created, readable only by its
+// owner, if it does not exist.
+//
+// Running keyrings use the key once reloaded.
+func AddKeyringKey(path, id string) error {
+	keys, err := readKeyringFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(id) == 0 || len(id) > maxKeyIDLength {
+		return fmt.Errorf("key ID '%s' must be 1 to %d bytes", id, maxKeyIDLength)
+	}
+	for _, key := range keys.Keys {
+		if key.ID == id {
+			return fmt.Errorf("duplicate key ID: '%s'", id)
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err = rand.Read(raw); err != nil {
+		return err
+	}
+	keys.Keys = append(keys.Keys, keyringKey{
+		ID:  id,
+		Key: base64.StdEncoding.EncodeToString(raw),
+	})
+
+	encoded, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file whole and durably, so neither a reload nor a crash
+	// leaves it half written - temporary files are created with mode 0600
+	return atomicWriteFile(path, func(w io.Writer) error {
+		_, err := w.Write(append(encoded, '\n'))
+		return err
+	})
+}
+
+// readKeyringFile reads the key file at `path`, warning if it is readable by
+// anyone other than its owner.
+func readKeyringFile(path string) (keyringFile, error) {
+	var keys keyringFile
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return keys, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		log.Printf("Keyring - key file '%s' is accessible by other users (mode %v)", path, info.Mode().Perm())
+	}
+
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return keys, err
+	}
+	if err = json.Unmarshal(encoded, &keys); err != nil {
+		return keys, fmt.Errorf("key file '%s' is invalid: %w", path, err)
+	}
+	return keys, nil
+}
@@ -0,0 +1,234 @@
+package datastorage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// Records are shared by the `LogStorage` data file and the `MemStorage`
+// write-ahead log and snapshots.
+const (
+	// logHeaderSize is the size of a record header:
+	// crc32 (4) | flags (1) | name length (4) | value length (4)
+	//
+	// The header is followed by the name, then the value.
+	logHeaderSize = 4 + 1 + 4 + 4
+
+	// logFlagTombstone marks a record as the deletion of its name.
+	logFlagTombstone byte = 1 << 0
+
+	// logFlagMetadata marks a record whose value begins with its JSON encoded
+	// `Metadata`: metadata length (4) | metadata | data
+	logFlagMetadata byte = 1 << 1
+
+	// logFlagBatch marks a record followed by more records of the same
+	// `ApplyBatch` - replay applies a batch only once its last record, without
+	// the flag, is read.
+	logFlagBatch byte = 1 << 2
+)
+
+// errLogCorrupt is returned when a record fails its checksum or is truncated.
+var errLogCorrupt = errors.New("corrupt log record")
+
+// logEntry locates a record, and the data within it, in a log file.
+type logEntry struct {
+	recordOffset int64 // start of the record header
+	recordSize   int64 // header + name + value
+	dataOffset   int64 // start of the data
+	dataSize     int64
+	meta         Metadata
+}
+
+// logRecord is a single decoded record.
+type logRecord struct {
+	flags byte
+	name  string
+	data  []byte
+	entry logEntry
+}
+
+// tombstone reports whether the record deletes its name.
+func (r logRecord) tombstone() bool {
+	return r.flags&logFlagTombstone != 0
+}
+
+// batched reports whether more records of the same batch follow the record.
+func (r logRecord) batched() bool {
+	return r.flags&logFlagBatch != 0
+}
+
+// encodeLogRecord serializes a single record, see `logHeaderSize` for the
+// layout - `meta` is omitted when nil.
+func encodeLogRecord(flags byte, name string, meta *Metadata, data []byte) ([]byte, error) {
+	prefix, err := encodeLogRecordPrefix(flags, name, meta, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, len(prefix)+len(data))
+	copy(record[copy(record, prefix):], data)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+
+	return record, nil
+}
+
+// encodeLogRecordPrefix serializes all of a record but its data, of
+// `dataSize` bytes, leaving its checksum unset - see `encodeLogRecord`.
+func encodeLogRecordPrefix(flags byte, name string, meta *Metadata, dataSize int64) ([]byte, error) {
+	var metaBytes []byte
+	if meta != nil {
+		var err error
+		if metaBytes, err = json.Marshal(meta); err != nil {
+			return nil, err
+		}
+		flags |= logFlagMetadata
+	}
+
+	valueSize := dataSize
+	if meta != nil {
+		valueSize += 4 + int64(len(metaBytes))
+	}
+	if valueSize > math.MaxUint32 {
+		return nil, customerrors.DataStorageEntryTooLarge{
+			Name:  name,
+			Size:  dataSize,
+			Limit: math.MaxUint32 - (valueSize - dataSize),
+		}
+	}
+
+	prefixSize := logHeaderSize + len(name)
+	if meta != nil {
+		prefixSize += 4 + len(metaBytes)
+	}
+	prefix := make([]byte, prefixSize)
+	prefix[4] = flags
+	binary.BigEndian.PutUint32(prefix[5:9], uint32(len(name)))
+	binary.BigEndian.PutUint32(prefix[9:13], uint32(valueSize))
+
+	pos := logHeaderSize + copy(prefix[logHeaderSize:], name)
+	if meta != nil {
+		binary.BigEndian.PutUint32(prefix[pos:pos+4], uint32(len(metaBytes)))
+		copy(prefix[pos+4:], metaBytes)
+	}
+
+	return prefix, nil
+}
+
+// encodeLogBatch serializes the records of a batch of `ops`, whose new
+// entries have `metas`, flagging all but the last with `logFlagBatch`.
+//
+// Returns the records concatenated, and the size of each.
+func encodeLogBatch(ops []BatchOp, metas []Metadata) ([]byte, []int64, error) {
+	var (
+		batch []byte
+		sizes = make([]int64, len(ops))
+	)
+	for i, op := range ops {
+		var flags byte
+		if i < len(ops)-1 {
+			flags |= logFlagBatch
+		}
+
+		var (
+			record []byte
+			err    error
+		)
+		if op.Delete {
+			record, err = encodeLogRecord(flags|logFlagTombstone, op.Name, nil, nil)
+		} else {
+			record, err = encodeLogRecord(flags, op.Name, &metas[i], op.Data)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		batch = append(batch, record...)
+		sizes[i] = int64(len(record))
+	}
+
+	return batch, sizes, nil
+}
+
+// unbatchLogRecord clears `logFlagBatch` from an encoded record in place, for
+// copying it out of its batch.
+func unbatchLogRecord(record []byte) {
+	if record[4]&logFlagBatch == 0 {
+		return
+	}
+	record[4] &^= logFlagBatch
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+}
+
+// readLogRecord reads and verifies the record starting at `offset`, within a
+// file of `fileSize` bytes.
+//
+// Returns `io.EOF` only if there are no more records, and
+// `io.ErrUnexpectedEOF` if the record runs past the end of the file. A record
+// failing its checksum is returned with its `recordOffset` and `recordSize`
+// alongside `errLogCorrupt`.
+func readLogRecord(reader io.Reader, offset, fileSize int64) (logRecord, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return logRecord{}, err
+	}
+
+	flags := header[4]
+	nameSize := int64(binary.BigEndian.Uint32(header[5:9]))
+	valueSize := int64(binary.BigEndian.Uint32(header[9:13]))
+
+	// A corrupt header must not trick us into allocating past the end of file
+	if offset+logHeaderSize+nameSize+valueSize > fileSize {
+		return logRecord{}, io.ErrUnexpectedEOF
+	}
+
+	body := make([]byte, nameSize+valueSize)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return logRecord{}, err
+	}
+
+	record := logRecord{
+		flags: flags,
+		name:  string(body[:nameSize]),
+		entry: logEntry{
+			recordOffset: offset,
+			recordSize:   logHeaderSize + nameSize + valueSize,
+		},
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(body)
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return logRecord{entry: record.entry}, errLogCorrupt
+	}
+
+	value := body[nameSize:]
+	dataOffset := offset + logHeaderSize + nameSize
+	if flags&logFlagMetadata != 0 {
+		if len(value) < 4 {
+			return logRecord{}, errLogCorrupt
+		}
+		metaSize := int64(binary.BigEndian.Uint32(value[0:4]))
+		if 4+metaSize > int64(len(value)) {
+			return logRecord{}, errLogCorrupt
+		}
+		if err := json.Unmarshal(value[4:4+metaSize], &record.entry.meta); err != nil {
+			return logRecord{}, errLogCorrupt
+		}
+		value = value[4+metaSize:]
+		dataOffset += 4 + metaSize
+	}
+
+	record.data = value
+	record.entry.dataOffset = dataOffset
+	record.entry.dataSize = int64(len(value))
+
+	return record, nil
+}
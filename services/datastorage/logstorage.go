@@ -0,0 +1,878 @@
+package datastorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// logDataFile is the name of the append-only data file within the
+	// `LogStorage` directory.
+	logDataFile = "data.log"
+
+	// logCompactFile is the temporary file live entries are rewritten into
+	// during compaction, before being renamed over `logDataFile`.
+	logCompactFile = "data.log.compact"
+
+	// logSpoolPrefix names the temporary files streamed data is spooled into
+	// before being appended, see `StoreStream`.
+	logSpoolPrefix = "data.log.spool-"
+
+	// defaultLogCompactGarbageRatio is the `CompactGarbageRatio` of a
+	// `LogStorage` when unset.
+	defaultLogCompactGarbageRatio = 0.5
+)
+
+// LogStorageOptions configures the durability and compaction behaviour of a
+// `LogStorage`.
+type LogStorageOptions struct {
+	// SyncWrites will fsync the data file after every write when true - slower,
+	// but no acknowledged write can be lost to a crash.
+	SyncWrites bool
+
+	// CompactInterval is how often the background compactor checks whether the
+	// data file is due for compaction, no background compaction when zero.
+	CompactInterval time.Duration
+
+	// CompactGarbageRatio is the minimum fraction (0-1) of the data file that
+	// must be stale (overwritten or deleted entries) before the background
+	// compactor rewrites it, defaults to 0.5.
+	CompactGarbageRatio float64
+}
+
+// LogStorageStats is a point in time summary of a `LogStorage` data file.
+type LogStorageStats struct {
+	LiveKeys     int   `json:"live_keys"`
+	FileSize     int64 `json:"file_size"`
+	GarbageBytes int64 `json:"garbage_bytes"`
+	Compactions  int   `json:"compactions"`
+}
+
+// LogStorage is a durable, Bitcask-style storage solution that implements the
+// `DataStorage` interface.
+//
+// Every write is appended to a single data file, while an in-memory key
+// directory maps each `name` to the location of its latest value - reads are
+// a single positioned read, and writes never seek. Deletions append a
+// tombstone record. On `Initialize` the data file is replayed to rebuild the
+// key directory, discarding any partially written record at its tail - but
+// failing on a corrupt record before it, rather than discard the records
+// after.
+//
+// Overwritten and deleted records are reclaimed by `Compact`, which may also
+// run periodically in the background (see `LogStorageOptions`).
+//
+// It implements `ContextStorage`, checking the context of each write once it
+// holds the lock - a write is only applied once its context is done should
+// that be while it is being appended.
+type LogStorage struct {
+	dir      string
+	opts     LogStorageOptions
+	file     *os.File
+	keydir   map[string]logEntry
+	size     int64
+	garbage  int64
+	revision uint64 // latest revision written
+
+	compactions int
+
+	rwMu *sync.RWMutex
+	done chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// Initialize opens (or creates) a `LogStorage` in the directory `dir`,
+// replaying its data file to recover all previously written data.
+//
+// `Close` must be called to release the data file and stop the background
+// compactor.
+func (ls LogStorage) Initialize(dir string, opts LogStorageOptions) (*LogStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if opts.CompactGarbageRatio <= 0 {
+		opts.CompactGarbageRatio = defaultLogCompactGarbageRatio
+	}
+
+	// A compaction interrupted before its rename is simply discarded, as is
+	// data spooled for a write that never completed
+	if err := os.Remove(filepath.Join(dir, logCompactFile)); err != nil &&
+		!errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	spooled, err := filepath.Glob(filepath.Join(dir, logSpoolPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range spooled {
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	storage := &LogStorage{
+		dir:    dir,
+		opts:   opts,
+		keydir: make(map[string]logEntry),
+		rwMu:   &sync.RWMutex{},
+		done:   make(chan struct{}),
+		wg:     &sync.WaitGroup{},
+	}
+	if err := storage.open(); err != nil {
+		return nil, err
+	}
+
+	if opts.CompactInterval > 0 {
+		storage.wg.Add(1)
+		go storage.compactLoop()
+	}
+
+	return storage, nil
+}
+
+// RetrieveData looks up the latest value associated with a given `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := ls.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry looks up the latest value and `Metadata` associated with a
+// given `name`.
+//
+// If the `name` is found (and not expired), returns the data (`[]byte`) and
+// metadata, elsewise returns error.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return ls.RetrieveEntryContext(context.Background(), name)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, failing if `ctx` is done.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	// Only block writers
+	ls.rwMu.RLock()
+	defer ls.rwMu.RUnlock()
+
+	entry, found := ls.keydir[name]
+	if !found || entry.meta.Expired(timeNow()) {
+		return []byte{}, Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	data := make([]byte, entry.dataSize)
+	if _, err := ls.file.ReadAt(data, entry.dataOffset); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	return data, entry.meta, nil
+}
+
+// RetrieveMetadata checks the `LogStorage` for the `Metadata` associated with
+// a given `name`, without reading its data from the log.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return ls.RetrieveMetadataContext(context.Background(), name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, failing if `ctx` is
+// done.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	// Only block writers
+	ls.rwMu.RLock()
+	defer ls.rwMu.RUnlock()
+
+	entry, found := ls.keydir[name]
+	if !found || entry.meta.Expired(timeNow()) {
+		return Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	return entry.meta, nil
+}
+
+// StoreData appends data `[]byte` to the log, mapping it to the given `name`.
+//
+// If the `name` already exists, it will overwrite the previous data values.
+//
+// Returns an error if writing fails.
+//
+// This method is thread safe.
+func (ls *LogStorage) StoreData(name string, data []byte) error {
+	return ls.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (ls *LogStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := ls.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (ls *LogStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return ls.CompareAndSwapContext(context.Background(), name, data, opts, cond)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, abandoning the write if
+// `ctx` is done by the time it is appended.
+//
+// This method is thread safe.
+func (ls *LogStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	now := timeNow()
+	prev, found := ls.keydir[name]
+	exists := found && !prev.meta.Expired(now)
+	if err := cond.Check(name, prev.meta, exists); err != nil {
+		return Metadata{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.metadata(data, prev.meta, exists, now)
+	meta.Revision = opts.revision(prev.meta.Revision, ls.revision)
+	entry, err := ls.append(0, name, &meta, data)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if found {
+		ls.garbage += prev.recordSize
+	}
+	ls.keydir[name] = entry
+	if meta.Revision > ls.revision {
+		ls.revision = meta.Revision
+	}
+
+	return meta, nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// into the log.
+//
+// The data is first spooled to a temporary file, so other writers are only
+// blocked while it is appended.
+//
+// This method is thread safe.
+func (ls *LogStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	spooled, err := spool(ls.dir, logSpoolPrefix, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	now := timeNow()
+	prev, found := ls.keydir[name]
+	exists := found && !prev.meta.Expired(now)
+	if err = cond.Check(name, prev.meta, exists); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.streamMetadata(spooled.size, spooled.checksum, prev.meta, exists, now)
+	meta.Revision = opts.revision(prev.meta.Revision, ls.revision)
+	entry, err := ls.appendStream(name, &meta, spooled, spooled.size)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if found {
+		ls.garbage += prev.recordSize
+	}
+	ls.keydir[name] = entry
+	if meta.Revision > ls.revision {
+		ls.revision = meta.Revision
+	}
+
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the data
+// within the log which the caller must close.
+//
+// The reader has its own handle on the data file, so is unaffected by later
+// writes and compactions.
+//
+// This method is thread safe.
+func (ls *LogStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	// Only block writers
+	ls.rwMu.RLock()
+	defer ls.rwMu.RUnlock()
+
+	entry, found := ls.keydir[name]
+	if !found || entry.meta.Expired(timeNow()) {
+		return nil, Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	f, err := os.Open(filepath.Join(ls.dir, logDataFile))
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return readCloser{
+		Reader: io.NewSectionReader(f, entry.dataOffset, entry.dataSize),
+		Closer: f,
+	}, entry.meta, nil
+}
+
+// DeleteData appends a tombstone for the given `name` to the log.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (ls *LogStorage) DeleteData(name string) error {
+	return ls.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (ls *LogStorage) CompareAndDelete(name string, cond Precondition) error {
+	return ls.CompareAndDeleteContext(context.Background(), name, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, abandoning the delete
+// if `ctx` is done by the time it is appended.
+//
+// This method is thread safe.
+func (ls *LogStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	prev, found := ls.keydir[name]
+	if !found {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	expired := prev.meta.Expired(timeNow())
+	if !expired {
+		if err := cond.Check(name, prev.meta, true); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := ls.remove(name, prev); err != nil {
+		return err
+	}
+	if expired {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	return nil
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// The batch is appended to the log with a single write, and replay discards
+// any batch left incomplete by a crash.
+//
+// This method is thread safe.
+func (ls *LogStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return ls.ApplyBatchContext(context.Background(), ops)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, abandoning the batch if `ctx` is
+// done by the time it is appended.
+//
+// This method is thread safe.
+func (ls *LogStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 {
+		return []Metadata{}, nil
+	}
+
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	now := timeNow()
+	revision := ls.revision
+	metas := make([]Metadata, len(ops))
+	for i, op := range ops {
+		prev, found := ls.keydir[op.Name]
+		exists := found && !prev.meta.Expired(now)
+		if err := op.check(prev.meta, exists); err != nil {
+			return nil, err
+		}
+		if !op.Delete {
+			metas[i] = op.Options.metadata(op.Data, prev.meta, exists, now)
+			metas[i].Revision = op.Options.revision(prev.meta.Revision, revision)
+			if metas[i].Revision > revision {
+				revision = metas[i].Revision
+			}
+		}
+	}
+
+	records, sizes, err := encodeLogBatch(ops, metas)
+	if err != nil {
+		return nil, err
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	offset := ls.size
+	if err = ls.write(records); err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		prev := ls.keydir[op.Name]
+		ls.garbage += prev.recordSize
+		if op.Delete {
+			delete(ls.keydir, op.Name)
+			ls.garbage += sizes[i]
+		} else {
+			ls.keydir[op.Name] = logEntry{
+				recordOffset: offset,
+				recordSize:   sizes[i],
+				dataOffset:   offset + sizes[i] - int64(len(op.Data)),
+				dataSize:     int64(len(op.Data)),
+				meta:         metas[i],
+			}
+		}
+		offset += sizes[i]
+	}
+	ls.revision = revision
+
+	return metas, nil
+}
+
+// ListNames lists the names of unexpired entries in the log beginning with
+// `prefix`, see `DataStorage`.
+//
+// This method is thread safe.
+func (ls *LogStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return ls.ListNamesContext(context.Background(), prefix, cursor, limit)
+}
+
+// ListNamesContext behaves as `ListNames`, failing if `ctx` is done.
+//
+// This method is thread safe.
+func (ls *LogStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	// Only block writers
+	ls.rwMu.RLock()
+	defer ls.rwMu.RUnlock()
+
+	now := timeNow()
+	names := make([]string, 0, len(ls.keydir))
+	for name, entry := range ls.keydir {
+		if !entry.meta.Expired(now) {
+			names = append(names, name)
+		}
+	}
+
+	page, next := pageNames(names, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// PurgeExpired appends a tombstone for every expired entry, so their space is
+// reclaimed by the next compaction.
+//
+// This method is thread safe.
+func (ls *LogStorage) PurgeExpired() (int, error) {
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	now := timeNow()
+	purged := 0
+	for name, entry := range ls.keydir {
+		if !entry.meta.Expired(now) {
+			continue
+		}
+		if err := ls.remove(name, entry); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Compact rewrites the data file with only the latest value of every live
+// name, reclaiming the space used by overwritten and deleted entries.
+//
+// Reads and writes are blocked while compaction runs.
+//
+// This method is thread safe.
+func (ls *LogStorage) Compact() error {
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	return ls.compact()
+}
+
+// Stats returns a summary of the current state of the data file.
+//
+// This method is thread safe.
+func (ls *LogStorage) Stats() LogStorageStats {
+	ls.rwMu.RLock()
+	defer ls.rwMu.RUnlock()
+
+	return LogStorageStats{
+		LiveKeys:     len(ls.keydir),
+		FileSize:     ls.size,
+		GarbageBytes: ls.garbage,
+		Compactions:  ls.compactions,
+	}
+}
+
+// Close stops the background compactor, then flushes and closes the data
+// file.
+func (ls *LogStorage) Close() error {
+	close(ls.done)
+	ls.wg.Wait()
+
+	ls.rwMu.Lock()
+	defer ls.rwMu.Unlock()
+
+	if err := ls.file.Sync(); err != nil {
+		ls.file.Close()
+		return err
+	}
+
+	return ls.file.Close()
+}
+
+// open opens the data file and replays it into the key directory, truncating
+// any torn record left at its tail by a crash - the last record of the file,
+// or one running past its end.
+//
+// Fails on a corrupt record followed by others, as truncating would discard
+// them too.
+func (ls *LogStorage) open() error {
+	path := filepath.Join(ls.dir, logDataFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	ls.keydir = make(map[string]logEntry)
+	ls.size = 0
+	ls.garbage = 0
+
+	var (
+		offset int64
+		batch  []logRecord
+	)
+	reader := bufio.NewReader(file)
+	for {
+		record, err := readLogRecord(reader, offset, info.Size())
+		if errors.Is(err, io.EOF) && len(batch) == 0 {
+			break
+		}
+		torn := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if errors.Is(err, errLogCorrupt) {
+			if end := record.entry.recordOffset + record.entry.recordSize; end < info.Size() {
+				file.Close()
+				return fmt.Errorf(
+					"corrupt log record at offset %d, followed by %d bytes: %w",
+					offset, info.Size()-end, err,
+				)
+			}
+			torn = true
+		}
+		if torn {
+			log.Printf(
+				"LogStorage - discarding torn log tail at offset %d: %v",
+				ls.size, err,
+			)
+			if err = file.Truncate(ls.size); err != nil {
+				file.Close()
+				return err
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+		offset += record.entry.recordSize
+
+		// A batch is only applied once all of it has been read
+		batch = append(batch, record)
+		if record.batched() {
+			continue
+		}
+		for _, record := range batch {
+			if prev, found := ls.keydir[record.name]; found {
+				ls.garbage += prev.recordSize
+			}
+			if record.tombstone() {
+				delete(ls.keydir, record.name)
+				ls.garbage += record.entry.recordSize
+			} else {
+				ls.keydir[record.name] = record.entry
+				if rev := record.entry.meta.Revision; rev > ls.revision {
+					ls.revision = rev
+				}
+			}
+		}
+		batch = batch[:0]
+		ls.size = offset
+	}
+
+	// Append all future writes after the last good record
+	if _, err = file.Seek(ls.size, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	ls.file = file
+
+	return nil
+}
+
+// remove appends a tombstone for `name`, whose current entry is `prev`,
+// callers must hold the write lock.
+func (ls *LogStorage) remove(name string, prev logEntry) error {
+	tombstone, err := ls.append(logFlagTombstone, name, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	delete(ls.keydir, name)
+	ls.garbage += prev.recordSize + tombstone.recordSize
+
+	return nil
+}
+
+// append writes a single record to the end of the data file, callers must
+// hold the write lock.
+func (ls *LogStorage) append(flags byte, name string, meta *Metadata, data []byte) (logEntry, error) {
+	record, err := encodeLogRecord(flags, name, meta, data)
+	if err != nil {
+		return logEntry{}, err
+	}
+	if err = ls.write(record); err != nil {
+		return logEntry{}, err
+	}
+
+	offset := ls.size - int64(len(record))
+	entry := logEntry{
+		recordOffset: offset,
+		recordSize:   int64(len(record)),
+		dataOffset:   offset + int64(len(record)-len(data)),
+		dataSize:     int64(len(data)),
+	}
+	if meta != nil {
+		entry.meta = *meta
+	}
+
+	return entry, nil
+}
+
+// appendStream writes a single record of the `size` bytes read from `data` to
+// the end of the data file, callers must hold the write lock.
+//
+// The record is checksummed as it is written, then the checksum is written
+// into its header.
+func (ls *LogStorage) appendStream(name string, meta *Metadata, data io.Reader, size int64) (logEntry, error) {
+	prefix, err := encodeLogRecordPrefix(0, name, meta, size)
+	if err != nil {
+		return logEntry{}, err
+	}
+
+	offset := ls.size
+	checksum := crc32.NewIEEE()
+	checksum.Write(prefix[4:])
+	if _, err = ls.file.Write(prefix); err != nil {
+		ls.discardTail()
+		return logEntry{}, err
+	}
+	written, err := io.Copy(io.MultiWriter(ls.file, checksum), data)
+	if err == nil && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		ls.discardTail()
+		return logEntry{}, err
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], checksum.Sum32())
+	if _, err = ls.file.WriteAt(crc[:], offset); err != nil {
+		ls.discardTail()
+		return logEntry{}, err
+	}
+
+	recordSize := int64(len(prefix)) + size
+	ls.size += recordSize
+	if ls.opts.SyncWrites {
+		if err = ls.file.Sync(); err != nil {
+			return logEntry{}, err
+		}
+	}
+
+	return logEntry{
+		recordOffset: offset,
+		recordSize:   recordSize,
+		dataOffset:   offset + int64(len(prefix)),
+		dataSize:     size,
+		meta:         *meta,
+	}, nil
+}
+
+// write appends already encoded records to the end of the data file, callers
+// must hold the write lock.
+func (ls *LogStorage) write(records []byte) error {
+	if _, err := ls.file.Write(records); err != nil {
+		ls.discardTail()
+		return err
+	}
+	ls.size += int64(len(records))
+
+	if ls.opts.SyncWrites {
+		return ls.file.Sync()
+	}
+	return nil
+}
+
+// discardTail drops whatever part of a failed write made it to disk, past the
+// last complete record - callers must hold the write lock.
+func (ls *LogStorage) discardTail() {
+	if err := ls.file.Truncate(ls.size); err == nil {
+		_, _ = ls.file.Seek(ls.size, io.SeekStart)
+	}
+}
+
+// compact rewrites the data file, callers must hold the write lock.
+//
+// The key directory of the compacted file is built as it is written, so the
+// storage is left as it was should compaction fail - before the compacted file
+// replaces the data file, or after, once it is in use.
+func (ls *LogStorage) compact() error {
+	tmpPath := filepath.Join(ls.dir, logCompactFile)
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	var (
+		keydir = make(map[string]logEntry, len(ls.keydir))
+		size   int64
+		writer = bufio.NewWriter(tmp)
+	)
+	for name, entry := range ls.keydir {
+		record := make([]byte, entry.recordSize)
+		if _, err = ls.file.ReadAt(record, entry.recordOffset); err != nil {
+			tmp.Close()
+			return err
+		}
+		// Only the live record of a batch is kept, so it must replay alone
+		unbatchLogRecord(record)
+		if _, err = writer.Write(record); err != nil {
+			tmp.Close()
+			return err
+		}
+
+		entry.dataOffset += size - entry.recordOffset
+		entry.recordOffset = size
+		keydir[name] = entry
+		size += entry.recordSize
+	}
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(ls.dir, logDataFile)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Swap over to the compacted file, which all future writes append to
+	ls.file.Close()
+	ls.file = tmp
+	ls.keydir = keydir
+	ls.size = size
+	ls.garbage = 0
+	ls.compactions++
+
+	return syncDir(ls.dir)
+}
+
+// compactLoop periodically compacts the data file once enough of it is
+// garbage, until `Close` is called.
+func (ls *LogStorage) compactLoop() {
+	defer ls.wg.Done()
+
+	ticker := time.NewTicker(ls.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ls.done:
+			return
+		case <-ticker.C:
+			ls.rwMu.Lock()
+			if ls.size > 0 &&
+				float64(ls.garbage)/float64(ls.size) >= ls.opts.CompactGarbageRatio {
+				if err := ls.compact(); err != nil {
+					log.Printf("LogStorage - background compaction failed: %v", err)
+				}
+			}
+			ls.rwMu.Unlock()
+		}
+	}
+}
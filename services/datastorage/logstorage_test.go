@@ -0,0 +1,453 @@
+package datastorage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initTestLogStorage(t *testing.T, dir string, opts LogStorageOptions) *LogStorage {
+	t.Helper()
+
+	ls, err := LogStorage{}.Initialize(dir, opts)
+	require.NoError(t, err)
+
+	return ls
+}
+
+func TestLogStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &LogStorage{}
+	var _ StreamingStorage = &LogStorage{}
+	var _ ContextStorage = &LogStorage{}
+}
+
+func TestLogStorage_Initialize(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	defer ls.Close()
+
+	assert.NotNil(t, ls.keydir)
+	assert.NotNil(t, ls.rwMu)
+	assert.FileExists(t, filepath.Join(dir, logDataFile))
+}
+
+func TestLogStorage_RetrieveData(t *testing.T) {
+	ls := initTestLogStorage(t, t.TempDir(), LogStorageOptions{})
+	defer ls.Close()
+	testData := []byte("test data")
+	require.NoError(t, ls.StoreData("test", testData))
+
+	t.Run("existing data", func(t *testing.T) {
+		data, err := ls.RetrieveData("test")
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+
+	t.Run("nonexistent key", func(t *testing.T) {
+		_, err := ls.RetrieveData("foo")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestLogStorage_StoreData(t *testing.T) {
+	ls := initTestLogStorage(t, t.TempDir(), LogStorageOptions{SyncWrites: true})
+	defer ls.Close()
+	dataName := "test"
+	testData := []byte("test data")
+
+	t.Run("first write", func(t *testing.T) {
+		err := ls.StoreData(dataName, testData)
+		require.NoError(t, err)
+		assert.Len(t, ls.keydir, 1)
+
+		data, err := ls.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		testData = []byte("foobar")
+		err := ls.StoreData(dataName, testData)
+		require.NoError(t, err)
+		assert.Len(t, ls.keydir, 1)
+
+		data, err := ls.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, testData, data)
+
+		// The first write is now garbage
+		assert.NotZero(t, ls.Stats().GarbageBytes)
+	})
+}
+
+func TestLogStorage_DeleteData(t *testing.T) {
+	ls := initTestLogStorage(t, t.TempDir(), LogStorageOptions{})
+	defer ls.Close()
+	dataName := "test"
+	require.NoError(t, ls.StoreData(dataName, []byte("test data")))
+
+	t.Run("delete existing data", func(t *testing.T) {
+		err := ls.DeleteData(dataName)
+		require.NoError(t, err)
+		assert.Len(t, ls.keydir, 0)
+	})
+
+	t.Run("delete nonexistent data", func(t *testing.T) {
+		err := ls.DeleteData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestLogStorage_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	require.NoError(t, ls.StoreData("kept", []byte("v1")))
+	require.NoError(t, ls.StoreData("kept", []byte("v2")))
+	require.NoError(t, ls.StoreData("deleted", []byte("gone")))
+	require.NoError(t, ls.DeleteData("deleted"))
+	require.NoError(t, ls.Close())
+
+	t.Run("replays log", func(t *testing.T) {
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+
+		data, err := ls.RetrieveData("kept")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+
+		_, err = ls.RetrieveData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("discards torn tail", func(t *testing.T) {
+		// Simulate a crash partway through appending a record
+		path := filepath.Join(dir, logDataFile)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		torn, err := encodeLogRecord(0, "torn", nil, []byte("never acknowledged"))
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.Write(torn[:len(torn)-3])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		assert.Equal(t, info.Size(), ls.Stats().FileSize)
+		_, err = ls.RetrieveData("torn")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		// New writes land after the last good record
+		require.NoError(t, ls.StoreData("after", []byte("crash")))
+		require.NoError(t, ls.Close())
+
+		ls = initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		data, err := ls.RetrieveData("after")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("crash"), data)
+		data, err = ls.RetrieveData("kept")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+	})
+
+	t.Run("discards corrupt record", func(t *testing.T) {
+		path := filepath.Join(dir, logDataFile)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+
+		// Flip a byte of the final record's data
+		f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{'X'}, info.Size()-1)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		_, err = ls.RetrieveData("after")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Less(t, ls.Stats().FileSize, info.Size())
+	})
+
+	t.Run("fails on corrupt record before tail", func(t *testing.T) {
+		path := filepath.Join(dir, logDataFile)
+		before, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		// Flip a byte of the first record's data
+		f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{'X'}, logHeaderSize+int64(len("kept")))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		_, err = LogStorage{}.Initialize(dir, LogStorageOptions{})
+		assert.ErrorIs(t, err, errLogCorrupt)
+		after, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, len(before), len(after))
+	})
+}
+
+func TestLogStorage_Batch(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	testStorageBatch(t, ls)
+	require.NoError(t, ls.Close())
+
+	t.Run("discards torn batch", func(t *testing.T) {
+		// Simulate a crash after appending only the first record of a batch
+		path := filepath.Join(dir, logDataFile)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		ops := []BatchOp{
+			{Name: "batch/a", Data: []byte("never acknowledged")},
+			{Name: "batch/b", Delete: true},
+		}
+		batch, sizes, err := encodeLogBatch(ops, make([]Metadata, len(ops)))
+		require.NoError(t, err)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.Write(batch[:sizes[0]])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		assert.Equal(t, info.Size(), ls.Stats().FileSize)
+		data, err := ls.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		_, err = ls.RetrieveData("batch/b")
+		require.NoError(t, err)
+	})
+
+	t.Run("compaction keeps part of a batch", func(t *testing.T) {
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		_, err := ls.ApplyBatch([]BatchOp{
+			{Name: "batch/a", Data: []byte("a2")},
+			{Name: "batch/b", Data: []byte("b2")},
+		})
+		require.NoError(t, err)
+
+		// Leaves only the flagged first record of the batch
+		require.NoError(t, ls.StoreData("batch/b", []byte("b3")))
+		require.NoError(t, ls.Compact())
+		require.NoError(t, ls.Close())
+
+		ls = initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		data, err := ls.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a2"), data)
+		data, err = ls.RetrieveData("batch/b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("b3"), data)
+	})
+}
+
+func TestLogStorage_Compact(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	defer ls.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ls.StoreData("overwritten", []byte(fmt.Sprintf("v%d", i))))
+	}
+	require.NoError(t, ls.StoreData("deleted", []byte("gone")))
+	require.NoError(t, ls.DeleteData("deleted"))
+	require.NoError(t, ls.StoreData("untouched", []byte("same")))
+
+	before := ls.Stats()
+	require.NoError(t, ls.Compact())
+	after := ls.Stats()
+
+	assert.Less(t, after.FileSize, before.FileSize)
+	assert.Zero(t, after.GarbageBytes)
+	assert.Equal(t, 2, after.LiveKeys)
+	assert.Equal(t, 1, after.Compactions)
+	assert.NoFileExists(t, filepath.Join(dir, logCompactFile))
+
+	data, err := ls.RetrieveData("overwritten")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v9"), data)
+	data, err = ls.RetrieveData("untouched")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("same"), data)
+	_, err = ls.RetrieveData("deleted")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+	// Writes continue to work against the compacted file
+	require.NoError(t, ls.StoreData("new", []byte("entry")))
+	data, err = ls.RetrieveData("new")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("entry"), data)
+
+	// The compacted file replays as compacted
+	replayed := initTestLogStorage(t, dir, LogStorageOptions{})
+	assert.Equal(t, ls.keydir, replayed.keydir)
+	require.NoError(t, replayed.Close())
+
+	t.Run("background", func(t *testing.T) {
+		bg := initTestLogStorage(t, t.TempDir(), LogStorageOptions{
+			CompactInterval:     10 * time.Millisecond,
+			CompactGarbageRatio: 0.5,
+		})
+		defer bg.Close()
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, bg.StoreData("overwritten", []byte("value")))
+		}
+		assert.Eventually(t, func() bool {
+			return bg.Stats().Compactions > 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("default garbage ratio", func(t *testing.T) {
+		bg := initTestLogStorage(t, t.TempDir(), LogStorageOptions{
+			CompactInterval: 10 * time.Millisecond,
+		})
+		defer bg.Close()
+		assert.Equal(t, defaultLogCompactGarbageRatio, bg.opts.CompactGarbageRatio)
+
+		// Without garbage, nothing to compact
+		require.NoError(t, bg.StoreData("a", []byte("value")))
+		time.Sleep(50 * time.Millisecond)
+		assert.Zero(t, bg.Stats().Compactions)
+	})
+}
+
+func TestLogStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	ls := initTestLogStorage(t, t.TempDir(), LogStorageOptions{
+		CompactInterval: time.Millisecond,
+	})
+	defer ls.Close()
+	dataName := "test"
+	testData := []byte("test data")
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			if itr%3 == 0 {
+				_ = ls.StoreData(dataName, testData)
+			} else if itr%3 == 1 {
+				_, _ = ls.RetrieveData(dataName)
+			} else {
+				_ = ls.DeleteData(dataName)
+			}
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+func TestLogStorage_TTL(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	testStorageTTL(t, ls)
+
+	t.Run("expiry survives restart", func(t *testing.T) {
+		require.NoError(t, ls.StoreDataWithOptions(
+			"restarted", []byte("test data"), StoreOptions{TTL: time.Hour},
+		))
+		require.NoError(t, ls.Compact())
+		require.NoError(t, ls.Close())
+
+		ls = initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		_, meta, err := ls.RetrieveEntry("restarted")
+		require.NoError(t, err)
+		assert.False(t, meta.ExpiresAt.IsZero())
+	})
+}
+
+func TestLogStorage_ConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	testStorageConditionalWrites(t, ls)
+
+	t.Run("revisions survive restart", func(t *testing.T) {
+		_, before, err := ls.RetrieveEntry("conditional")
+		require.NoError(t, err)
+		require.NoError(t, ls.Close())
+
+		ls = initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		_, after, err := ls.RetrieveEntry("conditional")
+		require.NoError(t, err)
+		assert.Equal(t, before.Revision, after.Revision)
+		assert.Equal(t, before.Revision, ls.revision)
+	})
+}
+
+func TestLogStorage_Metadata(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	testStorageMetadata(t, ls)
+
+	// Kept in the log records
+	before, err := ls.RetrieveMetadata("described")
+	require.NoError(t, err)
+	require.NoError(t, ls.Close())
+	ls = initTestLogStorage(t, dir, LogStorageOptions{})
+	defer ls.Close()
+	after, err := ls.RetrieveMetadata("described")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestLogStorage_ListNames(t *testing.T) {
+	ls := initTestLogStorage(t, t.TempDir(), LogStorageOptions{})
+	defer ls.Close()
+	testStorageListNames(t, ls)
+}
+
+func TestLogStorage_Streaming(t *testing.T) {
+	dir := t.TempDir()
+	ls := initTestLogStorage(t, dir, LogStorageOptions{})
+	testStorageStreaming(t, ls)
+
+	t.Run("reads are isolated from compaction", func(t *testing.T) {
+		stream, meta, err := ls.RetrieveStream("stream")
+		require.NoError(t, err)
+		defer stream.Close()
+		require.NoError(t, ls.StoreData("stream", []byte("overwritten again")))
+		require.NoError(t, ls.Compact())
+
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, meta.Size, len(retrieved))
+	})
+	require.NoError(t, ls.Close())
+
+	t.Run("replays streamed records", func(t *testing.T) {
+		spooled, err := filepath.Glob(filepath.Join(dir, logSpoolPrefix+"*"))
+		require.NoError(t, err)
+		assert.Empty(t, spooled)
+
+		ls := initTestLogStorage(t, dir, LogStorageOptions{})
+		defer ls.Close()
+		data, err := ls.RetrieveData("stream")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("overwritten again"), data)
+		_, err = ls.RetrieveData("torn")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
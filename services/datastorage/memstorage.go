@@ -1,28 +1,119 @@
 package datastorage
 
 import (
+	"errors"
+	"log"
 	"sync"
+	"time"
 
 	"github.com/dvo-dev/go-get-started/customerrors"
 )
 
+// MemStorageConfig configures the optional features of a `MemStorage`.
+type MemStorageConfig struct {
+	// WAL enables a write-ahead log with periodic snapshots when set, so data
+	// survives process restarts.
+	WAL *WALConfig
+
+	// MaxBytes bounds the total size of all names and data held, unbounded
+	// when zero.
+	MaxBytes int64
+
+	// MaxEntries bounds the number of names held, unbounded when zero.
+	MaxEntries int
+
+	// Eviction chooses which entries are evicted to stay within `MaxBytes` and
+	// `MaxEntries`, defaults to an `LRUPolicy` if either is set.
+	Eviction EvictionPolicy
+}
+
+// MemStorageStats is a point in time summary of a `MemStorage`.
+type MemStorageStats struct {
+	Entries      int   `json:"entries"`
+	Bytes        int64 `json:"bytes"`
+	Evictions    int64 `json:"evictions"`
+	EvictedBytes int64 `json:"evicted_bytes"`
+}
+
 // MemStorage is an in-memory storage solution that implements the `DataStorage`
 // interface.
 //
 // MemStorage stores data in the form of `[]byte` in map, with user defined
 // `string` keys.
+//
+// Optionally, every mutation may be recorded to a write-ahead log on disk, and
+// the size may be bounded by evicting entries once full (see
+// `MemStorageConfig`), while reads continue to be served from memory.
 type MemStorage struct {
 	data map[string][]byte
+	meta map[string]Metadata
 	rwMu *sync.RWMutex
+	wal  *memWAL
+
+	maxBytes   int64
+	maxEntries int
+	bytes      int64
+	revision   uint64 // latest revision written
+
+	// The policy is updated by readers too, so has its own lock
+	eviction     EvictionPolicy
+	evictMu      *sync.Mutex
+	evictions    int64
+	evictedBytes int64
 }
 
 // InitializeMemStorage initializes and returns a pointer to a clean
 // `MemStorage`.
 func (ms MemStorage) Initialize() *MemStorage {
 	return &MemStorage{
-		data: make(map[string][]byte),
-		rwMu: &sync.RWMutex{},
+		data:    make(map[string][]byte),
+		meta:    make(map[string]Metadata),
+		rwMu:    &sync.RWMutex{},
+		evictMu: &sync.Mutex{},
+	}
+}
+
+// InitializeWithConfig initializes and returns a pointer to a `MemStorage`
+// with the optional features of `cfg` enabled.
+//
+// With a WAL configured, data is first restored from the latest snapshot and
+// write-ahead log - `Close` must be called to stop background syncing and
+// snapshotting.
+func (ms MemStorage) InitializeWithConfig(cfg MemStorageConfig) (*MemStorage, error) {
+	storage := MemStorage{}.Initialize()
+	storage.maxBytes = cfg.MaxBytes
+	storage.maxEntries = cfg.MaxEntries
+	storage.eviction = cfg.Eviction
+	if storage.eviction == nil && (cfg.MaxBytes > 0 || cfg.MaxEntries > 0) {
+		storage.eviction = LRUPolicy{}.Initialize()
+	}
+
+	if cfg.WAL != nil {
+		wal, err := openMemWAL(*cfg.WAL, storage.data, storage.meta)
+		if err != nil {
+			return nil, err
+		}
+		storage.wal = wal
+	}
+
+	// Account for any restored data, evicting should the capacity have shrunk
+	for name, data := range storage.data {
+		storage.bytes += entrySize(name, data)
+		if rev := storage.meta[name].Revision; rev > storage.revision {
+			storage.revision = rev
+		}
+		if storage.eviction != nil {
+			storage.eviction.Added(name)
+		}
 	}
+	storage.evict(0, 0)
+
+	if storage.wal != nil {
+		storage.wal.wg.Add(1)
+		go storage.walLoop()
+	}
+
+	return storage, nil
 }
 
 // RetrieveData checks the `MemStorage` for data associated with a given `name`.
@@ -31,18 +122,46 @@ func (ms MemStorage) Initialize() *MemStorage {
 //
 // This method is thread safe.
 func (ms *MemStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := ms.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry checks the `MemStorage` for data and `Metadata` associated with
+// a given `name`.
+//
+// If the `name` is found (and not expired), returns the data (`[]byte`) and
+// metadata, elsewise returns error.
+//
+// This method is thread safe.
+func (ms *MemStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
 	// Only block writers
 	ms.rwMu.RLock()
 	defer ms.rwMu.RUnlock()
 
 	data, found := ms.data[name]
-	if !found {
-		return []byte{}, customerrors.DataStorageNameNotFound{
+	meta := ms.meta[name]
+	if !found || meta.Expired(timeNow()) {
+		return []byte{}, Metadata{}, customerrors.DataStorageNameNotFound{
 			Name: name,
 		}
 	}
 
-	return data, nil
+	if ms.eviction != nil {
+		ms.evictMu.Lock()
+		ms.eviction.Accessed(name)
+		ms.evictMu.Unlock()
+	}
+
+	return data, meta, nil
+}
+
+// RetrieveMetadata checks the `MemStorage` for the `Metadata` associated with
+// a given `name`.
+//
+// This method is thread safe.
+func (ms *MemStorage) RetrieveMetadata(name string) (Metadata, error) {
+	_, meta, err := ms.RetrieveEntry(name)
+	return meta, err
 }
 
 // StoreData writes data `[]byte` to the `MemStorage`, mapping it to the given
@@ -50,34 +169,427 @@ func (ms *MemStorage) RetrieveData(name string) ([]byte, error) {
 //
 // If the `name` already exists, it will overwrite the previous data values.
 //
-// Returns an error if writing fails.
+// If the `MemStorage` is capacity bounded, other entries are evicted to make
+// room for the data.
+//
+// Returns an error if writing fails, or the data could never fit.
 //
 // This method is thread safe.
 func (ms *MemStorage) StoreData(name string, data []byte) error {
+	return ms.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (ms *MemStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := ms.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// This method is thread safe.
+func (ms *MemStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
 	ms.rwMu.Lock()
 	defer ms.rwMu.Unlock()
 
-	ms.data[name] = data
+	now := timeNow()
+	_, exists := ms.data[name]
+	prev := ms.meta[name]
+	exists = exists && !prev.Expired(now)
+	if err := cond.Check(name, prev, exists); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.metadata(data, prev, exists, now)
+	meta.Revision = opts.revision(prev.Revision, ms.revision)
+	if err := ms.store(name, data, meta); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
+
+// storeEntry writes data `[]byte` and its `Metadata` as is to the
+// `MemStorage`, mapping it to the given `name`.
+//
+// This method is thread safe.
+func (ms *MemStorage) storeEntry(name string, data []byte, meta Metadata) error {
+	ms.rwMu.Lock()
+	defer ms.rwMu.Unlock()
+
+	return ms.store(name, data, meta)
+}
+
+// store writes data `[]byte` and its `Metadata` to the map, evicting other
+// entries if needed, callers must hold the write lock.
+func (ms *MemStorage) store(name string, data []byte, meta Metadata) error {
+	size := entrySize(name, data)
+	if ms.maxBytes > 0 && size > ms.maxBytes {
+		return customerrors.DataStorageEntryTooLarge{
+			Name:  name,
+			Size:  size,
+			Limit: ms.maxBytes,
+		}
+	}
+
+	if ms.wal != nil {
+		if err := ms.wal.append(0, name, &meta, data); err != nil {
+			return err
+		}
+	}
+	ms.put(name, data, meta, size)
 
 	return nil
 }
 
+// put writes data `[]byte` of `size` and its `Metadata` to the map, evicting
+// other entries if needed, callers must hold the write lock and have already
+// recorded the write to the WAL.
+func (ms *MemStorage) put(name string, data []byte, meta Metadata, size int64) {
+	// The previous value must not be chosen to make room for its replacement
+	if prev, found := ms.data[name]; found {
+		ms.remove(name, prev)
+	}
+	ms.evict(size, 1)
+
+	ms.data[name] = data
+	ms.meta[name] = meta
+	ms.bytes += size
+	if meta.Revision > ms.revision {
+		ms.revision = meta.Revision
+	}
+	if ms.eviction != nil {
+		ms.evictMu.Lock()
+		ms.eviction.Added(name)
+		ms.evictMu.Unlock()
+	}
+}
+
 // DeleteData removes data in the `MemStorage` associated with the given `name`.
 //
 // If the `name` does not exist, an error will be returned.
 //
 // This method is thread safe.
 func (ms *MemStorage) DeleteData(name string) error {
+	return ms.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (ms *MemStorage) CompareAndDelete(name string, cond Precondition) error {
 	ms.rwMu.Lock()
 	defer ms.rwMu.Unlock()
 
-	_, found := ms.data[name]
+	data, found := ms.data[name]
 	if !found {
 		return customerrors.DataStorageNameNotFound{
 			Name: name,
 		}
 	}
+	meta := ms.meta[name]
+	expired := meta.Expired(timeNow())
+	if !expired {
+		if err := cond.Check(name, meta, true); err != nil {
+			return err
+		}
+	}
 
-	delete(ms.data, name)
+	if ms.wal != nil {
+		if err := ms.wal.append(logFlagTombstone, name, nil, nil); err != nil {
+			return err
+		}
+	}
+	ms.remove(name, data)
+
+	// Expired data is purged, but was already considered gone
+	if expired {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
 	return nil
 }
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// With a WAL the batch is recorded as a whole, so a restart never restores
+// only part of it. A capacity bounded `MemStorage` may evict entries of the
+// batch to make room for its later entries, as it would writes of them one at
+// a time.
+//
+// This method is thread safe.
+func (ms *MemStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	ms.rwMu.Lock()
+	defer ms.rwMu.Unlock()
+
+	metas, err := ms.prepareBatch(ops)
+	if err != nil {
+		return nil, err
+	}
+	if err = ms.commitBatch(ops, metas); err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// prepareBatch checks every operation of `ops` against the current entries,
+// returning the `Metadata` of each new entry - callers must hold the write
+// lock.
+func (ms *MemStorage) prepareBatch(ops []BatchOp) ([]Metadata, error) {
+	now := timeNow()
+	revision := ms.revision
+	metas := make([]Metadata, len(ops))
+	for i, op := range ops {
+		_, exists := ms.data[op.Name]
+		prev := ms.meta[op.Name]
+		exists = exists && !prev.Expired(now)
+		if err := op.check(prev, exists); err != nil {
+			return nil, err
+		}
+		if op.Delete {
+			continue
+		}
+
+		if size := entrySize(op.Name, op.Data); ms.maxBytes > 0 && size > ms.maxBytes {
+			return nil, customerrors.DataStorageEntryTooLarge{
+				Name:  op.Name,
+				Size:  size,
+				Limit: ms.maxBytes,
+			}
+		}
+		metas[i] = op.Options.metadata(op.Data, prev, exists, now)
+		metas[i].Revision = op.Options.revision(prev.Revision, revision)
+		if metas[i].Revision > revision {
+			revision = metas[i].Revision
+		}
+	}
+
+	return metas, nil
+}
+
+// commitBatch applies `ops` checked by `prepareBatch`, recording them to the
+// WAL (if any) as a single batch - callers must hold the write lock.
+func (ms *MemStorage) commitBatch(ops []BatchOp, metas []Metadata) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if ms.wal != nil {
+		records, _, err := encodeLogBatch(ops, metas)
+		if err != nil {
+			return err
+		}
+		if err = ms.wal.write(records); err != nil {
+			return err
+		}
+	}
+
+	for i, op := range ops {
+		if op.Delete {
+			// Unless already evicted to make room for the batch
+			if data, found := ms.data[op.Name]; found {
+				ms.remove(op.Name, data)
+			}
+		} else {
+			ms.put(op.Name, op.Data, metas[i], entrySize(op.Name, op.Data))
+		}
+	}
+
+	return nil
+}
+
+// ListNames lists the names of unexpired entries in the `MemStorage`
+// beginning with `prefix`, see `DataStorage`.
+//
+// Every page sorts all matching names, so costs O(n log n) in the number of
+// entries.
+//
+// This method is thread safe.
+func (ms *MemStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	// Only block writers
+	ms.rwMu.RLock()
+	defer ms.rwMu.RUnlock()
+
+	now := timeNow()
+	names := make([]string, 0, len(ms.data))
+	for name := range ms.data {
+		if !ms.meta[name].Expired(now) {
+			names = append(names, name)
+		}
+	}
+
+	page, next := pageNames(names, prefix, cursor, limit)
+	return page, next, nil
+}
+
+// PurgeExpired removes all expired entries from the `MemStorage`.
+//
+// This method is thread safe.
+func (ms *MemStorage) PurgeExpired() (int, error) {
+	ms.rwMu.Lock()
+	defer ms.rwMu.Unlock()
+
+	now := timeNow()
+	purged := 0
+	for name, meta := range ms.meta {
+		if !meta.Expired(now) {
+			continue
+		}
+		if ms.wal != nil {
+			if err := ms.wal.append(logFlagTombstone, name, nil, nil); err != nil {
+				return purged, err
+			}
+		}
+		ms.remove(name, ms.data[name])
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Stats returns the current size of the `MemStorage` and eviction counters.
+//
+// This method is thread safe.
+func (ms *MemStorage) Stats() MemStorageStats {
+	ms.rwMu.RLock()
+	defer ms.rwMu.RUnlock()
+
+	return MemStorageStats{
+		Entries:      len(ms.data),
+		Bytes:        ms.bytes,
+		Evictions:    ms.evictions,
+		EvictedBytes: ms.evictedBytes,
+	}
+}
+
+// remove drops `name` from the map and eviction policy, callers must hold the
+// write lock.
+func (ms *MemStorage) remove(name string, data []byte) {
+	delete(ms.data, name)
+	delete(ms.meta, name)
+	ms.bytes -= entrySize(name, data)
+	if ms.eviction != nil {
+		ms.evictMu.Lock()
+		ms.eviction.Removed(name)
+		ms.evictMu.Unlock()
+	}
+}
+
+// evict removes entries chosen by the eviction policy until `bytes` and
+// `entries` more could be added within capacity, callers must hold the write
+// lock.
+//
+// Evictions are recorded to the WAL (if any) so they are not resurrected by a
+// restart.
+func (ms *MemStorage) evict(bytes int64, entries int) {
+	if ms.eviction == nil {
+		return
+	}
+
+	for (ms.maxBytes > 0 && ms.bytes+bytes > ms.maxBytes) ||
+		(ms.maxEntries > 0 && len(ms.data)+entries > ms.maxEntries) {
+		ms.evictMu.Lock()
+		victim, found := ms.eviction.Victim()
+		ms.evictMu.Unlock()
+		if !found {
+			return
+		}
+
+		data, found := ms.data[victim]
+		if !found {
+			// Policy out of sync, forget the name rather than loop forever
+			ms.evictMu.Lock()
+			ms.eviction.Removed(victim)
+			ms.evictMu.Unlock()
+			continue
+		}
+
+		if ms.wal != nil {
+			if err := ms.wal.append(logFlagTombstone, victim, nil, nil); err != nil {
+				log.Printf("MemStorage - failed to log eviction of '%s': %v", victim, err)
+			}
+		}
+		ms.remove(victim, data)
+		ms.evictions++
+		ms.evictedBytes += entrySize(victim, data)
+	}
+}
+
+// entrySize is the number of bytes an entry counts towards `MaxBytes`.
+func entrySize(name string, data []byte) int64 {
+	return int64(len(name) + len(data))
+}
+
+// Snapshot writes the full contents of the `MemStorage` to its snapshot file
+// and truncates the write-ahead log.
+//
+// Returns an error if no WAL is configured.
+//
+// This method is thread safe, writers are blocked until it completes.
+func (ms *MemStorage) Snapshot() error {
+	if ms.wal == nil {
+		return errors.New("MemStorage - no WAL configured")
+	}
+
+	ms.rwMu.RLock()
+	defer ms.rwMu.RUnlock()
+
+	return ms.wal.snapshot(ms.data, ms.meta)
+}
+
+// Close stops background WAL syncing and snapshotting, then flushes and closes
+// the write-ahead log - a no-op without a WAL.
+func (ms *MemStorage) Close() error {
+	if ms.wal == nil {
+		return nil
+	}
+
+	close(ms.wal.done)
+	ms.wal.wg.Wait()
+
+	return ms.wal.close()
+}
+
+// walLoop periodically syncs and snapshots the WAL as configured, until
+// `Close` is called.
+func (ms *MemStorage) walLoop() {
+	defer ms.wal.wg.Done()
+
+	// nil channels block forever, disabling that case
+	var syncC, snapshotC <-chan time.Time
+	if ms.wal.cfg.SyncPolicy == WALSyncInterval && ms.wal.cfg.SyncInterval > 0 {
+		ticker := time.NewTicker(ms.wal.cfg.SyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+	if ms.wal.cfg.SnapshotInterval > 0 {
+		ticker := time.NewTicker(ms.wal.cfg.SnapshotInterval)
+		defer ticker.Stop()
+		snapshotC = ticker.C
+	}
+
+	for {
+		select {
+		case <-ms.wal.done:
+			return
+		case <-syncC:
+			if err := ms.wal.sync(); err != nil {
+				log.Printf("MemStorage - WAL sync failed: %v", err)
+			}
+		case <-snapshotC:
+			if err := ms.Snapshot(); err != nil {
+				log.Printf("MemStorage - snapshot failed: %v", err)
+			}
+		}
+	}
+}
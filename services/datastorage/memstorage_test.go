@@ -133,3 +133,27 @@ func TestMemStorage_ThreadSafe(t *testing.T) {
 	close(start) // Start after all workers created
 	wg.Wait()    // Wait for workers to complete
 }
+
+func TestMemStorage_TTL(t *testing.T) {
+	testStorageTTL(t, MemStorage{}.Initialize())
+}
+
+func TestMemStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, MemStorage{}.Initialize())
+}
+
+func TestMemStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, MemStorage{}.Initialize())
+}
+
+func TestMemStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, MemStorage{}.Initialize())
+}
+
+func TestMemStorage_Batch(t *testing.T) {
+	testStorageBatch(t, MemStorage{}.Initialize())
+}
+
+func TestMemStorage_Streaming(t *testing.T) {
+	testStorageStreaming(t, MemStorage{}.Initialize())
+}
@@ -0,0 +1,277 @@
+package datastorage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// walFile is the name of the write-ahead log within `WALConfig.Dir`.
+	walFile = "wal.log"
+
+	// walSnapshotFile is the name of the latest snapshot within `WALConfig.Dir`.
+	walSnapshotFile = "snapshot"
+)
+
+// WALSyncPolicy determines when the write-ahead log is fsync'd to disk.
+type WALSyncPolicy int
+
+const (
+	// WALSyncAlways fsyncs after every write - no acknowledged write is lost.
+	WALSyncAlways WALSyncPolicy = iota
+
+	// WALSyncInterval fsyncs every `WALConfig.SyncInterval` - at most that
+	// window of writes may be lost to a crash.
+	WALSyncInterval
+
+	// WALSyncNever leaves flushing to the operating system.
+	WALSyncNever
+)
+
+// ParseWALSyncPolicy parses a `WALSyncPolicy` from its name: "always",
+// "interval" or "never".
+func ParseWALSyncPolicy(policy string) (WALSyncPolicy, error) {
+	switch policy {
+	case "always":
+		return WALSyncAlways, nil
+	case "interval":
+		return WALSyncInterval, nil
+	case "never":
+		return WALSyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown WAL sync policy: '%s'", policy)
+	}
+}
+
+// WALConfig configures the optional write-ahead log of a `MemStorage`.
+type WALConfig struct {
+	// Dir is the directory holding the write-ahead log and snapshot.
+	Dir string
+
+	// SyncPolicy determines when the write-ahead log is fsync'd.
+	SyncPolicy WALSyncPolicy
+
+	// SyncInterval is how often the write-ahead log is fsync'd under the
+	// `WALSyncInterval` policy.
+	SyncInterval time.Duration
+
+	// SnapshotInterval is how often a snapshot is taken (truncating the
+	// write-ahead log), no periodic snapshots when zero.
+	SnapshotInterval time.Duration
+}
+
+// memWAL is the write-ahead log of a `MemStorage`, recording every mutation
+// with the same record format as `LogStorage`.
+type memWAL struct {
+	cfg  WALConfig
+	file *os.File
+	size int64
+
+	mu   *sync.Mutex // guards `file` and `size`
+	done chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// openMemWAL opens (or creates) the write-ahead log in `cfg.Dir`, restoring the
+// latest snapshot and then replaying the log on top of it into `data` and
+// `meta`.
+func openMemWAL(cfg WALConfig, data map[string][]byte, meta map[string]Metadata) (*memWAL, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// Snapshots are written atomically, so a missing one is simply empty
+	snapshot, err := os.Open(filepath.Join(cfg.Dir, walSnapshotFile))
+	if err == nil {
+		_, err = replayLogRecords(snapshot, data, meta)
+		snapshot.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(
+		filepath.Join(cfg.Dir, walFile),
+		os.O_RDWR|os.O_CREATE,
+		0o644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	size, err := replayLogRecords(file, data, meta)
+	if err != nil && !errors.Is(err, errLogCorrupt) {
+		file.Close()
+		return nil, fmt.Errorf("failed to replay WAL: %w", err)
+	}
+	if err != nil {
+		log.Printf("MemStorage - discarding corrupt WAL tail at offset %d: %v", size, err)
+	}
+
+	// Append all future writes after the last good record
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &memWAL{
+		cfg:  cfg,
+		file: file,
+		size: size,
+		mu:   &sync.Mutex{},
+		done: make(chan struct{}),
+		wg:   &sync.WaitGroup{},
+	}, nil
+}
+
+// append records a single mutation, syncing according to the sync policy.
+func (w *memWAL) append(flags byte, name string, meta *Metadata, data []byte) error {
+	record, err := encodeLogRecord(flags, name, meta, data)
+	if err != nil {
+		return err
+	}
+	return w.write(record)
+}
+
+// write appends already encoded records, syncing according to the sync
+// policy.
+func (w *memWAL) write(record []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(record); err != nil {
+		// Drop whatever part of the record made it to disk
+		if tErr := w.file.Truncate(w.size); tErr == nil {
+			_, _ = w.file.Seek(w.size, io.SeekStart)
+		}
+		return err
+	}
+	w.size += int64(len(record))
+
+	if w.cfg.SyncPolicy == WALSyncAlways {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// snapshot atomically writes every entry of `data` (and its `meta`) to the
+// snapshot file, then truncates the write-ahead log. Callers must prevent
+// writes to `data` and `meta`.
+//
+// Should a crash occur before truncation, replaying the stale log over the new
+// snapshot still results in the same state.
+func (w *memWAL) snapshot(data map[string][]byte, meta map[string]Metadata) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := atomicWriteFile(
+		filepath.Join(w.cfg.Dir, walSnapshotFile),
+		func(dst io.Writer) error {
+			writer := bufio.NewWriter(dst)
+			for name, value := range data {
+				entryMeta := meta[name]
+				record, err := encodeLogRecord(0, name, &entryMeta, value)
+				if err != nil {
+					return err
+				}
+				if _, err = writer.Write(record); err != nil {
+					return err
+				}
+			}
+			return writer.Flush()
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if err = w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = 0
+
+	return w.file.Sync()
+}
+
+// sync flushes the write-ahead log to disk.
+func (w *memWAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Sync()
+}
+
+// close flushes and closes the write-ahead log, background loops must have
+// already been stopped.
+func (w *memWAL) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// replayLogRecords applies every record read from `file` to `data` and `meta`.
+//
+// Returns the number of bytes of valid records read - on a corrupt or torn
+// record, or an incomplete batch, this is alongside an `errLogCorrupt` error.
+func replayLogRecords(file *os.File, data map[string][]byte, meta map[string]Metadata) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		offset, applied int64
+		batch           []logRecord
+	)
+	reader := bufio.NewReader(file)
+	for {
+		record, err := readLogRecord(reader, offset, info.Size())
+		if errors.Is(err, io.EOF) && len(batch) == 0 {
+			return offset, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, errLogCorrupt) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return applied, errLogCorrupt
+		}
+		if err != nil {
+			return applied, err
+		}
+		offset += record.entry.recordSize
+
+		// A batch is only applied once all of it has been read
+		batch = append(batch, record)
+		if record.batched() {
+			continue
+		}
+		for _, record := range batch {
+			if record.tombstone() {
+				delete(data, record.name)
+				delete(meta, record.name)
+			} else {
+				data[record.name] = record.data
+				meta[record.name] = record.entry.meta
+			}
+		}
+		batch = batch[:0]
+		applied = offset
+	}
+}
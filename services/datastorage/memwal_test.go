@@ -0,0 +1,235 @@
+package datastorage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initTestWALMemStorage(t *testing.T, cfg WALConfig) *MemStorage {
+	t.Helper()
+
+	mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{WAL: &cfg})
+	require.NoError(t, err)
+
+	return mem
+}
+
+func TestParseWALSyncPolicy(t *testing.T) {
+	for name, expected := range map[string]WALSyncPolicy{
+		"always":   WALSyncAlways,
+		"interval": WALSyncInterval,
+		"never":    WALSyncNever,
+	} {
+		policy, err := ParseWALSyncPolicy(name)
+		require.NoError(t, err)
+		assert.Equal(t, expected, policy)
+	}
+
+	_, err := ParseWALSyncPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestMemStorage_InitializeWithConfig(t *testing.T) {
+	t.Run("no WAL", func(t *testing.T) {
+		mem, err := MemStorage{}.InitializeWithConfig(MemStorageConfig{})
+		require.NoError(t, err)
+		assert.NotNil(t, mem.data)
+		assert.Nil(t, mem.wal)
+		assert.NoError(t, mem.Close())
+		assert.Error(t, mem.Snapshot())
+	})
+
+	t.Run("WAL", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "wal")
+		mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+		defer mem.Close()
+		assert.NotNil(t, mem.wal)
+		assert.FileExists(t, filepath.Join(dir, walFile))
+	})
+}
+
+func TestMemStorage_WALReplay(t *testing.T) {
+	for _, policy := range []WALSyncPolicy{WALSyncAlways, WALSyncInterval, WALSyncNever} {
+		dir := t.TempDir()
+		cfg := WALConfig{
+			Dir:          dir,
+			SyncPolicy:   policy,
+			SyncInterval: time.Millisecond,
+		}
+
+		mem := initTestWALMemStorage(t, cfg)
+		require.NoError(t, mem.StoreData("kept", []byte("v1")))
+		require.NoError(t, mem.StoreData("kept", []byte("v2")))
+		require.NoError(t, mem.StoreData("deleted", []byte("gone")))
+		require.NoError(t, mem.DeleteData("deleted"))
+		require.NoError(t, mem.Close())
+
+		restarted := initTestWALMemStorage(t, cfg)
+		data, err := restarted.RetrieveData("kept")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+		_, err = restarted.RetrieveData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Len(t, restarted.data, 1)
+		require.NoError(t, restarted.Close())
+	}
+}
+
+func TestMemStorage_WALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+	require.NoError(t, mem.StoreData("kept", []byte("value")))
+	require.NoError(t, mem.Close())
+
+	// Simulate a crash partway through appending a record
+	torn, err := encodeLogRecord(0, "torn", nil, []byte("never acknowledged"))
+	require.NoError(t, err)
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.Write(torn[:len(torn)-1])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+	_, err = mem.RetrieveData("torn")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	require.NoError(t, mem.StoreData("after", []byte("crash")))
+	require.NoError(t, mem.Close())
+
+	mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+	defer mem.Close()
+	assert.Len(t, mem.data, 2)
+}
+
+func TestMemStorage_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+	require.NoError(t, mem.StoreData("snapshotted", []byte("before")))
+	require.NoError(t, mem.StoreData("deleted", []byte("gone")))
+	require.NoError(t, mem.DeleteData("deleted"))
+
+	require.NoError(t, mem.Snapshot())
+	assert.FileExists(t, filepath.Join(dir, walSnapshotFile))
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// Writes after the snapshot are replayed on top of it
+	require.NoError(t, mem.StoreData("logged", []byte("after")))
+	require.NoError(t, mem.Close())
+
+	mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+	defer mem.Close()
+	assert.Equal(t, map[string][]byte{
+		"snapshotted": []byte("before"),
+		"logged":      []byte("after"),
+	}, mem.data)
+
+	t.Run("periodic", func(t *testing.T) {
+		dir := t.TempDir()
+		mem := initTestWALMemStorage(t, WALConfig{
+			Dir:              dir,
+			SnapshotInterval: 10 * time.Millisecond,
+		})
+		defer mem.Close()
+		require.NoError(t, mem.StoreData("test", []byte("test data")))
+
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(dir, walSnapshotFile))
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestMemStorage_WALTTL(t *testing.T) {
+	dir := t.TempDir()
+	mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+	testStorageTTL(t, mem)
+
+	require.NoError(t, mem.StoreDataWithOptions(
+		"logged", []byte("test data"), StoreOptions{TTL: time.Hour},
+	))
+	require.NoError(t, mem.Snapshot())
+	require.NoError(t, mem.StoreDataWithOptions(
+		"snapshotted", []byte("test data"), StoreOptions{TTL: time.Hour},
+	))
+	require.NoError(t, mem.Close())
+
+	mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+	defer mem.Close()
+	for _, name := range []string{"logged", "snapshotted"} {
+		_, meta, err := mem.RetrieveEntry(name)
+		require.NoError(t, err)
+		assert.False(t, meta.ExpiresAt.IsZero())
+	}
+}
+
+func TestMemStorage_WALConditionalWrites(t *testing.T) {
+	dir := t.TempDir()
+	mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+	testStorageConditionalWrites(t, mem)
+
+	_, before, err := mem.RetrieveEntry("conditional")
+	require.NoError(t, err)
+	require.NoError(t, mem.Close())
+
+	mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+	defer mem.Close()
+	_, after, err := mem.RetrieveEntry("conditional")
+	require.NoError(t, err)
+	assert.Equal(t, before.Revision, after.Revision)
+	assert.Equal(t, before.Revision, mem.revision)
+}
+
+func TestMemStorage_WALBatch(t *testing.T) {
+	dir := t.TempDir()
+	mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+	testStorageBatch(t, mem)
+	require.NoError(t, mem.Close())
+
+	t.Run("replays batches", func(t *testing.T) {
+		mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+		defer mem.Close()
+
+		data, err := mem.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		_, err = mem.RetrieveData("batch/old")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("discards torn batch", func(t *testing.T) {
+		// Simulate a crash after appending only the first record of a batch
+		ops := []BatchOp{
+			{Name: "batch/a", Data: []byte("never acknowledged")},
+			{Name: "batch/b", Delete: true},
+		}
+		batch, sizes, err := encodeLogBatch(ops, make([]Metadata, len(ops)))
+		require.NoError(t, err)
+		f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0o644)
+		require.NoError(t, err)
+		_, err = f.Write(batch[:sizes[0]])
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		mem := initTestWALMemStorage(t, WALConfig{Dir: dir})
+		data, err := mem.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		require.NoError(t, mem.StoreData("after", []byte("crash")))
+		require.NoError(t, mem.Close())
+
+		mem = initTestWALMemStorage(t, WALConfig{Dir: dir})
+		defer mem.Close()
+		_, err = mem.RetrieveData("batch/b")
+		require.NoError(t, err)
+		_, err = mem.RetrieveData("after")
+		require.NoError(t, err)
+	})
+}
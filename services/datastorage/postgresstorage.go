@@ -0,0 +1,598 @@
+package datastorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// postgresMigrationLockID is the advisory lock key held while migrating, so
+// multiple webapp instances starting at once do not race each other.
+const postgresMigrationLockID = 7_340_032
+
+// postgresNameLockClass is the first key of the advisory locks held while
+// conditionally writing a name, the second being a hash of the name.
+const postgresNameLockClass = 7_340_033
+
+// postgresMigrations are applied in order on `Initialize`, each exactly once.
+//
+// Never edit or reorder an existing migration - append a new one instead.
+var postgresMigrations = []string{
+	// 1: initial schema
+	`CREATE TABLE IF NOT EXISTS datastorage (
+		name TEXT PRIMARY KEY,
+		data BYTEA NOT NULL
+	)`,
+	// 2: expiry
+	`ALTER TABLE datastorage ADD COLUMN expires_at TIMESTAMPTZ`,
+	// 3: revisions
+	`ALTER TABLE datastorage ADD COLUMN revision BIGINT NOT NULL DEFAULT 0`,
+	// 4: entry metadata
+	`ALTER TABLE datastorage
+		ADD COLUMN content_type TEXT NOT NULL DEFAULT '',
+		ADD COLUMN checksum TEXT NOT NULL DEFAULT '',
+		ADD COLUMN created_at TIMESTAMPTZ,
+		ADD COLUMN updated_at TIMESTAMPTZ`,
+	// 5: escaped names, see `postgresName` - none held NUL bytes before
+	`UPDATE datastorage SET name = replace(name, chr(1), chr(1) || chr(2))
+		WHERE strpos(name, chr(1)) > 0`,
+}
+
+// postgresMetadataColumns are selected to read a row's `Metadata`, see
+// `scanPostgresMetadata`.
+const postgresMetadataColumns = `revision, expires_at, content_type,
+	octet_length(data), checksum, created_at, updated_at`
+
+// PostgresStorage is a PostgreSQL backed storage solution that implements the
+// `DataStorage` interface.
+//
+// PostgresStorage stores data as `BYTEA` rows in the `datastorage` table,
+// keyed by their user defined `name` - escaped, as `TEXT` cannot hold the NUL
+// bytes of the internal names of decorators, see `postgresName`.
+type PostgresStorage struct {
+	db *sql.DB
+}
+
+// Initialize initializes and returns a pointer to a `PostgresStorage` using
+// the database connection pool `db`, migrating the schema to the latest
+// version if needed.
+//
+// The returned `PostgresStorage` takes ownership of `db`, which is closed by
+// `Close`.
+func (ps PostgresStorage) Initialize(db *sql.DB) (*PostgresStorage, error) {
+	storage := &PostgresStorage{
+		db: db,
+	}
+	if err := storage.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate postgres schema: %w", err)
+	}
+
+	return storage, nil
+}
+
+// RetrieveData queries the `PostgresStorage` for data associated with a given
+// `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) RetrieveData(name string) ([]byte, error) {
+	data, _, err := ps.RetrieveEntry(name)
+	return data, err
+}
+
+// RetrieveEntry queries the `PostgresStorage` for data and `Metadata`
+// associated with a given `name`.
+//
+// If the `name` is found (and not expired), returns the data (`[]byte`) and
+// metadata, elsewise returns error.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return ps.RetrieveEntryContext(context.Background(), name)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, cancelling the query once
+// `ctx` is done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	var data []byte
+	meta, err := scanPostgresMetadata(ps.db.QueryRowContext(ctx,
+		`SELECT `+postgresMetadataColumns+`, data FROM datastorage
+		WHERE name = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		postgresName(name), timeNow(),
+	), &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []byte{}, Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	if err != nil {
+		return []byte{}, Metadata{}, postgresContextErr(ctx, err)
+	}
+
+	return data, meta, nil
+}
+
+// RetrieveMetadata queries the `PostgresStorage` for the `Metadata` associated
+// with a given `name`, without transferring its data.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return ps.RetrieveMetadataContext(context.Background(), name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, cancelling the query
+// once `ctx` is done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	meta, err := scanPostgresMetadata(ps.db.QueryRowContext(ctx,
+		`SELECT `+postgresMetadataColumns+` FROM datastorage
+		WHERE name = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		postgresName(name), timeNow(),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Metadata{}, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	return meta, postgresContextErr(ctx, err)
+}
+
+// StoreData upserts data `[]byte` into the `PostgresStorage`, mapping it to the
+// given `name`.
+//
+// If the `name` already exists, it will overwrite the previous data values.
+//
+// Returns an error if writing fails.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) StoreData(name string, data []byte) error {
+	return ps.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := ps.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current row of `name`, returning the `Metadata` of the new row.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return ps.CompareAndSwapContext(context.Background(), name, data, opts, cond)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, rolling back once `ctx`
+// is done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if data == nil {
+		data = []byte{}
+	}
+
+	tx, prev, found, err := ps.lockName(ctx, name)
+	if err != nil {
+		return Metadata{}, postgresContextErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	now := timeNow()
+	exists := found && !prev.Expired(now)
+	if err = cond.Check(name, prev, exists); err != nil {
+		return Metadata{}, err
+	}
+
+	meta := opts.metadata(data, prev, exists, now)
+	meta.Revision = opts.revision(prev.Revision, prev.Revision)
+	if err = upsertPostgresRow(ctx, tx, name, data, meta); err != nil {
+		return Metadata{}, postgresContextErr(ctx, err)
+	}
+
+	return meta, postgresContextErr(ctx, tx.Commit())
+}
+
+// DeleteData removes data in the `PostgresStorage` associated with the given
+// `name`.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) DeleteData(name string) error {
+	return ps.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current row of `name`.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) CompareAndDelete(name string, cond Precondition) error {
+	return ps.CompareAndDeleteContext(context.Background(), name, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, rolling back once
+// `ctx` is done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	tx, prev, found, err := ps.lockName(ctx, name)
+	if err != nil {
+		return postgresContextErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Expired rows are left for `PurgeExpired`, but are already considered gone
+	if !found || prev.Expired(timeNow()) {
+		return customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+	if err = cond.Check(name, prev, true); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, `DELETE FROM datastorage WHERE name = $1`, postgresName(name)); err != nil {
+		return postgresContextErr(ctx, err)
+	}
+
+	return postgresContextErr(ctx, tx.Commit())
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`, within a single transaction.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return ps.ApplyBatchContext(context.Background(), ops)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, rolling back once `ctx` is done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, postgresContextErr(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Lock names in order, so overlapping batches cannot deadlock
+	order := make([]int, len(ops))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return ops[order[a]].Name < ops[order[b]].Name
+	})
+
+	now := timeNow()
+	metas := make([]Metadata, len(ops))
+	for _, i := range order {
+		op := ops[i]
+		prev, found, err := lockPostgresName(ctx, tx, op.Name)
+		if err != nil {
+			return nil, postgresContextErr(ctx, err)
+		}
+		exists := found && !prev.Expired(now)
+		if err = op.check(prev, exists); err != nil {
+			return nil, err
+		}
+		if !op.Delete {
+			metas[i] = op.Options.metadata(op.Data, prev, exists, now)
+			metas[i].Revision = op.Options.revision(prev.Revision, prev.Revision)
+		}
+	}
+
+	for i, op := range ops {
+		if op.Delete {
+			_, err = tx.ExecContext(ctx, `DELETE FROM datastorage WHERE name = $1`, postgresName(op.Name))
+		} else {
+			data := op.Data
+			if data == nil {
+				data = []byte{}
+			}
+			err = upsertPostgresRow(ctx, tx, op.Name, data, metas[i])
+		}
+		if err != nil {
+			return nil, postgresContextErr(ctx, err)
+		}
+	}
+
+	return metas, postgresContextErr(ctx, tx.Commit())
+}
+
+// ListNames lists the names of unexpired rows beginning with `prefix`, see
+// `DataStorage`.
+//
+// Names are compared with the "C" collation, so they are ordered by byte as
+// in every other storage - escaped, see `postgresName`, in an order keeping
+// way.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return ps.ListNamesContext(context.Background(), prefix, cursor, limit)
+}
+
+// ListNamesContext behaves as `ListNames`, cancelling the query once `ctx` is
+// done.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	// One more row than needed tells whether there is a next page
+	var queryLimit sql.NullInt64
+	if limit > 0 {
+		queryLimit = sql.NullInt64{Int64: int64(limit) + 1, Valid: true}
+	}
+
+	rows, err := ps.db.QueryContext(ctx,
+		`SELECT name FROM datastorage
+		WHERE left(name, length($1)) = $1
+			AND name COLLATE "C" > $2
+			AND (expires_at IS NULL OR expires_at > $3)
+		ORDER BY name COLLATE "C"
+		LIMIT $4`,
+		postgresName(prefix), postgresName(cursor), timeNow(), queryLimit,
+	)
+	if err != nil {
+		return nil, "", postgresContextErr(ctx, err)
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, "", postgresContextErr(ctx, err)
+		}
+		names = append(names, unescapePostgresName(name))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", postgresContextErr(ctx, err)
+	}
+
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+		return names, names[limit-1], nil
+	}
+	return names, "", nil
+}
+
+// PurgeExpired deletes all expired rows.
+//
+// This method is thread safe.
+func (ps *PostgresStorage) PurgeExpired() (int, error) {
+	result, err := ps.db.Exec(
+		`DELETE FROM datastorage WHERE expires_at <= $1`,
+		timeNow(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// Close closes the underlying database connection pool.
+func (ps *PostgresStorage) Close() error {
+	return ps.db.Close()
+}
+
+// lockName begins a transaction holding an advisory lock on `name`, so
+// conditional writes of it (including its creation) are serialized, and reads
+// its current `Metadata` - reporting whether a row exists.
+//
+// The caller must commit or roll back the returned transaction.
+func (ps *PostgresStorage) lockName(ctx context.Context, name string) (*sql.Tx, Metadata, bool, error) {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, Metadata{}, false, err
+	}
+
+	meta, found, err := lockPostgresName(ctx, tx, name)
+	if err != nil {
+		tx.Rollback()
+		return nil, Metadata{}, false, err
+	}
+
+	return tx, meta, found, nil
+}
+
+// lockPostgresName takes the advisory lock on `name` within `tx`, then reads
+// its current `Metadata` - reporting whether a row exists.
+func lockPostgresName(ctx context.Context, tx *sql.Tx, name string) (Metadata, bool, error) {
+	if _, err := tx.ExecContext(ctx,
+		`SELECT pg_advisory_xact_lock($1, hashtext($2))`,
+		postgresNameLockClass, postgresName(name),
+	); err != nil {
+		return Metadata{}, false, err
+	}
+
+	meta, err := scanPostgresMetadata(tx.QueryRowContext(ctx,
+		`SELECT `+postgresMetadataColumns+` FROM datastorage WHERE name = $1`,
+		postgresName(name),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Metadata{}, false, nil
+	}
+	if err != nil {
+		return Metadata{}, false, err
+	}
+
+	return meta, true, nil
+}
+
+// upsertPostgresRow writes the row of `name` within `tx`, replacing any
+// previous row.
+func upsertPostgresRow(ctx context.Context, tx *sql.Tx, name string, data []byte, meta Metadata) error {
+	var expiresAt sql.NullTime
+	if !meta.ExpiresAt.IsZero() {
+		expiresAt = sql.NullTime{Time: meta.ExpiresAt, Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO datastorage (name, data, revision, expires_at,
+			content_type, checksum, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (name) DO UPDATE
+		SET data = EXCLUDED.data,
+			revision = EXCLUDED.revision,
+			expires_at = EXCLUDED.expires_at,
+			content_type = EXCLUDED.content_type,
+			checksum = EXCLUDED.checksum,
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at`,
+		postgresName(name), data, int64(meta.Revision), expiresAt,
+		meta.ContentType, meta.Checksum, meta.CreatedAt, meta.UpdatedAt,
+	)
+	return err
+}
+
+// postgresNameEscape begins the escape sequences of `postgresName`.
+const postgresNameEscape = '\x01'
+
+// postgresName escapes `name` to be stored as `TEXT`, which cannot hold NUL
+// bytes: NUL as "\x01\x01", and the escape byte itself as "\x01\x02".
+//
+// Both sort below every other byte as the bytes they escape do, so escaped
+// names keep their order and prefixes - for `ListNames`.
+func postgresName(name string) string {
+	if !strings.ContainsAny(name, "\x00\x01") {
+		return name
+	}
+
+	var b strings.Builder
+	b.Grow(len(name) + 2)
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case 0:
+			b.WriteString("\x01\x01")
+		case postgresNameEscape:
+			b.WriteString("\x01\x02")
+		default:
+			b.WriteByte(name[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapePostgresName returns the name escaped by `postgresName` as
+// `escaped`.
+func unescapePostgresName(escaped string) string {
+	if strings.IndexByte(escaped, postgresNameEscape) < 0 {
+		return escaped
+	}
+
+	var b strings.Builder
+	b.Grow(len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == postgresNameEscape && i+1 < len(escaped) {
+			i++
+			b.WriteByte(escaped[i] - 1)
+			continue
+		}
+		b.WriteByte(escaped[i])
+	}
+	return b.String()
+}
+
+// postgresContextErr returns the error of `ctx` in place of `err` if `ctx` is
+// done, as a query cancelled by it fails with a driver error instead.
+func postgresContextErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if cErr := ctx.Err(); cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// scanPostgresMetadata scans a row selecting `postgresMetadataColumns`, and
+// then any `extra` columns, into a `Metadata`.
+func scanPostgresMetadata(row *sql.Row, extra ...any) (Metadata, error) {
+	var (
+		meta      Metadata
+		revision  int64
+		expiresAt sql.NullTime
+		createdAt sql.NullTime
+		updatedAt sql.NullTime
+	)
+	dest := append([]any{
+		&revision, &expiresAt, &meta.ContentType,
+		&meta.Size, &meta.Checksum, &createdAt, &updatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return Metadata{}, err
+	}
+
+	meta.Revision = uint64(revision)
+	meta.ExpiresAt = expiresAt.Time
+	meta.CreatedAt = createdAt.Time
+	meta.UpdatedAt = updatedAt.Time
+
+	return meta, nil
+}
+
+// migrate applies any `postgresMigrations` not yet recorded in the
+// `datastorage_migrations` table, all within a single transaction.
+func (ps *PostgresStorage) migrate() error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(
+		`SELECT pg_advisory_xact_lock($1)`,
+		postgresMigrationLockID,
+	); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(
+		`CREATE TABLE IF NOT EXISTS datastorage_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	); err != nil {
+		return err
+	}
+
+	var current int
+	if err = tx.QueryRow(
+		`SELECT COALESCE(MAX(version), 0) FROM datastorage_migrations`,
+	).Scan(&current); err != nil {
+		return err
+	}
+
+	for i := current; i < len(postgresMigrations); i++ {
+		if _, err = tx.Exec(postgresMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err = tx.Exec(
+			`INSERT INTO datastorage_migrations (version) VALUES ($1)`,
+			i+1,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,830 @@
+package datastorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+const (
+	// quotaScanBatchSize is the number of names listed at a time when
+	// measuring the usage of a backing storage.
+	quotaScanBatchSize = 1000
+
+	// quotaSpoolPrefix names the temporary files streams are spooled to.
+	quotaSpoolPrefix = "quota-spool-"
+)
+
+// Quota limits the entries of the names beginning with `Prefix`, every name
+// if empty. The names of bucket data are matched as "{bucket}/{name}".
+//
+// Each limit is unlimited if zero.
+type Quota struct {
+	Prefix string `json:"prefix,omitempty"`
+
+	// MaxBytes is the total size of the entries, in bytes.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+
+	// MaxEntrySize is the size of each entry, in bytes.
+	MaxEntrySize int64 `json:"max_entry_size,omitempty"`
+
+	// MaxEntries is the number of entries.
+	MaxEntries int64 `json:"max_entries,omitempty"`
+}
+
+// ReadQuotas reads a JSON file at `path` of a list of `Quota`, such as:
+//
+//	[{"max_bytes": 1073741824}, {"prefix": "uploads/", "max_entry_size": 1048576, "max_entries": 1000}]
+func ReadQuotas(path string) ([]Quota, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotas []Quota
+	if err = json.Unmarshal(contents, &quotas); err != nil {
+		return nil, fmt.Errorf("invalid quotas file '%s': %w", path, err)
+	}
+	return quotas, nil
+}
+
+// QuotaUsage is the usage of a single `Quota` of a `QuotaStorage`.
+type QuotaUsage struct {
+	Quota
+
+	Bytes   int64 `json:"bytes"`
+	Entries int64 `json:"entries"`
+}
+
+// QuotaStorageConfig configures a `QuotaStorage`.
+type QuotaStorageConfig struct {
+	// Quotas are enforced on every write, each name counting towards every
+	// quota it matches.
+	Quotas []Quota
+
+	// SpoolDir holds the temporary files streamed data is measured in before
+	// being written, defaults to `os.TempDir`.
+	SpoolDir string
+}
+
+// quotaEntry is an entry counted towards the quotas of a `QuotaStorage`.
+type quotaEntry struct {
+	size      int64
+	expiresAt time.Time
+}
+
+// QuotaStorage is a decorator that implements the `DataStorage` interface by
+// refusing writes to its backing `DataStorage` which would exceed a `Quota`,
+// with `customerrors.DataStorageQuotaExceeded` - so no single writer can
+// exhaust the storage.
+//
+// The usage of the backing storage is measured on initialization, and then
+// counted on every write through the `QuotaStorage` - any other writes to the
+// backing storage are not counted. Sizes are of the data as written, before
+// any compression or encryption beneath, and only current entries count - not
+// previous versions. Expired entries count until purged, see `Reaper`.
+//
+// Writes which do not increase the usage of a quota are never refused, even
+// if it is already exceeded - such as after its limits were lowered. The usage
+// of a write is reserved while it is made, and released should it fail, so
+// writes to different names are made concurrently.
+//
+// It implements `ContextStorage`, passing contexts on to the backing storage
+// if it honours them natively.
+type QuotaStorage struct {
+	backing DataStorage
+	cfg     QuotaStorageConfig
+
+	// mu guards the usage, which includes that reserved by writes being made
+	mu      *sync.Mutex
+	usage   []QuotaUsage
+	entries map[string]quotaEntry
+
+	// names serializes the writes to each name matching a quota, so they are
+	// counted in the order they are made
+	names *nameLocks
+}
+
+// Initialize initializes and returns a pointer to a `QuotaStorage` in front
+// of `backing`, configured by `cfg` - measuring the current usage of
+// `backing`, which must be beneath any `BucketStorage` so the data of buckets
+// is counted.
+//
+// The returned `QuotaStorage` takes ownership of `backing` - `Close` closes
+// `backing` if it is an `io.Closer`.
+func (qs QuotaStorage) Initialize(backing DataStorage, cfg QuotaStorageConfig) (*QuotaStorage, error) {
+	storage := &QuotaStorage{
+		backing: backing,
+		cfg:     cfg,
+		mu:      &sync.Mutex{},
+		usage:   make([]QuotaUsage, len(cfg.Quotas)),
+		entries: map[string]quotaEntry{},
+		names:   &nameLocks{mu: &sync.Mutex{}, locks: map[string]*nameLock{}},
+	}
+	for i, quota := range cfg.Quotas {
+		if quota.MaxBytes < 0 || quota.MaxEntrySize < 0 || quota.MaxEntries < 0 {
+			return nil, fmt.Errorf("quota of prefix '%s' has a negative limit", quota.Prefix)
+		}
+		storage.usage[i].Quota = quota
+	}
+
+	if err := storage.measure(); err != nil {
+		return nil, fmt.Errorf("failed to measure data storage usage: %w", err)
+	}
+	return storage, nil
+}
+
+// RetrieveData retrieves the data associated with a given `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveData(name string) ([]byte, error) {
+	return qs.backing.RetrieveData(name)
+}
+
+// RetrieveEntry retrieves the data and `Metadata` associated with a given
+// `name`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return qs.backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadata retrieves the `Metadata` associated with a given `name`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return qs.backing.RetrieveMetadata(name)
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, streaming the data if the
+// backing storage can, see `StreamingStorage`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	return RetrieveStream(qs.backing, name)
+}
+
+// StoreData stores data `[]byte` with an associated `name`, unless it would
+// exceed a quota.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) StoreData(name string, data []byte) error {
+	return qs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := qs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`, returning the `Metadata` of the new entry.
+//
+// Returns `customerrors.DataStorageQuotaExceeded` if `data` would exceed a
+// quota.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return qs.compareAndSwap(qs.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (qs *QuotaStorage) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if !qs.limited(name) {
+		return backing.CompareAndSwap(name, data, opts, cond)
+	}
+
+	defer qs.names.lock(name)()
+	reserved, err := qs.reserve(name, int64(len(data)))
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta, err := backing.CompareAndSwap(name, data, opts, cond)
+	if err != nil {
+		qs.settle(reserved, nil)
+		return Metadata{}, err
+	}
+	qs.settle(reserved, func() { qs.commit(name, &meta) })
+
+	return meta, nil
+}
+
+// StoreStream behaves as `CompareAndSwap`, spooling the data read from `r` to
+// a temporary file to measure it - failing as soon as more is read than any
+// quota allows - then streaming it to the backing storage.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if !qs.limited(name) {
+		return StoreStream(qs.backing, name, r, opts, cond)
+	}
+
+	spooled, err := spool(qs.cfg.SpoolDir, quotaSpoolPrefix, &quotaLimitedReader{
+		reader:  r,
+		storage: qs,
+		name:    name,
+	})
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	defer qs.names.lock(name)()
+	reserved, err := qs.reserve(name, spooled.size)
+	if err != nil {
+		return Metadata{}, err
+	}
+	meta, err := StoreStream(qs.backing, name, spooled, opts, cond)
+	if err != nil {
+		qs.settle(reserved, nil)
+		return Metadata{}, err
+	}
+	qs.settle(reserved, func() { qs.commit(name, &meta) })
+
+	return meta, nil
+}
+
+// DeleteData deletes data associated with a given `name`, releasing its
+// usage.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) DeleteData(name string) error {
+	return qs.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) CompareAndDelete(name string, cond Precondition) error {
+	return qs.compareAndDelete(qs.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (qs *QuotaStorage) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	if !qs.limited(name) {
+		return backing.CompareAndDelete(name, cond)
+	}
+
+	defer qs.names.lock(name)()
+	err := backing.CompareAndDelete(name, cond)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); err != nil && !notFound {
+		return err
+	}
+	// Not found once expired, so no longer counted either way
+	qs.settle(nil, func() { qs.commit(name, nil) })
+
+	return err
+}
+
+// ApplyBatch atomically applies every operation of `ops`, or none of them, as
+// per `DataStorage`.
+//
+// Returns `customerrors.DataStorageQuotaExceeded` if the batch as a whole
+// would exceed a quota.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return qs.applyBatch(qs.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (qs *QuotaStorage) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+	limited := false
+	for _, op := range ops {
+		limited = limited || qs.limited(op.Name)
+	}
+	if !limited {
+		return backing.ApplyBatch(ops)
+	}
+
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Name
+	}
+	defer qs.names.lock(names...)()
+
+	// Names are unique within a batch, so each is counted against its
+	// current entry alone - deletions first, as the batch applies as a whole
+	qs.mu.Lock()
+	usage := qs.usageCopy()
+	for _, op := range ops {
+		if op.Delete {
+			usage, _ = qs.count(usage, op.Name, -1, false)
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			continue
+		}
+		var err error
+		if usage, err = qs.count(usage, op.Name, int64(len(op.Data)), true); err != nil {
+			qs.mu.Unlock()
+			return nil, err
+		}
+	}
+	reserved := qs.reserveUsage(usage)
+	qs.mu.Unlock()
+
+	metas, err := backing.ApplyBatch(ops)
+	if err != nil {
+		qs.settle(reserved, nil)
+		return nil, err
+	}
+	qs.settle(reserved, func() {
+		for i, op := range ops {
+			if op.Delete {
+				qs.commit(op.Name, nil)
+			} else {
+				qs.commit(op.Name, &metas[i])
+			}
+		}
+	})
+
+	return metas, nil
+}
+
+// PurgeExpired permanently removes all expired entries from the backing
+// storage, releasing their usage, and returns how many were removed.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) PurgeExpired() (int, error) {
+	// Entries expired by now are purged, those written since are counted
+	// as written
+	now := timeNow()
+	purged, err := qs.backing.PurgeExpired()
+	if err != nil {
+		return purged, err
+	}
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	for name, entry := range qs.entries {
+		if entry.expiresAt.IsZero() || now.Before(entry.expiresAt) {
+			continue
+		}
+		qs.usage, _ = qs.count(qs.usage, name, -1, false)
+		delete(qs.entries, name)
+	}
+	return purged, nil
+}
+
+// ListNames lists the names of entries beginning with `prefix`, see
+// `DataStorage`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return qs.backing.ListNames(prefix, cursor, limit)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.RetrieveEntryContext(ctx, name)
+	}
+	return backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.RetrieveMetadataContext(ctx, name)
+	}
+	return backing.RetrieveMetadata(name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return qs.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return qs.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return backing.ListNames(prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, qs.backing)
+	if !ok {
+		return contextAdapter{qs}.ApplyBatchContext(ctx, ops)
+	}
+	return qs.applyBatch(backing, ops)
+}
+
+func (qs *QuotaStorage) contextNative() bool {
+	_, ok := nativeContext(qs.backing)
+	return ok
+}
+
+// RetrieveVersion retrieves a previous `version` of the data of `name`, if
+// the backing storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RetrieveVersion(name string, version int) ([]byte, Metadata, error) {
+	history, err := versionHistory(qs.backing)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return history.RetrieveVersion(name, version)
+}
+
+// ListVersions lists the kept versions of the data of `name`, if the backing
+// storage implements `VersionHistory`.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) ListVersions(name string) ([]VersionInfo, error) {
+	history, err := versionHistory(qs.backing)
+	if err != nil {
+		return nil, err
+	}
+	return history.ListVersions(name)
+}
+
+// RestoreVersion restores the data of `name` to a previous `version`, if the
+// backing storage implements `VersionHistory`, unless it would exceed a
+// quota.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) RestoreVersion(name string, version int) (int, error) {
+	history, err := versionHistory(qs.backing)
+	if err != nil {
+		return 0, err
+	}
+	if !qs.limited(name) {
+		return history.RestoreVersion(name, version)
+	}
+
+	defer qs.names.lock(name)()
+	versions, err := history.ListVersions(name)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		size     int64
+		reserved []QuotaUsage
+	)
+	for _, info := range versions {
+		if info.Version != version {
+			continue
+		}
+		size = int64(info.Size)
+		if reserved, err = qs.reserve(name, size); err != nil {
+			return 0, err
+		}
+	}
+
+	restored, err := history.RestoreVersion(name, version)
+	if err != nil {
+		qs.settle(reserved, nil)
+		return 0, err
+	}
+	meta, err := qs.backing.RetrieveMetadata(name)
+	if err != nil {
+		// Counted as the version listed until measured again
+		meta = Metadata{Size: int(size)}
+	}
+	qs.settle(reserved, func() { qs.commit(name, &meta) })
+
+	return restored, nil
+}
+
+// Usage returns the usage of every quota, in the order configured.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) Usage() []QuotaUsage {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	return qs.usageCopy()
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (qs *QuotaStorage) Close() error {
+	if closer, ok := qs.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// measure counts every entry of the backing storage towards the quotas it
+// matches.
+func (qs *QuotaStorage) measure() error {
+	cursor := ""
+	for {
+		names, next, err := qs.backing.ListNames("", cursor, quotaScanBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if !qs.limited(name) {
+				continue
+			}
+			meta, err := qs.backing.RetrieveMetadata(name)
+			if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+				// Deleted, or expired, since listed
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			qs.usage, _ = qs.count(qs.usage, name, int64(meta.Size), false)
+			qs.track(name, meta)
+		}
+
+		if len(next) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// quotaName returns the name the quotas match `name` of the backing storage
+// by, reporting false for the internal names of a `BucketStorage`.
+func quotaName(name string) (string, bool) {
+	bucket, bucketName, isData := ParseBucketKey(name)
+	if !isData {
+		return "", false
+	}
+	if len(bucket) > 0 {
+		return bucket + "/" + bucketName, true
+	}
+	return bucketName, true
+}
+
+// limited reports whether `name` matches any quota.
+func (qs *QuotaStorage) limited(name string) bool {
+	quotaName, ok := quotaName(name)
+	if !ok {
+		return false
+	}
+	for _, quota := range qs.cfg.Quotas {
+		if strings.HasPrefix(quotaName, quota.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns `usage` once the entry of `name` is `size` bytes, or deleted
+// if `size` is negative - or, if `enforce`, the
+// `customerrors.DataStorageQuotaExceeded` of the first quota it would exceed.
+//
+// `usage` may be modified either way. `mu` must be held.
+func (qs *QuotaStorage) count(usage []QuotaUsage, name string, size int64, enforce bool) ([]QuotaUsage, error) {
+	quotaName, ok := quotaName(name)
+	if !ok {
+		return usage, nil
+	}
+	prev, exists := qs.entries[name]
+
+	for i := range usage {
+		u := &usage[i]
+		if !strings.HasPrefix(quotaName, u.Prefix) {
+			continue
+		}
+		if size < 0 {
+			if exists {
+				u.Bytes -= prev.size
+				u.Entries--
+			}
+			continue
+		}
+
+		bytes, entries := u.Bytes+size-prev.size, u.Entries
+		if !exists {
+			entries++
+		}
+		if !enforce {
+			u.Bytes, u.Entries = bytes, entries
+			continue
+		}
+		exceeded := customerrors.DataStorageQuotaExceeded{
+			Name:   name,
+			Prefix: u.Prefix,
+		}
+		switch {
+		case u.MaxEntrySize > 0 && size > u.MaxEntrySize:
+			exceeded.Quota, exceeded.Usage, exceeded.Limit = customerrors.QuotaEntrySize, size, u.MaxEntrySize
+			return usage, exceeded
+		case u.MaxBytes > 0 && bytes > u.MaxBytes && size > prev.size:
+			exceeded.Quota, exceeded.Usage, exceeded.Limit = customerrors.QuotaBytes, bytes, u.MaxBytes
+			return usage, exceeded
+		case u.MaxEntries > 0 && entries > u.MaxEntries && !exists:
+			exceeded.Quota, exceeded.Usage, exceeded.Limit = customerrors.QuotaEntries, entries, u.MaxEntries
+			return usage, exceeded
+		}
+		u.Bytes, u.Entries = bytes, entries
+	}
+	return usage, nil
+}
+
+// reserve reserves the usage of writing `size` bytes to `name`, see
+// `reserveUsage` - or returns the `customerrors.DataStorageQuotaExceeded` of
+// the first quota it would exceed.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) reserve(name string, size int64) ([]QuotaUsage, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	usage, err := qs.count(qs.usageCopy(), name, size, true)
+	if err != nil {
+		return nil, err
+	}
+	return qs.reserveUsage(usage), nil
+}
+
+// reserveUsage counts any increase of `usage` over the current usage until
+// released by `settle`, returning the increase reserved. Decreases only count
+// once the write is made, so never make room for others before. `mu` must be
+// held.
+func (qs *QuotaStorage) reserveUsage(usage []QuotaUsage) []QuotaUsage {
+	reserved := make([]QuotaUsage, len(usage))
+	for i := range usage {
+		if bytes := usage[i].Bytes - qs.usage[i].Bytes; bytes > 0 {
+			reserved[i].Bytes = bytes
+		}
+		if entries := usage[i].Entries - qs.usage[i].Entries; entries > 0 {
+			reserved[i].Entries = entries
+		}
+		qs.usage[i].Bytes += reserved[i].Bytes
+		qs.usage[i].Entries += reserved[i].Entries
+	}
+	return reserved
+}
+
+// settle releases the `reserved` usage of a write once done, then calls
+// `counted` to count it - nil should it have failed.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) settle(reserved []QuotaUsage, counted func()) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	for i := range reserved {
+		qs.usage[i].Bytes -= reserved[i].Bytes
+		qs.usage[i].Entries -= reserved[i].Entries
+	}
+	if counted != nil {
+		counted()
+	}
+}
+
+// commit counts `name` as written with `meta`, or deleted if `meta` is nil.
+// `mu` must be held.
+func (qs *QuotaStorage) commit(name string, meta *Metadata) {
+	if meta == nil {
+		qs.usage, _ = qs.count(qs.usage, name, -1, false)
+		delete(qs.entries, name)
+		return
+	}
+	qs.usage, _ = qs.count(qs.usage, name, int64(meta.Size), false)
+	qs.track(name, *meta)
+}
+
+// track records the entry of `name` as `meta`, if it matches any quota. `mu`
+// must be held.
+func (qs *QuotaStorage) track(name string, meta Metadata) {
+	if !qs.limited(name) {
+		return
+	}
+	qs.entries[name] = quotaEntry{
+		size:      int64(meta.Size),
+		expiresAt: meta.ExpiresAt,
+	}
+}
+
+// usageCopy returns a copy of the current usage. `mu` must be held.
+func (qs *QuotaStorage) usageCopy() []QuotaUsage {
+	return append([]QuotaUsage{}, qs.usage...)
+}
+
+// check returns the `customerrors.DataStorageQuotaExceeded` of the first
+// quota the entry of `name` would exceed were it `size` bytes.
+//
+// This method is thread safe.
+func (qs *QuotaStorage) check(name string, size int64) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	_, err := qs.count(qs.usageCopy(), name, size, true)
+	return err
+}
+
+// quotaLimitedReader reads the data of `name` from `reader`, failing with
+// `customerrors.DataStorageQuotaExceeded` once more is read than the quotas
+// of `storage` allow.
+type quotaLimitedReader struct {
+	reader  io.Reader
+	storage *QuotaStorage
+	name    string
+	read    int64
+}
+
+func (r *quotaLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if qErr := r.storage.check(r.name, r.read); qErr != nil {
+		return n, qErr
+	}
+	return n, err
+}
+
+// nameLocks serializes operations on each name, while those on different
+// names run concurrently.
+type nameLocks struct {
+	mu    *sync.Mutex
+	locks map[string]*nameLock
+}
+
+// nameLock is the lock of a name, held or waited on by `refs` callers.
+type nameLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks every name of `names`, returning a func unlocking them. Names are
+// locked in order, so callers locking several never deadlock.
+//
+// This method is thread safe.
+func (nl *nameLocks) lock(names ...string) func() {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+
+	locks := make([]*nameLock, len(names))
+	nl.mu.Lock()
+	for i, name := range names {
+		lock, ok := nl.locks[name]
+		if !ok {
+			lock = &nameLock{}
+			nl.locks[name] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	nl.mu.Unlock()
+
+	for _, lock := range locks {
+		lock.mu.Lock()
+	}
+	return func() {
+		nl.mu.Lock()
+		defer nl.mu.Unlock()
+
+		for i, lock := range locks {
+			lock.mu.Unlock()
+			if lock.refs--; lock.refs == 0 {
+				delete(nl.locks, names[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package datastorage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func initTestQuotaStorage(t *testing.T, backing DataStorage, quotas ...Quota) *QuotaStorage {
+	t.Helper()
+	qs, err := QuotaStorage{}.Initialize(backing, QuotaStorageConfig{
+		Quotas:   quotas,
+		SpoolDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+	return qs
+}
+
+// generousQuota limits every name, without refusing any test writes.
+var generousQuota = Quota{MaxBytes: 1 << 30, MaxEntrySize: 1 << 28, MaxEntries: 1 << 20}
+
+func TestQuotaStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &QuotaStorage{}
+	var _ StreamingStorage = &QuotaStorage{}
+	var _ VersionHistory = &QuotaStorage{}
+}
+
+func TestQuotaStorage_Initialize(t *testing.T) {
+	_, err := QuotaStorage{}.Initialize(MemStorage{}.Initialize(), QuotaStorageConfig{
+		Quotas: []Quota{{MaxBytes: -1}},
+	})
+	assert.Error(t, err)
+
+	// Measures the current usage
+	mem := MemStorage{}.Initialize()
+	require.NoError(t, mem.StoreData("a", []byte("1234")))
+	require.NoError(t, mem.StoreData("b/a", []byte("12345678")))
+	qs := initTestQuotaStorage(t, mem, Quota{}, Quota{Prefix: "b/"})
+	usage := qs.Usage()
+	require.Len(t, usage, 2)
+	assert.Equal(t, int64(12), usage[0].Bytes)
+	assert.Equal(t, int64(2), usage[0].Entries)
+	assert.Equal(t, "b/", usage[1].Prefix)
+	assert.Equal(t, int64(8), usage[1].Bytes)
+	assert.Equal(t, int64(1), usage[1].Entries)
+}
+
+func TestQuotaStorage_ReadQuotas(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"max_bytes": 100}, {"prefix": "a/", "max_entries": 2}]`), 0o600))
+	quotas, err := ReadQuotas(path)
+	require.NoError(t, err)
+	assert.Equal(t, []Quota{{MaxBytes: 100}, {Prefix: "a/", MaxEntries: 2}}, quotas)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"max_bytes": 100}`), 0o600))
+	_, err = ReadQuotas(path)
+	assert.Error(t, err)
+}
+
+func TestQuotaStorage_Limits(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+
+	t.Run("entry size", func(t *testing.T) {
+		qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxEntrySize: 4})
+		require.NoError(t, qs.StoreData("a", []byte("1234")))
+
+		err := qs.StoreData("a", []byte("12345"))
+		require.ErrorAs(t, err, exceeded)
+		assert.Equal(t, customerrors.QuotaEntrySize, exceeded.Quota)
+		assert.True(t, exceeded.EntryTooLarge())
+		assert.Equal(t, int64(5), exceeded.Usage)
+		assert.Equal(t, int64(4), exceeded.Limit)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxBytes: 10})
+		require.NoError(t, qs.StoreData("a", []byte("123456")))
+		require.NoError(t, qs.StoreData("b", []byte("1234")))
+
+		err := qs.StoreData("c", []byte("1"))
+		require.ErrorAs(t, err, exceeded)
+		assert.Equal(t, customerrors.QuotaBytes, exceeded.Quota)
+		assert.False(t, exceeded.EntryTooLarge())
+		assert.Equal(t, int64(11), exceeded.Usage)
+		_, err = qs.RetrieveData("c")
+		assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+
+		// Overwriting counts only the difference, and deleting frees space
+		require.NoError(t, qs.StoreData("a", []byte("12")))
+		require.NoError(t, qs.StoreData("c", []byte("1234")))
+		require.NoError(t, qs.DeleteData("b"))
+		require.NoError(t, qs.StoreData("d", []byte("1234")))
+		assert.Equal(t, int64(10), qs.Usage()[0].Bytes)
+		assert.Equal(t, int64(3), qs.Usage()[0].Entries)
+	})
+
+	t.Run("entries", func(t *testing.T) {
+		qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxEntries: 2})
+		require.NoError(t, qs.StoreData("a", []byte("test data")))
+		require.NoError(t, qs.StoreData("b", []byte("test data")))
+		require.NoError(t, qs.StoreData("b", []byte("overwritten")))
+
+		err := qs.StoreData("c", []byte("test data"))
+		require.ErrorAs(t, err, exceeded)
+		assert.Equal(t, customerrors.QuotaEntries, exceeded.Quota)
+		assert.Equal(t, int64(3), exceeded.Usage)
+	})
+
+	t.Run("lowered", func(t *testing.T) {
+		mem := MemStorage{}.Initialize()
+		require.NoError(t, mem.StoreData("a", []byte("1234567890")))
+		qs := initTestQuotaStorage(t, mem, Quota{MaxBytes: 4})
+
+		// Already exceeded, but shrinking is allowed
+		require.ErrorAs(t, qs.StoreData("a", []byte("12345678901")), exceeded)
+		require.NoError(t, qs.StoreData("a", []byte("12345")))
+		assert.Equal(t, int64(5), qs.Usage()[0].Bytes)
+	})
+}
+
+func TestQuotaStorage_Prefix(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+	qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{Prefix: "uploads/", MaxEntries: 1}, Quota{Prefix: "pics/", MaxBytes: 4})
+	bs, err := BucketStorage{}.Initialize(qs)
+	require.NoError(t, err)
+	require.NoError(t, bs.CreateBucket("pics", BucketConfig{}))
+
+	require.NoError(t, bs.StoreData("uploads/a", []byte("test data")))
+	require.ErrorAs(t, bs.StoreData("uploads/b", []byte("test data")), exceeded)
+	assert.Equal(t, "uploads/", exceeded.Prefix)
+	// Other names are not limited
+	require.NoError(t, bs.StoreData("other", []byte("test data")))
+
+	// Bucket data is matched as "{bucket}/{name}", configs are not limited
+	bucket, err := bs.Bucket("pics")
+	require.NoError(t, err)
+	require.ErrorAs(t, bucket.StoreData("a", []byte("test data")), exceeded)
+	assert.Equal(t, "pics/", exceeded.Prefix)
+	require.NoError(t, bucket.StoreData("a", []byte("12")))
+	require.ErrorAs(t, bs.StoreData("pics/a", []byte("123")), exceeded)
+	require.NoError(t, bs.StoreData("pics/a", []byte("12")))
+	require.NoError(t, bs.CreateBucket("docs", BucketConfig{}))
+
+	usage := qs.Usage()
+	assert.Equal(t, int64(1), usage[0].Entries)
+	assert.Equal(t, int64(4), usage[1].Bytes)
+	assert.Equal(t, int64(2), usage[1].Entries)
+}
+
+func TestQuotaStorage_BatchLimits(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+	qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxBytes: 10})
+	require.NoError(t, qs.StoreData("a", []byte("123456")))
+
+	// Within the quota only once "a" is deleted, counted as a whole
+	_, err := qs.ApplyBatch([]BatchOp{
+		{Name: "b", Data: []byte("123456")},
+		{Name: "a", Delete: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), qs.Usage()[0].Bytes)
+
+	_, err = qs.ApplyBatch([]BatchOp{
+		{Name: "c", Data: []byte("123")},
+		{Name: "d", Data: []byte("123")},
+	})
+	require.ErrorAs(t, err, exceeded)
+	_, err = qs.RetrieveData("c")
+	assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+	assert.Equal(t, int64(6), qs.Usage()[0].Bytes)
+	assert.Equal(t, int64(1), qs.Usage()[0].Entries)
+}
+
+// endlessReader reads zeroes forever, counting how many were read.
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestQuotaStorage_StoreStream(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+	qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxBytes: 1 << 20})
+
+	meta, err := qs.StoreStream("a", strings.NewReader("test data"), StoreOptions{}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, 9, meta.Size)
+	assert.Equal(t, int64(9), qs.Usage()[0].Bytes)
+
+	// A runaway upload is refused as soon as it exceeds the quota
+	r := &endlessReader{}
+	_, err = qs.StoreStream("b", r, StoreOptions{}, Precondition{})
+	require.ErrorAs(t, err, exceeded)
+	assert.Less(t, r.read, int64(2<<20))
+	_, err = qs.RetrieveData("b")
+	assert.IsType(t, customerrors.DataStorageNameNotFound{}, err)
+	assert.Equal(t, int64(9), qs.Usage()[0].Bytes)
+
+	data, err := io.ReadAll(io.LimitReader(&endlessReader{}, 1<<20-9))
+	require.NoError(t, err)
+	_, err = qs.StoreStream("b", bytes.NewReader(data), StoreOptions{}, Precondition{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), qs.Usage()[0].Bytes)
+}
+
+func TestQuotaStorage_PurgeExpired(t *testing.T) {
+	now := fakeClock(t)
+	qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxEntries: 1})
+	require.NoError(t, qs.StoreDataWithOptions("a", []byte("test data"), StoreOptions{TTL: time.Minute}))
+
+	// Expired entries count until purged
+	*now = now.Add(2 * time.Minute)
+	assert.Error(t, qs.StoreData("b", []byte("test data")))
+
+	purged, err := qs.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, int64(0), qs.Usage()[0].Entries)
+	require.NoError(t, qs.StoreData("b", []byte("test data")))
+}
+
+func TestQuotaStorage_RestoreVersion(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+	qs := initTestQuotaStorage(t, VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 5), Quota{MaxBytes: 8})
+	require.NoError(t, qs.StoreData("a", []byte("12345678")))
+	require.NoError(t, qs.StoreData("a", []byte("1234")))
+	require.NoError(t, qs.StoreData("b", []byte("12")))
+
+	_, err := qs.RestoreVersion("a", 1)
+	require.ErrorAs(t, err, exceeded)
+
+	require.NoError(t, qs.DeleteData("b"))
+	_, err = qs.RestoreVersion("a", 1)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), qs.Usage()[0].Bytes)
+}
+
+// failingWriteStorage is a `DataStorage` whose writes signal `entered`, then
+// block until `release` is closed and fail.
+type failingWriteStorage struct {
+	DataStorage
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s failingWriteStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return Metadata{}, customerrors.DataStorageUnsupported{Operation: "test"}
+}
+
+func TestQuotaStorage_Reserved(t *testing.T) {
+	exceeded := &customerrors.DataStorageQuotaExceeded{}
+	mem := MemStorage{}.Initialize()
+	failing := failingWriteStorage{mem, make(chan struct{}), make(chan struct{})}
+	qs := initTestQuotaStorage(t, failing, Quota{MaxBytes: 10})
+
+	failed := make(chan error)
+	go func() {
+		failed <- qs.StoreData("slow", []byte("12345678"))
+	}()
+	<-failing.entered
+
+	// Other names are written meanwhile, within the usage reserved
+	_, err := qs.ApplyBatch([]BatchOp{{Name: "a", Data: []byte("12")}})
+	require.NoError(t, err)
+	_, err = qs.ApplyBatch([]BatchOp{{Name: "b", Data: []byte("1")}})
+	require.ErrorAs(t, err, exceeded)
+	assert.Equal(t, int64(10), qs.Usage()[0].Bytes)
+
+	// Released once the write fails
+	close(failing.release)
+	assert.Error(t, <-failed)
+	assert.Equal(t, int64(2), qs.Usage()[0].Bytes)
+	_, err = qs.ApplyBatch([]BatchOp{{Name: "b", Data: []byte("12345678")}})
+	require.NoError(t, err)
+}
+
+func TestQuotaStorage_ThreadSafe(t *testing.T) {
+	qs := initTestQuotaStorage(t, MemStorage{}.Initialize(), Quota{MaxBytes: 100, MaxEntries: 10})
+
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			name := string(rune('a' + itr%16))
+			switch itr % 4 {
+			case 0:
+				_ = qs.StoreData(name, []byte("test data"))
+			case 1:
+				_ = qs.DeleteData(name)
+			case 2:
+				_, _ = qs.StoreStream(name, strings.NewReader("test data"), StoreOptions{}, Precondition{})
+			case 3:
+				_ = qs.Usage()
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	// The usage counted matches what is stored
+	names, _, err := qs.ListNames("", "", 0)
+	require.NoError(t, err)
+	usage := qs.Usage()[0]
+	assert.Equal(t, int64(len(names)), usage.Entries)
+	assert.Equal(t, int64(len(names)*9), usage.Bytes)
+	assert.LessOrEqual(t, usage.Entries, int64(10))
+}
+
+func TestQuotaStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
+
+func TestQuotaStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
+
+func TestQuotaStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
+
+func TestQuotaStorage_Batch(t *testing.T) {
+	testStorageBatch(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
+
+func TestQuotaStorage_TTL(t *testing.T) {
+	testStorageTTL(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
+
+func TestQuotaStorage_Streaming(t *testing.T) {
+	testStorageStreaming(t, initTestQuotaStorage(t, MemStorage{}.Initialize(), generousQuota))
+}
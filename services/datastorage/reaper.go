@@ -0,0 +1,62 @@
+package datastorage
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// timeNow is the clock used for expiry, replaceable in tests.
+var timeNow = time.Now
+
+// Reaper periodically purges expired entries from a `DataStorage`.
+type Reaper struct {
+	storage  DataStorage
+	interval time.Duration
+
+	done chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// Initialize initializes and starts a `Reaper`, calling `PurgeExpired` on
+// `storage` every `interval` until `Stop` is called.
+func (r Reaper) Initialize(storage DataStorage, interval time.Duration) *Reaper {
+	reaper := &Reaper{
+		storage:  storage,
+		interval: interval,
+		done:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+
+	reaper.wg.Add(1)
+	go reaper.loop()
+
+	return reaper
+}
+
+// Stop stops the `Reaper`, waiting for any in progress purge to complete.
+func (r *Reaper) Stop() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *Reaper) loop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			purged, err := r.storage.PurgeExpired()
+			if err != nil {
+				log.Printf("Reaper - failed to purge expired data: %v", err)
+			} else if purged > 0 {
+				log.Printf("Reaper - purged %d expired entries", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package datastorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock replaces `timeNow` for the duration of a test, returning a pointer
+// to the current time which may be advanced.
+//
+// Not safe for use alongside background goroutines which read the clock.
+func fakeClock(t *testing.T) *time.Time {
+	t.Helper()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	return &now
+}
+
+// testStorageTTL checks the expiry behaviour every `DataStorage` shares.
+func testStorageTTL(t *testing.T, storage DataStorage) {
+	t.Helper()
+	now := fakeClock(t)
+
+	require.NoError(t, storage.StoreDataWithOptions(
+		"expiring", []byte("test data"), StoreOptions{TTL: time.Minute},
+	))
+	require.NoError(t, storage.StoreDataWithOptions(
+		"deleted", []byte("test data"), StoreOptions{TTL: time.Minute},
+	))
+	require.NoError(t, storage.StoreData("forever", []byte("test data")))
+
+	t.Run("before expiry", func(t *testing.T) {
+		data, meta, err := storage.RetrieveEntry("expiring")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		assert.WithinDuration(t, now.Add(time.Minute), meta.ExpiresAt, time.Millisecond)
+		assert.InDelta(t, time.Minute, meta.TTL(*now), float64(time.Millisecond))
+
+		_, meta, err = storage.RetrieveEntry("forever")
+		require.NoError(t, err)
+		assert.True(t, meta.ExpiresAt.IsZero())
+		assert.Zero(t, meta.TTL(*now))
+	})
+
+	t.Run("after expiry", func(t *testing.T) {
+		*now = now.Add(time.Minute)
+
+		_, err := storage.RetrieveData("expiring")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		_, _, err = storage.RetrieveEntry("expiring")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		err = storage.DeleteData("deleted")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		data, err := storage.RetrieveData("forever")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		purged, err := storage.PurgeExpired()
+		require.NoError(t, err)
+		assert.LessOrEqual(t, 1, purged) // "deleted" may already be purged
+
+		purged, err = storage.PurgeExpired()
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+
+		_, err = storage.RetrieveData("forever")
+		require.NoError(t, err)
+	})
+
+	t.Run("overwrite clears expiry", func(t *testing.T) {
+		require.NoError(t, storage.StoreDataWithOptions(
+			"expiring", []byte("test data"), StoreOptions{TTL: time.Minute},
+		))
+		require.NoError(t, storage.StoreData("expiring", []byte("test data")))
+		*now = now.Add(time.Hour)
+
+		_, err := storage.RetrieveData("expiring")
+		require.NoError(t, err)
+	})
+}
+
+func TestReaper(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	require.NoError(t, mem.StoreDataWithOptions(
+		"expiring", []byte("test data"), StoreOptions{TTL: time.Millisecond},
+	))
+	require.NoError(t, mem.StoreData("forever", []byte("test data")))
+
+	reaper := Reaper{}.Initialize(mem, 5*time.Millisecond)
+	defer reaper.Stop()
+
+	assert.Eventually(t, func() bool {
+		return mem.Stats().Entries == 1
+	}, time.Second, 5*time.Millisecond)
+	_, err := mem.RetrieveData("forever")
+	require.NoError(t, err)
+}
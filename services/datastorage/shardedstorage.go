@@ -0,0 +1,235 @@
+package datastorage
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// defaultShardCount is the number of shards used when none is given.
+const defaultShardCount = 32
+
+// ShardedMemStorage is an in-memory storage solution that implements the
+// `DataStorage` interface, spreading names across independently locked
+// `MemStorage` shards.
+//
+// Writers only block readers and writers of names in the same shard, so
+// concurrent writes to different names rarely contend - at the cost of
+// whole-storage operations such as `PurgeExpired` visiting every shard.
+type ShardedMemStorage struct {
+	shards []*MemStorage
+}
+
+// Initialize initializes and returns a pointer to a clean `ShardedMemStorage`
+// with the given number of `shards`, or 32 if not positive.
+func (ss ShardedMemStorage) Initialize(shards int) *ShardedMemStorage {
+	if shards <= 0 {
+		shards = defaultShardCount
+	}
+
+	storage := &ShardedMemStorage{
+		shards: make([]*MemStorage, shards),
+	}
+	for i := range storage.shards {
+		storage.shards[i] = MemStorage{}.Initialize()
+	}
+
+	return storage
+}
+
+// RetrieveData checks the `ShardedMemStorage` for data associated with a given
+// `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) RetrieveData(name string) ([]byte, error) {
+	return ss.shardFor(name).RetrieveData(name)
+}
+
+// RetrieveEntry checks the `ShardedMemStorage` for data and `Metadata`
+// associated with a given `name`.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return ss.shardFor(name).RetrieveEntry(name)
+}
+
+// RetrieveMetadata checks the `ShardedMemStorage` for the `Metadata`
+// associated with a given `name`.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return ss.shardFor(name).RetrieveMetadata(name)
+}
+
+// StoreData writes data `[]byte` to the `ShardedMemStorage`, mapping it to the
+// given `name`.
+//
+// If the `name` already exists, it will overwrite the previous data values.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) StoreData(name string, data []byte) error {
+	return ss.shardFor(name).StoreData(name, data)
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the entry.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	return ss.shardFor(name).StoreDataWithOptions(name, data, opts)
+}
+
+// DeleteData removes data in the `ShardedMemStorage` associated with the given
+// `name`.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) DeleteData(name string) error {
+	return ss.shardFor(name).DeleteData(name)
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current entry of `name`.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return ss.shardFor(name).CompareAndSwap(name, data, opts, cond)
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current entry of `name`.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) CompareAndDelete(name string, cond Precondition) error {
+	return ss.shardFor(name).CompareAndDelete(name, cond)
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// Every shard holding a name of the batch is locked, in order, until the
+// batch is applied.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	// Group the operations by shard, remembering their place in the batch
+	groups := make(map[int][]int)
+	for i, op := range ops {
+		shard := ss.shardIndex(op.Name)
+		groups[shard] = append(groups[shard], i)
+	}
+	shards := make([]int, 0, len(groups))
+	for shard := range groups {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+
+	// Locking in a consistent order prevents deadlocks between batches
+	for _, shard := range shards {
+		ss.shards[shard].rwMu.Lock()
+		defer ss.shards[shard].rwMu.Unlock()
+	}
+
+	shardOps := make(map[int][]BatchOp, len(shards))
+	shardMetas := make(map[int][]Metadata, len(shards))
+	for _, shard := range shards {
+		for _, i := range groups[shard] {
+			shardOps[shard] = append(shardOps[shard], ops[i])
+		}
+		metas, err := ss.shards[shard].prepareBatch(shardOps[shard])
+		if err != nil {
+			return nil, err
+		}
+		shardMetas[shard] = metas
+	}
+
+	metas := make([]Metadata, len(ops))
+	for _, shard := range shards {
+		if err := ss.shards[shard].commitBatch(shardOps[shard], shardMetas[shard]); err != nil {
+			return nil, err
+		}
+		for j, i := range groups[shard] {
+			metas[i] = shardMetas[shard][j]
+		}
+	}
+
+	return metas, nil
+}
+
+// ListNames lists the names of unexpired entries beginning with `prefix`
+// across every shard, see `DataStorage`.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	// Each shard's first `limit` names hold the first `limit` of the merge
+	var (
+		names []string
+		more  bool
+	)
+	for _, shard := range ss.shards {
+		shardNames, shardNext, err := shard.ListNames(prefix, cursor, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		names = append(names, shardNames...)
+		more = more || len(shardNext) > 0
+	}
+
+	page, next := pageNames(names, prefix, cursor, limit)
+	if more && len(next) == 0 {
+		// Exactly `limit` names merged, but a shard holds more
+		next = page[len(page)-1]
+	}
+	return page, next, nil
+}
+
+// PurgeExpired removes all expired entries from every shard in turn.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) PurgeExpired() (int, error) {
+	total := 0
+	for _, shard := range ss.shards {
+		purged, err := shard.PurgeExpired()
+		total += purged
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Stats returns the combined size of every shard.
+//
+// Shards are visited in turn, so the result is not an atomic snapshot under
+// concurrent writes.
+//
+// This method is thread safe.
+func (ss *ShardedMemStorage) Stats() MemStorageStats {
+	var stats MemStorageStats
+	for _, shard := range ss.shards {
+		shardStats := shard.Stats()
+		stats.Entries += shardStats.Entries
+		stats.Bytes += shardStats.Bytes
+	}
+
+	return stats
+}
+
+// shardFor returns the shard holding `name`.
+func (ss *ShardedMemStorage) shardFor(name string) *MemStorage {
+	return ss.shards[ss.shardIndex(name)]
+}
+
+// shardIndex returns the index of the shard holding `name`.
+func (ss *ShardedMemStorage) shardIndex(name string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(name))
+
+	return int(hash.Sum32() % uint32(len(ss.shards)))
+}
@@ -0,0 +1,173 @@
+package datastorage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedMemStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &ShardedMemStorage{}
+}
+
+func TestShardedMemStorage_Initialize(t *testing.T) {
+	ss := ShardedMemStorage{}.Initialize(0)
+	assert.Len(t, ss.shards, defaultShardCount)
+
+	ss = ShardedMemStorage{}.Initialize(4)
+	assert.Len(t, ss.shards, 4)
+	for _, shard := range ss.shards {
+		assert.NotNil(t, shard)
+	}
+}
+
+func TestShardedMemStorage_Operations(t *testing.T) {
+	ss := ShardedMemStorage{}.Initialize(8)
+
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("name-%d", i)
+		require.NoError(t, ss.StoreData(name, []byte(name)))
+	}
+	assert.Equal(t, 100, ss.Stats().Entries)
+
+	t.Run("names are spread across shards", func(t *testing.T) {
+		for _, shard := range ss.shards {
+			assert.NotZero(t, shard.Stats().Entries)
+		}
+	})
+
+	t.Run("retrieve", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("name-%d", i)
+			data, err := ss.RetrieveData(name)
+			require.NoError(t, err)
+			assert.Equal(t, []byte(name), data)
+		}
+
+		_, err := ss.RetrieveData("foo")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, ss.DeleteData("name-0"))
+		_, err := ss.RetrieveData("name-0")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		err = ss.DeleteData("name-0")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Equal(t, 99, ss.Stats().Entries)
+	})
+}
+
+func TestShardedMemStorage_TTL(t *testing.T) {
+	testStorageTTL(t, ShardedMemStorage{}.Initialize(4))
+}
+
+func TestShardedMemStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	ss := ShardedMemStorage{}.Initialize(4)
+	testData := []byte("test data")
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			dataName := fmt.Sprintf("test-%d", itr%7)
+			if itr%3 == 0 {
+				_ = ss.StoreData(dataName, testData)
+			} else if itr%3 == 1 {
+				_, _ = ss.RetrieveData(dataName)
+			} else {
+				_ = ss.DeleteData(dataName)
+			}
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+// benchmarkMixedWorkload runs the store/retrieve/delete mix of the
+// `ThreadSafe` tests in parallel against `storage`, spread over `names`.
+func benchmarkMixedWorkload(b *testing.B, storage DataStorage, names int) {
+	keys := make([]string, names)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("test-%d", i)
+	}
+	testData := []byte("test data")
+
+	// Each worker starts at a different name, without sharing a counter
+	var workers uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		itr := atomic.AddUint64(&workers, 1) * 7919
+		for pb.Next() {
+			itr++
+			dataName := keys[itr%uint64(names)]
+			if itr%3 == 0 {
+				_ = storage.StoreData(dataName, testData)
+			} else if itr%3 == 1 {
+				_, _ = storage.RetrieveData(dataName)
+			} else {
+				_ = storage.DeleteData(dataName)
+			}
+		}
+	})
+}
+
+// Compare with e.g.
+//
+//	go test ./services/datastorage -run '^$' -bench MixedWorkload -cpu 1,4,16
+func BenchmarkMixedWorkload(b *testing.B) {
+	for _, names := range []int{1, 1024} {
+		b.Run(fmt.Sprintf("MemStorage/names=%d", names), func(b *testing.B) {
+			benchmarkMixedWorkload(b, MemStorage{}.Initialize(), names)
+		})
+		b.Run(fmt.Sprintf("ShardedMemStorage/names=%d", names), func(b *testing.B) {
+			benchmarkMixedWorkload(b, ShardedMemStorage{}.Initialize(0), names)
+		})
+	}
+}
+
+func TestShardedMemStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, ShardedMemStorage{}.Initialize(4))
+}
+
+func TestShardedMemStorage_Metadata(t *testing.T) {
+	testStorageMetadata(t, ShardedMemStorage{}.Initialize(4))
+}
+
+func TestShardedMemStorage_ListNames(t *testing.T) {
+	testStorageListNames(t, ShardedMemStorage{}.Initialize(4))
+
+	t.Run("one shard holds the next page", func(t *testing.T) {
+		ss := ShardedMemStorage{}.Initialize(1)
+		for _, name := range []string{"a", "b", "c"} {
+			require.NoError(t, ss.StoreData(name, []byte("test data")))
+		}
+
+		page, next, err := ss.ListNames("", "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, page)
+		assert.Equal(t, "b", next)
+	})
+}
+
+func TestShardedMemStorage_Batch(t *testing.T) {
+	testStorageBatch(t, ShardedMemStorage{}.Initialize(4))
+}
+
+func TestShardedMemStorage_Streaming(t *testing.T) {
+	testStorageStreaming(t, ShardedMemStorage{}.Initialize(4))
+}
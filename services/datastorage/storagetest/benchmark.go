@@ -0,0 +1,153 @@
+package storagetest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/require"
+)
+
+// Benchmark benchmarks the common operations on the storage of `h`, each as
+// a sub-benchmark of `b` with a new storage - so that backends may be
+// compared with e.g.
+//
+//	go test ./services/datastorage -run '^$' -bench Conformance -benchmem
+func Benchmark(b *testing.B, h Harness) {
+	small := []byte("test data")
+	large := randomData(1<<20, 1)
+
+	b.Run("StoreData", func(b *testing.B) {
+		storage := h.New(b)
+		b.SetBytes(int64(len(small)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := storage.StoreData(fmt.Sprintf("test-%d", i%1024), small); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("RetrieveData", func(b *testing.B) {
+		storage := h.New(b)
+		fill(b, storage, 1024, small)
+		b.SetBytes(int64(len(small)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := storage.RetrieveData(fmt.Sprintf("test-%d", i%1024)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("RetrieveMetadata", func(b *testing.B) {
+		storage := h.New(b)
+		fill(b, storage, 1024, small)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := storage.RetrieveMetadata(fmt.Sprintf("test-%d", i%1024)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("CompareAndSwap", func(b *testing.B) {
+		storage := h.New(b)
+		meta, err := storage.CompareAndSwap("test", small, datastorage.StoreOptions{}, datastorage.Precondition{})
+		require.NoError(b, err)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			meta, err = storage.CompareAndSwap("test", small, datastorage.StoreOptions{},
+				datastorage.Precondition{IfMatch: []uint64{meta.Revision}})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ListNames", func(b *testing.B) {
+		storage := h.New(b)
+		fill(b, storage, 1024, small)
+		b.ReportAllocs()
+		b.ResetTimer()
+		var cursor string
+		for i := 0; i < b.N; i++ {
+			var err error
+			if _, cursor, err = storage.ListNames("test-", cursor, 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("StoreStream", func(b *testing.B) {
+		storage := h.New(b)
+		b.SetBytes(int64(len(large)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := datastorage.StoreStream(storage, "large", bytes.NewReader(large),
+				datastorage.StoreOptions{}, datastorage.Precondition{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("RetrieveStream", func(b *testing.B) {
+		storage := h.New(b)
+		require.NoError(b, storage.StoreData("large", large))
+		b.SetBytes(int64(len(large)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			stream, _, err := datastorage.RetrieveStream(storage, "large")
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = io.Copy(io.Discard, stream)
+			stream.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("MixedParallel", func(b *testing.B) {
+		// The store/retrieve/delete mix of the thread safety tests
+		storage := h.New(b)
+		fill(b, storage, 1024, small)
+
+		// Each worker starts at a different name, without sharing a counter
+		var started uint64
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			itr := atomic.AddUint64(&started, 1) * 7919
+			for pb.Next() {
+				itr++
+				dataName := fmt.Sprintf("test-%d", itr%1024)
+				if itr%3 == 0 {
+					_ = storage.StoreData(dataName, small)
+				} else if itr%3 == 1 {
+					_, _ = storage.RetrieveData(dataName)
+				} else {
+					_ = storage.DeleteData(dataName)
+				}
+			}
+		})
+	})
+}
+
+// fill stores `data` under `n` names.
+func fill(b *testing.B, storage datastorage.DataStorage, n int, data []byte) {
+	b.Helper()
+	for i := 0; i < n; i++ {
+		require.NoError(b, storage.StoreData(fmt.Sprintf("test-%d", i), data))
+	}
+}
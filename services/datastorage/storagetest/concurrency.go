@@ -0,0 +1,263 @@
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// workers is the number of goroutines the concurrency tests race.
+const workers = 69
+
+// assertExpected asserts `err` is nil, or an error which the concurrent
+// operations of another goroutine may have caused.
+func assertExpected(t *testing.T, err error) {
+	t.Helper()
+	switch err.(type) {
+	case nil, customerrors.DataStorageNameNotFound, customerrors.DataStoragePreconditionFailed:
+	default:
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// race runs `fn` in `n` goroutines at once, waiting for them to return.
+func race(n int, fn func(itr int)) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			fn(itr)
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+// testConcurrency checks the storage is thread safe, and that its
+// conditional writes are atomic.
+func testConcurrency(t *testing.T, _ Harness, storage datastorage.DataStorage) {
+	t.Run("mixed operations", func(t *testing.T) {
+		// -race test flag will detect race conditions
+		testData := []byte("test data")
+		race(workers, func(itr int) {
+			dataName := fmt.Sprintf("test-%d", itr%7)
+			switch itr % 7 {
+			case 0:
+				assertExpected(t, storage.StoreData(dataName, testData))
+			case 1:
+				_, err := storage.RetrieveData(dataName)
+				assertExpected(t, err)
+			case 2:
+				_, err := storage.RetrieveMetadata(dataName)
+				assertExpected(t, err)
+			case 3:
+				_, err := storage.CompareAndSwap(dataName, testData, datastorage.StoreOptions{},
+					datastorage.Precondition{MustNotExist: true})
+				assertExpected(t, err)
+			case 4:
+				_, _, err := storage.ListNames("test-", "", 3)
+				assertExpected(t, err)
+			case 5:
+				_, err := storage.ApplyBatch([]datastorage.BatchOp{
+					{Name: dataName, Data: testData},
+					{Name: fmt.Sprintf("test-%d", (itr+1)%7), Data: testData},
+				})
+				assertExpected(t, err)
+			default:
+				assertExpected(t, storage.DeleteData(dataName))
+			}
+		})
+
+		// Every entry left is whole
+		names, _, err := storage.ListNames("test-", "", 0)
+		require.NoError(t, err)
+		for _, name := range names {
+			data, meta, err := storage.RetrieveEntry(name)
+			require.NoError(t, err)
+			assert.Equal(t, testData, data)
+			assert.Equal(t, len(testData), meta.Size)
+			assert.Equal(t, checksum(testData), meta.Checksum)
+		}
+	})
+
+	t.Run("created once", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			created []int
+		)
+		race(workers, func(itr int) {
+			_, err := storage.CompareAndSwap("created", []byte(strconv.Itoa(itr)), datastorage.StoreOptions{},
+				datastorage.Precondition{MustNotExist: true})
+			if err != nil {
+				assert.IsType(t, customerrors.DataStoragePreconditionFailed{}, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			created = append(created, itr)
+		})
+
+		require.Len(t, created, 1)
+		data, err := storage.RetrieveData("created")
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(created[0]), string(data))
+	})
+
+	t.Run("compare and swap counter", func(t *testing.T) {
+		// Each worker increments the counter, retrying whenever another got
+		// there first - so no increment is lost
+		const increments = 5
+		_, err := storage.CompareAndSwap("counter", []byte("0"), datastorage.StoreOptions{},
+			datastorage.Precondition{MustNotExist: true})
+		require.NoError(t, err)
+
+		race(16, func(int) {
+			for i := 0; i < increments; {
+				data, meta, err := storage.RetrieveEntry("counter")
+				if !assert.NoError(t, err) {
+					return
+				}
+				count, err := strconv.Atoi(string(data))
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				_, err = storage.CompareAndSwap("counter", []byte(strconv.Itoa(count+1)), datastorage.StoreOptions{},
+					datastorage.Precondition{IfMatch: []uint64{meta.Revision}})
+				if errors.As(err, &customerrors.DataStoragePreconditionFailed{}) {
+					continue
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				i++
+			}
+		})
+
+		data, err := storage.RetrieveData("counter")
+		require.NoError(t, err)
+		assert.Equal(t, strconv.Itoa(16*increments), string(data))
+	})
+
+	t.Run("streams", func(t *testing.T) {
+		// Each worker writes a distinct value, so a reader may tell whether
+		// it read one whole
+		values := make(map[string]bool, workers)
+		for i := 0; i < workers; i++ {
+			values[checksum(streamValue(i))] = true
+		}
+		require.NoError(t, storage.StoreData("streamed", streamValue(0)))
+
+		race(workers, func(itr int) {
+			if itr%2 == 0 {
+				_, err := datastorage.StoreStream(storage, "streamed", bytes.NewReader(streamValue(itr)),
+					datastorage.StoreOptions{}, datastorage.Precondition{})
+				assert.NoError(t, err)
+				return
+			}
+
+			stream, meta, err := datastorage.RetrieveStream(storage, "streamed")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer stream.Close()
+			data, err := io.ReadAll(stream)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, meta.Checksum, checksum(data))
+			assert.True(t, values[checksum(data)], "read a torn value")
+		})
+	})
+}
+
+// streamValue returns the value written by worker `itr` of the streaming
+// concurrency test.
+func streamValue(itr int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("worker %d ", itr)), 10_000)
+}
+
+// testLargeValues checks values of `Harness.LargeValueSize` are stored whole,
+// whether written at once or streamed.
+func testLargeValues(t *testing.T, h Harness, storage datastorage.DataStorage) {
+	size := h.LargeValueSize
+	if size == 0 {
+		size = DefaultLargeValueSize
+	}
+	data := randomData(size, 1)
+
+	t.Run("store and retrieve", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("large", data))
+
+		retrieved, meta, err := storage.RetrieveEntry("large")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, retrieved), "retrieved data differs")
+		assert.Equal(t, size, meta.Size)
+		assert.Equal(t, checksum(data), meta.Checksum)
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		streamed := randomData(size+1, 2)
+		meta, err := datastorage.StoreStream(storage, "large/streamed", bytes.NewReader(streamed),
+			datastorage.StoreOptions{}, datastorage.Precondition{})
+		require.NoError(t, err)
+		assert.Equal(t, size+1, meta.Size)
+		assert.Equal(t, checksum(streamed), meta.Checksum)
+
+		stream, _, err := datastorage.RetrieveStream(storage, "large/streamed")
+		require.NoError(t, err)
+		defer stream.Close()
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(streamed, retrieved), "streamed data differs")
+	})
+
+	t.Run("batched", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]datastorage.BatchOp{
+			{Name: "large/a", Data: data},
+			{Name: "large/b", Data: data[:size/2]},
+		})
+		require.NoError(t, err)
+
+		retrieved, err := storage.RetrieveData("large/b")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data[:size/2], retrieved), "batched data differs")
+	})
+
+	t.Run("shrunk and grown", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("large", []byte("small")))
+		retrieved, meta, err := storage.RetrieveEntry("large")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("small"), retrieved)
+		assert.Equal(t, len("small"), meta.Size)
+
+		require.NoError(t, storage.StoreData("large", data))
+		retrieved, err = storage.RetrieveData("large")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, retrieved), "retrieved data differs")
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		for _, name := range []string{"large", "large/streamed", "large/a", "large/b"} {
+			require.NoError(t, storage.DeleteData(name))
+		}
+		names, _, err := storage.ListNames("", "", 0)
+		require.NoError(t, err)
+		assert.Empty(t, names)
+	})
+}
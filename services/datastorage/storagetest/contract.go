@@ -0,0 +1,569 @@
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBasic checks data is stored, overwritten and deleted by name.
+func testBasic(t *testing.T, _ Harness, storage datastorage.DataStorage) {
+	t.Run("store and retrieve", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("test", []byte("test data")))
+
+		data, err := storage.RetrieveData("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		data, meta, err := storage.RetrieveEntry("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		assert.Equal(t, len(data), meta.Size)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("test", []byte("foobar")))
+
+		data, err := storage.RetrieveData("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foobar"), data)
+	})
+
+	t.Run("names are independent", func(t *testing.T) {
+		names := []string{"test2", "dir/name", "dir/name/nested", "with space", "ünïcode", "dots.in.name"}
+		for _, name := range names {
+			require.NoError(t, storage.StoreData(name, []byte("data of "+name)), name)
+		}
+		for _, name := range append(names, "test") {
+			data, err := storage.RetrieveData(name)
+			require.NoError(t, err, name)
+			if name == "test" {
+				assert.Equal(t, []byte("foobar"), data)
+				continue
+			}
+			assert.Equal(t, []byte("data of "+name), data, name)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, storage.DeleteData("test"))
+		_, err := storage.RetrieveData("test")
+		assertNotFound(t, err, "test")
+
+		// Others are untouched
+		data, err := storage.RetrieveData("test2")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("data of test2"), data)
+	})
+
+	t.Run("empty and binary values", func(t *testing.T) {
+		require.NoError(t, storage.StoreData("empty", []byte{}))
+		data, err := storage.RetrieveData("empty")
+		require.NoError(t, err)
+		assert.Empty(t, data)
+
+		binary := make([]byte, 256)
+		for i := range binary {
+			binary[i] = byte(i)
+		}
+		require.NoError(t, storage.StoreData("binary", binary))
+		data, err = storage.RetrieveData("binary")
+		require.NoError(t, err)
+		assert.Equal(t, binary, data)
+	})
+
+	t.Run("options", func(t *testing.T) {
+		require.NoError(t, storage.StoreDataWithOptions("typed", []byte("{}"), datastorage.StoreOptions{
+			ContentType: "application/json",
+		}))
+		data, meta, err := storage.RetrieveEntry("typed")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("{}"), data)
+		assert.Equal(t, "application/json", meta.ContentType)
+		assert.True(t, meta.ExpiresAt.IsZero())
+	})
+}
+
+// testNotFound checks every operation on a missing name fails with a
+// `customerrors.DataStorageNameNotFound` - whether it never existed, was
+// deleted, or has expired.
+func testNotFound(t *testing.T, h Harness, storage datastorage.DataStorage) {
+	clock := newClock(t, h)
+	require.NoError(t, storage.StoreData("deleted", []byte("test data")))
+	require.NoError(t, storage.DeleteData("deleted"))
+	require.NoError(t, storage.StoreDataWithOptions("expired", []byte("test data"), datastorage.StoreOptions{
+		TTL: clock.unit,
+	}))
+	clock.Advance(2 * clock.unit)
+
+	for _, name := range []string{"missing", "deleted", "expired"} {
+		t.Run(name, func(t *testing.T) {
+			_, err := storage.RetrieveData(name)
+			assertNotFound(t, err, name)
+			_, _, err = storage.RetrieveEntry(name)
+			assertNotFound(t, err, name)
+			_, err = storage.RetrieveMetadata(name)
+			assertNotFound(t, err, name)
+			_, _, err = datastorage.RetrieveStream(storage, name)
+			assertNotFound(t, err, name)
+			err = storage.CompareAndDelete(name, datastorage.Precondition{})
+			assertNotFound(t, err, name)
+			err = storage.DeleteData(name)
+			assertNotFound(t, err, name)
+			_, err = storage.ApplyBatch([]datastorage.BatchOp{{Name: name, Delete: true}})
+			assertNotFound(t, err, name)
+
+			// A precondition on the entry fails instead
+			_, err = storage.CompareAndSwap(name, []byte("test data"), datastorage.StoreOptions{},
+				datastorage.Precondition{MustExist: true})
+			assert.IsType(t, customerrors.DataStoragePreconditionFailed{}, err)
+			_, err = storage.RetrieveData(name)
+			assertNotFound(t, err, name)
+		})
+	}
+}
+
+// testConditionalWrites checks revisions, and that writes are only applied
+// when their `datastorage.Precondition` holds.
+func testConditionalWrites(t *testing.T, _ Harness, storage datastorage.DataStorage) {
+	dataName := "conditional"
+	failed := &customerrors.DataStoragePreconditionFailed{}
+
+	created, err := storage.CompareAndSwap(
+		dataName, []byte("v1"), datastorage.StoreOptions{}, datastorage.Precondition{MustNotExist: true},
+	)
+	require.NoError(t, err)
+	assert.NotZero(t, created.Revision)
+
+	t.Run("revision is retrievable", func(t *testing.T) {
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, created.Revision, meta.Revision)
+		meta, err = storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, created.Revision, meta.Revision)
+	})
+
+	t.Run("create only once", func(t *testing.T) {
+		_, err := storage.CompareAndSwap(
+			dataName, []byte("v2"), datastorage.StoreOptions{}, datastorage.Precondition{MustNotExist: true},
+		)
+		assert.ErrorAs(t, err, failed)
+	})
+
+	t.Run("if none match", func(t *testing.T) {
+		_, err := storage.CompareAndSwap(
+			dataName, []byte("v2"), datastorage.StoreOptions{},
+			datastorage.Precondition{IfNoneMatch: []uint64{created.Revision}},
+		)
+		assert.ErrorAs(t, err, failed)
+		data, err := storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v1"), data)
+	})
+
+	t.Run("swap", func(t *testing.T) {
+		swapped, err := storage.CompareAndSwap(
+			dataName, []byte("v2"), datastorage.StoreOptions{},
+			datastorage.Precondition{IfMatch: []uint64{created.Revision}},
+		)
+		require.NoError(t, err)
+		assert.NotEqual(t, created.Revision, swapped.Revision)
+
+		// The first revision is now stale
+		_, err = storage.CompareAndSwap(
+			dataName, []byte("v3"), datastorage.StoreOptions{},
+			datastorage.Precondition{IfMatch: []uint64{created.Revision}},
+		)
+		assert.ErrorAs(t, err, failed)
+		data, err := storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v2"), data)
+
+		// Unconditional writes also change the revision
+		require.NoError(t, storage.StoreData(dataName, []byte("v3")))
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+		assert.NotEqual(t, swapped.Revision, meta.Revision)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		_, meta, err := storage.RetrieveEntry(dataName)
+		require.NoError(t, err)
+
+		err = storage.CompareAndDelete(dataName, datastorage.Precondition{IfMatch: []uint64{created.Revision}})
+		assert.ErrorAs(t, err, failed)
+		_, err = storage.RetrieveData(dataName)
+		require.NoError(t, err)
+
+		err = storage.CompareAndDelete(dataName, datastorage.Precondition{IfMatch: []uint64{meta.Revision}})
+		require.NoError(t, err)
+		_, err = storage.RetrieveData(dataName)
+		assertNotFound(t, err, dataName)
+
+		err = storage.CompareAndDelete(dataName, datastorage.Precondition{MustExist: true})
+		assertNotFound(t, err, dataName)
+	})
+
+	t.Run("recreated names get new revisions", func(t *testing.T) {
+		recreated, err := storage.CompareAndSwap(
+			dataName, []byte("v1"), datastorage.StoreOptions{}, datastorage.Precondition{MustNotExist: true},
+		)
+		require.NoError(t, err)
+		assert.Greater(t, recreated.Revision, created.Revision)
+	})
+}
+
+// testMetadata checks the `datastorage.Metadata` kept of each entry.
+func testMetadata(t *testing.T, h Harness, storage datastorage.DataStorage) {
+	clock := newClock(t, h)
+	created := clock.Now()
+	dataName := "described"
+
+	stored, err := storage.CompareAndSwap(
+		dataName, []byte("hello"), datastorage.StoreOptions{ContentType: "text/plain"}, datastorage.Precondition{},
+	)
+	require.NoError(t, err)
+
+	t.Run("stored", func(t *testing.T) {
+		for _, retrieve := range []func() (datastorage.Metadata, error){
+			func() (datastorage.Metadata, error) {
+				_, meta, err := storage.RetrieveEntry(dataName)
+				return meta, err
+			},
+			func() (datastorage.Metadata, error) { return storage.RetrieveMetadata(dataName) },
+		} {
+			meta, err := retrieve()
+			require.NoError(t, err)
+			assert.Equal(t, stored.Revision, meta.Revision)
+			assert.Equal(t, "text/plain", meta.ContentType)
+			assert.Equal(t, 5, meta.Size)
+			// sha256sum <<< "hello" without the trailing newline
+			assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", meta.Checksum)
+			assert.WithinDuration(t, created, meta.CreatedAt, clock.tolerance)
+			assert.WithinDuration(t, created, meta.UpdatedAt, clock.tolerance)
+		}
+	})
+
+	t.Run("overwritten", func(t *testing.T) {
+		clock.Advance(clock.unit)
+		require.NoError(t, storage.StoreData(dataName, []byte("")))
+
+		meta, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.Empty(t, meta.ContentType)
+		assert.Zero(t, meta.Size)
+		assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", meta.Checksum)
+		assert.WithinDuration(t, created, meta.CreatedAt, clock.tolerance)
+		assert.WithinDuration(t, clock.Now(), meta.UpdatedAt, clock.tolerance)
+	})
+
+	t.Run("recreated", func(t *testing.T) {
+		require.NoError(t, storage.DeleteData(dataName))
+		_, err := storage.RetrieveMetadata(dataName)
+		assertNotFound(t, err, dataName)
+
+		clock.Advance(clock.unit)
+		require.NoError(t, storage.StoreData(dataName, []byte("hello")))
+		meta, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.WithinDuration(t, clock.Now(), meta.CreatedAt, clock.tolerance)
+	})
+
+	t.Run("kept", func(t *testing.T) {
+		prev, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		kept := datastorage.StoreOptions{
+			Revision:  prev.Revision + 100,
+			CreatedAt: created.Add(-time.Hour),
+			UpdatedAt: created.Add(-time.Minute),
+		}
+		require.NoError(t, storage.StoreDataWithOptions(dataName, []byte("copied"), kept))
+
+		meta, err := storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, kept.Revision, meta.Revision)
+		assert.WithinDuration(t, kept.CreatedAt, meta.CreatedAt, clock.tolerance)
+		assert.WithinDuration(t, kept.UpdatedAt, meta.UpdatedAt, clock.tolerance)
+
+		// Revisions never go backwards
+		kept.Revision = prev.Revision
+		require.NoError(t, storage.StoreDataWithOptions(dataName, []byte("older"), kept))
+		meta, err = storage.RetrieveMetadata(dataName)
+		require.NoError(t, err)
+		assert.Greater(t, meta.Revision, prev.Revision+100)
+	})
+}
+
+// testTTL checks entries expire once their TTL has passed.
+func testTTL(t *testing.T, h Harness, storage datastorage.DataStorage) {
+	clock := newClock(t, h)
+	ttl := datastorage.StoreOptions{TTL: clock.unit}
+
+	require.NoError(t, storage.StoreDataWithOptions("expiring", []byte("test data"), ttl))
+	require.NoError(t, storage.StoreDataWithOptions("deleted", []byte("test data"), ttl))
+	require.NoError(t, storage.StoreData("forever", []byte("test data")))
+
+	t.Run("before expiry", func(t *testing.T) {
+		data, meta, err := storage.RetrieveEntry("expiring")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+		assert.WithinDuration(t, clock.Now().Add(clock.unit), meta.ExpiresAt, clock.tolerance)
+		assert.InDelta(t, clock.unit, meta.TTL(clock.Now()), float64(clock.tolerance))
+
+		_, meta, err = storage.RetrieveEntry("forever")
+		require.NoError(t, err)
+		assert.True(t, meta.ExpiresAt.IsZero())
+		assert.Zero(t, meta.TTL(clock.Now()))
+	})
+
+	t.Run("after expiry", func(t *testing.T) {
+		clock.Advance(clock.unit)
+		if clock.fake == nil {
+			// Allow for the time taken since storing
+			clock.Advance(clock.tolerance)
+		}
+
+		_, err := storage.RetrieveData("expiring")
+		assertNotFound(t, err, "expiring")
+		_, _, err = storage.RetrieveEntry("expiring")
+		assertNotFound(t, err, "expiring")
+		err = storage.DeleteData("deleted")
+		assertNotFound(t, err, "deleted")
+
+		data, err := storage.RetrieveData("forever")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test data"), data)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		purged, err := storage.PurgeExpired()
+		require.NoError(t, err)
+		assert.LessOrEqual(t, 1, purged) // "deleted" may already be purged
+
+		purged, err = storage.PurgeExpired()
+		require.NoError(t, err)
+		assert.Zero(t, purged)
+
+		_, err = storage.RetrieveData("forever")
+		require.NoError(t, err)
+	})
+
+	t.Run("overwrite clears expiry", func(t *testing.T) {
+		require.NoError(t, storage.StoreDataWithOptions("expiring", []byte("test data"), ttl))
+		require.NoError(t, storage.StoreData("expiring", []byte("test data")))
+		clock.Advance(2 * clock.unit)
+
+		_, err := storage.RetrieveData("expiring")
+		require.NoError(t, err)
+	})
+}
+
+// testListNames checks names are listed in order, a page at a time.
+func testListNames(t *testing.T, h Harness, storage datastorage.DataStorage) {
+	clock := newClock(t, h)
+
+	for _, name := range []string{"list/b", "list/a", "list/d", "lists", "other"} {
+		require.NoError(t, storage.StoreData(name, []byte("test data")))
+	}
+	require.NoError(t, storage.StoreDataWithOptions(
+		"list/expired", []byte("test data"), datastorage.StoreOptions{TTL: clock.unit},
+	))
+	clock.Advance(2 * clock.unit)
+
+	listAll := func(t *testing.T, prefix string, limit int) []string {
+		var (
+			all    []string
+			cursor string
+		)
+		for pages := 0; ; pages++ {
+			require.Less(t, pages, 10, "pagination does not terminate")
+			page, next, err := storage.ListNames(prefix, cursor, limit)
+			require.NoError(t, err)
+			require.NotNil(t, page)
+			if limit > 0 {
+				assert.LessOrEqual(t, len(page), limit)
+			}
+			all = append(all, page...)
+			if len(next) == 0 {
+				return all
+			}
+			cursor = next
+		}
+	}
+
+	t.Run("everything", func(t *testing.T) {
+		assert.Equal(t, []string{"list/a", "list/b", "list/d", "lists", "other"}, listAll(t, "", 0))
+	})
+
+	t.Run("prefix pages", func(t *testing.T) {
+		for limit := 1; limit <= 4; limit++ {
+			assert.Equal(t, []string{"list/a", "list/b", "list/d"}, listAll(t, "list/", limit))
+		}
+
+		page, next, err := storage.ListNames("nothing", "", 10)
+		require.NoError(t, err)
+		assert.Empty(t, page)
+		assert.Empty(t, next)
+	})
+
+	t.Run("stable under writes", func(t *testing.T) {
+		page, next, err := storage.ListNames("list/", "", 1)
+		require.NoError(t, err)
+		require.Equal(t, []string{"list/a"}, page)
+
+		// Written before and after the cursor, and the next name deleted
+		require.NoError(t, storage.StoreData("list/0", []byte("test data")))
+		require.NoError(t, storage.StoreData("list/c", []byte("test data")))
+		require.NoError(t, storage.DeleteData("list/b"))
+
+		page, _, err = storage.ListNames("list/", next, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"list/c", "list/d"}, page)
+	})
+}
+
+// testBatch checks `ApplyBatch` applies all of its operations, or none.
+func testBatch(t *testing.T, _ Harness, storage datastorage.DataStorage) {
+	failed := &customerrors.DataStoragePreconditionFailed{}
+
+	require.NoError(t, storage.StoreData("batch/old", []byte("old")))
+	_, old, err := storage.RetrieveEntry("batch/old")
+	require.NoError(t, err)
+
+	metas, err := storage.ApplyBatch([]datastorage.BatchOp{
+		{Name: "batch/a", Data: []byte("a1"), Options: datastorage.StoreOptions{ContentType: "text/plain"}},
+		{Name: "batch/b", Data: []byte("b1"), Precondition: datastorage.Precondition{MustNotExist: true}},
+		{Name: "batch/old", Delete: true, Precondition: datastorage.Precondition{IfMatch: []uint64{old.Revision}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, metas, 3)
+
+	t.Run("applied", func(t *testing.T) {
+		data, meta, err := storage.RetrieveEntry("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		assert.Equal(t, "text/plain", meta.ContentType)
+		assert.Equal(t, metas[0].Revision, meta.Revision)
+
+		data, meta, err = storage.RetrieveEntry("batch/b")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("b1"), data)
+		assert.Equal(t, metas[1].Revision, meta.Revision)
+
+		_, err = storage.RetrieveData("batch/old")
+		assertNotFound(t, err, "batch/old")
+	})
+
+	t.Run("failed precondition applies nothing", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]datastorage.BatchOp{
+			{Name: "batch/a", Data: []byte("a2")},
+			{Name: "batch/c", Data: []byte("c1")},
+			{Name: "batch/b", Data: []byte("b2"), Precondition: datastorage.Precondition{IfMatch: []uint64{old.Revision}}},
+		})
+		assert.ErrorAs(t, err, failed)
+
+		data, err := storage.RetrieveData("batch/a")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+		_, err = storage.RetrieveData("batch/c")
+		assertNotFound(t, err, "batch/c")
+	})
+
+	t.Run("missing delete applies nothing", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]datastorage.BatchOp{
+			{Name: "batch/a", Delete: true},
+			{Name: "batch/missing", Delete: true},
+		})
+		assertNotFound(t, err, "batch/missing")
+
+		_, err = storage.RetrieveData("batch/a")
+		assert.NoError(t, err)
+	})
+
+	t.Run("duplicate names are invalid", func(t *testing.T) {
+		_, err := storage.ApplyBatch([]datastorage.BatchOp{
+			{Name: "batch/c", Data: []byte("c1")},
+			{Name: "batch/c", Delete: true},
+		})
+		assert.IsType(t, customerrors.DataStorageBatchInvalid{}, err)
+
+		_, err = storage.RetrieveData("batch/c")
+		assertNotFound(t, err, "batch/c")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		metas, err := storage.ApplyBatch(nil)
+		require.NoError(t, err)
+		assert.Empty(t, metas)
+	})
+}
+
+// testStreaming checks `datastorage.StoreStream` and
+// `datastorage.RetrieveStream`, whether or not the storage streams natively.
+func testStreaming(t *testing.T, _ Harness, storage datastorage.DataStorage) {
+	dataName := "stream"
+	data := bytes.Repeat([]byte("streamed data "), 100_000)
+
+	meta, err := datastorage.StoreStream(storage, dataName, bytes.NewReader(data), datastorage.StoreOptions{
+		ContentType: "text/plain",
+	}, datastorage.Precondition{MustNotExist: true})
+	require.NoError(t, err)
+	assert.Equal(t, len(data), meta.Size)
+	assert.Equal(t, checksum(data), meta.Checksum)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	t.Run("retrieve", func(t *testing.T) {
+		stream, streamed, err := datastorage.RetrieveStream(storage, dataName)
+		require.NoError(t, err)
+		defer stream.Close()
+		assert.Equal(t, meta.Revision, streamed.Revision)
+		assert.Equal(t, meta.Checksum, streamed.Checksum)
+
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+
+		// Readable as a whole too
+		retrieved, err = storage.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+	})
+
+	t.Run("reads are isolated from later writes", func(t *testing.T) {
+		stream, _, err := datastorage.RetrieveStream(storage, dataName)
+		require.NoError(t, err)
+		defer stream.Close()
+		require.NoError(t, storage.StoreData(dataName, []byte("overwritten")))
+
+		retrieved, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, data, retrieved)
+	})
+
+	t.Run("failed precondition", func(t *testing.T) {
+		_, err := datastorage.StoreStream(
+			storage, dataName, bytes.NewReader(data), datastorage.StoreOptions{},
+			datastorage.Precondition{MustNotExist: true},
+		)
+		assert.ErrorAs(t, err, &customerrors.DataStoragePreconditionFailed{})
+	})
+
+	t.Run("failed read stores nothing", func(t *testing.T) {
+		failed := errors.New("connection reset")
+		_, err := datastorage.StoreStream(storage, "torn", &errReader{
+			data: data[:1000],
+			err:  failed,
+		}, datastorage.StoreOptions{}, datastorage.Precondition{})
+		assert.ErrorIs(t, err, failed)
+
+		_, err = storage.RetrieveData("torn")
+		assertNotFound(t, err, "torn")
+	})
+}
@@ -0,0 +1,149 @@
+// Package storagetest checks that a `datastorage.DataStorage` implementation
+// behaves as every other does, so that it may back the webapp in their place.
+//
+// Every backend runs the same suite from its tests:
+//
+//	func TestMyStorage(t *testing.T) {
+//		storagetest.Run(t, storagetest.Harness{
+//			New: func(tb testing.TB) datastorage.DataStorage {
+//				return MyStorage{}.Initialize()
+//			},
+//		})
+//	}
+//
+// and may be benchmarked against the others with `Benchmark`.
+package storagetest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+)
+
+// DefaultLargeValueSize is the size of the values stored by the large value
+// tests, unless the `Harness` says otherwise.
+const DefaultLargeValueSize = 4 << 20
+
+// Harness describes the `datastorage.DataStorage` under test.
+type Harness struct {
+	// New returns a new, empty storage - releasing it with `tb.Cleanup` if
+	// need be. Called once for each test, and each benchmark.
+	New func(tb testing.TB) datastorage.DataStorage
+
+	// Clock, if set, fakes the time seen by the storage for the duration of
+	// a test, returning a pointer to the current time which the suite
+	// advances. Expiry and timestamps are otherwise tested in real time,
+	// which takes a few seconds.
+	Clock func(t *testing.T) *time.Time
+
+	// LargeValueSize is the size of the values stored by the large value
+	// tests, `DefaultLargeValueSize` if zero.
+	LargeValueSize int
+}
+
+// Run runs the whole suite against the storage of `h`, each test as a
+// subtest of `t` with a new storage.
+//
+// Run with `-race` to check the storage is thread safe.
+func Run(t *testing.T, h Harness) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, h Harness, storage datastorage.DataStorage)
+	}{
+		{"Basic", testBasic},
+		{"NotFound", testNotFound},
+		{"ConditionalWrites", testConditionalWrites},
+		{"Metadata", testMetadata},
+		{"TTL", testTTL},
+		{"ListNames", testListNames},
+		{"Batch", testBatch},
+		{"Streaming", testStreaming},
+		{"Concurrency", testConcurrency},
+		{"LargeValues", testLargeValues},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, h, h.New(t))
+		})
+	}
+}
+
+// clock is the time seen by the storage under test - faked if the `Harness`
+// allows, in which case the suite may move it on instantly.
+type clock struct {
+	fake *time.Time
+
+	// unit is the shortest TTL worth testing, and tolerance the error allowed
+	// in the timestamps kept by the storage.
+	unit, tolerance time.Duration
+}
+
+// newClock returns the clock of `h` for the duration of `t`.
+func newClock(t *testing.T, h Harness) clock {
+	if h.Clock == nil {
+		return clock{unit: 500 * time.Millisecond, tolerance: 250 * time.Millisecond}
+	}
+	return clock{fake: h.Clock(t), unit: time.Minute, tolerance: time.Millisecond}
+}
+
+// Now returns the current time.
+func (c clock) Now() time.Time {
+	if c.fake == nil {
+		return time.Now()
+	}
+	return *c.fake
+}
+
+// Advance moves the clock on by `d`, waiting for it if real.
+func (c clock) Advance(d time.Duration) {
+	if c.fake == nil {
+		time.Sleep(d)
+		return
+	}
+	*c.fake = c.fake.Add(d)
+}
+
+// assertNotFound asserts `err` is a `customerrors.DataStorageNameNotFound`
+// for `name` - as is, since callers switch on the type of the error.
+func assertNotFound(t *testing.T, err error, name string) bool {
+	t.Helper()
+	if !assert.IsType(t, customerrors.DataStorageNameNotFound{}, err) {
+		return false
+	}
+	return assert.Equal(t, name, err.(customerrors.DataStorageNameNotFound).Name)
+}
+
+// checksum returns the checksum a storage keeps of `data`.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// randomData returns `size` bytes which do not compress, the same for a
+// given `seed`.
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// errReader fails with `err` once `data` is read.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
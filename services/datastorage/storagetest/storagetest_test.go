@@ -0,0 +1,26 @@
+package storagetest_test
+
+import (
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/dvo-dev/go-get-started/services/datastorage/storagetest"
+)
+
+func TestRun(t *testing.T) {
+	// Without a fake clock, as the suite runs against storages of other
+	// packages
+	storagetest.Run(t, storagetest.Harness{
+		New: func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.MemStorage{}.Initialize()
+		},
+	})
+}
+
+func BenchmarkMemStorage(b *testing.B) {
+	storagetest.Benchmark(b, storagetest.Harness{
+		New: func(tb testing.TB) datastorage.DataStorage {
+			return datastorage.MemStorage{}.Initialize()
+		},
+	})
+}
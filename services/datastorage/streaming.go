@@ -0,0 +1,115 @@
+package datastorage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// StreamingStorage is implemented by a `DataStorage` able to store and
+// retrieve data as streams, never holding all of it in memory at once.
+//
+// Use the package functions `StoreStream` and `RetrieveStream` to stream with
+// any `DataStorage`, falling back to whole `[]byte` values where the storage
+// cannot stream natively.
+type StreamingStorage interface {
+	// StoreStream behaves as `CompareAndSwap`, storing the data read from `r`
+	// until EOF. If reading `r` fails, nothing is stored.
+	StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error)
+
+	// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the
+	// data which the caller must close.
+	//
+	// The reader yields the data as of the call, even if `name` is written
+	// before it is read.
+	RetrieveStream(name string) (io.ReadCloser, Metadata, error)
+}
+
+// StoreStream stores the data read from `r` as `name` in `storage` if `cond`
+// holds, as `DataStorage.CompareAndSwap`.
+//
+// The data is streamed if `storage` implements `StreamingStorage`, elsewise it
+// is read into memory first.
+func StoreStream(storage DataStorage, name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if streaming, ok := storage.(StreamingStorage); ok {
+		return streaming.StoreStream(name, r, opts, cond)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return storage.CompareAndSwap(name, data, opts, cond)
+}
+
+// RetrieveStream returns a reader of the data of `name` in `storage`, which
+// the caller must close, and its `Metadata`.
+//
+// The data is streamed if `storage` implements `StreamingStorage`, elsewise it
+// is read into memory first.
+func RetrieveStream(storage DataStorage, name string) (io.ReadCloser, Metadata, error) {
+	if streaming, ok := storage.(StreamingStorage); ok {
+		return streaming.RetrieveStream(name)
+	}
+
+	data, meta, err := storage.RetrieveEntry(name)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), meta, nil
+}
+
+// spooledData is data read from a stream into a temporary file, so it can be
+// checked and measured before being written in place.
+type spooledData struct {
+	file     *os.File
+	size     int64
+	checksum string
+}
+
+// spool reads `r` until EOF into a temporary file in `dir` named with
+// `prefix`, hashing it along the way.
+//
+// The returned data is read from the start of the file, and must be closed.
+func spool(dir, prefix string, r io.Reader) (*spooledData, error) {
+	file, err := os.CreateTemp(dir, prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledData{file: file}
+
+	hash := sha256.New()
+	if spooled.size, err = io.Copy(io.MultiWriter(file, hash), r); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	spooled.checksum = hex.EncodeToString(hash.Sum(nil))
+
+	return spooled, nil
+}
+
+// Read reads the spooled data.
+func (s *spooledData) Read(p []byte) (int, error) {
+	return s.file.Read(p)
+}
+
+// Close closes and removes the temporary file.
+func (s *spooledData) Close() error {
+	err := s.file.Close()
+	if rErr := os.Remove(s.file.Name()); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+// readCloser joins a reader with the closer of what it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,783 @@
+package datastorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+)
+
+// versionKeyPrefix begins the names a `VersionedStorage` keeps its history
+// under within the backing storage - names beginning with it are refused.
+const versionKeyPrefix = reservedNamePrefix + "version\x00"
+
+// versionSpoolPrefix names the temporary files streams are spooled to.
+const versionSpoolPrefix = "version-spool-"
+
+// VersionHistory is implemented by `DataStorage`s which keep previous versions
+// of overwritten data, such as `VersionedStorage`.
+//
+// Versions of a name are numbered from 1, increasing by 1 on every write.
+type VersionHistory interface {
+	// RetrieveVersion retrieves the data associated with `name` as of the
+	// given `version`, which may be the current version.
+	//
+	// Returns `customerrors.DataStorageVersionNotFound` if the version was
+	// never written, or is no longer kept.
+	RetrieveVersion(name string, version int) ([]byte, Metadata, error)
+
+	// ListVersions lists the kept versions of `name`, oldest first.
+	ListVersions(name string) ([]VersionInfo, error)
+
+	// RestoreVersion writes the data of `version` as a new version of `name`,
+	// returning the new version - the restore may itself be undone.
+	RestoreVersion(name string, version int) (int, error)
+}
+
+// VersionInfo describes a single version of a name.
+type VersionInfo struct {
+	Version  int       `json:"version"`
+	Size     int       `json:"size"`
+	StoredAt time.Time `json:"stored_at"`
+	Current  bool      `json:"current,omitempty"`
+}
+
+// versionIndex records the versions of a name, stored as JSON under
+// `versionIndexKey`.
+type versionIndex struct {
+	// Latest is the last version written, and so the current version if it
+	// has not since expired
+	Latest int `json:"latest"`
+
+	// Versions are those kept, oldest first
+	Versions []VersionInfo `json:"versions"`
+}
+
+// hasCurrent reports whether the current version is in the index.
+func (idx versionIndex) hasCurrent() bool {
+	return len(idx.Versions) > 0 && idx.Versions[len(idx.Versions)-1].Version == idx.Latest
+}
+
+// has reports whether `version` is kept.
+func (idx versionIndex) has(version int) bool {
+	for _, info := range idx.Versions {
+		if info.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionedStorage is a decorator that implements the `DataStorage` and
+// `VersionHistory` interfaces, keeping up to a fixed number of previous
+// versions of every name in its backing `DataStorage`.
+//
+// The current version is stored under its name as usual, previous versions
+// and an index of them are stored under names prefixed with an unprintable
+// `versionKeyPrefix`, which callers may not use - so that the history can only
+// be changed through the `VersionedStorage`. Deleting a name deletes its
+// history too.
+//
+// It implements `ContextStorage`, passing contexts on to the backing storage
+// if it honours them natively.
+type VersionedStorage struct {
+	backing     DataStorage
+	maxVersions int
+
+	// Writers must read-modify-write the index, so are serialized
+	writeMu *sync.Mutex
+}
+
+// Initialize initializes and returns a pointer to a `VersionedStorage` in
+// front of `backing`, keeping up to `maxVersions` previous versions of each
+// name.
+//
+// The returned `VersionedStorage` takes ownership of `backing` - `Close`
+// closes `backing` if it is an `io.Closer`.
+func (vs VersionedStorage) Initialize(backing DataStorage, maxVersions int) *VersionedStorage {
+	return &VersionedStorage{
+		backing:     backing,
+		maxVersions: maxVersions,
+		writeMu:     &sync.Mutex{},
+	}
+}
+
+// RetrieveData retrieves the current version of the data associated with a
+// given `name`.
+//
+// If the `name` is found, returns the data (`[]byte`), elsewise returns error.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveData(name string) ([]byte, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return []byte{}, err
+	}
+	return vs.backing.RetrieveData(name)
+}
+
+// RetrieveEntry retrieves the current version of the data and `Metadata`
+// associated with a given `name`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveEntry(name string) ([]byte, Metadata, error) {
+	return vs.retrieveEntry(vs.backing, name)
+}
+
+// retrieveEntry behaves as `RetrieveEntry`, reading from `backing`.
+func (vs *VersionedStorage) retrieveEntry(backing DataStorage, name string) ([]byte, Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	return backing.RetrieveEntry(name)
+}
+
+// RetrieveMetadata retrieves the `Metadata` of the current version associated
+// with a given `name`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveMetadata(name string) (Metadata, error) {
+	return vs.retrieveMetadata(vs.backing, name)
+}
+
+// retrieveMetadata behaves as `RetrieveMetadata`, reading from `backing`.
+func (vs *VersionedStorage) retrieveMetadata(backing DataStorage, name string) (Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	return backing.RetrieveMetadata(name)
+}
+
+// StoreData writes data `[]byte` as the new current version of `name`,
+// keeping the previous version.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) StoreData(name string, data []byte) error {
+	return vs.StoreDataWithOptions(name, data, StoreOptions{})
+}
+
+// StoreDataWithOptions behaves as `StoreData`, applying `opts` to the new
+// current version only.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) StoreDataWithOptions(name string, data []byte, opts StoreOptions) error {
+	_, err := vs.CompareAndSwap(name, data, opts, Precondition{})
+	return err
+}
+
+// CompareAndSwap behaves as `StoreDataWithOptions` only if `cond` holds for
+// the current version of `name`, returning the `Metadata` of the new version.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) CompareAndSwap(name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	return vs.compareAndSwap(vs.backing, name, data, opts, cond)
+}
+
+// compareAndSwap behaves as `CompareAndSwap`, writing to `backing`.
+func (vs *VersionedStorage) compareAndSwap(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	vs.writeMu.Lock()
+	defer vs.writeMu.Unlock()
+
+	meta, _, err := vs.store(backing, name, data, opts, cond)
+	return meta, err
+}
+
+// StoreStream behaves as `CompareAndSwap`, streaming the data read from `r`
+// to the backing storage as a new version of `name` - and the current version
+// to its history.
+//
+// The data is first spooled to a temporary file, so other writers need not
+// wait for it to be read.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) StoreStream(name string, r io.Reader, opts StoreOptions, cond Precondition) (Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return Metadata{}, err
+	}
+	spooled, err := spool("", versionSpoolPrefix, r)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer spooled.Close()
+
+	vs.writeMu.Lock()
+	defer vs.writeMu.Unlock()
+
+	prev, err := vs.backing.RetrieveMetadata(name)
+	exists := true
+	switch err.(type) {
+	case nil:
+	case customerrors.DataStorageNameNotFound:
+		exists = false
+	default:
+		return Metadata{}, err
+	}
+	if err = cond.Check(name, prev, exists); err != nil {
+		return Metadata{}, err
+	}
+
+	plan, err := vs.planVersion(vs.backing, name, int(spooled.size), prev.Size, exists)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if len(plan.archive) > 0 {
+		current, _, err := RetrieveStream(vs.backing, name)
+		if err != nil {
+			return Metadata{}, err
+		}
+		_, err = StoreStream(
+			vs.backing, plan.archive, current, StoreOptions{ContentType: prev.ContentType}, Precondition{},
+		)
+		current.Close()
+		if err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	// The stream cannot be stored in the same batch as the history, so the
+	// history is restored should it fail
+	if err = vs.writeIndex(vs.backing, name, plan.idx); err != nil {
+		return Metadata{}, err
+	}
+	meta, err := StoreStream(vs.backing, name, spooled, opts, Precondition{})
+	if err != nil {
+		if rErr := vs.writeIndex(vs.backing, name, plan.prev); rErr != nil {
+			log.Printf("VersionedStorage - failed to restore the version index of '%s': %v", name, rErr)
+		} else if len(plan.archive) > 0 {
+			if dErr := vs.deleteKey(vs.backing, plan.archive); dErr != nil {
+				log.Printf("VersionedStorage - failed to delete %q: %v", plan.archive, dErr)
+			}
+		}
+		return Metadata{}, err
+	}
+	vs.prune(vs.backing, name, plan.pruned)
+
+	return meta, nil
+}
+
+// RetrieveStream behaves as `RetrieveEntry`, returning a reader of the current
+// version which the caller must close.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveStream(name string) (io.ReadCloser, Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return nil, Metadata{}, err
+	}
+	return RetrieveStream(vs.backing, name)
+}
+
+// DeleteData removes data in the `VersionedStorage` associated with the given
+// `name`, along with all of its previous versions.
+//
+// If the `name` does not exist, an error will be returned.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) DeleteData(name string) error {
+	return vs.CompareAndDelete(name, Precondition{})
+}
+
+// CompareAndDelete behaves as `DeleteData` only if `cond` holds for the
+// current version of `name`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) CompareAndDelete(name string, cond Precondition) error {
+	return vs.compareAndDelete(vs.backing, name, cond)
+}
+
+// compareAndDelete behaves as `CompareAndDelete`, deleting from `backing`.
+func (vs *VersionedStorage) compareAndDelete(backing DataStorage, name string, cond Precondition) error {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return err
+	}
+	vs.writeMu.Lock()
+	defer vs.writeMu.Unlock()
+
+	err := backing.CompareAndDelete(name, cond)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); err != nil && !notFound {
+		return err
+	}
+
+	// Remove any history even if the current version had already expired
+	idx, iErr := vs.readIndex(backing, name)
+	if iErr != nil {
+		return iErr
+	}
+	for _, info := range idx.Versions {
+		if info.Version == idx.Latest {
+			continue
+		}
+		if dErr := vs.deleteKey(backing, versionKey(name, info.Version)); dErr != nil {
+			return dErr
+		}
+	}
+	if dErr := vs.deleteKey(backing, versionIndexKey(name)); dErr != nil {
+		return dErr
+	}
+
+	return err
+}
+
+// ApplyBatch atomically applies every operation of `ops` or none of them, see
+// `DataStorage`.
+//
+// The history of every stored name is updated within the same batch of the
+// backing storage, while pruned versions and the history of deleted names are
+// removed once it is applied.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) ApplyBatch(ops []BatchOp) ([]Metadata, error) {
+	return vs.applyBatch(vs.backing, ops)
+}
+
+// applyBatch behaves as `ApplyBatch`, applying `ops` to `backing`.
+func (vs *VersionedStorage) applyBatch(backing DataStorage, ops []BatchOp) ([]Metadata, error) {
+	if err := validateBatch(ops); err != nil {
+		return nil, err
+	}
+	if err := checkBatchNames(ops, versionKeyPrefix); err != nil {
+		return nil, err
+	}
+
+	vs.writeMu.Lock()
+	defer vs.writeMu.Unlock()
+
+	// History is written in the same batch as the data, as by `store`
+	var (
+		batch  []BatchOp
+		pruned []string
+	)
+	for _, op := range ops {
+		if op.Delete {
+			continue
+		}
+		current, prev, exists, err := vs.currentEntry(backing, op.Name)
+		if err != nil {
+			return nil, err
+		}
+		plan, err := vs.planVersion(backing, op.Name, len(op.Data), len(current), exists)
+		if err != nil {
+			return nil, err
+		}
+		index, err := json.Marshal(plan.idx)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(plan.archive) > 0 {
+			batch = append(batch, BatchOp{
+				Name:    plan.archive,
+				Data:    current,
+				Options: StoreOptions{ContentType: prev.ContentType},
+			})
+		}
+		batch = append(batch, BatchOp{Name: versionIndexKey(op.Name), Data: index})
+		for _, info := range plan.pruned {
+			pruned = append(pruned, versionKey(op.Name, info.Version))
+		}
+	}
+	history := len(batch)
+	batch = append(batch, ops...)
+
+	metas, err := backing.ApplyBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	// The batch is applied, so failing to tidy up leaves only unreferenced keys
+	for _, op := range ops {
+		if !op.Delete {
+			continue
+		}
+		idx, err := vs.readIndex(backing, op.Name)
+		if err != nil {
+			log.Printf("VersionedStorage - failed to delete history of '%s': %v", op.Name, err)
+			continue
+		}
+		for _, info := range idx.Versions {
+			if info.Version != idx.Latest {
+				pruned = append(pruned, versionKey(op.Name, info.Version))
+			}
+		}
+		pruned = append(pruned, versionIndexKey(op.Name))
+	}
+	for _, key := range pruned {
+		if err = vs.deleteKey(backing, key); err != nil {
+			log.Printf("VersionedStorage - failed to delete %q: %v", key, err)
+		}
+	}
+
+	return metas[history:], nil
+}
+
+// PurgeExpired removes all expired entries from the backing storage.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) PurgeExpired() (int, error) {
+	return vs.backing.PurgeExpired()
+}
+
+// ListNames lists the names of current versions beginning with `prefix`, see
+// `DataStorage` - the history kept in the backing storage is not listed.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) ListNames(prefix, cursor string, limit int) ([]string, string, error) {
+	return listNamesExcept(vs.backing, versionKeyPrefix, prefix, cursor, limit)
+}
+
+// RetrieveEntryContext behaves as `RetrieveEntry`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveEntryContext(ctx context.Context, name string) ([]byte, Metadata, error) {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.RetrieveEntryContext(ctx, name)
+	}
+	return vs.retrieveEntry(backing, name)
+}
+
+// RetrieveMetadataContext behaves as `RetrieveMetadata`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveMetadataContext(ctx context.Context, name string) (Metadata, error) {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.RetrieveMetadataContext(ctx, name)
+	}
+	return vs.retrieveMetadata(backing, name)
+}
+
+// CompareAndSwapContext behaves as `CompareAndSwap`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) CompareAndSwapContext(ctx context.Context, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, error) {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.CompareAndSwapContext(ctx, name, data, opts, cond)
+	}
+	return vs.compareAndSwap(backing, name, data, opts, cond)
+}
+
+// CompareAndDeleteContext behaves as `CompareAndDelete`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) CompareAndDeleteContext(ctx context.Context, name string, cond Precondition) error {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.CompareAndDeleteContext(ctx, name, cond)
+	}
+	return vs.compareAndDelete(backing, name, cond)
+}
+
+// ListNamesContext behaves as `ListNames`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) ListNamesContext(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.ListNamesContext(ctx, prefix, cursor, limit)
+	}
+	return listNamesExcept(backing, versionKeyPrefix, prefix, cursor, limit)
+}
+
+// ApplyBatchContext behaves as `ApplyBatch`, within `ctx`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) ApplyBatchContext(ctx context.Context, ops []BatchOp) ([]Metadata, error) {
+	backing, ok := bindContext(ctx, vs.backing)
+	if !ok {
+		return contextAdapter{vs}.ApplyBatchContext(ctx, ops)
+	}
+	return vs.applyBatch(backing, ops)
+}
+
+func (vs *VersionedStorage) contextNative() bool {
+	_, ok := nativeContext(vs.backing)
+	return ok
+}
+
+// RetrieveVersion retrieves the data associated with `name` as of the given
+// `version`.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RetrieveVersion(name string, version int) ([]byte, Metadata, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return []byte{}, Metadata{}, err
+	}
+	idx, err := vs.readIndex(vs.backing, name)
+	if err != nil {
+		return []byte{}, Metadata{}, err
+	}
+
+	notFound := customerrors.DataStorageVersionNotFound{
+		Name:    name,
+		Version: version,
+	}
+	if !idx.has(version) {
+		return []byte{}, Metadata{}, notFound
+	}
+
+	key := versionKey(name, version)
+	if version == idx.Latest {
+		key = name
+	}
+	data, meta, err := vs.backing.RetrieveEntry(key)
+	if _, ok := err.(customerrors.DataStorageNameNotFound); ok {
+		// Expired, or pruned since the index was read
+		return []byte{}, Metadata{}, notFound
+	}
+
+	return data, meta, err
+}
+
+// ListVersions lists the kept versions of `name`, oldest first.
+//
+// Returns `customerrors.DataStorageNameNotFound` if there are none.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) ListVersions(name string) ([]VersionInfo, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return nil, err
+	}
+	idx, err := vs.readIndex(vs.backing, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx.Versions) == 0 {
+		return nil, customerrors.DataStorageNameNotFound{
+			Name: name,
+		}
+	}
+
+	if idx.hasCurrent() {
+		idx.Versions[len(idx.Versions)-1].Current = true
+	}
+	return idx.Versions, nil
+}
+
+// RestoreVersion writes the data of `version` as a new version of `name`,
+// returning the new version.
+//
+// This method is thread safe.
+func (vs *VersionedStorage) RestoreVersion(name string, version int) (int, error) {
+	if err := checkName(name, versionKeyPrefix); err != nil {
+		return 0, err
+	}
+	vs.writeMu.Lock()
+	defer vs.writeMu.Unlock()
+
+	data, meta, err := vs.RetrieveVersion(name, version)
+	if err != nil {
+		return 0, err
+	}
+
+	_, version, err = vs.store(vs.backing, name, data, StoreOptions{ContentType: meta.ContentType}, Precondition{})
+	return version, err
+}
+
+// Close closes the backing storage if it is an `io.Closer`.
+func (vs *VersionedStorage) Close() error {
+	if closer, ok := vs.backing.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// store writes `data` as a new version of `name` if `cond` holds, archiving
+// the current version and pruning those beyond `maxVersions` - callers must
+// hold the write lock.
+func (vs *VersionedStorage) store(backing DataStorage, name string, data []byte, opts StoreOptions, cond Precondition) (Metadata, int, error) {
+	current, prev, exists, err := vs.currentEntry(backing, name)
+	if err != nil {
+		return Metadata{}, 0, err
+	}
+	if err = cond.Check(name, prev, exists); err != nil {
+		return Metadata{}, 0, err
+	}
+
+	plan, err := vs.planVersion(backing, name, len(data), len(current), exists)
+	if err != nil {
+		return Metadata{}, 0, err
+	}
+	index, err := json.Marshal(plan.idx)
+	if err != nil {
+		return Metadata{}, 0, err
+	}
+
+	// The history is written in the same batch as the data, so neither is
+	// written unless both are
+	var batch []BatchOp
+	if len(plan.archive) > 0 {
+		batch = append(batch, BatchOp{
+			Name:    plan.archive,
+			Data:    current,
+			Options: StoreOptions{ContentType: prev.ContentType},
+		})
+	}
+	batch = append(batch,
+		BatchOp{Name: versionIndexKey(name), Data: index},
+		BatchOp{Name: name, Data: data, Options: opts},
+	)
+	metas, err := backing.ApplyBatch(batch)
+	if err != nil {
+		return Metadata{}, 0, err
+	}
+	vs.prune(backing, name, plan.pruned)
+	meta := metas[len(metas)-1]
+
+	return meta, plan.idx.Latest, nil
+}
+
+// versionPlan is how writing a new version of a name changes its history,
+// see `planVersion`.
+type versionPlan struct {
+	// idx is the new index, with the new version as the latest
+	idx versionIndex
+
+	// archive is the `versionKey` to store the current version under, if kept
+	archive string
+
+	// pruned are the versions no longer kept, to delete once written
+	pruned []VersionInfo
+
+	// prev is the current index, to restore should the write fail
+	prev versionIndex
+}
+
+// planVersion plans writing a new version of `name`, of `size` bytes, over
+// its current version of `currentSize` bytes if it `exists` - callers must
+// hold the write lock.
+func (vs *VersionedStorage) planVersion(backing DataStorage, name string, size, currentSize int, exists bool) (versionPlan, error) {
+	idx, err := vs.readIndex(backing, name)
+	if err != nil {
+		return versionPlan{}, err
+	}
+	now := timeNow().UTC()
+	plan := versionPlan{
+		prev: versionIndex{Latest: idx.Latest, Versions: append([]VersionInfo(nil), idx.Versions...)},
+	}
+
+	// Data written before versioning was enabled is kept as a version too
+	if exists && !idx.hasCurrent() {
+		idx.Latest++
+		idx.Versions = append(idx.Versions, VersionInfo{
+			Version:  idx.Latest,
+			Size:     currentSize,
+			StoredAt: now,
+		})
+	}
+
+	// Archive the current version, unless it has since expired
+	if idx.hasCurrent() {
+		if exists {
+			plan.archive = versionKey(name, idx.Latest)
+		} else {
+			idx.Versions = idx.Versions[:len(idx.Versions)-1]
+		}
+	}
+
+	idx.Latest++
+	idx.Versions = append(idx.Versions, VersionInfo{
+		Version:  idx.Latest,
+		Size:     size,
+		StoredAt: now,
+	})
+
+	// Prune the oldest previous versions
+	if previous := len(idx.Versions) - 1; previous > vs.maxVersions {
+		plan.pruned = idx.Versions[:previous-vs.maxVersions]
+		idx.Versions = idx.Versions[previous-vs.maxVersions:]
+	}
+	plan.idx = idx
+
+	return plan, nil
+}
+
+// currentEntry reads the current version of `name`, reporting whether it
+// exists.
+func (vs *VersionedStorage) currentEntry(backing DataStorage, name string) ([]byte, Metadata, bool, error) {
+	current, meta, err := backing.RetrieveEntry(name)
+	switch err.(type) {
+	case nil:
+		return current, meta, true, nil
+	case customerrors.DataStorageNameNotFound:
+		return nil, Metadata{}, false, nil
+	default:
+		return nil, Metadata{}, false, err
+	}
+}
+
+// readIndex reads the `versionIndex` of `name`, empty if it has none.
+//
+// Versions whose current data has gone (expired or deleted) are left in the
+// index, `store` removes them.
+func (vs *VersionedStorage) readIndex(backing DataStorage, name string) (versionIndex, error) {
+	var idx versionIndex
+
+	data, err := backing.RetrieveData(versionIndexKey(name))
+	switch err.(type) {
+	case nil:
+	case customerrors.DataStorageNameNotFound:
+		return idx, nil
+	default:
+		return idx, err
+	}
+
+	if err = json.Unmarshal(data, &idx); err != nil {
+		return idx, fmt.Errorf("corrupt version index of '%s': %w", name, err)
+	}
+	sort.Slice(idx.Versions, func(i, j int) bool {
+		return idx.Versions[i].Version < idx.Versions[j].Version
+	})
+
+	return idx, nil
+}
+
+// writeIndex writes the `versionIndex` of `name`, deleting it if empty.
+func (vs *VersionedStorage) writeIndex(backing DataStorage, name string, idx versionIndex) error {
+	if idx.Latest == 0 {
+		return vs.deleteKey(backing, versionIndexKey(name))
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return backing.StoreData(versionIndexKey(name), data)
+}
+
+// prune deletes the `pruned` versions of `name` once no longer referenced by
+// its index. The write is applied by then, so failures are only logged - they
+// leave unreferenced versions behind.
+func (vs *VersionedStorage) prune(backing DataStorage, name string, pruned []VersionInfo) {
+	for _, info := range pruned {
+		if err := vs.deleteKey(backing, versionKey(name, info.Version)); err != nil {
+			log.Printf("VersionedStorage - failed to prune version %d of '%s': %v", info.Version, name, err)
+		}
+	}
+}
+
+// deleteKey deletes `key` from the backing storage, ignoring if not found.
+func (vs *VersionedStorage) deleteKey(backing DataStorage, key string) error {
+	err := backing.DeleteData(key)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		return nil
+	}
+	return err
+}
+
+// versionIndexKey is the name the `versionIndex` of `name` is stored under.
+func versionIndexKey(name string) string {
+	return versionKeyPrefix + "index\x00" + name
+}
+
+// versionKey is the name a previous `version` of `name` is stored under.
+func versionKey(name string, version int) string {
+	return fmt.Sprintf("%s%d\x00%s", versionKeyPrefix, version, name)
+}
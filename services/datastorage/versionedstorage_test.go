@@ -0,0 +1,351 @@
+package datastorage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedStorage_ImplementsDataStorage(t *testing.T) {
+	var _ DataStorage = &VersionedStorage{}
+	var _ StreamingStorage = &VersionedStorage{}
+	var _ VersionHistory = &VersionedStorage{}
+}
+
+func TestVersionedStorage_StoreData(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	vs := VersionedStorage{}.Initialize(mem, 2)
+	dataName := "test"
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, vs.StoreData(dataName, []byte(fmt.Sprintf("v%d", i))))
+	}
+
+	t.Run("current version", func(t *testing.T) {
+		data, err := vs.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v4"), data)
+
+		// Readable without the decorator too
+		data, err = mem.RetrieveData(dataName)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v4"), data)
+	})
+
+	t.Run("list versions", func(t *testing.T) {
+		versions, err := vs.ListVersions(dataName)
+		require.NoError(t, err)
+		require.Len(t, versions, 3)
+		for i, info := range versions {
+			assert.Equal(t, i+2, info.Version)
+			assert.Equal(t, 2, info.Size)
+			assert.False(t, info.StoredAt.IsZero())
+			assert.Equal(t, i == 2, info.Current)
+		}
+
+		_, err = vs.ListVersions("foo")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("retrieve version", func(t *testing.T) {
+		for version := 2; version <= 4; version++ {
+			data, _, err := vs.RetrieveVersion(dataName, version)
+			require.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("v%d", version)), data)
+		}
+
+		// Pruned, and never written
+		for _, version := range []int{1, 5} {
+			_, _, err := vs.RetrieveVersion(dataName, version)
+			assert.ErrorAs(t, err, &customerrors.DataStorageVersionNotFound{})
+		}
+	})
+
+	t.Run("pruned versions are deleted", func(t *testing.T) {
+		_, err := mem.RetrieveData(versionKey(dataName, 1))
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		// Index, 2 previous versions and the current version
+		assert.Equal(t, 4, mem.Stats().Entries)
+	})
+}
+
+func TestVersionedStorage_RestoreVersion(t *testing.T) {
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 10)
+	dataName := "test"
+	require.NoError(t, vs.StoreData(dataName, []byte("original")))
+	require.NoError(t, vs.StoreData(dataName, []byte("accidental overwrite")))
+
+	version, err := vs.RestoreVersion(dataName, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, version)
+
+	data, err := vs.RetrieveData(dataName)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("original"), data)
+
+	// The overwrite is kept, so the restore can be undone
+	data, _, err = vs.RetrieveVersion(dataName, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("accidental overwrite"), data)
+
+	_, err = vs.RestoreVersion(dataName, 7)
+	assert.ErrorAs(t, err, &customerrors.DataStorageVersionNotFound{})
+}
+
+func TestVersionedStorage_DeleteData(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	vs := VersionedStorage{}.Initialize(mem, 10)
+	dataName := "test"
+	require.NoError(t, vs.StoreData(dataName, []byte("v1")))
+	require.NoError(t, vs.StoreData(dataName, []byte("v2")))
+
+	t.Run("delete existing data", func(t *testing.T) {
+		require.NoError(t, vs.DeleteData(dataName))
+
+		_, err := vs.RetrieveData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		_, err = vs.ListVersions(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+		assert.Zero(t, mem.Stats().Entries)
+	})
+
+	t.Run("delete nonexistent data", func(t *testing.T) {
+		err := vs.DeleteData(dataName)
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+
+	t.Run("versions restart", func(t *testing.T) {
+		require.NoError(t, vs.StoreData(dataName, []byte("v1")))
+		versions, err := vs.ListVersions(dataName)
+		require.NoError(t, err)
+		require.Len(t, versions, 1)
+		assert.Equal(t, 1, versions[0].Version)
+	})
+}
+
+func TestVersionedStorage_ReservedNames(t *testing.T) {
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 10)
+	require.NoError(t, vs.StoreData("a", []byte("v1")))
+	require.NoError(t, vs.StoreData("a", []byte("v2")))
+
+	// The history may not be overwritten through the storage
+	index := versionIndexKey("a")
+	err := vs.StoreData(index, []byte("garbage"))
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = vs.CompareAndSwap(versionKey("a", 1), []byte("garbage"), StoreOptions{}, Precondition{})
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = vs.StoreStream(index, strings.NewReader("garbage"), StoreOptions{}, Precondition{})
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = vs.ApplyBatch([]BatchOp{
+		{Name: "b", Data: []byte("b")},
+		{Name: index, Data: []byte("garbage")},
+	})
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, vs.DeleteData(index))
+
+	// Nor read, nor versioned itself
+	_, err = vs.RetrieveData(index)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+	_, err = vs.ListVersions(index)
+	assert.IsType(t, customerrors.DataStorageNameReserved{}, err)
+
+	versions, err := vs.ListVersions("a")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+	require.NoError(t, vs.StoreData("a", []byte("v3")))
+	data, _, err := vs.RetrieveVersion("a", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), data)
+	_, err = vs.RetrieveData("b")
+	assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+}
+
+func TestVersionedStorage_TTL(t *testing.T) {
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 10)
+	testStorageTTL(t, vs)
+
+	t.Run("expired versions are not archived", func(t *testing.T) {
+		now := fakeClock(t)
+		require.NoError(t, vs.StoreDataWithOptions(
+			"versioned", []byte("v1"), StoreOptions{TTL: time.Minute},
+		))
+		*now = now.Add(time.Hour)
+		require.NoError(t, vs.StoreData("versioned", []byte("v2")))
+
+		versions, err := vs.ListVersions("versioned")
+		require.NoError(t, err)
+		require.Len(t, versions, 1)
+		assert.Equal(t, 2, versions[0].Version)
+	})
+}
+
+func TestVersionedStorage_ThreadSafe(t *testing.T) {
+	// -race test flag will detect race conditions
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 3)
+	dataName := "test"
+	testData := []byte("test data")
+
+	for i := 0; i < 69; i++ {
+		wg.Add(1)
+
+		go func(itr int) {
+			defer wg.Done()
+			<-start
+			switch itr % 4 {
+			case 0:
+				_ = vs.StoreData(dataName, testData)
+			case 1:
+				_, _, _ = vs.RetrieveVersion(dataName, itr%5)
+			case 2:
+				_, _ = vs.RestoreVersion(dataName, itr%5)
+			default:
+				_ = vs.DeleteData(dataName)
+			}
+		}(i)
+	}
+
+	close(start) // Start after all workers created
+	wg.Wait()    // Wait for workers to complete
+}
+
+func TestVersionedStorage_ConditionalWrites(t *testing.T) {
+	testStorageConditionalWrites(t, VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 2))
+}
+
+func TestVersionedStorage_Metadata(t *testing.T) {
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 2)
+	testStorageMetadata(t, vs)
+
+	t.Run("versions keep their content type", func(t *testing.T) {
+		require.NoError(t, vs.StoreDataWithOptions(
+			"typed", []byte("{}"), StoreOptions{ContentType: "application/json"},
+		))
+		require.NoError(t, vs.StoreData("typed", []byte("untyped")))
+
+		_, meta, err := vs.RetrieveVersion("typed", 1)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", meta.ContentType)
+
+		_, err = vs.RestoreVersion("typed", 1)
+		require.NoError(t, err)
+		meta, err = vs.RetrieveMetadata("typed")
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", meta.ContentType)
+	})
+}
+
+func TestVersionedStorage_ListNames(t *testing.T) {
+	vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 2)
+	testStorageListNames(t, vs)
+
+	t.Run("history is not listed", func(t *testing.T) {
+		vs := VersionedStorage{}.Initialize(MemStorage{}.Initialize(), 300)
+		for i := 0; i < 300; i++ {
+			require.NoError(t, vs.StoreData("a", []byte(fmt.Sprint(i))))
+		}
+		require.NoError(t, vs.StoreData("b", []byte("test data")))
+
+		page, next, err := vs.ListNames("", "", 1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, page)
+		page, next, err = vs.ListNames("", next, 1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b"}, page)
+		assert.Empty(t, next)
+	})
+}
+
+func TestVersionedStorage_Batch(t *testing.T) {
+	mem := MemStorage{}.Initialize()
+	vs := VersionedStorage{}.Initialize(mem, 1)
+	testStorageBatch(t, vs)
+
+	t.Run("history", func(t *testing.T) {
+		for i := 2; i <= 3; i++ {
+			_, err := vs.ApplyBatch([]BatchOp{
+				{Name: "batch/a", Data: []byte(fmt.Sprintf("a%d", i))},
+				{Name: "batch/b", Delete: true},
+			})
+			if i == 3 {
+				// batch/b is already gone, so nothing is archived either
+				assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+				continue
+			}
+			require.NoError(t, err)
+		}
+
+		versions, err := vs.ListVersions("batch/a")
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		data, _, err := vs.RetrieveVersion("batch/a", versions[0].Version)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("a1"), data)
+
+		// Deleting a name deletes its history too
+		_, err = mem.RetrieveData(versionIndexKey("batch/b"))
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+	})
+}
+
+func TestVersionedStorage_Streaming(t *testing.T) {
+	fs, err := FileStorage{}.Initialize(t.TempDir())
+	require.NoError(t, err)
+	vs := VersionedStorage{}.Initialize(fs, 2)
+	testStorageStreaming(t, vs)
+
+	t.Run("history", func(t *testing.T) {
+		_, err := vs.StoreStream("stream", strings.NewReader("streamed again"), StoreOptions{}, Precondition{})
+		require.NoError(t, err)
+
+		versions, err := vs.ListVersions("stream")
+		require.NoError(t, err)
+		require.Len(t, versions, 3)
+		assert.Equal(t, len("streamed again"), versions[2].Size)
+		data, _, err := vs.RetrieveVersion("stream", versions[1].Version)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("overwritten"), data)
+	})
+}
+
+func TestVersionedStorage_FailedWrite(t *testing.T) {
+	qs, err := QuotaStorage{}.Initialize(MemStorage{}.Initialize(), QuotaStorageConfig{
+		Quotas: []Quota{{Prefix: "limited", MaxEntrySize: 4}},
+	})
+	require.NoError(t, err)
+	vs := VersionedStorage{}.Initialize(qs, 2)
+	require.NoError(t, vs.StoreData("limited", []byte("v1")))
+
+	// Neither write is recorded in the history once refused
+	for _, store := range []func() error{
+		func() error { return vs.StoreData("limited", []byte("too large")) },
+		func() error {
+			_, err := vs.StoreStream("limited", strings.NewReader("too large"), StoreOptions{}, Precondition{})
+			return err
+		},
+	} {
+		assert.ErrorAs(t, store(), &customerrors.DataStorageQuotaExceeded{})
+
+		versions, err := vs.ListVersions("limited")
+		require.NoError(t, err)
+		require.Len(t, versions, 1)
+		assert.Equal(t, 2, versions[0].Size)
+		data, _, err := vs.RetrieveVersion("limited", versions[0].Version)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v1"), data)
+	}
+
+	// Nor is a first write
+	assert.ErrorAs(t, vs.StoreData("limited-new", []byte("too large")), &customerrors.DataStorageQuotaExceeded{})
+	names, _, err := qs.ListNames("", "", 0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"limited", versionIndexKey("limited")}, names)
+}
@@ -0,0 +1,389 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+const (
+	// StreamRoute is the URL path a primary serves its replication stream at.
+	StreamRoute = "/replication/stream"
+
+	// defaultRetryInterval is how long a `Follower` waits to reconnect when
+	// `FollowerConfig.RetryInterval` is unset.
+	defaultRetryInterval = time.Second
+
+	// defaultFollowerTimeout is how long a `Follower` waits on a silent
+	// primary when `FollowerConfig.Timeout` is unset.
+	defaultFollowerTimeout = 10 * time.Second
+)
+
+// FollowerConfig configures a `Follower`.
+type FollowerConfig struct {
+	// Primary is the base URL of the primary, e.g. "http://localhost:8080".
+	Primary string
+
+	// RetryInterval is how long to wait before reconnecting to the primary,
+	// defaults to 1s.
+	RetryInterval time.Duration
+
+	// Timeout is how long the primary may send nothing before the follower
+	// reconnects, defaults to 10s - longer than the primary's heartbeat
+	// interval.
+	Timeout time.Duration
+
+	// Client sends requests to the primary, defaults to a client without a
+	// timeout, as the stream lasts indefinitely.
+	Client *http.Client
+
+	// OnApply, if set, is called with the name of every entry written or
+	// deleted by replication.
+	OnApply func(name string) error
+}
+
+// FollowerStatus is the replication status of a `Follower`.
+type FollowerStatus struct {
+	// Role is always "follower".
+	Role    string `json:"role"`
+	Primary string `json:"primary"`
+
+	// Connected reports whether the follower is streaming from the primary.
+	Connected bool `json:"connected"`
+
+	// Seq is the `Seq` of the last change of the primary applied, and
+	// PrimarySeq the latest change of the primary last heard of.
+	Seq        uint64 `json:"seq"`
+	PrimarySeq uint64 `json:"primary_seq"`
+
+	// LagChanges is how many changes of the primary are yet to be applied,
+	// and LagSeconds how long since the follower last had none - zero when
+	// caught up.
+	LagChanges uint64  `json:"lag_changes"`
+	LagSeconds float64 `json:"lag_seconds"`
+
+	// LastContact is when the primary last sent anything, and LastError why
+	// the follower last disconnected.
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Follower replicates the `DataStorage` of a primary to a local `DataStorage`,
+// streaming every change from the primary's `Primary.Stream` and applying it
+// in order - reconnecting whenever the stream fails.
+//
+// The first connection begins with a snapshot of the primary, so the local
+// storage ends up holding exactly the entries of the primary. Writes made to
+// the local storage other than by the follower are overwritten or lost.
+//
+// Entries are written with the `Metadata.Revision` and timestamps they have on
+// the primary, so their ETags match those of the primary.
+type Follower struct {
+	storage datastorage.DataStorage
+	cfg     FollowerConfig
+
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+
+	// mu guards the status
+	mu          *sync.Mutex
+	epoch       uint64
+	seq, head   uint64
+	connected   bool
+	lastContact time.Time
+	caughtUp    time.Time
+	lastErr     error
+}
+
+// Initialize initializes and starts a `Follower`, replicating the primary
+// configured by `cfg` to `storage` until `Stop` is called.
+func (f Follower) Initialize(storage datastorage.DataStorage, cfg FollowerConfig) *Follower {
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultFollowerTimeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{}
+	}
+	cfg.Primary = strings.TrimSuffix(cfg.Primary, "/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	follower := &Follower{
+		storage:  storage,
+		cfg:      cfg,
+		cancel:   cancel,
+		wg:       &sync.WaitGroup{},
+		mu:       &sync.Mutex{},
+		caughtUp: time.Now(),
+	}
+
+	follower.wg.Add(1)
+	go follower.loop(ctx)
+
+	return follower
+}
+
+// Stop stops the `Follower`, waiting for any change being applied.
+func (f *Follower) Stop() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+// Status returns the progress of the `Follower`, and how far it lags behind
+// the primary.
+//
+// This method is thread safe.
+func (f *Follower) Status() FollowerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := FollowerStatus{
+		Role:       "follower",
+		Primary:    f.cfg.Primary,
+		Connected:  f.connected,
+		Seq:        f.seq,
+		PrimarySeq: f.head,
+	}
+	if f.head > f.seq {
+		status.LagChanges = f.head - f.seq
+	}
+	if status.LagChanges > 0 || !f.connected {
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	if !f.lastContact.IsZero() {
+		lastContact := f.lastContact
+		status.LastContact = &lastContact
+	}
+	if f.lastErr != nil {
+		status.LastError = f.lastErr.Error()
+	}
+	return status
+}
+
+func (f *Follower) loop(ctx context.Context) {
+	defer f.wg.Done()
+
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Follower - replication from '%s' interrupted: %v", f.cfg.Primary, err)
+
+		f.mu.Lock()
+		f.connected = false
+		f.lastErr = err
+		f.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.cfg.RetryInterval):
+		}
+	}
+}
+
+// follow streams and applies changes from the primary until the stream
+// fails.
+func (f *Follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	f.mu.Lock()
+	epoch, since := f.epoch, f.seq
+	f.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, f.cfg.Primary+StreamRoute+"?since="+FormatSince(epoch, since), nil,
+	)
+	if err != nil {
+		return err
+	}
+	resp, err := f.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg customerrors.ClientErrorMessage
+		_ = json.NewDecoder(resp.Body).Decode(&msg)
+		return fmt.Errorf("primary responded %d: %s", resp.StatusCode, msg.Error)
+	}
+
+	// Give up on a primary which has gone silent
+	watchdog := time.AfterFunc(f.cfg.Timeout, cancel)
+	defer watchdog.Stop()
+	records := newRecordReader(watchdogReader{resp.Body, watchdog, f.cfg.Timeout})
+
+	var (
+		snapshot      map[string]bool
+		snapshotEpoch uint64
+	)
+	for {
+		rec, data, err := records.next()
+		if err != nil {
+			return err
+		}
+
+		switch rec.Type {
+		case RecordSnapshot:
+			log.Printf("Follower - replicating snapshot of '%s' as of change %d...", f.cfg.Primary, rec.Seq)
+			snapshot = map[string]bool{}
+			snapshotEpoch = rec.Epoch
+			rec.Seq = since
+
+		case RecordEntry:
+			if err = f.apply(rec, data); err != nil {
+				return err
+			}
+			if snapshot != nil {
+				snapshot[rec.Name] = true
+				rec.Seq = since
+			}
+
+		case RecordSnapshotEnd:
+			if snapshot == nil {
+				return fmt.Errorf("replication snapshot ended before it began")
+			}
+			if err = f.prune(snapshot); err != nil {
+				return err
+			}
+			snapshot = nil
+			// Only now, so an interrupted snapshot is begun again
+			epoch = snapshotEpoch
+			log.Printf("Follower - replicated snapshot of '%s'", f.cfg.Primary)
+
+		case RecordHeartbeat:
+			rec.Seq = since
+
+		default:
+			return fmt.Errorf("unknown replication record type: '%s'", rec.Type)
+		}
+
+		since = rec.Seq
+		f.applied(epoch, rec.Seq, rec.Head)
+	}
+}
+
+// apply writes, or deletes, the entry of `rec` with `data`.
+func (f *Follower) apply(rec Record, data io.Reader) error {
+	var (
+		meta datastorage.Metadata
+		now  = time.Now()
+	)
+	if rec.Metadata != nil {
+		meta = *rec.Metadata
+	}
+
+	if rec.Deleted || meta.Expired(now) {
+		if err := f.delete(rec.Name); err != nil {
+			return err
+		}
+	} else {
+		// Keep the revision of the primary, so a write forwarded to it with
+		// an ETag read from the follower is not refused
+		opts := datastorage.StoreOptions{
+			TTL:         meta.TTL(now),
+			ContentType: meta.ContentType,
+			Revision:    meta.Revision,
+			CreatedAt:   meta.CreatedAt,
+			UpdatedAt:   meta.UpdatedAt,
+		}
+		if _, err := datastorage.StoreStream(f.storage, rec.Name, data, opts, datastorage.Precondition{}); err != nil {
+			return fmt.Errorf("failed to replicate '%s': %w", rec.Name, err)
+		}
+	}
+
+	f.applyHook(rec.Name)
+	return nil
+}
+
+// prune deletes every local entry not in `snapshot`.
+func (f *Follower) prune(snapshot map[string]bool) error {
+	cursor := ""
+	for {
+		names, next, err := f.storage.ListNames("", cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if snapshot[name] {
+				continue
+			}
+			if err = f.delete(name); err != nil {
+				return err
+			}
+			f.applyHook(name)
+		}
+
+		if len(next) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// delete deletes the local entry of `name`, if any.
+func (f *Follower) delete(name string) error {
+	err := f.storage.DeleteData(name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replicate deletion of '%s': %w", name, err)
+	}
+	return nil
+}
+
+// applyHook calls `FollowerConfig.OnApply` for `name`, if set.
+func (f *Follower) applyHook(name string) {
+	if f.cfg.OnApply == nil {
+		return
+	}
+	if err := f.cfg.OnApply(name); err != nil {
+		log.Printf("Follower - failed to apply '%s': %v", name, err)
+	}
+}
+
+// applied records that every change up to `seq` of `epoch` was applied, of
+// those up to `head` made by the primary.
+func (f *Follower) applied(epoch, seq, head uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.epoch = epoch
+	f.seq = seq
+	f.head = head
+	f.connected = true
+	f.lastContact = now
+	if seq >= head {
+		f.caughtUp = now
+	}
+}
+
+// watchdogReader reads from `r`, postponing the `watchdog` by `timeout` on
+// every read.
+type watchdogReader struct {
+	r        io.Reader
+	watchdog *time.Timer
+	timeout  time.Duration
+}
+
+// Read reads from the underlying reader.
+func (wr watchdogReader) Read(p []byte) (int, error) {
+	n, err := wr.r.Read(p)
+	wr.watchdog.Reset(wr.timeout)
+	return n, err
+}
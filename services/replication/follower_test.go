@@ -0,0 +1,238 @@
+package replication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPrimary serves the replication stream of a `Primary`, refusing
+// followers while `down`.
+type testPrimary struct {
+	feed    *datastorage.ChangeFeed
+	primary *Primary
+	server  *httptest.Server
+
+	mu   *sync.Mutex
+	down bool
+}
+
+func initTestPrimary(t *testing.T, capacity int) *testPrimary {
+	t.Helper()
+	tp := &testPrimary{mu: &sync.Mutex{}}
+	tp.restart(datastorage.MemStorage{}.Initialize(), capacity)
+	tp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tp.mu.Lock()
+		down, primary := tp.down, tp.primary
+		tp.mu.Unlock()
+		if down || r.URL.Path != StreamRoute {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		epoch, since, err := ParseSince(r.URL.Query().Get("since"))
+		require.NoError(t, err)
+		_ = primary.Stream(r.Context(), w, w.(http.Flusher).Flush, epoch, since)
+	}))
+	t.Cleanup(tp.server.Close)
+	return tp
+}
+
+// restart replaces the primary with a new one in front of `backing`, as if
+// the webapp restarted with the same storage.
+func (tp *testPrimary) restart(backing datastorage.DataStorage, capacity int) {
+	feed := datastorage.ChangeFeed{}.Initialize(backing, capacity)
+	primary := Primary{}.Initialize(feed, PrimaryConfig{HeartbeatInterval: 10 * time.Millisecond})
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.feed, tp.primary = feed, primary
+}
+
+// setDown refuses, or accepts, followers - dropping those connected.
+func (tp *testPrimary) setDown(down bool) {
+	tp.mu.Lock()
+	tp.down = down
+	tp.mu.Unlock()
+	if down {
+		tp.server.CloseClientConnections()
+	}
+}
+
+func initTestFollower(t *testing.T, tp *testPrimary, storage datastorage.DataStorage) *Follower {
+	t.Helper()
+	follower := Follower{}.Initialize(storage, FollowerConfig{
+		Primary:       tp.server.URL + "/",
+		RetryInterval: 10 * time.Millisecond,
+		Timeout:       time.Second,
+	})
+	t.Cleanup(follower.Stop)
+	return follower
+}
+
+// requireReplicated waits for `follower` to catch up with `tp`, then requires
+// `storage` to hold exactly the entries of the primary.
+func requireReplicated(t *testing.T, tp *testPrimary, follower *Follower, storage datastorage.DataStorage) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		status := follower.Status()
+		return status.Connected && status.Seq == tp.feed.Seq() && status.PrimarySeq == status.Seq
+	}, 5*time.Second, 5*time.Millisecond)
+
+	want, _, err := tp.feed.ListNames("", "", 0)
+	require.NoError(t, err)
+	got, _, err := storage.ListNames("", "", 0)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	for _, name := range want {
+		wantData, wantMeta, err := tp.feed.RetrieveEntry(name)
+		require.NoError(t, err)
+		gotData, gotMeta, err := storage.RetrieveEntry(name)
+		require.NoError(t, err)
+		assert.Equal(t, wantData, gotData, name)
+		assert.Equal(t, wantMeta.Revision, gotMeta.Revision, name)
+		assert.Equal(t, wantMeta.ContentType, gotMeta.ContentType, name)
+		assert.True(t, wantMeta.CreatedAt.Equal(gotMeta.CreatedAt), name)
+		assert.True(t, wantMeta.UpdatedAt.Equal(gotMeta.UpdatedAt), name)
+		assert.Equal(t, wantMeta.ExpiresAt.IsZero(), gotMeta.ExpiresAt.IsZero(), name)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	tp := initTestPrimary(t, 0)
+	require.NoError(t, tp.feed.StoreData("a", []byte("test data a")))
+	require.NoError(t, tp.feed.StoreDataWithOptions("b", make([]byte, 3*maxFrameSize), datastorage.StoreOptions{
+		TTL:         time.Hour,
+		ContentType: "application/octet-stream",
+	}))
+	require.NoError(t, tp.feed.StoreData("deleted", []byte("test data")))
+	require.NoError(t, tp.feed.DeleteData("deleted"))
+
+	storage := datastorage.MemStorage{}.Initialize()
+	require.NoError(t, storage.StoreData("stale", []byte("not on the primary")))
+	follower := initTestFollower(t, tp, storage)
+
+	t.Run("snapshot", func(t *testing.T) {
+		requireReplicated(t, tp, follower, storage)
+		_, err := storage.RetrieveData("stale")
+		assert.ErrorAs(t, err, &customerrors.DataStorageNameNotFound{})
+
+		assert.Equal(t, PrimaryStatus{Role: "primary", Seq: 4, Followers: 1}, tp.primary.Status())
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		require.NoError(t, tp.feed.StoreData("c", []byte("test data c")))
+		require.NoError(t, tp.feed.StoreData("a", []byte("test data a, again")))
+		require.NoError(t, tp.feed.DeleteData("b"))
+		_, err := tp.feed.ApplyBatch([]datastorage.BatchOp{
+			{Name: "d", Data: []byte("test data d")},
+			{Name: "c", Delete: true},
+		})
+		require.NoError(t, err)
+
+		requireReplicated(t, tp, follower, storage)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		status := follower.Status()
+		assert.Equal(t, "follower", status.Role)
+		assert.Equal(t, tp.server.URL, status.Primary)
+		assert.Zero(t, status.LagChanges)
+		assert.Zero(t, status.LagSeconds)
+		require.NotNil(t, status.LastContact)
+		assert.WithinDuration(t, time.Now(), *status.LastContact, time.Second)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		tp.setDown(true)
+		require.Eventually(t, func() bool {
+			return !follower.Status().Connected
+		}, 5*time.Second, 5*time.Millisecond)
+
+		require.NoError(t, tp.feed.StoreData("e", []byte("test data e")))
+		require.Eventually(t, func() bool {
+			status := follower.Status()
+			return len(status.LastError) > 0 && status.LagSeconds > 0
+		}, 5*time.Second, 5*time.Millisecond)
+
+		tp.setDown(false)
+		requireReplicated(t, tp, follower, storage)
+	})
+}
+
+func TestFollower_PrimaryRestarted(t *testing.T) {
+	backing := datastorage.MemStorage{}.Initialize()
+	tp := initTestPrimary(t, 0)
+	tp.restart(backing, 0)
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, tp.feed.StoreData(name, []byte("test data "+name)))
+	}
+
+	storage := datastorage.MemStorage{}.Initialize()
+	follower := initTestFollower(t, tp, storage)
+	requireReplicated(t, tp, follower, storage)
+
+	// The restarted primary numbers as many changes again, so the follower's
+	// seq alone would resume after all of them
+	tp.setDown(true)
+	require.Eventually(t, func() bool {
+		return !follower.Status().Connected
+	}, 5*time.Second, 5*time.Millisecond)
+	tp.restart(backing, 0)
+	require.NoError(t, tp.feed.DeleteData("a"))
+	require.NoError(t, tp.feed.StoreData("b", []byte("test data b, again")))
+	require.NoError(t, tp.feed.StoreData("d", []byte("test data d")))
+	require.Equal(t, follower.Status().Seq, tp.feed.Seq())
+
+	tp.setDown(false)
+	require.NoError(t, tp.feed.StoreData("e", []byte("test data e")))
+	requireReplicated(t, tp, follower, storage)
+}
+
+func TestFollower_Truncated(t *testing.T) {
+	tp := initTestPrimary(t, 2)
+	require.NoError(t, tp.feed.StoreData("a", []byte("test data a")))
+	require.NoError(t, tp.feed.StoreData("b", []byte("test data b")))
+
+	storage := datastorage.MemStorage{}.Initialize()
+	var applied []string
+	appliedMu := &sync.Mutex{}
+	follower := Follower{}.Initialize(storage, FollowerConfig{
+		Primary:       tp.server.URL,
+		RetryInterval: 10 * time.Millisecond,
+		OnApply: func(name string) error {
+			appliedMu.Lock()
+			defer appliedMu.Unlock()
+			applied = append(applied, name)
+			return nil
+		},
+	})
+	t.Cleanup(follower.Stop)
+	requireReplicated(t, tp, follower, storage)
+
+	// More changes than the primary keeps are made while disconnected
+	tp.setDown(true)
+	require.Eventually(t, func() bool {
+		return !follower.Status().Connected
+	}, 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, tp.feed.DeleteData("a"))
+	require.NoError(t, tp.feed.StoreData("c", []byte("test data c")))
+	require.NoError(t, tp.feed.StoreData("d", []byte("test data d")))
+	_, err := tp.feed.Changes(follower.Status().Seq, 0)
+	require.ErrorAs(t, err, &customerrors.DataStorageChangesTruncated{})
+
+	tp.setDown(false)
+	requireReplicated(t, tp, follower, storage)
+
+	appliedMu.Lock()
+	defer appliedMu.Unlock()
+	assert.Contains(t, applied, "a")
+	assert.Contains(t, applied, "d")
+}
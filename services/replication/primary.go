@@ -0,0 +1,216 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dvo-dev/go-get-started/customerrors"
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+const (
+	// defaultHeartbeatInterval is how often a `Primary` sends heartbeats when
+	// `PrimaryConfig.HeartbeatInterval` is unset.
+	defaultHeartbeatInterval = time.Second
+
+	// streamBatchSize is the most changes streamed between flushes.
+	streamBatchSize = 256
+)
+
+// PrimaryConfig configures a `Primary`.
+type PrimaryConfig struct {
+	// HeartbeatInterval is how often a heartbeat is sent to followers while
+	// there are no changes, defaults to 1s.
+	HeartbeatInterval time.Duration
+}
+
+// PrimaryStatus is the replication status of a `Primary`.
+type PrimaryStatus struct {
+	// Role is always "primary".
+	Role string `json:"role"`
+
+	// Seq is the `Seq` of the latest change.
+	Seq uint64 `json:"seq"`
+
+	// Followers counts the followers streaming changes.
+	Followers int `json:"followers"`
+}
+
+// Primary streams the changes recorded by a `datastorage.ChangeFeed` to its
+// followers, see `Follower`.
+type Primary struct {
+	feed *datastorage.ChangeFeed
+	cfg  PrimaryConfig
+
+	mu        *sync.Mutex
+	followers int
+}
+
+// Initialize initializes and returns a pointer to a `Primary` streaming the
+// changes of `feed`, configured by `cfg`.
+func (p Primary) Initialize(feed *datastorage.ChangeFeed, cfg PrimaryConfig) *Primary {
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	return &Primary{
+		feed: feed,
+		cfg:  cfg,
+		mu:   &sync.Mutex{},
+	}
+}
+
+// Stream writes the records of the changes after `since` of `epoch` to `w`,
+// calling `flush` once each batch is written, until `ctx` is done or writing
+// fails.
+//
+// The changes are preceded by a snapshot of every entry if `since` is zero, of
+// another epoch than the feed's - as the primary has restarted since - or the
+// changes after it are no longer kept. Should the follower fall so far behind
+// that changes it has yet to be sent are no longer kept, returns
+// `customerrors.DataStorageChangesTruncated` - it reconnects for a snapshot.
+//
+// This method is thread safe.
+func (p *Primary) Stream(ctx context.Context, w io.Writer, flush func(), epoch, since uint64) error {
+	p.mu.Lock()
+	p.followers++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.followers--
+		p.mu.Unlock()
+	}()
+
+	records := newRecordWriter(w)
+	flushed := func() error {
+		if err := records.flush(); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	}
+
+	_, err := p.feed.Changes(since, 1)
+	_, truncated := err.(customerrors.DataStorageChangesTruncated)
+	if truncated || since == 0 || epoch != p.feed.Epoch() || since > p.feed.Seq() {
+		// The follower is new, too far behind, or following another primary -
+		// or this one before it restarted
+		if since, err = p.snapshot(ctx, records); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if err = flushed(); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(p.cfg.HeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		changes, err := p.feed.Changes(since, streamBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = p.writeEntry(records, change.Seq, change.Name); err != nil {
+				return err
+			}
+			since = change.Seq
+		}
+		if len(changes) > 0 {
+			if err = flushed(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.feed.Wait(since):
+		case <-heartbeat.C:
+			if err = records.write(Record{
+				Type: RecordHeartbeat,
+				Seq:  since,
+				Head: p.feed.Seq(),
+			}, nil); err != nil {
+				return err
+			}
+			if err = flushed(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Status returns the latest change, and how many followers are streaming.
+//
+// This method is thread safe.
+func (p *Primary) Status() PrimaryStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PrimaryStatus{
+		Role:      "primary",
+		Seq:       p.feed.Seq(),
+		Followers: p.followers,
+	}
+}
+
+// snapshot writes a snapshot of every entry, returning the change it is as
+// of - entries written since may be included, and are sent again as changes.
+func (p *Primary) snapshot(ctx context.Context, records *recordWriter) (uint64, error) {
+	seq := p.feed.Seq()
+	if err := records.write(Record{Type: RecordSnapshot, Seq: seq, Epoch: p.feed.Epoch(), Head: seq}, nil); err != nil {
+		return 0, err
+	}
+
+	cursor := ""
+	for {
+		names, next, err := p.feed.ListNames("", cursor, streamBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range names {
+			if err = ctx.Err(); err != nil {
+				return 0, err
+			}
+			if err = p.writeEntry(records, seq, name); err != nil {
+				return 0, err
+			}
+		}
+
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	return seq, records.write(Record{Type: RecordSnapshotEnd, Seq: seq, Head: p.feed.Seq()}, nil)
+}
+
+// writeEntry writes the current entry of `name`, changed by the change `seq`.
+func (p *Primary) writeEntry(records *recordWriter, seq uint64, name string) error {
+	rec := Record{
+		Type: RecordEntry,
+		Seq:  seq,
+		Head: p.feed.Seq(),
+		Name: name,
+	}
+
+	stream, meta, err := p.feed.RetrieveStream(name)
+	if _, notFound := err.(customerrors.DataStorageNameNotFound); notFound {
+		rec.Deleted = true
+		return records.write(rec, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	rec.Metadata = &meta
+	return records.write(rec, stream)
+}
@@ -0,0 +1,221 @@
+// Package replication replicates the `datastorage.DataStorage` of one webapp
+// instance, the primary, to others, its followers, over HTTP.
+//
+// A follower streams the changes recorded by the `datastorage.ChangeFeed` of
+// the primary, beginning with a snapshot of every entry unless it can resume
+// from the last change it applied.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+)
+
+// maxFrameSize is the most data written in a single frame of a record.
+const maxFrameSize = 32 << 10
+
+// RecordType is the kind of a `Record`.
+type RecordType string
+
+const (
+	// RecordSnapshot begins a snapshot of every entry of the primary, as of
+	// the change `Seq` of `Epoch`.
+	RecordSnapshot RecordType = "snapshot"
+
+	// RecordEntry is the current state of the entry of `Name`, changed by the
+	// change `Seq`, or as of the snapshot.
+	RecordEntry RecordType = "entry"
+
+	// RecordSnapshotEnd ends a snapshot - entries it did not include no longer
+	// exist.
+	RecordSnapshotEnd RecordType = "snapshot_end"
+
+	// RecordHeartbeat is sent while there are no changes, so followers know
+	// the primary is still there.
+	RecordHeartbeat RecordType = "heartbeat"
+)
+
+// Record is a single record of the replication stream, each written as a line
+// of JSON. The data of an entry which is not `Deleted` follows its line in
+// frames: a 4 byte big endian length then as many bytes of data, ending with
+// an empty frame.
+type Record struct {
+	Type RecordType `json:"type"`
+	Seq  uint64     `json:"seq"`
+
+	// Epoch is the `datastorage.ChangeFeed.Epoch` of the primary, which
+	// numbers its changes afresh whenever it restarts - given by a snapshot,
+	// as the changes of another epoch are only ever caught up with by one.
+	Epoch uint64 `json:"epoch,omitempty"`
+
+	// Head is the `Seq` of the latest change of the primary as of the record.
+	Head uint64 `json:"head"`
+
+	// Name, Deleted and Metadata describe an entry.
+	Name     string                `json:"name,omitempty"`
+	Deleted  bool                  `json:"deleted,omitempty"`
+	Metadata *datastorage.Metadata `json:"metadata,omitempty"`
+}
+
+// FormatSince formats the `since` param of a follower resuming after the
+// change `seq` of the primary's `epoch`, see `ParseSince`.
+func FormatSince(epoch, seq uint64) string {
+	return fmt.Sprintf("%d:%d", epoch, seq)
+}
+
+// ParseSince parses the `since` param of a follower, "<epoch>:<seq>" - a bare
+// seq is of no epoch, so always begins with a snapshot.
+func ParseSince(value string) (uint64, uint64, error) {
+	var (
+		epoch uint64
+		err   error
+	)
+	if epochValue, seq, found := strings.Cut(value, ":"); found {
+		if epoch, err = strconv.ParseUint(epochValue, 10, 64); err != nil {
+			return 0, 0, err
+		}
+		value = seq
+	}
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return epoch, seq, nil
+}
+
+// hasData reports whether data follows the record.
+func (rec Record) hasData() bool {
+	return rec.Type == RecordEntry && !rec.Deleted
+}
+
+// recordWriter writes the records of a replication stream.
+type recordWriter struct {
+	w     *bufio.Writer
+	frame []byte
+}
+
+func newRecordWriter(w io.Writer) *recordWriter {
+	return &recordWriter{
+		w:     bufio.NewWriter(w),
+		frame: make([]byte, 4+maxFrameSize),
+	}
+}
+
+// write writes `rec`, followed by the data read from `data` if it has any.
+func (rw *recordWriter) write(rec Record, data io.Reader) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = rw.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if !rec.hasData() {
+		return nil
+	}
+
+	for {
+		n, err := io.ReadFull(data, rw.frame[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		binary.BigEndian.PutUint32(rw.frame, uint32(n))
+		if _, wErr := rw.w.Write(rw.frame[:4+n]); wErr != nil {
+			return wErr
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+// flush writes any buffered records.
+func (rw *recordWriter) flush() error {
+	return rw.w.Flush()
+}
+
+// recordReader reads the records of a replication stream.
+type recordReader struct {
+	r    *bufio.Reader
+	data *frameReader
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReader(r)}
+}
+
+// next reads the next record, and a reader of its data if it has any - which
+// is only valid until the following call.
+func (rr *recordReader) next() (Record, io.Reader, error) {
+	if rr.data != nil {
+		// Skip whatever data of the previous record was left unread
+		if _, err := io.Copy(io.Discard, rr.data); err != nil {
+			return Record{}, nil, err
+		}
+		rr.data = nil
+	}
+
+	line, err := rr.r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, nil, err
+	}
+	var rec Record
+	if err = json.Unmarshal(line, &rec); err != nil {
+		return Record{}, nil, fmt.Errorf("invalid replication record: %w", err)
+	}
+
+	if !rec.hasData() {
+		return rec, nil, nil
+	}
+	rr.data = &frameReader{r: rr.r}
+	return rec, rr.data, nil
+}
+
+// frameReader reads the data of a record from its frames.
+type frameReader struct {
+	r         *bufio.Reader
+	remaining int
+	done      bool
+}
+
+// Read reads the data of the record.
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for fr.remaining == 0 {
+		if fr.done {
+			return 0, io.EOF
+		}
+
+		var length [4]byte
+		if _, err := io.ReadFull(fr.r, length[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		fr.remaining = int(binary.BigEndian.Uint32(length[:]))
+		fr.done = fr.remaining == 0
+	}
+
+	if len(p) > fr.remaining {
+		p = p[:fr.remaining]
+	}
+	n, err := fr.r.Read(p)
+	fr.remaining -= n
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF returns `err`, as `io.ErrUnexpectedEOF` if it is `io.EOF` -
+// the stream ending within a record.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
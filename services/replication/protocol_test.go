@@ -0,0 +1,103 @@
+package replication
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/dvo-dev/go-get-started/services/datastorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecords(t *testing.T) {
+	large := make([]byte, 3*maxFrameSize+7)
+	rand.New(rand.NewSource(69)).Read(large)
+
+	records := []struct {
+		rec  Record
+		data []byte
+	}{
+		{rec: Record{Type: RecordSnapshot, Seq: 3, Epoch: 69, Head: 3}},
+		{
+			rec: Record{
+				Type:     RecordEntry,
+				Seq:      3,
+				Head:     4,
+				Name:     "large",
+				Metadata: &datastorage.Metadata{Size: len(large), ContentType: "text/plain"},
+			},
+			data: large,
+		},
+		{rec: Record{Type: RecordEntry, Seq: 3, Head: 4, Name: "empty", Metadata: &datastorage.Metadata{}}, data: []byte{}},
+		{rec: Record{Type: RecordEntry, Seq: 3, Head: 4, Name: "unread", Metadata: &datastorage.Metadata{}}, data: []byte("skipped")},
+		{rec: Record{Type: RecordSnapshotEnd, Seq: 3, Head: 4}},
+		{rec: Record{Type: RecordEntry, Seq: 4, Head: 4, Name: "deleted", Deleted: true}},
+		{rec: Record{Type: RecordHeartbeat, Seq: 4, Head: 4}},
+	}
+
+	buf := &bytes.Buffer{}
+	writer := newRecordWriter(buf)
+	for _, r := range records {
+		require.NoError(t, writer.write(r.rec, bytes.NewReader(r.data)))
+	}
+	require.NoError(t, writer.flush())
+
+	reader := newRecordReader(buf)
+	for _, r := range records {
+		rec, data, err := reader.next()
+		require.NoError(t, err)
+		assert.Equal(t, r.rec, rec)
+		if !rec.hasData() {
+			assert.Nil(t, data)
+			continue
+		}
+		if rec.Name == "unread" {
+			continue
+		}
+		read, err := io.ReadAll(data)
+		require.NoError(t, err)
+		assert.Equal(t, r.data, read, rec.Name)
+	}
+	_, _, err := reader.next()
+	assert.Equal(t, io.EOF, err)
+
+	t.Run("truncated", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		writer := newRecordWriter(buf)
+		require.NoError(t, writer.write(records[1].rec, bytes.NewReader(large)))
+		require.NoError(t, writer.flush())
+
+		reader := newRecordReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+		_, data, err := reader.next()
+		require.NoError(t, err)
+		_, err = io.ReadAll(data)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := newRecordReader(bytes.NewReader([]byte("not json\n"))).next()
+		assert.Error(t, err)
+		_, _, err = newRecordReader(bytes.NewReader([]byte(`{"type": "heartbeat"`))).next()
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	})
+}
+
+func TestParseSince(t *testing.T) {
+	epoch, seq, err := ParseSince(FormatSince(69, 420))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(69), epoch)
+	assert.Equal(t, uint64(420), seq)
+
+	// Of no epoch
+	epoch, seq, err = ParseSince("420")
+	require.NoError(t, err)
+	assert.Zero(t, epoch)
+	assert.Equal(t, uint64(420), seq)
+
+	for _, invalid := range []string{"", "latest", "69:", ":420", "69:420:0"} {
+		_, _, err = ParseSince(invalid)
+		assert.Error(t, err, invalid)
+	}
+}